@@ -2,10 +2,9 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"time"
@@ -13,9 +12,17 @@ import (
 	"github.com/awesome-gocui/gocui"
 	"github.com/fatih/color"
 	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/filter"
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/record"
+	"github.com/foolishCDN/AV-spy/summary"
+	"github.com/foolishCDN/AV-spy/validate"
 	"github.com/mattn/go-runewidth"
 )
 
+// timestampSkipThreshold(ms) is the largest timestamp step of one frame not shown as skip
+const timestampSkipThreshold = 100
+
 type App struct {
 	viewIndex int
 
@@ -28,6 +35,18 @@ type App struct {
 	audioTags  []*flv.AudioTag
 	scriptTags []*flv.ScriptTag
 
+	// prober analyses the stream of current request
+	prober        *probe.Prober
+	startupShown  bool
+	disabledRules []string
+
+	// filter selects the tags shown in timestamp view
+	filter     *filter.Filter
+	streamVars *flv.StreamVars
+
+	recordConfig record.Config
+	recorder     *record.Recorder
+
 	tags          []flv.TagI
 	isShowTagInfo bool
 	isShowNetwork bool
@@ -42,6 +61,14 @@ func (app *App) Init(g *gocui.Gui) {
 		g.ASCII = true
 	}
 
+	app.recordConfig.OnFile = func(path string) {
+		showNotice(g, "Record file %s\n", path)
+	}
+	app.recorder = record.New(app.recordConfig)
+	if *Record {
+		app.recorder.Start()
+	}
+
 	g.SetManagerFunc(app.Layout)
 	app.SetKeys(g)
 }
@@ -102,6 +129,7 @@ func (app *App) SetKeys(g *gocui.Gui) {
 	_ = g.SetKeybinding(AllViewName, gocui.KeyEnter, gocui.ModNone, app.SubmitOrStopRequest)
 	_ = g.SetKeybinding(AllViewName, gocui.KeyCtrlR, gocui.ModNone, clearInfoView)
 	_ = g.SetKeybinding(AllViewName, gocui.KeyCtrlQ, gocui.ModNone, app.switchViewVisible(g, NetworkViewName))
+	_ = g.SetKeybinding(AllViewName, gocui.KeyCtrlS, gocui.ModNone, app.switchRecording)
 
 	_ = g.SetKeybinding(PathViewName, gocui.KeyEnter, gocui.ModNone, app.SubmitOrStopRequest)
 
@@ -141,9 +169,24 @@ func (app *App) quit(_ *gocui.Gui, _ *gocui.View) error {
 			return nil
 		}
 	}
+	_ = app.recorder.Close()
 	return gocui.ErrQuit
 }
 
+// switchRecording starts or stops recording the stream to file
+func (app *App) switchRecording(g *gocui.Gui, _ *gocui.View) error {
+	if app.recorder.Recording() {
+		if err := app.recorder.Stop(); err != nil {
+			showError(g, "Stop recording failed, error: %v\n", err)
+		}
+		showInfo(g, color.CyanString("Stop recording\n"))
+		return nil
+	}
+	app.recorder.Start()
+	showInfo(g, color.CyanString("Start recording to %s on the next keyframe, press Ctrl-S to stop\n", app.recordConfig.Dir))
+	return nil
+}
+
 func (app *App) SubmitOrStopRequest(g *gocui.Gui, _ *gocui.View) error {
 	if app.ctx != nil {
 		select {
@@ -156,7 +199,8 @@ func (app *App) SubmitOrStopRequest(g *gocui.Gui, _ *gocui.View) error {
 	return app.SubmitRequest(g)
 }
 
-func (app *App) clearPerRequest(g *gocui.Gui) {
+// clearPerRequest resets the views and the state of last request, it returns an error if the prober can't be created.
+func (app *App) clearPerRequest(g *gocui.Gui) error {
 	timestampView, _ := g.View(TimestampViewName)
 	timestampView.Clear()
 	latestTimestampView, _ := g.View(LatestTimestampViewName)
@@ -172,14 +216,33 @@ func (app *App) clearPerRequest(g *gocui.Gui) {
 	app.scriptTags = app.scriptTags[:0]
 
 	app.tags = app.tags[:0]
+	app.streamVars = flv.NewStreamVars()
+
+	app.startupShown = false
+	options := probe.DefaultOptions()
+	options.HintGap = timestampSkipThreshold
+	options.Validate.Disabled = app.disabledRules
+	options.EventSink = summary.MultiSink{&eventSink{g: g}, app.recorder}
+	options.Observer = &appObserver{app: app, g: g}
+	prober, err := probe.New(options)
+	if err != nil {
+		return err
+	}
+	app.prober = prober
+	app.streamVars.Offset = app.prober.TagOffset
+	return nil
 }
 
 func (app *App) SubmitRequest(g *gocui.Gui) error {
-	app.clearPerRequest(g)
+	if err := app.clearPerRequest(g); err != nil {
+		showError(g, "Create prober failed, error: %v\n", err)
+		return nil
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	app.ctx = ctx
 	app.cancel = cancel
+	prober := app.prober
 	go func(ctx context.Context) {
 		defer func() {
 			cancel()
@@ -196,8 +259,11 @@ func (app *App) SubmitRequest(g *gocui.Gui) error {
 			return
 		}
 		var trace Trace
+		startup := prober.Startup()
+		defer writeStartup(g, startup)
 		req = req.WithContext(ctx)
 		req = req.WithContext(WithTrace(req.Context(), &trace))
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), startup.ClientTrace()))
 
 		submitEvent(func(gui *gocui.Gui) error {
 			networkView, _ := g.View(NetworkViewName)
@@ -245,32 +311,14 @@ func (app *App) SubmitRequest(g *gocui.Gui) error {
 			_ = body.Close()
 		}()
 
-		demuxer := new(flv.Demuxer)
-		header, err := demuxer.ReadHeader(body)
+		err = prober.Run(ctx, body)
+		showValidation(g, prober.Report().Validation)
 		if err != nil {
-			showError(g, "Parse flv header failed,  error: %v\n", err)
-			return
-		}
-		showNotice(g, "Flv Header:\n\t\tVersion: %d\n\t\tHasVideo: %t\n\t\tHasAudio: %t\n\t\tHeaderSize: %d\n", header.Version, header.HasVideo, header.HasAudio, header.DataOffset)
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-			tag, err := demuxer.ReadTag(body)
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					showWarning(g, "Receive EOF")
-				} else if errors.Is(err, context.Canceled) {
-					showInfo(g, color.CyanString("Stop request, Press Ctrl-C to Quit"))
-				} else {
-					showError(g, "Parse flv tag failed,  error: %v\n", err)
-				}
-				return
-			}
-			app.onTag(g, tag)
+			showError(g, "Parse flv failed,  error: %v\n", err)
+		} else if ctx.Err() != nil {
+			showInfo(g, color.CyanString("Stop request, Press Ctrl-C to Quit"))
+		} else {
+			showWarning(g, "Receive EOF")
 		}
 	}(ctx)
 	return nil
@@ -284,9 +332,49 @@ func (app *App) setView(g *gocui.Gui) error {
 	return nil
 }
 
+// appObserver shows what the prober of App finds
+type appObserver struct {
+	probe.NopObserver
+	app *App
+	g   *gocui.Gui
+}
+
+func (o *appObserver) OnHeader(header *flv.Header) {
+	if err := o.app.recorder.OnHeader(header); err != nil {
+		showError(o.g, "Record failed, error: %v\n", err)
+	}
+	showNotice(o.g, "Flv Header:\n\t\tVersion: %d\n\t\tHasVideo: %t\n\t\tHasAudio: %t\n\t\tHeaderSize: %d\n", header.Version, header.HasVideo, header.HasAudio, header.DataOffset)
+}
+
+// OnReceive records tag before the counters of prober, so the rolling buffer flushed on events contains it
+func (o *appObserver) OnReceive(tag flv.TagI) error {
+	if err := o.app.recorder.WriteTag(tag); err != nil {
+		showError(o.g, "Record failed, error: %v\n", err)
+		_ = o.app.recorder.Stop()
+	}
+	return nil
+}
+
+func (o *appObserver) OnTag(tag flv.TagI) {
+	o.app.onTag(o.g, tag)
+}
+
+func (o *appObserver) OnWarning(warning probe.Warning) {
+	switch {
+	case warning.Event != nil:
+		// shown by eventSink
+	case warning.Issue != nil && warning.Issue.Severity == validate.SeverityInfo:
+		showNotice(o.g, "%s\n", warning.Message)
+	default:
+		showWarning(o.g, "%s\n", warning.Message)
+	}
+}
+
 func (app *App) onTag(g *gocui.Gui, tag flv.TagI) {
-	onTag(g, tag, nil)
-	app.tags = append(app.tags, tag)
+	if app.filter.Match(app.streamVars.Vars(tag, time.Now())) {
+		onTag(g, tag, nil)
+		app.tags = append(app.tags, tag)
+	}
 	switch t := tag.(type) {
 	case *flv.VideoTag:
 		if t.PacketType == flv.SequenceHeader {
@@ -297,17 +385,18 @@ func (app *App) onTag(g *gocui.Gui, tag flv.TagI) {
 			app.avc = append(app.avc, t)
 			return
 		}
-		if len(app.videoTags) > 0 {
-			now := int(tag.Timestamp())
-			last := int(app.videoTags[len(app.videoTags)-1].Timestamp())
-			diff := now - last
-			if now < last || diff > 100 {
-				showWarning(g, "Video timestamp skip %d, now %d -> last %d\n", diff, now, last)
-			}
+		if t.FrameType == flv.KeyFrame && !app.startupShown {
+			app.startupShown = true
+			startup := app.prober.Startup().String()
+			submitEvent(func(gui *gocui.Gui) error {
+				networkView, _ := g.View(NetworkViewName)
+				_, _ = fmt.Fprintf(networkView, "\n%s\n%s", color.CyanString("Startup:"), startup)
+				return nil
+			})
 		}
 		app.videoTags = append(app.videoTags, t)
 	case *flv.AudioTag:
-		if t.SoundFormat == flv.AAC && t.PacketType == flv.SequenceHeader {
+		if flv.IsSequenceHeader(t) {
 			if len(app.aac) > 0 {
 				showWarning(g, "Receive new aac, %d\n", len(app.aac)+1)
 			}
@@ -315,14 +404,6 @@ func (app *App) onTag(g *gocui.Gui, tag flv.TagI) {
 			app.aac = append(app.aac, t)
 			return
 		}
-		if len(app.audioTags) > 0 {
-			now := int(tag.Timestamp())
-			last := int(app.audioTags[len(app.audioTags)-1].Timestamp())
-			diff := now - last
-			if now < last || diff > 100 {
-				showWarning(g, "Audio timestamp skip %d, now %d -> last %d\n", diff, now, last)
-			}
-		}
 		app.audioTags = append(app.audioTags, t)
 	case *flv.ScriptTag:
 		if len(app.scriptTags) > 0 {
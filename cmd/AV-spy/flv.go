@@ -7,10 +7,9 @@ import (
 
 	"github.com/awesome-gocui/gocui"
 	"github.com/fatih/color"
-	"github.com/foolishCDN/AV-spy/codec"
-	"github.com/foolishCDN/AV-spy/codec/avc"
 	"github.com/foolishCDN/AV-spy/container/flv"
 	"github.com/foolishCDN/AV-spy/encoding/amf"
+	"github.com/foolishCDN/AV-spy/probe"
 )
 
 func onTag(g *gocui.Gui, tag flv.TagI, w io.Writer) {
@@ -24,32 +23,21 @@ func onTag(g *gocui.Gui, tag flv.TagI, w io.Writer) {
 	}
 }
 
-func onAAC(g *gocui.Gui, t *flv.AudioTag, w io.Writer) {
-	aac := new(codec.AACAudioSpecificConfig)
-	if err := aac.Read(t.Bytes); err != nil {
-		showError(g, "Parse aac fail, err %v\n", err)
+// onSequenceHeader decodes the sequence header of AAC, AVC or HEVC
+func onSequenceHeader(g *gocui.Gui, tag flv.TagI, w io.Writer) {
+	header, err := probe.DecodeSequenceHeader(tag)
+	if err != nil {
+		showError(g, "Parse sequence header fail, err %v\n", err)
 		return
 	}
-	if w != nil {
-		submitEvent(func(gui *gocui.Gui) error {
-			_, _ = fmt.Fprintf(w, color.RedString("AAC Audio Specific Config:\n"))
-			prettyPrintTo(w, aac)
-			_, _ = fmt.Fprintf(w, "\n")
-			return nil
-		})
-	}
-}
-
-func onAVC(g *gocui.Gui, t *flv.VideoTag, w io.Writer) {
-	decoderConfigurationRecord := new(avc.AVCDecoderConfigurationRecord)
-	if err := decoderConfigurationRecord.Read(t.Bytes); err != nil {
-		showError(g, "Parse avc fail, err %v\n", err)
-		return
+	title := header.StreamType + " Decoder Configuration Record:\n"
+	if header.StreamType == "AAC" {
+		title = "AAC Audio Specific Config:\n"
 	}
 	if w != nil {
 		submitEvent(func(gui *gocui.Gui) error {
-			_, _ = fmt.Fprintf(w, color.RedString("AVC Decoder Configuration Record:\n"))
-			prettyPrintTo(w, decoderConfigurationRecord)
+			_, _ = fmt.Fprintf(w, color.RedString(title))
+			prettyPrintTo(w, header.Config)
 			_, _ = fmt.Fprintf(w, "\n")
 			return nil
 		})
@@ -85,9 +73,9 @@ func onScript(g *gocui.Gui, t *flv.ScriptTag, w io.Writer) {
 
 func onAudio(g *gocui.Gui, t *flv.AudioTag, w io.Writer) {
 	label := "{ AUDIO}"
-	if t.SoundFormat == flv.AAC && t.PacketType == flv.SequenceHeader {
+	if flv.IsSequenceHeader(t) {
 		label = "{   AAC}"
-		onAAC(g, t, w)
+		onSequenceHeader(g, t, w)
 	}
 	if w != nil {
 		submitEvent(func(gui *gocui.Gui) error {
@@ -115,7 +103,7 @@ func onVideo(g *gocui.Gui, t *flv.VideoTag, w io.Writer) {
 		if t.CodecID == flv.H265 {
 			label = "{  HAVC}"
 		}
-		onAVC(g, t, w)
+		onSequenceHeader(g, t, w)
 	}
 	if w != nil {
 		submitEvent(func(gui *gocui.Gui) error {
@@ -2,12 +2,26 @@ package main
 
 import (
 	"flag"
+	"strings"
+	"time"
 
 	"github.com/awesome-gocui/gocui"
 	"github.com/sirupsen/logrus"
+
+	"github.com/foolishCDN/AV-spy/filter"
+	"github.com/foolishCDN/AV-spy/record"
+	"github.com/foolishCDN/AV-spy/validate"
 )
 
 var URL = flag.String("i", "", "input url")
+var StartupOutput = flag.String("startup_output", "", "append startup metrics of every request as a JSON line to file")
+var Filter = flag.String("filter", "", "only show the tags match the expression in timestamp view, e.g. 'keyframe || delta_dts > 100'")
+var RecordDir = flag.String("record_dir", ".", "directory of the recorded files, press Ctrl-S to start/stop recording")
+var Record = flag.Bool("record", false, "start recording when the stream starts")
+var RecordDuration = flag.Int("record_duration", 0, "rotate the recorded file on keyframe after duration(seconds) (no limit if 0)")
+var RecordSize = flag.Int("record_size", 0, "rotate the recorded file on keyframe after size(MB) (no limit if 0)")
+var RecordBuffer = flag.Int("record_buffer", 0, "keep the last duration(seconds) of stream and flush it to file on gap/rewind/hole (no buffer if 0)")
+var DisableRules = flag.String("disable_rules", "", "comma separated validation rules not checked, e.g. 'stream_id,sequence_header_changed'")
 
 var eventChan chan func(*gocui.Gui) error
 
@@ -16,6 +30,29 @@ func main() {
 
 	flag.Parse()
 
+	app := &App{}
+	if *Filter != "" {
+		f, err := filter.Compile(*Filter)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+		app.filter = f
+	}
+	if *DisableRules != "" {
+		app.disabledRules = strings.Split(*DisableRules, ",")
+		if _, err := validate.New(validate.Config{Disabled: app.disabledRules}); err != nil {
+			logrus.Fatalln(err)
+		}
+	}
+
+	app.recordConfig = record.Config{
+		Dir:         *RecordDir,
+		Prefix:      "AV-spy",
+		MaxDuration: time.Duration(*RecordDuration) * time.Second,
+		MaxSize:     int64(*RecordSize) << 20,
+		Buffer:      time.Duration(*RecordBuffer) * time.Second,
+	}
+
 	var g *gocui.Gui
 	var err error
 	for _, outputMode := range []gocui.OutputMode{gocui.Output256, gocui.Output216, gocui.OutputTrue, gocui.OutputNormal, gocui.OutputGrayscale} {
@@ -33,7 +70,6 @@ func main() {
 	eventChan = make(chan func(*gocui.Gui) error, 100)
 	go update(g)
 
-	app := &App{}
 	app.Init(g)
 
 	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
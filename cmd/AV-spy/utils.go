@@ -1,12 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"sort"
 	"strings"
 
 	"github.com/awesome-gocui/gocui"
 	"github.com/fatih/color"
+	"github.com/foolishCDN/AV-spy/summary"
+	"github.com/foolishCDN/AV-spy/validate"
 	"github.com/sikasjc/pretty"
 )
 
@@ -147,3 +152,68 @@ func viewString(b []byte) string {
 	}
 	return string(r)
 }
+
+func writeStartup(g *gocui.Gui, startup *summary.Startup) {
+	if *StartupOutput == "" {
+		return
+	}
+	data, err := json.Marshal(startup)
+	if err != nil {
+		showError(g, "Marshal startup metrics failed, error: %v\n", err)
+		return
+	}
+	// one line per request, the file is appended so the previous requests are kept
+	f, err := os.OpenFile(*StartupOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		showError(g, "Write startup metrics failed, error: %v\n", err)
+		return
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		showError(g, "Write startup metrics failed, error: %v\n", err)
+	}
+}
+
+// eventSink shows the events of summary.Counter in info view, the duplicate timestamps are counted but not shown
+type eventSink struct {
+	g *gocui.Gui
+}
+
+func (s *eventSink) OnEvent(event summary.Event) {
+	switch event.Type {
+	case summary.EventGap, summary.EventRewind:
+		showWarning(s.g, "%s timestamp skip %d, now %d -> last %d\n",
+			event.Track, event.Value, event.Timestamp, event.LastTimestamp)
+	case summary.EventHole:
+		showWarning(s.g, "%s data has hole %dms\n", event.Track, event.Value)
+	case summary.EventRollover:
+		showNotice(s.g, "%s timestamp rollover %d, now %d -> last %d\n",
+			event.Track, event.Value, event.Timestamp, event.LastTimestamp)
+	}
+}
+
+// showValidation shows the number of issues by rule found in the stream, report is nil if not validate
+func showValidation(g *gocui.Gui, report *validate.Report) {
+	if report == nil {
+		return
+	}
+	severity, ok := report.Worst()
+	if !ok {
+		return
+	}
+	rules := make([]string, 0, len(report.Counts))
+	for rule, count := range report.Counts {
+		if count > 0 {
+			rules = append(rules, fmt.Sprintf("\t\t%s: %d\n", rule, count))
+		}
+	}
+	sort.Strings(rules)
+	show := showWarning
+	if severity == validate.SeverityInfo {
+		show = showNotice
+	}
+	show(g, "Validation issues:\n%s", strings.Join(rules, ""))
+}
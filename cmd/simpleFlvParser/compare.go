@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/codec"
+	"github.com/foolishCDN/AV-spy/codec/avc"
+	"github.com/foolishCDN/AV-spy/codec/hevc"
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+)
+
+var (
+	compareDuration int
+	maxDiffs        int
+)
+
+var compareCmd = &cobra.Command{
+	Use:   "compare [flags] <origin file path or http url> <edge file path or http url>",
+	Short: "Pull two streams simultaneously and report the differences of tags, timestamps, sequence headers and metadata",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			_ = cmd.Usage()
+			return errors.New("please specify two file paths or http urls")
+		}
+		sources := make([]*compareSource, 2)
+		interrupt := make(chan struct{})
+		var wg sync.WaitGroup
+		for i, path := range args {
+			r, err := parseFilePathOrURL(context.Background(), path, nil)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			defer func() {
+				_ = r.Close()
+			}()
+			wg.Add(1)
+			go func(i int, path string, r io.ReadCloser) {
+				defer wg.Done()
+				sources[i] = readCompareSource(path, r, time.Duration(compareDuration)*time.Second, interrupt)
+			}(i, path, r)
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-c:
+			// stop both sources and compare the tags read so far
+			close(interrupt)
+			<-done
+			fmt.Println("Interrupted, compare the tags read so far")
+		}
+		for _, source := range sources {
+			if source.Err != nil {
+				return fmt.Errorf("%s: %v", source.Name, source.Err)
+			}
+		}
+		report := compareStreams(sources[0], sources[1])
+		printCompareReport(os.Stdout, report, maxDiffs)
+		return nil
+	},
+}
+
+func initCompareFlags() {
+	compareCmd.Flags().IntVar(
+		&compareDuration,
+		"compare_duration",
+		30,
+		"pull the http urls for seconds (no limit if <=0), files are always read to the end",
+	)
+	compareCmd.Flags().IntVar(
+		&maxDiffs,
+		"max_diffs",
+		20,
+		"show the first n different tags of every kind (no limit if n<=0)",
+	)
+}
+
+// compareTag is the digest of an audio or video tag except sequence header
+type compareTag struct {
+	Track    string // video or audio
+	DTS      int64
+	PTS      int64
+	Size     int
+	KeyFrame bool
+	Hash     [sha1.Size]byte
+}
+
+type compareSource struct {
+	Name     string
+	Tags     []compareTag
+	Video    []byte // the payload of the first video sequence header
+	VideoID  flv.CodecID
+	Audio    []byte // the payload of the first AAC sequence header
+	MetaData amf.ECMAArray
+	Err      error
+}
+
+// readCompareSource reads tags from r until EOF, the stream is stopped after duration if it's an http url,
+// or when interrupt is closed. The tags read before stopped are kept.
+func readCompareSource(name string, r io.ReadCloser, duration time.Duration, interrupt <-chan struct{}) *compareSource {
+	source := &compareSource{Name: name}
+	stopped := false
+	var mu sync.Mutex
+	var timeout <-chan time.Time
+	if duration > 0 && isValidURL(name) {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-timeout:
+		case <-interrupt:
+		case <-done:
+			return
+		}
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		_ = r.Close()
+	}()
+	demuxer := new(flv.Demuxer)
+	if _, err := demuxer.ReadHeader(r); err != nil {
+		source.Err = err
+		return source
+	}
+	for {
+		tag, err := demuxer.ReadTag(r)
+		if err != nil {
+			mu.Lock()
+			if err != io.EOF && !stopped {
+				source.Err = err
+			}
+			mu.Unlock()
+			return source
+		}
+		source.add(tag)
+	}
+}
+
+func (source *compareSource) add(tag flv.TagI) {
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		if t.PacketType == flv.SequenceHeader {
+			if source.Video == nil {
+				source.Video = t.Bytes
+				source.VideoID = t.CodecID
+			}
+			return
+		}
+		source.Tags = append(source.Tags, compareTag{
+			Track:    "video",
+			DTS:      int64(t.DTS),
+			PTS:      int64(t.PTS),
+			Size:     len(t.Bytes),
+			KeyFrame: t.FrameType == flv.KeyFrame,
+			Hash:     sha1.Sum(t.Bytes),
+		})
+	case *flv.AudioTag:
+		if flv.IsSequenceHeader(t) {
+			if source.Audio == nil {
+				source.Audio = t.Bytes
+			}
+			return
+		}
+		source.Tags = append(source.Tags, compareTag{
+			Track:    "audio",
+			DTS:      int64(t.PTS),
+			PTS:      int64(t.PTS),
+			Size:     len(t.Bytes),
+			KeyFrame: true,
+			Hash:     sha1.Sum(t.Bytes),
+		})
+	case *flv.ScriptTag:
+		if source.MetaData != nil {
+			return
+		}
+		got, _ := amf.NewDecoder(amf.Version0).DecodeBatch(bytes.NewReader(t.Bytes))
+		if len(got) < 2 || got[0] != "onMetaData" {
+			return
+		}
+		switch values := got[1].(type) {
+		case amf.ECMAArray:
+			source.MetaData = values
+		case map[string]interface{}:
+			source.MetaData = values
+		}
+	}
+}
+
+func (source *compareSource) track(name string) []compareTag {
+	var tags []compareTag
+	for _, tag := range source.Tags {
+		if tag.Track == name {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// trackReport is the result of comparing a track, the timestamps of tags are on the timeline of their own source.
+type trackReport struct {
+	Track string
+	A, B  int // number of tags
+
+	// HashAligned is true if some tags have the same payload, then the tags are aligned by payload hash,
+	// otherwise they are aligned by the timestamp of the first keyframe.
+	HashAligned bool
+	Matched     int
+	Offset      int64 // dts of B - dts of A at the start of overlap
+	Drift       int64 // how much the offset changed from the start to the end of overlap
+
+	Missing    []compareTag // tags of A not in B
+	Extra      []compareTag // tags of B not in A
+	Mismatched []compareTag // tags of A whose payload is different from the tag of B at the same timestamp
+	Outside    int          // tags out of the time range covered by both sources, e.g. pulled earlier or later
+}
+
+type compareReport struct {
+	A, B          string
+	Tracks        []*trackReport
+	SequenceDiffs []string
+	MetaDataDiffs []string
+}
+
+func compareStreams(a, b *compareSource) *compareReport {
+	report := &compareReport{A: a.Name, B: b.Name}
+	for _, name := range []string{"video", "audio"} {
+		ta, tb := a.track(name), b.track(name)
+		if len(ta) == 0 && len(tb) == 0 {
+			continue
+		}
+		report.Tracks = append(report.Tracks, compareTrack(name, ta, tb))
+	}
+	report.SequenceDiffs = compareSequenceHeaders(a, b)
+	report.MetaDataDiffs = compareMetaData(a.MetaData, b.MetaData)
+	return report
+}
+
+func compareTrack(name string, a, b []compareTag) *trackReport {
+	report := &trackReport{Track: name, A: len(a), B: len(b)}
+	if len(a) == 0 || len(b) == 0 {
+		report.Missing = a
+		report.Extra = b
+		return report
+	}
+
+	// match the tags by payload hash in order, pairs[i] is the index of b matched with a[i] or -1
+	pairs := make([]int, len(a))
+	indexes := make(map[[sha1.Size]byte][]int)
+	for j, tag := range b {
+		indexes[tag.Hash] = append(indexes[tag.Hash], j)
+	}
+	matchedB := make([]bool, len(b))
+	last := -1
+	var first, final = -1, -1
+	for i, tag := range a {
+		pairs[i] = -1
+		candidates := indexes[tag.Hash]
+		for len(candidates) > 0 && candidates[0] <= last {
+			candidates = candidates[1:]
+		}
+		indexes[tag.Hash] = candidates
+		if len(candidates) == 0 {
+			continue
+		}
+		pairs[i], last = candidates[0], candidates[0]
+		matchedB[last] = true
+		report.Matched++
+		if first < 0 {
+			first = i
+		}
+		final = i
+	}
+
+	// offsets[i] is the offset around a[i], it's the offset of the nearest matched pair before it
+	offsets := make([]int64, len(a))
+	if first >= 0 {
+		report.HashAligned = true
+		offset := b[pairs[first]].DTS - a[first].DTS
+		for i := range a {
+			if pairs[i] >= 0 {
+				offset = b[pairs[i]].DTS - a[i].DTS
+			}
+			offsets[i] = offset
+		}
+		report.Offset = offsets[first]
+		report.Drift = offsets[final] - offsets[first]
+	} else {
+		report.Offset = firstKeyFrame(b).DTS - firstKeyFrame(a).DTS
+		for i := range offsets {
+			offsets[i] = report.Offset
+		}
+	}
+
+	// the time range covered by both sources on the timeline of a
+	start := maxInt64(a[0].DTS, b[0].DTS-offsets[0])
+	end := minInt64(a[len(a)-1].DTS, b[len(b)-1].DTS-offsets[len(a)-1])
+	inside := func(dts int64) bool {
+		return dts >= start && dts <= end
+	}
+
+	// the tags of a not matched by hash are mismatched if there is a tag of b at the same timestamp
+	unmatched := make(map[int64][]int)
+	for j, tag := range b {
+		if !matchedB[j] {
+			unmatched[tag.DTS] = append(unmatched[tag.DTS], j)
+		}
+	}
+	for i, tag := range a {
+		if pairs[i] >= 0 {
+			continue
+		}
+		if !inside(tag.DTS) {
+			report.Outside++
+			continue
+		}
+		dts := tag.DTS + offsets[i]
+		if candidates := unmatched[dts]; len(candidates) > 0 {
+			matchedB[candidates[0]] = true
+			unmatched[dts] = candidates[1:]
+			report.Mismatched = append(report.Mismatched, tag)
+			continue
+		}
+		report.Missing = append(report.Missing, tag)
+	}
+
+	i := 0
+	for j, tag := range b {
+		if matchedB[j] {
+			continue
+		}
+		for i+1 < len(a) && pairs[i+1] >= 0 && pairs[i+1] < j {
+			i++
+		}
+		if !inside(tag.DTS - offsets[i]) {
+			report.Outside++
+			continue
+		}
+		report.Extra = append(report.Extra, tag)
+	}
+	return report
+}
+
+func firstKeyFrame(tags []compareTag) compareTag {
+	for _, tag := range tags {
+		if tag.KeyFrame {
+			return tag
+		}
+	}
+	return tags[0]
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// compareSequenceHeaders decodes the sequence headers and returns the different fields
+func compareSequenceHeaders(a, b *compareSource) []string {
+	var diffs []string
+	switch {
+	case a.Video == nil && b.Video == nil:
+	case a.Video == nil || b.Video == nil:
+		diffs = append(diffs, fmt.Sprintf("video: exists %v != %v", a.Video != nil, b.Video != nil))
+	case a.VideoID != b.VideoID:
+		diffs = append(diffs, fmt.Sprintf("video: codec %v != %v", a.VideoID, b.VideoID))
+	case !bytes.Equal(a.Video, b.Video):
+		var ra, rb interface{}
+		switch a.VideoID {
+		case flv.H264:
+			ra, rb = new(avc.AVCDecoderConfigurationRecord), new(avc.AVCDecoderConfigurationRecord)
+		case flv.H265:
+			ra, rb = new(hevc.HEVCDecoderConfigurationRecord), new(hevc.HEVCDecoderConfigurationRecord)
+		}
+		diffs = append(diffs, diffRecords("video", ra, rb, a.Video, b.Video)...)
+	}
+	switch {
+	case a.Audio == nil && b.Audio == nil:
+	case a.Audio == nil || b.Audio == nil:
+		diffs = append(diffs, fmt.Sprintf("audio: exists %v != %v", a.Audio != nil, b.Audio != nil))
+	case !bytes.Equal(a.Audio, b.Audio):
+		diffs = append(diffs, diffRecords("audio", new(codec.AACAudioSpecificConfig), new(codec.AACAudioSpecificConfig), a.Audio, b.Audio)...)
+	}
+	return diffs
+}
+
+type recordReader interface {
+	Read(data []byte) error
+}
+
+// diffRecords decodes the configuration records and compares them field by field,
+// it falls back to the bytes if the records can't be decoded.
+func diffRecords(prefix string, ra, rb interface{}, a, b []byte) []string {
+	ma, okA := ra.(recordReader)
+	mb, okB := rb.(recordReader)
+	if !okA || !okB || ma.Read(a) != nil || mb.Read(b) != nil {
+		return []string{fmt.Sprintf("%s: bytes %x != %x", prefix, a, b)}
+	}
+	var diffs []string
+	va, vb := reflect.ValueOf(ra).Elem(), reflect.ValueOf(rb).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		fa, fb := fmt.Sprintf("%v", va.Field(i).Interface()), fmt.Sprintf("%v", vb.Field(i).Interface())
+		if fa != fb {
+			diffs = append(diffs, fmt.Sprintf("%s: %s %s != %s", prefix, va.Type().Field(i).Name, fa, fb))
+		}
+	}
+	if len(diffs) == 0 {
+		diffs = append(diffs, fmt.Sprintf("%s: bytes %x != %x", prefix, a, b))
+	}
+	return diffs
+}
+
+// compareMetaData returns the different values of onMetaData
+func compareMetaData(a, b amf.ECMAArray) []string {
+	var diffs []string
+	if (a == nil) != (b == nil) {
+		return append(diffs, fmt.Sprintf("onMetaData: exists %v != %v", a != nil, b != nil))
+	}
+	keys := make(map[string]struct{})
+	for key := range a {
+		keys[key] = struct{}{}
+	}
+	for key := range b {
+		keys[key] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		va, okA := a[key]
+		vb, okB := b[key]
+		switch {
+		case !okA:
+			diffs = append(diffs, fmt.Sprintf("%s: missing != %v", key, vb))
+		case !okB:
+			diffs = append(diffs, fmt.Sprintf("%s: %v != missing", key, va))
+		case !reflect.DeepEqual(va, vb):
+			diffs = append(diffs, fmt.Sprintf("%s: %v != %v", key, va, vb))
+		}
+	}
+	return diffs
+}
+
+func printCompareReport(w io.Writer, report *compareReport, max int) {
+	fmt.Fprintf(w, "A: %s\nB: %s\n", report.A, report.B)
+	for _, track := range report.Tracks {
+		fmt.Fprintf(w, "---------- %s ----------\n", track.Track)
+		aligned := "first keyframe"
+		if track.HashAligned {
+			aligned = "payload hash"
+		}
+		fmt.Fprintf(w, "tags: A %d, B %d, matched %d, aligned by %s\n", track.A, track.B, track.Matched, aligned)
+		fmt.Fprintf(w, "timestamp offset(B-A): %dms, drift: %dms\n", track.Offset, track.Drift)
+		fmt.Fprintf(w, "missing in B: %d, extra in B: %d, payload mismatched: %d, out of overlap: %d\n",
+			len(track.Missing), len(track.Extra), len(track.Mismatched), track.Outside)
+		printCompareTags(w, "missing", track.Missing, max)
+		printCompareTags(w, "extra", track.Extra, max)
+		printCompareTags(w, "mismatched", track.Mismatched, max)
+	}
+	fmt.Fprintln(w, "---------- sequence header ----------")
+	printDiffs(w, report.SequenceDiffs)
+	fmt.Fprintln(w, "---------- metadata ----------")
+	printDiffs(w, report.MetaDataDiffs)
+}
+
+func printCompareTags(w io.Writer, kind string, tags []compareTag, max int) {
+	for i, tag := range tags {
+		if max > 0 && i >= max {
+			fmt.Fprintf(w, "  ... %d more %s\n", len(tags)-max, kind)
+			return
+		}
+		fmt.Fprintf(w, "  %-10s dts:%7d pts:%7d size:%7d keyframe:%v\n", kind, tag.DTS, tag.PTS, tag.Size, tag.KeyFrame)
+	}
+}
+
+func printDiffs(w io.Writer, diffs []string) {
+	if len(diffs) == 0 {
+		fmt.Fprintln(w, "identical")
+		return
+	}
+	for _, diff := range diffs {
+		fmt.Fprintf(w, "  %s\n", diff)
+	}
+}
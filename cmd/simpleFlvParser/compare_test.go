@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+)
+
+func TestCompare(t *testing.T) {
+	f, err := os.Open("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := readCompareSource("origin", f, 0, nil)
+	_ = f.Close()
+	assert.Nil(t, a.Err)
+	assert.NotNil(t, a.Video)
+	assert.NotNil(t, a.MetaData)
+
+	report := compareStreams(a, a)
+	for _, track := range report.Tracks {
+		assert.Equal(t, track.A, track.Matched)
+		assert.Equal(t, int64(0), track.Offset)
+		assert.Empty(t, track.Missing)
+		assert.Empty(t, track.Extra)
+		assert.Empty(t, track.Mismatched)
+	}
+	assert.Empty(t, report.SequenceDiffs)
+	assert.Empty(t, report.MetaDataDiffs)
+
+	// the edge starts later, rewrites timestamps, drops a tag, changes a tag and inserts a tag
+	video := a.track("video")
+	var tags []compareTag
+	for i, tag := range video[5:] {
+		tag.DTS += 1000
+		tag.PTS += 1000
+		switch i {
+		case 10:
+			continue
+		case 20:
+			tag.Hash = sha1.Sum([]byte("changed"))
+		case 30:
+			extra := tag
+			extra.DTS++
+			extra.Hash = sha1.Sum([]byte("extra"))
+			tags = append(tags, extra)
+		}
+		tags = append(tags, tag)
+	}
+	b := &compareSource{Name: "edge", Tags: tags, Video: a.Video[:len(a.Video)-1], VideoID: a.VideoID, MetaData: amf.ECMAArray{}}
+	for key, value := range a.MetaData {
+		b.MetaData[key] = value
+	}
+	b.MetaData["width"] = float64(1)
+	b.MetaData["server"] = "edge"
+
+	report = compareStreams(a, b)
+	assert.Equal(t, 2, len(report.Tracks))
+	track := report.Tracks[0]
+	assert.True(t, track.HashAligned)
+	assert.Equal(t, int64(1000), track.Offset)
+	assert.Equal(t, int64(0), track.Drift)
+	assert.Equal(t, 5, track.Outside)
+	assert.Equal(t, []compareTag{video[15]}, track.Missing)
+	assert.Equal(t, []compareTag{video[25]}, track.Mismatched)
+	assert.Equal(t, 1, len(track.Extra))
+	assert.Equal(t, len(video)-7, track.Matched)
+	assert.Equal(t, 0, report.Tracks[1].B)
+	assert.NotEmpty(t, report.SequenceDiffs)
+	assert.Contains(t, report.MetaDataDiffs, "server: missing != edge")
+
+	var buf bytes.Buffer
+	printCompareReport(&buf, report, 1)
+	assert.Contains(t, buf.String(), "timestamp offset(B-A): 1000ms, drift: 0ms")
+	assert.Contains(t, buf.String(), "missing in B: 1, extra in B: 1, payload mismatched: 1, out of overlap: 5")
+}
+
+func TestCompareSourceInterrupted(t *testing.T) {
+	data, err := os.ReadFile("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := readAllTags(t, bytes.NewReader(data))
+	r, w := io.Pipe()
+	interrupt := make(chan struct{})
+	go func() {
+		var buf bytes.Buffer
+		muxer := new(flv.Muxer)
+		_ = muxer.WriteHeader(&buf, true, true)
+		for _, tag := range tags[:20] {
+			_ = muxer.WriteTag(&buf, tag)
+		}
+		_, _ = w.Write(buf.Bytes())
+		// the live stream goes on, it's stopped by the interrupt
+		close(interrupt)
+	}()
+	source := readCompareSource("http://example.com/live/test.flv", r, 0, interrupt)
+	assert.Nil(t, source.Err)
+	assert.NotEmpty(t, source.Tags)
+	assert.NotNil(t, source.Video)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+var concatCmd = &cobra.Command{
+	Use:   "concat [flags] <input file path>... <output file path>",
+	Short: "Concatenate FLV files with timestamps rebased to be continuous",
+	Long: `Concatenate FLV files with timestamps rebased to be continuous,
+every file continues after the last frame of the file before it,
+the same sequence headers are written once and the changed ones are written again.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 3 {
+			_ = cmd.Usage()
+			return errors.New("please specify two input file paths at least and the output file path")
+		}
+		inputs, output := args[:len(args)-1], args[len(args)-1]
+		if err := checkOutput(output, inputs...); err != nil {
+			return err
+		}
+		return concatFLV(inputs, output, os.Stdout)
+	},
+}
+
+// concatFLV concatenates inputs to output, the changes are reported to out.
+func concatFLV(inputs []string, output string, out io.Writer) error {
+	files := make([]*os.File, 0, len(inputs))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	demuxers := make([]*flv.Demuxer, 0, len(inputs))
+	hasAudio, hasVideo := false, false
+	for _, input := range inputs {
+		f, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("open file err: %v", err)
+		}
+		files = append(files, f)
+		demuxer := &flv.Demuxer{MaxTagSize: maxTagSize}
+		header, err := demuxer.ReadHeader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", input, err)
+		}
+		demuxers = append(demuxers, demuxer)
+		hasAudio = hasAudio || header.HasAudio
+		hasVideo = hasVideo || header.HasVideo
+	}
+	w, err := createFLVWriter(output, hasAudio, hasVideo)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		if err = concatFile(w, inputs[i], f, demuxers[i], out); err != nil {
+			break
+		}
+	}
+	if err := w.Close(err); err != nil {
+		return err
+	}
+	w.Print(out)
+	return nil
+}
+
+// concatFile writes the tags of file to w, the timestamps continue after the tags written.
+func concatFile(w *flvWriter, name string, r io.Reader, demuxer *flv.Demuxer, out io.Writer) error {
+	started := false
+	var held []flv.TagI // the tags before the first audio/video frame, they are written after the shift is known
+	write := func(tag flv.TagI) error {
+		if flv.IsSequenceHeader(tag) {
+			if last := w.headers[tag.Type()]; last != nil && !bytes.Equal(last, tag.Data()) {
+				fmt.Fprintf(out, "%s: %s sequence header changed\n", name, tag.Type())
+			}
+		}
+		return w.writeTag(tag)
+	}
+	err := readAll(func() (flv.TagI, error) {
+		return demuxer.ReadTag(r)
+	}, func(tag flv.TagI) error {
+		if started {
+			return write(tag)
+		}
+		if tag.Type() == flv.TagScript || flv.IsSequenceHeader(tag) {
+			held = append(held, tag)
+			return nil
+		}
+		started = true
+		w.shift = w.next() - int64(tag.Timestamp())
+		fmt.Fprintf(out, "%s: shift timestamps by %d\n", name, w.shift)
+		for _, t := range held {
+			if err := write(t); err != nil {
+				return err
+			}
+		}
+		return write(tag)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
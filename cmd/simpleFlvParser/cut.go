@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+var (
+	cutFrom        int
+	cutTo          int
+	keepTimestamps bool
+)
+
+var cutCmd = &cobra.Command{
+	Use:   "cut [flags] <input file path> <output file path>",
+	Short: "Cut the tags between two timestamps on keyframe boundaries",
+	Long: `Cut the tags between two timestamps on keyframe boundaries,
+it starts at the nearest keyframe at or before --from and stops before the first keyframe at or after --to,
+the original onMetaData is dropped since it's out of date, use the inject command to make the output seekable.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			_ = cmd.Usage()
+			return errors.New("please specify the input and output file paths")
+		}
+		if err := checkOutput(args[1], args[0]); err != nil {
+			return err
+		}
+		if cutTo > 0 && cutTo <= cutFrom {
+			return fmt.Errorf("--to %d should be after --from %d", cutTo, cutFrom)
+		}
+		in, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("open file err: %v", err)
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		w, err := cutFLV(in, args[1], uint32(cutFrom), uint32(cutTo))
+		if err != nil {
+			return err
+		}
+		w.Print(os.Stdout)
+		return nil
+	},
+}
+
+func initCutFlags() {
+	cutCmd.Flags().IntVar(
+		&cutFrom,
+		"from",
+		0,
+		"start at the nearest keyframe at or before the timestamp(ms)",
+	)
+	cutCmd.Flags().IntVar(
+		&cutTo,
+		"to",
+		0,
+		"stop before the first keyframe at or after the timestamp(ms) (until the end if to<=0)",
+	)
+	cutCmd.Flags().BoolVar(
+		&keepTimestamps,
+		"keep_timestamps",
+		false,
+		"keep the original timestamps instead of starting from zero",
+	)
+}
+
+// cutFLV writes the tags of in between from and to(ms) to output on keyframe boundaries, no limit if to is 0.
+func cutFLV(in io.ReadSeeker, output string, from, to uint32) (*flvWriter, error) {
+	reader, err := flv.NewReader(in, &flv.Demuxer{MaxTagSize: maxTagSize})
+	if err != nil {
+		return nil, err
+	}
+	if err := reader.Seek(from); err != nil {
+		return nil, err
+	}
+	w, err := createFLVWriter(output, reader.Header().HasAudio, reader.Header().HasVideo)
+	if err != nil {
+		return nil, err
+	}
+	hasVideo := reader.Header().HasVideo
+	started := false
+	var held []flv.TagI // the sequence headers before the keyframe, they are written after the shift is known
+	err = readAll(reader.ReadTag, func(tag flv.TagI) error {
+		if isKeyFrameTag(tag, hasVideo) {
+			if to > 0 && tag.Timestamp() >= to {
+				return errStop
+			}
+			if !started {
+				started = true
+				if !keepTimestamps {
+					w.shift = -int64(tag.Timestamp())
+				}
+				for _, t := range held {
+					if err := w.writeTag(t); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if !started {
+			held = append(held, tag)
+			return nil
+		}
+		return w.writeTag(tag)
+	})
+	return w, w.Close(err)
+}
+
+// errStop stops readAll without error
+var errStop = errors.New("stop")
+
+// readAll calls onTag with every tag read by readTag except onMetaData, until io.EOF or errStop.
+func readAll(readTag func() (flv.TagI, error), onTag func(tag flv.TagI) error) error {
+	for {
+		tag, err := readTag()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%v (try the repair command first)", err)
+		}
+		if script, ok := tag.(*flv.ScriptTag); ok && flv.IsMetaData(script) {
+			continue
+		}
+		if err := onTag(tag); err == errStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// isKeyFrameTag returns true if tag is a video keyframe, or an audio frame if there is no video.
+func isKeyFrameTag(tag flv.TagI, hasVideo bool) bool {
+	if flv.IsSequenceHeader(tag) {
+		return false
+	}
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		return t.FrameType == flv.KeyFrame
+	case *flv.AudioTag:
+		return !hasVideo
+	}
+	return false
+}
+
+// flvWriter writes tags to a FLV file, the timestamps are shifted by shift,
+// and a sequence header is written only if it differs from the one written last.
+type flvWriter struct {
+	path   string
+	number int // number of segment
+	f      *outputFile
+	muxer  *flv.Muxer
+	shift  int64
+
+	size    int64
+	tags    int
+	headers map[flv.TagType][]byte // the sequence headers written last
+	vars    *flv.StreamVars        // the variables of tags for --filter
+
+	started bool
+	first   int64
+	last    map[flv.TagType]int64 // the last timestamp written of tracks
+	delta   map[flv.TagType]int64 // the last frame duration of tracks
+}
+
+func createFLVWriter(path string, hasAudio, hasVideo bool) (*flvWriter, error) {
+	f, err := createOutputFile(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &flvWriter{
+		path:    path,
+		f:       f,
+		muxer:   new(flv.Muxer),
+		size:    9 + 4,
+		headers: make(map[flv.TagType][]byte),
+		vars:    flv.NewStreamVars(),
+		last:    make(map[flv.TagType]int64),
+		delta:   make(map[flv.TagType]int64),
+	}
+	if err := w.muxer.WriteHeader(f, hasAudio, hasVideo); err != nil {
+		f.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// writeTag writes tag with timestamps shifted if it passes --filter, the timestamps before zero are written as zero.
+func (w *flvWriter) writeTag(tag flv.TagI) error {
+	if packetFilter != nil && !passFilter(tag, w.vars.Vars(tag, time.Now())) {
+		return nil
+	}
+	if flv.IsSequenceHeader(tag) {
+		if bytes.Equal(w.headers[tag.Type()], tag.Data()) {
+			return nil
+		}
+		w.headers[tag.Type()] = tag.Data()
+	}
+	shift := func(timestamp uint32) uint32 {
+		if t := int64(timestamp) + w.shift; t > 0 {
+			return uint32(t)
+		}
+		return 0
+	}
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		video := *t
+		video.DTS = shift(t.DTS)
+		video.PTS = video.DTS + (t.PTS - t.DTS)
+		tag = &video
+	case *flv.AudioTag:
+		audio := *t
+		audio.PTS = shift(t.PTS)
+		tag = &audio
+	case *flv.ScriptTag:
+		script := *t
+		script.PTS = shift(t.PTS)
+		tag = &script
+	}
+	if err := w.muxer.WriteTag(w.f, tag); err != nil {
+		return err
+	}
+	w.size += int64(11 + tag.Len() + 4)
+	w.tags++
+	if tagType := tag.Type(); tagType != flv.TagScript && !flv.IsSequenceHeader(tag) {
+		timestamp := int64(tag.Timestamp())
+		if !w.started || timestamp < w.first {
+			w.first = timestamp
+		}
+		w.started = true
+		if last, ok := w.last[tagType]; ok && timestamp > last {
+			w.delta[tagType] = timestamp - last
+		}
+		w.last[tagType] = timestamp
+	}
+	return nil
+}
+
+// duration returns the duration of tags written in ms
+func (w *flvWriter) duration() int64 {
+	var last int64
+	for _, timestamp := range w.last {
+		if timestamp > last {
+			last = timestamp
+		}
+	}
+	return last - w.first
+}
+
+// next returns the timestamp to continue after the tags written, that is the last one plus the frame duration.
+func (w *flvWriter) next() int64 {
+	var next int64
+	for tagType, last := range w.last {
+		delta, ok := w.delta[tagType]
+		if !ok && tagType == flv.TagVideo {
+			delta = defaultVideoDelta
+		} else if !ok {
+			delta = defaultAudioDelta
+		}
+		if last+delta > next {
+			next = last + delta
+		}
+	}
+	return next
+}
+
+// Close renames the file written to path if err is nil, or removes it and returns err.
+func (w *flvWriter) Close(err error) error {
+	return closeOutput(w.f, err)
+}
+
+func (w *flvWriter) Print(out io.Writer) {
+	fmt.Fprintf(out, "%s: %d tags, %d bytes, timestamp %d-%d, duration %dms\n",
+		w.path, w.tags, w.size, w.first, w.first+w.duration(), w.duration())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+// readFileTags reads the tags of file
+func readFileTags(t *testing.T, path string) []flv.TagI {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAllTags(t, bytes.NewReader(data))
+}
+
+func TestCutSplitConcat(t *testing.T) {
+	const input = "../../container/flv/test.flv"
+	dir := t.TempDir()
+	original := readFileTags(t, input)
+
+	f, err := os.Open(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	cut, err := cutFLV(f, filepath.Join(dir, "cut.flv"), 3000, 9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := readFileTags(t, cut.path)
+	assert.Equal(t, cut.tags, len(tags))
+	assert.True(t, flv.IsSequenceHeader(tags[0]))
+	assert.True(t, isKeyFrameTag(tags[1], true))
+	assert.Equal(t, uint32(0), tags[1].Timestamp())
+	for _, tag := range tags[2:] {
+		assert.False(t, isKeyFrameTag(tag, true) && tag.Timestamp() == 0, "only the first keyframe is at 0")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	var segments []string
+	err = splitFLV(f, filepath.Join(dir, "seg_%03d.flv"), 4000, 0, func(w *flvWriter) {
+		segments = append(segments, w.path)
+	})
+	assert.Nil(t, err)
+	assert.True(t, len(segments) >= 3)
+	for _, segment := range segments[1:] {
+		tags := readFileTags(t, segment)
+		// every segment starts with the sequence header and a keyframe at 0
+		assert.True(t, flv.IsSequenceHeader(tags[0]))
+		assert.True(t, isKeyFrameTag(tags[1], true))
+		assert.Equal(t, uint32(0), tags[1].Timestamp())
+	}
+
+	// the segments are concatenated back without the repeated sequence headers and onMetaData
+	var report bytes.Buffer
+	output := filepath.Join(dir, "concat.flv")
+	assert.Nil(t, concatFLV(segments, output, &report))
+	tags = readFileTags(t, output)
+	assert.Equal(t, len(original)-1, len(tags), report.String())
+	last := map[flv.TagType]uint32{}
+	for _, tag := range tags {
+		assert.True(t, tag.Timestamp() >= last[tag.Type()], "timestamps should be monotonic")
+		last[tag.Type()] = tag.Timestamp()
+	}
+	assert.NotContains(t, report.String(), "sequence header changed")
+
+	assert.Equal(t, "out_%03d.flv", segmentPattern("out.flv"))
+	assert.Equal(t, "out-%d.flv", segmentPattern("out-%d.flv"))
+}
+
+func TestCutFilter(t *testing.T) {
+	defer func(expr string) {
+		filterExpr, packetFilter = expr, nil
+	}(filterExpr)
+	filterExpr = `stream_type == "VIDEO" && keyframe`
+	assert.Nil(t, compileFilter(cutCmd, nil))
+	assert.NotNil(t, packetFilter)
+	assert.EqualError(t, compileFilter(repairCmd, nil), "--filter is not supported by the repair command")
+
+	f, err := os.Open("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	cut, err := cutFLV(f, filepath.Join(t.TempDir(), "cut.flv"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := readFileTags(t, cut.path)
+	assert.True(t, len(tags) > 2)
+	assert.True(t, flv.IsSequenceHeader(tags[0]), "the sequence headers pass the filter")
+	for _, tag := range tags[1:] {
+		assert.True(t, isKeyFrameTag(tag, true) && tag.Type() == flv.TagVideo)
+	}
+}
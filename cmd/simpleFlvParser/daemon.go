@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/foolishCDN/AV-spy/metrics"
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+// exitUnhealthy is the exit code when the health thresholds are breached longer than the grace period
+const exitUnhealthy = 3
+
+var (
+	interval       int
+	intervalOutput string
+
+	healthMinFPS      float64
+	healthMaxGap      int
+	healthMaxHole     int
+	healthMaxAVOffset int
+	healthGrace       int
+
+	metricsAddr string
+)
+
+func initDaemonFlags() {
+	rootCmd.Flags().IntVar(
+		&interval,
+		"interval",
+		0,
+		"daemon mode, report every interval(seconds) until the stream ends or is interrupted (no report if interval<=0)",
+	)
+	rootCmd.Flags().StringVar(
+		&intervalOutput,
+		"interval_output",
+		"",
+		"write the interval reports as JSON lines to file, '-' is stdout",
+	)
+	rootCmd.Flags().Float64Var(
+		&healthMinFPS,
+		"health_min_fps",
+		0,
+		"unhealthy if the video fps(or the audio pps without video) of an interval is less than it (no check if 0)",
+	)
+	rootCmd.Flags().IntVar(
+		&healthMaxGap,
+		"health_max_gap",
+		0,
+		"unhealthy if the max gap(ms) of timestamp in an interval is larger than it (no check if 0)",
+	)
+	rootCmd.Flags().IntVar(
+		&healthMaxHole,
+		"health_max_hole",
+		0,
+		"unhealthy if the max hole(ms) of data in an interval is larger than it (no check if 0)",
+	)
+	rootCmd.Flags().IntVar(
+		&healthMaxAVOffset,
+		"health_max_av_offset",
+		0,
+		"unhealthy if the offset(ms) between the last video and audio timestamps is larger than it (no check if 0)",
+	)
+	rootCmd.Flags().IntVar(
+		&healthGrace,
+		"health_grace",
+		30,
+		"exit with code 3 if the stream is unhealthy longer than grace period(seconds)",
+	)
+	rootCmd.Flags().StringVar(
+		&metricsAddr,
+		"metrics_addr",
+		"",
+		"serve the stream health in Prometheus text format on http://<addr>/metrics, e.g. :9100",
+	)
+}
+
+type intervalReport struct {
+	Time       time.Time            `json:"time"`
+	DurationMs int64                `json:"duration_ms"`
+	Video      *intervalTrackReport `json:"video,omitempty"`
+	Audio      *intervalTrackReport `json:"audio,omitempty"`
+	AVOffset   *int64               `json:"av_offset,omitempty"` // the last video timestamp - the last audio timestamp
+	Cache      *probe.CacheSummary  `json:"cache,omitempty"`     // the estimated cache of video, or audio without video
+	Unhealthy  []string             `json:"unhealthy,omitempty"`
+}
+
+type intervalTrackReport struct {
+	Frames            int     `json:"frames"`
+	Bytes             int64   `json:"bytes"`
+	Rate              float64 `json:"rate"`    // frames per second
+	Bitrate           float64 `json:"bitrate"` // bits per second
+	TimestampDuration int64   `json:"timestamp_duration"`
+	Gaps              int     `json:"gaps"`
+	MaxGap            int64   `json:"max_gap"`
+	Rewinds           int     `json:"rewinds"`
+	Duplicates        int     `json:"duplicates"`
+	Holes             int     `json:"holes"`
+	MaxHoleMs         int64   `json:"max_hole_ms"`
+	Total             int     `json:"total"` // cumulative frames
+}
+
+func newIntervalTrackReport(i summary.IntervalStats, s summary.Stats) *intervalTrackReport {
+	return &intervalTrackReport{
+		Frames:            i.Frames,
+		Bytes:             i.Bytes,
+		Rate:              i.Rate,
+		Bitrate:           i.Bitrate,
+		TimestampDuration: i.TimestampDuration,
+		Gaps:              i.Gaps,
+		MaxGap:            i.MaxGap,
+		Rewinds:           i.Rewinds,
+		Duplicates:        i.Duplicates,
+		Holes:             i.Holes,
+		MaxHoleMs:         i.MaxHole.Milliseconds(),
+		Total:             s.Total,
+	}
+}
+
+// Interval reports the stats of the interval ended at now, the interval-scoped stats of counters are reset.
+func (p *FlvParser) Interval(now time.Time) *intervalReport {
+	report := &intervalReport{Time: now}
+	vi, ai := p.videoCounter.Interval(now), p.audioCounter.Interval(now)
+	v, a := p.videoCounter.Snapshot(), p.audioCounter.Snapshot()
+	report.DurationMs = max(vi.Duration, ai.Duration).Milliseconds()
+	if v.Total > 0 {
+		report.Video = newIntervalTrackReport(vi, v)
+	}
+	if a.Total > 0 {
+		report.Audio = newIntervalTrackReport(ai, a)
+	}
+	if v.Total > 0 && a.Total > 0 {
+		offset := v.LastTimestamp - a.LastTimestamp
+		report.AVOffset = &offset
+	}
+	cache := v
+	if v.Total == 0 {
+		cache = a
+	}
+	if cache.Total > 0 {
+		report.Cache = &probe.NewTrackSummary(cache).Cache
+	}
+	return report
+}
+
+func (r *intervalReport) Print(out io.Writer) {
+	fmt.Fprintf(out, "[%s] interval %dms\n", r.Time.Format(time.RFC3339), r.DurationMs)
+	for _, track := range []struct {
+		name   string
+		report *intervalTrackReport
+	}{{"video", r.Video}, {"audio", r.Audio}} {
+		if track.report == nil {
+			continue
+		}
+		t := track.report
+		fmt.Fprintf(out, "  %s: rate %.2f, bitrate %.0fkbps, frames %d/%d, gaps %d (max %d), rewinds %d, duplicates %d, holes %d (max %dms)\n",
+			track.name, t.Rate, t.Bitrate/1000, t.Frames, t.Total, t.Gaps, t.MaxGap, t.Rewinds, t.Duplicates, t.Holes, t.MaxHoleMs)
+	}
+	if r.AVOffset != nil {
+		fmt.Fprintf(out, "  av offset: %dms\n", *r.AVOffset)
+	}
+	if r.Cache != nil {
+		fmt.Fprintf(out, "  cache: %d (converged: %v, confidence: %.2f)\n", r.Cache.Duration, r.Cache.Converged, r.Cache.Confidence)
+	}
+	if len(r.Unhealthy) > 0 {
+		fmt.Fprintf(out, "  unhealthy: %s\n", strings.Join(r.Unhealthy, ", "))
+	}
+}
+
+type healthConfig struct {
+	MinFPS      float64
+	MaxGap      int
+	MaxHole     time.Duration
+	MaxAVOffset int
+	Grace       time.Duration
+}
+
+// healthChecker checks the interval reports, the stream is breached if it's unhealthy longer than Grace
+type healthChecker struct {
+	config         healthConfig
+	unhealthySince time.Time // zero if healthy
+}
+
+// check sets the unhealthy reasons of report, it returns the unhealthy duration if it's longer than grace
+func (h *healthChecker) check(report *intervalReport) (time.Duration, bool) {
+	c := h.config
+	var reasons []string
+	primary := report.Video
+	if primary == nil {
+		primary = report.Audio
+	}
+	if c.MinFPS > 0 && (primary == nil || primary.Rate < c.MinFPS) {
+		rate := 0.0
+		if primary != nil {
+			rate = primary.Rate
+		}
+		reasons = append(reasons, fmt.Sprintf("rate %.2f < %.2f", rate, c.MinFPS))
+	}
+	for _, t := range []*intervalTrackReport{report.Video, report.Audio} {
+		if t == nil {
+			continue
+		}
+		if c.MaxGap > 0 && t.MaxGap > int64(c.MaxGap) {
+			reasons = append(reasons, fmt.Sprintf("gap %d > %d", t.MaxGap, c.MaxGap))
+		}
+		if c.MaxHole > 0 && t.MaxHoleMs > c.MaxHole.Milliseconds() {
+			reasons = append(reasons, fmt.Sprintf("hole %dms > %dms", t.MaxHoleMs, c.MaxHole.Milliseconds()))
+		}
+	}
+	if c.MaxAVOffset > 0 && report.AVOffset != nil && (*report.AVOffset > int64(c.MaxAVOffset) || *report.AVOffset < -int64(c.MaxAVOffset)) {
+		reasons = append(reasons, fmt.Sprintf("av offset %dms > %dms", *report.AVOffset, c.MaxAVOffset))
+	}
+	report.Unhealthy = reasons
+	if len(reasons) == 0 {
+		h.unhealthySince = time.Time{}
+		return 0, false
+	}
+	if h.unhealthySince.IsZero() {
+		h.unhealthySince = report.Time.Add(-time.Duration(report.DurationMs) * time.Millisecond)
+	}
+	d := report.Time.Sub(h.unhealthySince)
+	return d, d > c.Grace
+}
+
+// runDaemon reports p every interval until stop is closed, onBreach is called if the health is breached
+func runDaemon(p *FlvParser, every time.Duration, out io.Writer, jsonLines bool, health *healthChecker, stop <-chan struct{}, onBreach func(error)) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			report := p.Interval(now)
+			d, breached := health.check(report)
+			if jsonLines {
+				_ = encoder.Encode(report)
+			} else {
+				report.Print(out)
+			}
+			if breached {
+				onBreach(fmt.Errorf("unhealthy for %v: %s", d.Round(time.Second), strings.Join(report.Unhealthy, ", ")))
+				return
+			}
+		}
+	}
+}
+
+// serveMetrics serves exporter on addr in background, the listening address is returned
+func serveMetrics(addr string, exporter *metrics.Exporter) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen metrics address err: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logrus.WithField("error", err).Error("serve metrics failed")
+		}
+	}()
+	return l.Addr(), nil
+}
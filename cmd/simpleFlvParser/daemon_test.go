@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/metrics"
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+func TestDaemon(t *testing.T) {
+	p, err := NewFlvParser(DefaultFormat, probe.Options{EventSink: summary.DiscardSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, p.Run(context.Background(), bytes.NewReader(data)))
+	now := time.Now().Add(time.Second)
+	report := p.Interval(now)
+	assert.True(t, report.Video.Frames > 0)
+	assert.Equal(t, report.Video.Frames, report.Video.Total)
+	assert.True(t, report.Video.Bitrate > 0)
+	assert.NotNil(t, report.AVOffset)
+
+	health := &healthChecker{config: healthConfig{MinFPS: 10, Grace: 5 * time.Second}}
+	_, breached := health.check(report)
+	assert.False(t, breached)
+	assert.Empty(t, report.Unhealthy)
+
+	// no frames after, the interval-scoped stats are reset
+	for i := 1; i <= 3; i++ {
+		report = p.Interval(now.Add(time.Duration(i) * 3 * time.Second))
+		assert.Equal(t, 0, report.Video.Frames)
+		assert.True(t, report.Video.Total > 0)
+		d, breached := health.check(report)
+		assert.Equal(t, []string{"rate 0.00 < 10.00"}, report.Unhealthy)
+		assert.Equal(t, time.Duration(i)*3*time.Second, d)
+		assert.Equal(t, i == 2 || i == 3, breached)
+	}
+
+	var buf bytes.Buffer
+	report.Print(&buf)
+	assert.Contains(t, buf.String(), "unhealthy: rate 0.00 < 10.00")
+	out, err := json.Marshal(report)
+	assert.Nil(t, err)
+	var decoded intervalReport
+	assert.Nil(t, json.Unmarshal(out, &decoded))
+	assert.Equal(t, report.Unhealthy, decoded.Unhealthy)
+}
+
+func TestServeMetrics(t *testing.T) {
+	p, err := NewFlvParser(DefaultFormat, probe.Options{EventSink: summary.DiscardSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.videoCounter.Count(0)
+	exporter := metrics.NewExporter()
+	exporter.Add(&metrics.Stream{URL: "test.flv", Video: p.videoCounter, Latency: p.latency})
+	addr, err := serveMetrics("127.0.0.1:0", exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `avspy_frames_total{url="test.flv",track="video"} 1`)
+	assert.NotContains(t, string(body), "avspy_latency_milliseconds", "the latency is unknown if not simulate")
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+	"github.com/foolishCDN/AV-spy/formatter"
+)
+
+const (
+	diffFieldPayload  = "payload"  // sha1 of tag data
+	diffFieldMetaData = "metadata" // prefix of the values of script tag, e.g. metadata.onMetaData.width
+)
+
+// diffHeaderFields are the fields of flv header, named as the header record of json output
+var diffHeaderFields = []string{"version", "has_video", "has_audio", "data_offset"}
+
+var (
+	ignoreOffset bool
+	ignoreFields []string
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [flags] <a.flv> <b.flv>",
+	Short: "Compare two FLV files tag by tag, exit with 0 if they are the same, 1 if different and 2 if trouble",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			_ = cmd.Usage()
+			return &exitError{code: 2, err: errors.New("please specify two file paths")}
+		}
+		if err := checkIgnoreFields(ignoreFields); err != nil {
+			return &exitError{code: 2, err: err}
+		}
+		a, err := readDiffFile(args[0])
+		if err != nil {
+			return &exitError{code: 2, err: err}
+		}
+		b, err := readDiffFile(args[1])
+		if err != nil {
+			return &exitError{code: 2, err: err}
+		}
+		diffs := diffFiles(a, b, diffOptions{IgnoreOffset: ignoreOffset, IgnoreFields: ignoreFields})
+		printDiffLines(os.Stdout, diffs)
+		if len(diffs) > 0 {
+			return &exitError{code: 1}
+		}
+		return nil
+	},
+}
+
+func initDiffFlags() {
+	diffCmd.Flags().BoolVar(
+		&ignoreOffset,
+		"ignore_offset",
+		false,
+		"shift the audio/video timestamps of the second file to make the first audio/video tags of the two files have the same timestamp, script tags are not shifted",
+	)
+	diffCmd.Flags().StringSliceVar(
+		&ignoreFields,
+		"ignore_fields",
+		nil,
+		"fields not compared: template elements(e.g. pts,stream_id), header fields(version,has_video,has_audio,data_offset), payload, metadata or metadata.<name>.<key>",
+	)
+}
+
+func checkIgnoreFields(fields []string) error {
+	for _, field := range fields {
+		if _, ok := formatter.LookupElement(formatter.ElementName(field)); ok {
+			continue
+		}
+		if field == diffFieldPayload || field == diffFieldMetaData || strings.HasPrefix(field, diffFieldMetaData+".") {
+			continue
+		}
+		known := false
+		for _, name := range diffHeaderFields {
+			known = known || name == field
+		}
+		if !known {
+			return fmt.Errorf("unknown field %q to ignore", field)
+		}
+	}
+	return nil
+}
+
+type diffTag struct {
+	Type      string // audio, video or script
+	Timestamp int64  // dts of video, pts of others
+	Fields    map[string]string
+}
+
+type diffFile struct {
+	Name   string
+	Header map[string]string
+	Tags   []diffTag
+}
+
+func readDiffFile(path string) (*diffFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	file := &diffFile{Name: path}
+	demuxer := new(flv.Demuxer)
+	header, err := demuxer.ReadHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	file.Header = map[string]string{
+		"version":     fmt.Sprint(header.Version),
+		"has_video":   fmt.Sprint(header.HasVideo),
+		"has_audio":   fmt.Sprint(header.HasAudio),
+		"data_offset": fmt.Sprint(header.DataOffset),
+	}
+	for {
+		tag, err := demuxer.ReadTag(f)
+		if err == io.EOF {
+			return file, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		file.Tags = append(file.Tags, newDiffTag(tag))
+	}
+}
+
+func newDiffTag(tag flv.TagI) diffTag {
+	var vars map[formatter.ElementName]interface{}
+	t := diffTag{Fields: make(map[string]string)}
+	switch tag := tag.(type) {
+	case *flv.AudioTag:
+		t.Type = "audio"
+		t.Timestamp = int64(tag.PTS)
+		vars = tag.ToVars()
+	case *flv.VideoTag:
+		t.Type = "video"
+		t.Timestamp = int64(tag.DTS)
+		vars = tag.ToVars()
+	case *flv.ScriptTag:
+		t.Type = "script"
+		t.Timestamp = int64(tag.PTS)
+		vars = tag.ToVars()
+		got, _ := amf.NewDecoder(amf.Version0).DecodeBatch(bytes.NewReader(tag.Bytes))
+		addMetaDataFields(t.Fields, got)
+	}
+	for name, value := range vars {
+		t.Fields[string(name)] = fmt.Sprint(value)
+	}
+	t.Fields[diffFieldPayload] = fmt.Sprintf("%x", sha1.Sum(tag.Data()))
+	return t
+}
+
+// addMetaDataFields flattens the AMF values of script tag, the objects following a string are named by the string,
+// e.g. ["onMetaData", {"width": 1280}] is metadata.onMetaData.width=1280
+func addMetaDataFields(fields map[string]string, values []interface{}) {
+	name := ""
+	for i, value := range values {
+		var object map[string]interface{}
+		switch v := value.(type) {
+		case string:
+			if i == 0 {
+				name = v
+				continue
+			}
+		case amf.ECMAArray:
+			object = v
+		case map[string]interface{}:
+			object = v
+		}
+		prefix := fmt.Sprintf("%s.%d", diffFieldMetaData, i)
+		if name != "" {
+			prefix = diffFieldMetaData + "." + name
+		}
+		if object == nil {
+			fields[prefix] = fmt.Sprint(value)
+			continue
+		}
+		for key, v := range object {
+			fields[prefix+"."+key] = fmt.Sprint(v)
+		}
+	}
+}
+
+type diffOptions struct {
+	IgnoreOffset bool
+	IgnoreFields []string
+}
+
+func (options diffOptions) ignored(field string) bool {
+	for _, f := range options.IgnoreFields {
+		if field == f || strings.HasPrefix(field, f+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffLine is a difference, Sign is '-' for the tag only in a, '+' for the tag only in b and ' ' for the different fields
+type diffLine struct {
+	Sign      byte
+	Timestamp int64 // on the timeline of a
+	Text      string
+}
+
+type diffKey struct {
+	Type      string
+	Timestamp int64
+	N         int // the nth tag of the same type and timestamp
+}
+
+// diffFiles matches the tags of a and b by type and timestamp, and returns the differences in order of timestamp.
+func diffFiles(a, b *diffFile, options diffOptions) []diffLine {
+	var lines []diffLine
+	for _, name := range diffHeaderFields {
+		if !options.ignored(name) && a.Header[name] != b.Header[name] {
+			lines = append(lines, diffLine{Sign: ' ', Text: fmt.Sprintf("header: %s %s != %s", name, a.Header[name], b.Header[name])})
+		}
+	}
+
+	var offset int64
+	if options.IgnoreOffset {
+		offset = firstMediaTimestamp(b.Tags) - firstMediaTimestamp(a.Tags)
+	}
+	keys := func(tags []diffTag, offset int64) []diffKey {
+		count := make(map[diffKey]int)
+		res := make([]diffKey, len(tags))
+		for i, tag := range tags {
+			key := diffKey{Type: tag.Type, Timestamp: tag.Timestamp - mediaOffset(tag.Type, offset)}
+			key.N = count[key]
+			count[key]++
+			res[i] = key
+		}
+		return res
+	}
+	keysA, keysB := keys(a.Tags, 0), keys(b.Tags, offset)
+	indexB := make(map[diffKey]int, len(keysB))
+	for j, key := range keysB {
+		indexB[key] = j
+	}
+	matched := make([]bool, len(b.Tags))
+	for i, key := range keysA {
+		j, ok := indexB[key]
+		if !ok {
+			lines = append(lines, diffLine{Sign: '-', Timestamp: key.Timestamp, Text: fmt.Sprintf("%s %d only in %s", key.Type, key.Timestamp, a.Name)})
+			continue
+		}
+		matched[j] = true
+		lines = append(lines, diffTagFields(key, a.Tags[i], b.Tags[j], mediaOffset(key.Type, offset), options)...)
+	}
+	for j, key := range keysB {
+		if !matched[j] {
+			lines = append(lines, diffLine{Sign: '+', Timestamp: key.Timestamp, Text: fmt.Sprintf("%s %d only in %s", key.Type, b.Tags[j].Timestamp, b.Name)})
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Timestamp < lines[j].Timestamp
+	})
+	return lines
+}
+
+func diffTagFields(key diffKey, a, b diffTag, offset int64, options diffOptions) []diffLine {
+	names := make(map[string]struct{})
+	for name := range a.Fields {
+		names[name] = struct{}{}
+	}
+	for name := range b.Fields {
+		names[name] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !options.ignored(name) {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	var lines []diffLine
+	for _, name := range sorted {
+		va, okA := a.Fields[name]
+		vb, okB := b.Fields[name]
+		if offset != 0 && (name == string(formatter.ElementPTS) || name == string(formatter.ElementDTS)) {
+			vb = shiftTimestamp(vb, offset)
+		}
+		if !okA {
+			va = "missing"
+		}
+		if !okB {
+			vb = "missing"
+		}
+		if va != vb {
+			lines = append(lines, diffLine{Sign: ' ', Timestamp: key.Timestamp, Text: fmt.Sprintf("%s %d #%d: %s %s != %s", key.Type, key.Timestamp, key.N, name, va, vb)})
+		}
+	}
+	return lines
+}
+
+func shiftTimestamp(s string, offset int64) string {
+	var timestamp int64
+	if _, err := fmt.Sscan(s, &timestamp); err != nil {
+		return s
+	}
+	return fmt.Sprint(timestamp - offset)
+}
+
+// mediaOffset returns the offset to shift the tag of tagType, only the audio and video tags are shifted,
+// the script tags keep their timestamps, e.g. onMetaData is at 0 in both files.
+func mediaOffset(tagType string, offset int64) int64 {
+	if tagType == "script" {
+		return 0
+	}
+	return offset
+}
+
+func firstMediaTimestamp(tags []diffTag) int64 {
+	for _, tag := range tags {
+		if tag.Type != "script" {
+			return tag.Timestamp
+		}
+	}
+	return 0
+}
+
+func printDiffLines(w io.Writer, lines []diffLine) {
+	for _, line := range lines {
+		fmt.Fprintf(w, "%c %s\n", line.Sign, line.Text)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	a, err := readDiffFile("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, diffFiles(a, a, diffOptions{}))
+
+	// the audio and video of b are shifted by 100ms, the script tags are not,
+	// the 10th tag is dropped and the nalu types of a video tag are changed
+	video := 20
+	for a.Tags[video].Type != "video" {
+		video++
+	}
+	b := &diffFile{Name: "b.flv", Header: map[string]string{}}
+	for name, value := range a.Header {
+		b.Header[name] = value
+	}
+	b.Header["has_audio"] = "false"
+	for i, tag := range a.Tags {
+		if i == 10 {
+			continue
+		}
+		shift := int64(100)
+		if tag.Type == "script" {
+			shift = 0
+		}
+		shifted := diffTag{Type: tag.Type, Timestamp: tag.Timestamp + shift, Fields: map[string]string{}}
+		for name, value := range tag.Fields {
+			shifted.Fields[name] = value
+		}
+		shifted.Fields["pts"] = shiftTimestamp(tag.Fields["pts"], -shift)
+		shifted.Fields["dts"] = shiftTimestamp(tag.Fields["dts"], -shift)
+		if i == video {
+			shifted.Fields["nalu_types"] = "AVCC [5]"
+		}
+		b.Tags = append(b.Tags, shifted)
+	}
+	assert.True(t, len(diffFiles(a, b, diffOptions{})) > 100)
+
+	lines := diffFiles(a, b, diffOptions{IgnoreOffset: true, IgnoreFields: []string{"has_audio"}})
+	assert.Equal(t, 2, len(lines), lines)
+	dropped, changed := a.Tags[10], a.Tags[video]
+	var buf bytes.Buffer
+	printDiffLines(&buf, lines)
+	assert.Contains(t, buf.String(), fmt.Sprintf("- %s %d only in ../../container/flv/test.flv", dropped.Type, dropped.Timestamp))
+	assert.Contains(t, buf.String(), fmt.Sprintf("  %s %d #0: nalu_types %s != AVCC [5]", changed.Type, changed.Timestamp, changed.Fields["nalu_types"]))
+
+	assert.Nil(t, checkIgnoreFields([]string{"pts", "payload", "data_offset", "metadata.onMetaData.encoder"}))
+	assert.NotNil(t, checkIgnoreFields([]string{"no_such_field"}))
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/foolishCDN/AV-spy/codec"
+	"github.com/foolishCDN/AV-spy/codec/avc"
+	"github.com/foolishCDN/AV-spy/codec/hevc"
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/utils"
+)
+
+const formatFFprobe = "ffprobe"
+
+// ffprobePacket has the same fields as the packet of `ffprobe -show_packets -of json`.
+type ffprobePacket struct {
+	CodecType    string `json:"codec_type"`
+	StreamIndex  int    `json:"stream_index"`
+	PTS          int64  `json:"pts"`
+	PTSTime      string `json:"pts_time"`
+	DTS          int64  `json:"dts"`
+	DTSTime      string `json:"dts_time"`
+	Duration     int64  `json:"duration"`
+	DurationTime string `json:"duration_time"`
+	Size         string `json:"size"`
+	Pos          string `json:"pos"`
+	Flags        string `json:"flags"`
+}
+
+// ffprobeStream has the same fields as the stream of `ffprobe -show_streams -of json`.
+type ffprobeStream struct {
+	Index          int    `json:"index"`
+	CodecName      string `json:"codec_name"`
+	CodecLongName  string `json:"codec_long_name,omitempty"`
+	Profile        string `json:"profile,omitempty"`
+	CodecType      string `json:"codec_type"`
+	CodecTagString string `json:"codec_tag_string"`
+	CodecTag       string `json:"codec_tag"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	SampleRate     string `json:"sample_rate,omitempty"`
+	Channels       int    `json:"channels,omitempty"`
+	ChannelLayout  string `json:"channel_layout,omitempty"`
+	RFrameRate     string `json:"r_frame_rate"`
+	AvgFrameRate   string `json:"avg_frame_rate"`
+	TimeBase       string `json:"time_base"`
+	StartPTS       int64  `json:"start_pts"`
+	StartTime      string `json:"start_time"`
+
+	fps      float64 // from SPS
+	frames   int
+	firstDTS int64
+	lastDTS  int64
+	pending  *ffprobePacket // the last packet, its duration is known by the next packet
+	duration int64          // the duration of the packet before pending
+}
+
+// maxQueuedFFprobePackets is the most packets waiting for their durations,
+// the packet is written with the duration of the previous one if the next packet of its stream doesn't come in time.
+const maxQueuedFFprobePackets = 1024
+
+// ffprobeOutput writes the packets and streams like `ffprobe -show_packets -show_streams -of json`.
+// The time base of FLV is 1/1000, sequence headers are not packets but the extradata of streams.
+//
+// The packets are written as soon as their durations are known, so the memory is bounded on live streams,
+// the streams are written by Write at the end.
+type ffprobeOutput struct {
+	w      io.Writer
+	offset func() int64 // offset of the current tag
+
+	streams []*ffprobeStream
+	video   *ffprobeStream
+	audio   *ffprobeStream
+	queue   []*ffprobePacket // the packets to show in order
+	written int              // the number of packets written
+	err     error            // the first error of writing
+}
+
+func newFFprobeOutput(w io.Writer) *ffprobeOutput {
+	return &ffprobeOutput{
+		w: w,
+		offset: func() int64 {
+			return -1
+		},
+	}
+}
+
+func (o *ffprobeOutput) newStream(codecType, codecName string) *ffprobeStream {
+	s := &ffprobeStream{
+		Index:          len(o.streams),
+		CodecName:      codecName,
+		CodecLongName:  codecLongNames[codecName],
+		CodecType:      codecType,
+		CodecTagString: "[0][0][0][0]",
+		CodecTag:       "0x0000",
+		TimeBase:       "1/1000",
+	}
+	o.streams = append(o.streams, s)
+	return s
+}
+
+// OnPacket adds the tag, show is false if the packet is filtered out.
+func (o *ffprobeOutput) OnPacket(tag flv.TagI, show bool) {
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		if o.video == nil {
+			o.video = o.newStream("video", videoCodecName(t.CodecID))
+		}
+		if flv.IsSequenceHeader(t) {
+			if err := o.video.readVideoSequenceHeader(t); err != nil {
+				logrus.WithField("error", err).Error("parse sequence header of video failed")
+			}
+			return
+		}
+		flags := "__"
+		if t.FrameType == flv.KeyFrame {
+			flags = "K_"
+		}
+		o.addPacket(o.video, int64(t.PTS), int64(t.DTS), len(t.Bytes), flags, show)
+	case *flv.AudioTag:
+		if o.audio == nil {
+			o.audio = o.newStream("audio", audioCodecName(t))
+			o.audio.SampleRate = fmt.Sprint(audioSampleRate(t))
+			o.audio.setChannels(int(t.Channels) + 1)
+			o.audio.RFrameRate = "0/0"
+			o.audio.AvgFrameRate = "0/0"
+		}
+		if flv.IsSequenceHeader(t) {
+			aac := new(codec.AACAudioSpecificConfig)
+			if err := aac.Read(t.Bytes); err != nil {
+				logrus.WithField("error", err).Error("parse sequence header of audio AACAudioSpecificConfig failed")
+				return
+			}
+			o.audio.Profile = aacProfiles[aac.ObjectType]
+			if frequency := aac.Frequency(); frequency > 0 {
+				o.audio.SampleRate = fmt.Sprint(frequency)
+			}
+			if aac.Channel > 0 {
+				o.audio.setChannels(int(aac.Channel))
+			}
+			return
+		}
+		o.addPacket(o.audio, int64(t.PTS), int64(t.PTS), len(t.Bytes), "K_", show)
+	}
+}
+
+func (o *ffprobeOutput) addPacket(s *ffprobeStream, pts, dts int64, size int, flags string, show bool) {
+	if s.frames == 0 {
+		s.firstDTS = dts
+		s.StartPTS = pts
+		s.StartTime = timeString(pts)
+	}
+	s.frames++
+	s.lastDTS = dts
+	// the duration of packet is the dts diff to the next packet of the same stream, the hidden packets included
+	if s.pending != nil {
+		s.pending.Duration = dts - s.pending.DTS
+		s.duration = s.pending.Duration
+	}
+	s.pending = &ffprobePacket{
+		CodecType:   s.CodecType,
+		StreamIndex: s.Index,
+		PTS:         pts,
+		PTSTime:     timeString(pts),
+		DTS:         dts,
+		DTSTime:     timeString(dts),
+		Size:        fmt.Sprint(size),
+		Pos:         fmt.Sprint(o.offset()),
+		Flags:       flags,
+	}
+	if show && showPacket {
+		o.queue = append(o.queue, s.pending)
+	}
+	o.flush(false)
+}
+
+// flush writes the queued packets whose durations are known, all of them at the end.
+// The last packet of stream uses the duration of the previous one.
+func (o *ffprobeOutput) flush(end bool) {
+	for len(o.queue) > 0 {
+		packet := o.queue[0]
+		if s := o.streams[packet.StreamIndex]; s.pending == packet {
+			if !end && len(o.queue) <= maxQueuedFFprobePackets {
+				return
+			}
+			packet.Duration = s.duration
+		}
+		packet.DurationTime = timeString(packet.Duration)
+		o.writePacket(packet)
+		o.queue[0] = nil
+		o.queue = o.queue[1:]
+	}
+}
+
+// writePacket writes packet as an element of "packets", the document is opened by the first packet.
+func (o *ffprobeOutput) writePacket(packet *ffprobePacket) {
+	data, err := json.MarshalIndent(packet, "        ", "    ")
+	if err != nil {
+		o.setErr(err)
+		return
+	}
+	if o.written == 0 {
+		o.write("{\n    \"packets\": [\n        ")
+	} else {
+		o.write(",\n        ")
+	}
+	o.write(string(data))
+	o.written++
+}
+
+func (o *ffprobeOutput) write(s string) {
+	if o.err != nil {
+		return
+	}
+	_, err := io.WriteString(o.w, s)
+	o.setErr(err)
+}
+
+func (o *ffprobeOutput) setErr(err error) {
+	if o.err == nil {
+		o.err = err
+	}
+}
+
+func (s *ffprobeStream) readVideoSequenceHeader(t *flv.VideoTag) error {
+	var sps codec.SPS
+	switch t.CodecID {
+	case flv.H264:
+		record := new(avc.AVCDecoderConfigurationRecord)
+		if err := record.Read(t.Bytes); err != nil {
+			return err
+		}
+		s.Profile = avcProfiles[record.AVCProfileIndication]
+		if len(record.SPS) == 0 {
+			return nil
+		}
+		reader := utils.NewBitReader(record.SPS[0])
+		avc.ParseNALUHeader(reader)
+		avcSPS, err := avc.ParseSPS(reader)
+		if err != nil {
+			return err
+		}
+		sps = avcSPS
+	case flv.H265:
+		record := new(hevc.HEVCDecoderConfigurationRecord)
+		if err := record.Read(t.Bytes); err != nil {
+			return err
+		}
+		s.Profile = hevcProfiles[record.GeneralProfileIDC]
+		for _, ps := range record.NALUs {
+			if ps.NALUnitType != hevc.NalSPS || len(ps.NALUs) == 0 {
+				continue
+			}
+			reader := utils.NewBitReader(ps.NALUs[0])
+			hevc.ParseNALUHeader(reader)
+			hevcSPS, err := hevc.ParseSPS(reader)
+			if err != nil {
+				return err
+			}
+			sps = hevcSPS
+		}
+	}
+	if sps != nil {
+		s.Width, s.Height, s.fps = sps.Width(), sps.Height(), sps.FPS()
+	}
+	return nil
+}
+
+func (s *ffprobeStream) setChannels(channels int) {
+	s.Channels = channels
+	s.ChannelLayout = channelLayouts[channels]
+}
+
+// Write writes the packets left and the streams, and closes the document.
+func (o *ffprobeOutput) Write() error {
+	o.flush(true)
+
+	for _, s := range o.streams {
+		if s.CodecType != "video" {
+			continue
+		}
+		avg := 0.0
+		if s.frames > 1 && s.lastDTS > s.firstDTS {
+			avg = float64(s.frames-1) / float64(s.lastDTS-s.firstDTS) * 1000
+		}
+		s.AvgFrameRate = rational(avg)
+		s.RFrameRate = s.AvgFrameRate
+		if s.fps > 0 {
+			s.RFrameRate = rational(s.fps)
+		}
+	}
+
+	// the same layout as json.Encoder with 4 spaces indent, the empty fields are omitted
+	if showStreams && len(o.streams) > 0 {
+		data, err := json.MarshalIndent(o.streams, "    ", "    ")
+		if err != nil {
+			return err
+		}
+		if o.written == 0 {
+			o.write("{\n")
+		} else {
+			o.write("\n    ],\n")
+		}
+		o.write("    \"streams\": " + string(data) + "\n}\n")
+	} else if o.written > 0 {
+		o.write("\n    ]\n}\n")
+	} else {
+		o.write("{}\n")
+	}
+	return o.err
+}
+
+func timeString(ms int64) string {
+	return fmt.Sprintf("%.6f", float64(ms)/1000)
+}
+
+// rational converts the frame rate to the fraction used by ffprobe, e.g. 25/1, 30000/1001
+func rational(rate float64) string {
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return "0/0"
+	}
+	// the exact fraction first, e.g. 30000/1001 from SPS shouldn't be approximated by 989/33
+	for _, tolerance := range []float64{1e-9, 1e-3} {
+		for den := 1; den <= 1001; den++ {
+			num := math.Round(rate * float64(den))
+			if math.Abs(num/float64(den)-rate) < tolerance {
+				return fmt.Sprintf("%d/%d", int64(num), den)
+			}
+		}
+	}
+	return fmt.Sprintf("%d/1000", int64(math.Round(rate*1000)))
+}
+
+var codecLongNames = map[string]string{
+	"h264":       "H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10",
+	"hevc":       "H.265 / HEVC (High Efficiency Video Coding)",
+	"flv1":       "FLV / Sorenson Spark / Sorenson H.263 (Flash Video)",
+	"vp6f":       "On2 VP6 (Flash version)",
+	"vp6a":       "On2 VP6 (Flash version, with alpha channel)",
+	"flashsv":    "Flash Screen Video v1",
+	"flashsv2":   "Flash Screen Video v2",
+	"aac":        "AAC (Advanced Audio Coding)",
+	"mp3":        "MP3 (MPEG audio layer 3)",
+	"pcm_s16le":  "PCM signed 16-bit little-endian",
+	"pcm_u8":     "PCM unsigned 8-bit",
+	"pcm_alaw":   "PCM A-law / G.711 A-law",
+	"pcm_mulaw":  "PCM mu-law / G.711 mu-law",
+	"adpcm_swf":  "ADPCM Shockwave Flash",
+	"nellymoser": "Nellymoser Asao",
+	"speex":      "Speex",
+}
+
+var avcProfiles = map[byte]string{
+	44:  "CAVLC 4:4:4",
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4 Predictive",
+}
+
+var hevcProfiles = map[byte]string{
+	1: "Main",
+	2: "Main 10",
+	3: "Main Still Picture",
+	4: "Rext",
+}
+
+var aacProfiles = map[byte]string{
+	1:  "Main",
+	2:  "LC",
+	3:  "SSR",
+	4:  "LTP",
+	5:  "HE-AAC",
+	23: "LD",
+	29: "HE-AACv2",
+	39: "ELD",
+}
+
+var channelLayouts = map[int]string{
+	1: "mono",
+	2: "stereo",
+	3: "3.0",
+	4: "4.0",
+	5: "5.0",
+	6: "5.1",
+	8: "7.1",
+}
+
+func videoCodecName(id flv.CodecID) string {
+	switch id {
+	case flv.H263:
+		return "flv1"
+	case flv.ScreenVideo:
+		return "flashsv"
+	case flv.On2VP6:
+		return "vp6f"
+	case flv.On2VP6WithAlpha:
+		return "vp6a"
+	case flv.ScreenVideoV2:
+		return "flashsv2"
+	case flv.H264:
+		return "h264"
+	case flv.H265:
+		return "hevc"
+	default:
+		return "unknown"
+	}
+}
+
+func audioCodecName(t *flv.AudioTag) string {
+	switch t.SoundFormat {
+	case flv.LinearPCM, flv.PCM:
+		if t.BitPerSample == 0 {
+			return "pcm_u8"
+		}
+		return "pcm_s16le"
+	case flv.ADPCM:
+		return "adpcm_swf"
+	case flv.MP3, flv.MP38KHz:
+		return "mp3"
+	case flv.Nellymoser16KHzMono, flv.Nellymoser8KHzMono, flv.Nellymoser:
+		return "nellymoser"
+	case flv.G711A:
+		return "pcm_alaw"
+	case flv.G711U:
+		return "pcm_mulaw"
+	case flv.AAC:
+		return "aac"
+	case flv.Speex:
+		return "speex"
+	default:
+		return "unknown"
+	}
+}
+
+func audioSampleRate(t *flv.AudioTag) int {
+	switch t.SoundFormat {
+	case flv.Nellymoser16KHzMono, flv.Speex:
+		return 16000
+	case flv.Nellymoser8KHzMono, flv.MP38KHz, flv.G711A, flv.G711U:
+		return 8000
+	}
+	return []int{5512, 11025, 22050, 44100}[t.SampleRate&0x03]
+}
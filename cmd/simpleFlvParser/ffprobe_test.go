@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+func TestFFprobeOutput(t *testing.T) {
+	defer func(packet, streams bool) {
+		showPacket, showStreams = packet, streams
+	}(showPacket, showStreams)
+	showPacket, showStreams = true, true
+
+	f, err := os.Open("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	demuxer := new(flv.Demuxer)
+	if _, err := demuxer.ReadHeader(f); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	o := newFFprobeOutput(&buf)
+	o.offset = demuxer.TagOffset
+	videos := 0
+	for {
+		tag, err := demuxer.ReadTag(f)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first 400ms are shown except every third video frame,
+		// the hidden packets still count for the duration of the packets before them
+		show := tag.Timestamp() < 400
+		if tag.Type() == flv.TagVideo {
+			videos++
+			show = show && videos%3 != 0
+		}
+		o.OnPacket(tag, show)
+	}
+	assert.NoError(t, o.Write())
+
+	golden, err := os.ReadFile("testdata/ffprobe.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(golden), buf.String())
+}
+
+func TestFFprobeOutputBounded(t *testing.T) {
+	defer func(packet, streams bool) {
+		showPacket, showStreams = packet, streams
+	}(showPacket, showStreams)
+	showPacket, showStreams = true, false
+
+	var buf bytes.Buffer
+	o := newFFprobeOutput(&buf)
+	// the video stops after the first frame, its packet waits for the next one until the queue is full
+	o.OnPacket(&flv.VideoTag{FrameType: flv.KeyFrame, CodecID: flv.H263}, true)
+	for i := 0; i < 3*maxQueuedFFprobePackets; i++ {
+		o.OnPacket(&flv.AudioTag{SoundFormat: flv.MP3, PTS: uint32(i * 20)}, true)
+		assert.True(t, len(o.queue) <= maxQueuedFFprobePackets)
+	}
+	assert.NoError(t, o.Write())
+	assert.Empty(t, o.queue)
+	assert.Equal(t, 1+3*maxQueuedFFprobePackets, o.written)
+}
+
+func TestRational(t *testing.T) {
+	for _, c := range []struct {
+		rate float64
+		want string
+	}{
+		{25, "25/1"},
+		{29.97, "2997/100"},
+		{30000.0 / 1001, "30000/1001"},
+		{24000.0 / 1001, "24000/1001"},
+		{12.5, "25/2"},
+		{0, "0/0"},
+		{-1, "0/0"},
+		{math.NaN(), "0/0"},
+		{math.Inf(1), "0/0"},
+	} {
+		assert.Equal(t, c.want, rational(c.rate), "rate %v", c.rate)
+	}
+}
+
+func TestTimeString(t *testing.T) {
+	assert.Equal(t, "0.000000", timeString(0))
+	assert.Equal(t, "1.040000", timeString(1040))
+	assert.Equal(t, "-0.020000", timeString(-20))
+}
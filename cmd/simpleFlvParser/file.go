@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var errSameFile = errors.New("the output file should be different from the input file(s)")
+
+// checkOutput returns errSameFile if output is one of inputs, paths like "./a.flv" and "a.flv",
+// links and hard links to the same file are the same, an output that doesn't exist yet is fine.
+func checkOutput(output string, inputs ...string) error {
+	outInfo, err := os.Stat(output)
+	if err != nil {
+		return nil
+	}
+	for _, input := range inputs {
+		// an input that can't be read is reported when it's opened
+		if info, err := os.Stat(input); err == nil && os.SameFile(info, outInfo) {
+			return errSameFile
+		}
+	}
+	return nil
+}
+
+// outputFile is written to a temp file in the same directory of path,
+// which is renamed to path by Commit, so path is never left half written.
+type outputFile struct {
+	*os.File
+	path string
+}
+
+func createOutputFile(path string) (*outputFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create file err: %v", err)
+	}
+	// os.CreateTemp creates the file with 0600, use the mode of os.Create instead
+	if err := f.Chmod(0644); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, fmt.Errorf("create file err: %v", err)
+	}
+	return &outputFile{File: f, path: path}, nil
+}
+
+// Commit closes the temp file and renames it to path
+func (f *outputFile) Commit() error {
+	if err := f.File.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort closes and removes the temp file, path is left as it was
+func (f *outputFile) Abort() {
+	_ = f.File.Close()
+	_ = os.Remove(f.Name())
+}
+
+// closeOutput commits f if err is nil or aborts it, it returns the first error.
+func closeOutput(f *outputFile, err error) error {
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOutput(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.flv")
+	if err := os.WriteFile(input, []byte("FLV"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.flv")
+	if err := os.Symlink(input, link); err != nil {
+		t.Fatal(err)
+	}
+	hardLink := filepath.Join(dir, "hard.flv")
+	if err := os.Link(input, hardLink); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, checkOutput(filepath.Join(dir, "out.flv"), input))
+	assert.Equal(t, errSameFile, checkOutput(input, input))
+	assert.Equal(t, errSameFile, checkOutput(dir+"/./in.flv", input))
+	assert.Equal(t, errSameFile, checkOutput(link, input))
+	assert.Equal(t, errSameFile, checkOutput(hardLink, filepath.Join(dir, "out.flv"), input))
+}
+
+func TestOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.flv")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the output is left as it was on error
+	f, err := createOutputFile(path)
+	assert.Nil(t, err)
+	_, _ = f.WriteString("broken")
+	assert.Equal(t, os.ErrClosed, closeOutput(f, os.ErrClosed))
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "old", string(data))
+
+	f, err = createOutputFile(path)
+	assert.Nil(t, err)
+	_, _ = f.WriteString("new")
+	assert.Nil(t, closeOutput(f, nil))
+	data, _ = os.ReadFile(path)
+	assert.Equal(t, "new", string(data))
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// no temp file is left
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/foolishCDN/AV-spy/codec"
 	"github.com/foolishCDN/AV-spy/codec/avc"
 	"github.com/foolishCDN/AV-spy/codec/hevc"
 	"github.com/foolishCDN/AV-spy/container/flv"
-	"github.com/foolishCDN/AV-spy/encoding/amf"
 	"github.com/foolishCDN/AV-spy/formatter"
+	"github.com/foolishCDN/AV-spy/probe"
+	recorder "github.com/foolishCDN/AV-spy/record"
 	"github.com/foolishCDN/AV-spy/summary"
-	"github.com/foolishCDN/AV-spy/utils"
+	"github.com/foolishCDN/AV-spy/validate"
 	"github.com/sikasjc/pretty"
 	"github.com/sirupsen/logrus"
 )
@@ -32,13 +38,37 @@ type FlvParser struct {
 	audioFormatter  formatter.Formatter
 	scriptFormatter formatter.Formatter
 
-	videoCounter *summary.Counter
+	prober       *probe.Prober
+	videoCounter *summary.Counter // the counters of prober
 	audioCounter *summary.Counter
-	sps          codec.SPS
-	codec        string
+
+	player        *summary.Player
+	arrivalWriter *summary.ArrivalWriter
+	startup       *summary.Startup    // the startup of prober
+	reconnects    *summary.Reconnects // nil if not reconnect
+	conn          *reconnector        // nil if not reconnect
+	recorder      *recorder.Recorder  // nil if not record
+	stop          context.CancelFunc  // stops Run after --num tags
+	// the latency(ms) of simulated players, they are read by the metrics exporter
+	videoLatency atomic.Int64
+	audioLatency atomic.Int64
+
+	sps   codec.SPS
+	codec string
+
+	out   *jsonOutput    // nil if the format is not json or ndjson
+	hook  *warningHook   // writes the warnings to out, removed by Close
+	probe *ffprobeOutput // nil if the format is not ffprobe
+
+	streamVars *flv.StreamVars
+	vars       map[formatter.ElementName]interface{} // the variables of tag received, see OnReceive
 }
 
-func (p *FlvParser) Println(tag flv.TagI) {
+func (p *FlvParser) Println(tag flv.TagI, vars map[formatter.ElementName]interface{}) {
+	if p.out != nil {
+		p.emitTag(tag, vars)
+		return
+	}
 	if !p.titleDone {
 		p.titleDone = true
 		fmt.Printf("%16s %7s %7s %7s\n", "StreamID", "PTS", "DTS", "Size")
@@ -46,7 +76,7 @@ func (p *FlvParser) Println(tag flv.TagI) {
 	switch t := tag.(type) {
 	case *flv.AudioTag:
 		if showPacket {
-			fmt.Println(p.audioFormatter.Format(t.ToVars()))
+			fmt.Println(p.audioFormatter.Format(vars))
 		}
 	case *flv.VideoTag:
 		payloadType, payloadSize, payload := t.SEI()
@@ -65,24 +95,65 @@ func (p *FlvParser) Println(tag flv.TagI) {
 					pretty.Println(string(payload))
 				}
 				fmt.Println("------------------------------")
-				fmt.Println(p.videoFormatter.Format(t.ToVars()))
+				fmt.Println(p.videoFormatter.Format(vars))
 			}
 		}
 		if showPacket {
-			fmt.Println(p.videoFormatter.Format(t.ToVars()))
+			fmt.Println(p.videoFormatter.Format(vars))
+		}
+	case *flv.ScriptTag:
+		if showPacket {
+			fmt.Println(p.scriptFormatter.Format(vars))
+		}
+	}
+}
+
+func (p *FlvParser) emitTag(tag flv.TagI, vars map[formatter.ElementName]interface{}) {
+	switch t := tag.(type) {
+	case *flv.AudioTag:
+		if showPacket {
+			p.out.emit(recordPacket, packetRecord(vars))
+		}
+	case *flv.VideoTag:
+		payloadType, payloadSize, payload := t.SEI()
+		if showSEI && payloadType != 0 {
+			p.out.emit(recordSEI, seiRecord{
+				PTS:         t.PTS,
+				DTS:         t.DTS,
+				PayloadType: payloadType,
+				PayloadSize: payloadSize,
+				Payload:     seiPayload(payload),
+			})
+		}
+		if showPacket {
+			p.out.emit(recordPacket, packetRecord(vars))
 		}
 	case *flv.ScriptTag:
 		if showPacket {
-			fmt.Println(p.scriptFormatter.Format(t.ToVars()))
+			p.out.emit(recordPacket, packetRecord(vars))
 		}
 	}
 }
 
 func (p *FlvParser) Summary() {
-	v := p.videoCounter
-	a := p.audioCounter
+	p.prober.Report() // the checks of the whole stream
+	v := p.videoCounter.Snapshot()
+	a := p.audioCounter.Snapshot()
+	if p.player != nil {
+		p.player.Finish(time.Now())
+	}
+	if p.out != nil {
+		p.emitSummary(v, a)
+		return
+	}
+	if p.probe != nil {
+		if err := p.probe.Write(); err != nil {
+			logrus.WithField("error", err).Error("write ffprobe output failed")
+		}
+		return
+	}
 	fmt.Println("\nSummary:")
-	fmt.Printf("  Running time: %v\n", v.Duration())
+	fmt.Printf("  Running time: %v\n", v.Duration)
 	if v.Total > 0 {
 		fmt.Println("  video:")
 		if p.sps != nil {
@@ -95,170 +166,302 @@ func (p *FlvParser) Summary() {
 			}
 		}
 		fmt.Printf("    count/timestamp: %d/%d, fps: %.2f, real fps: %0.2f, gap: %d, rewind: %d, duplicate: %d, hole: %dms\n",
-			v.Total, v.TimestampDuration(), v.Rate(), v.RealRate(), v.MaxGap, v.MaxRewind, v.Duplicate, v.MaxHole.Milliseconds())
-		cacheTimestampDuration := v.CacheTimestampDuration()
-		cacheDuration := v.CacheDuration()
-		estimatedCacheFps := v.EstimatedCacheFps()
-		if cacheTimestampDuration == 0 {
-			fmt.Printf("    Estimated cache: %d(not yet over) was send within %v\n", v.TimestampDuration(), v.Duration())
-		} else {
-			fmt.Printf("    Estimated cache: %d was send within %v, estimated fps: %0.2f\n", cacheTimestampDuration, cacheDuration, estimatedCacheFps)
+			v.Total, v.TimestampDuration, v.Rate, v.RealRate, v.MaxGap, v.MaxRewind, v.Duplicate, v.MaxHole.Milliseconds())
+		if v.Rollovers > 0 {
+			fmt.Printf("    timestamp rollover: %d\n", v.Rollovers)
 		}
+		printCache(v)
 	}
 	if a.Total > 0 {
 		fmt.Println("  audio:")
 		fmt.Printf("    count/timestamp: %d/%d, pps: %.2f, real pps: %0.2f, gap: %d, rewind: %d, duplicate: %d, hole: %dms\n",
-			a.Total, a.TimestampDuration(), a.Rate(), a.RealRate(), a.MaxGap, a.MaxRewind, a.Duplicate, a.MaxHole.Milliseconds())
-		cacheTimestampDuration := a.CacheTimestampDuration()
-		cacheDuration := a.CacheDuration()
-		estimatedCacheFps := a.EstimatedCacheFps()
-		if cacheTimestampDuration == 0 {
-			fmt.Printf("    Estimated cache: %d(not yet over) was send within %v\n", a.TimestampDuration(), a.Duration())
-		} else {
-			fmt.Printf("    Estimated cache: %d was send within %v, estimated fps: %0.2f\n", cacheTimestampDuration, cacheDuration, estimatedCacheFps)
+			a.Total, a.TimestampDuration, a.Rate, a.RealRate, a.MaxGap, a.MaxRewind, a.Duplicate, a.MaxHole.Milliseconds())
+		if a.Rollovers > 0 {
+			fmt.Printf("    timestamp rollover: %d\n", a.Rollovers)
 		}
+		printCache(a)
 	}
+	printPlayer(p.player)
+	if p.reconnects != nil {
+		printReconnects(p.reconnects.Snapshot())
+	}
+	if showStartup {
+		fmt.Println("  startup:")
+		for _, line := range strings.Split(strings.TrimSpace(p.startup.String()), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+	if startupOutput != "" {
+		if err := writeJSON(startupOutput, p.startup); err != nil {
+			logrus.WithField("error", err).Error("write startup metrics failed")
+		}
+	}
+}
 
+func (p *FlvParser) emitSummary(v, a summary.Stats) {
+	s := summaryRecord{RunningTimeMs: v.Duration.Milliseconds()}
+	if v.Total > 0 {
+		s.Video = probe.NewTrackSummary(v)
+		s.Video.Codec = p.codec
+		if p.sps != nil {
+			s.Video.Width = p.sps.Width()
+			s.Video.Height = p.sps.Height()
+			s.Video.SPSFPS, _ = probe.FiniteValue(p.sps.FPS()).(float64)
+		}
+	}
+	if a.Total > 0 {
+		s.Audio = probe.NewTrackSummary(a)
+	}
+	if p.player != nil {
+		s.Player = probe.NewPlayerSummary(p.player)
+	}
+	if p.reconnects != nil {
+		s.Reconnect = newReconnectSummary(p.reconnects.Snapshot())
+	}
+	if showStartup {
+		s.Startup = p.startup
+	}
+	if startupOutput != "" {
+		if err := writeJSON(startupOutput, p.startup); err != nil {
+			logrus.WithField("error", err).Error("write startup metrics failed")
+		}
+	}
+	p.out.emit(recordSummary, s)
 }
 
-func (p *FlvParser) OnHeader(header *flv.Header) {
-	if !(showHeader) {
+func printCache(s summary.Stats) {
+	estimate := s.Cache
+	if !estimate.Converged {
+		fmt.Printf("    Estimated cache: %d(not yet over) was send within %v, confidence: %.2f\n",
+			s.TimestampDuration, s.Duration, estimate.Confidence)
 		return
 	}
-	fmt.Println("---------- FLV Header ----------")
-	fmt.Printf("Version: %d\n", header.Version)
-	fmt.Printf("HasVideo: %t\n", header.HasVideo)
-	fmt.Printf("HasAudio: %t\n", header.HasAudio)
-	fmt.Printf("HeaderSize: %d\n", header.DataOffset)
-	fmt.Println("------------------------------")
+	fmt.Printf("    Estimated cache: %d (%d frames) was send within %v, speed: %.2fx, estimated fps: %0.2f, confidence: %.2f\n",
+		estimate.Duration, estimate.Frames, estimate.SendTime, estimate.Speed, estimate.Rate, estimate.Confidence)
 }
 
-func (p *FlvParser) OnPacket(tag flv.TagI) error {
-	switch t := tag.(type) {
-	case *flv.AudioTag:
-		if t.SoundFormat == flv.AAC && t.PacketType == flv.SequenceHeader {
-			if err := p.OnAAC(t); err != nil {
-				logrus.WithField("error", err).Error("parse sequence header of audio AACAudioSpecificConfig failed")
-			}
-		} else {
-			p.audioCounter.Count(int(t.PTS))
-		}
-	case *flv.VideoTag:
-		if t.PacketType == flv.SequenceHeader {
-			switch t.CodecID {
-			case flv.H264:
-				p.codec = "avc"
-				if err := p.OnAVC(t); err != nil {
-					logrus.WithField("error", err).Error("parse sequence header of video AVCDecoderConfigurationRecord failed")
-				}
-			case flv.H265:
-				p.codec = "hevc"
-				if err := p.OnHEVC(t); err != nil {
-					logrus.WithField("error", err).Error("parse sequence header of video HEVCDecoderConfigurationRecord failed")
-				}
-			default:
-				logrus.WithField("codec_id", t.CodecID).Warn("unknown sequence header type of video")
-			}
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Run analyses the stream of r until ctx is done, the stream ends or --num tags are analysed,
+// what's found is printed by flvObserver.
+func (p *FlvParser) Run(ctx context.Context, r io.Reader) error {
+	ctx, p.stop = context.WithCancel(ctx)
+	defer p.stop()
+	return p.prober.Run(ctx, r)
+}
+
+func (p *FlvParser) onArrival(track string, timestamp int64) {
+	now := time.Now()
+	if p.player != nil {
+		p.player.FeedTrack(now, track, timestamp)
+		latency, _ := p.player.TrackLatency(track)
+		if track == "video" {
+			p.videoLatency.Store(latency.Milliseconds())
 		} else {
-			p.videoCounter.Count(int(t.DTS))
+			p.audioLatency.Store(latency.Milliseconds())
 		}
-	case *flv.ScriptTag:
-		decoder := amf.NewDecoder(amf.Version0)
-		buf := bytes.NewBuffer(t.Bytes)
-		got, err := decoder.DecodeBatch(buf)
-		if err != nil {
-			if err != io.EOF {
-				logrus.WithField("error", err).Error("parse script tag failed")
-			}
-		}
-		if showMetaData {
-			fmt.Println("---------- MetaData ----------")
-			pretty.Println(got)
-			fmt.Println("------------------------------")
+	}
+	if p.arrivalWriter != nil {
+		if err := p.arrivalWriter.Write(now, track, timestamp); err != nil {
+			logrus.WithField("error", err).Error("write arrival log failed")
+			p.arrivalWriter = nil
 		}
 	}
-	if !(showPacket || showSEI) {
-		return nil
+}
+
+// latency returns the latency of simulated player of track, ok is false if not simulate
+func (p *FlvParser) latency(track string) (time.Duration, bool) {
+	if p.player == nil {
+		return 0, false
+	}
+	if track == "video" {
+		return time.Duration(p.videoLatency.Load()) * time.Millisecond, true
+	}
+	return time.Duration(p.audioLatency.Load()) * time.Millisecond, true
+}
+
+// flvObserver prints what the prober of FlvParser finds by the flags,
+// and it records and reconnects the stream read by FlvParser.Run.
+type flvObserver struct {
+	p *FlvParser
+}
+
+// OnReceive records tag if it passes --filter, the first frame after reconnect ends the downtime.
+// The variables of tag are kept for OnTag, since the ones of a track depend on the tag before.
+func (o flvObserver) OnReceive(tag flv.TagI) error {
+	p := o.p
+	if p.conn != nil {
+		p.conn.onTag(tag)
+	}
+	p.vars = p.streamVars.Vars(tag, time.Now())
+	if p.recorder != nil && passFilter(tag, p.vars) {
+		if err := p.recorder.WriteTag(tag); err != nil {
+			return fmt.Errorf("record err: %v", err)
+		}
 	}
-	p.Println(tag)
 	return nil
 }
 
-func (p *FlvParser) OnAAC(t *flv.AudioTag) error {
-	if !(showExtraData) {
-		return nil
+// Reconnect requests the url again if --reconnect is set, a live stream ends with EOF or an error when disconnected.
+func (o flvObserver) Reconnect(reason error) error {
+	if o.p.conn == nil {
+		return reason
 	}
-	aac := new(codec.AACAudioSpecificConfig)
-	if err := aac.Read(t.Bytes); err != nil {
-		return err
+	return o.p.conn.reconnect(reason)
+}
+
+func (o flvObserver) OnHeader(header *flv.Header) {
+	p := o.p
+	if p.conn != nil && p.conn.down {
+		logrus.WithFields(logrus.Fields{"has_video": header.HasVideo, "has_audio": header.HasAudio}).Info("reconnected")
+	}
+	if p.recorder != nil {
+		if err := p.recorder.OnHeader(header); err != nil {
+			logrus.WithField("error", err).Error("record header failed")
+		}
+	}
+	if !(showHeader) || p.probe != nil {
+		return
+	}
+	if p.out != nil {
+		p.out.emit(recordHeader, probe.Header{
+			Version:    header.Version,
+			HasVideo:   header.HasVideo,
+			HasAudio:   header.HasAudio,
+			DataOffset: header.DataOffset,
+		})
+		return
 	}
-	fmt.Println("-- sequence header of audio --")
-	pretty.Println(aac)
+	fmt.Println("---------- FLV Header ----------")
+	fmt.Printf("Version: %d\n", header.Version)
+	fmt.Printf("HasVideo: %t\n", header.HasVideo)
+	fmt.Printf("HasAudio: %t\n", header.HasAudio)
+	fmt.Printf("HeaderSize: %d\n", header.DataOffset)
 	fmt.Println("------------------------------")
-	return nil
 }
 
-func (p *FlvParser) OnAVC(t *flv.VideoTag) error {
-	if !(showExtraData) {
-		return nil
+func (o flvObserver) OnMetadata(tag *flv.ScriptTag, values []interface{}) {
+	p := o.p
+	if p.probe != nil {
+		return
 	}
-	decoderConfigurationRecord := new(avc.AVCDecoderConfigurationRecord)
-	if err := decoderConfigurationRecord.Read(t.Bytes); err != nil {
-		return err
+	if showMetaData && p.out != nil {
+		p.out.emit(recordMetaData, probe.MetaData{Timestamp: tag.PTS, Values: values})
+	} else if showMetaData {
+		fmt.Println("---------- MetaData ----------")
+		pretty.Println(values)
+		fmt.Println("------------------------------")
+	}
+}
+
+func (o flvObserver) OnSequenceHeader(tag flv.TagI, header *probe.SequenceHeader) {
+	p := o.p
+	if header.StreamType != "AAC" {
+		p.codec = strings.ToLower(header.StreamType)
+		p.sps = header.SPS
+		if header.SPS == nil {
+			logrus.Debugf("parse sps failed, the hex string of decoderConfigurationRecord is %s", hex.EncodeToString(tag.Data()))
+		}
+	}
+	if !(showExtraData) || p.probe != nil {
+		return
+	}
+	if t, ok := tag.(*flv.VideoTag); ok {
+		// for $nalu_types of the sequence header
+		switch config := header.Config.(type) {
+		case *avc.AVCDecoderConfigurationRecord:
+			t.NALUs = append(t.NALUs, config.SPS...)
+			t.NALUs = append(t.NALUs, config.PPS...)
+		case *hevc.HEVCDecoderConfigurationRecord:
+			for _, ps := range config.NALUs {
+				t.NALUs = append(t.NALUs, ps.NALUs...)
+			}
+		}
+	}
+	if p.out != nil {
+		p.out.emit(recordSequenceHeader, *header)
+		return
+	}
+	if header.StreamType == "AAC" {
+		fmt.Println("-- sequence header of audio --")
+		pretty.Println(header.Config)
+		fmt.Println("------------------------------")
+		return
 	}
-	t.NALUs = append(t.NALUs, decoderConfigurationRecord.SPS...)
-	t.NALUs = append(t.NALUs, decoderConfigurationRecord.PPS...)
 	fmt.Println("-- sequence header of video --")
-	pretty.Println(decoderConfigurationRecord)
-	reader := utils.NewBitReader(decoderConfigurationRecord.SPS[0])
-	avc.ParseNALUHeader(reader)
-	sps, err := avc.ParseSPS(reader)
-	if err != nil {
-		logrus.Debugf("parse sps failed, the hex string of decoderConfigurationRecord is %s", hex.EncodeToString(t.Bytes))
+	pretty.Println(header.Config)
+	if header.SPS != nil {
+		fmt.Println("-- From SPS --")
+		fmt.Printf("resolution: %dx%d\n", header.Width, header.Height)
+		fmt.Printf("fps: %.2f (It's not mandatory)\n", header.FPS)
 	}
-	p.sps = sps
-	fmt.Println("-- From SPS --")
-	fmt.Printf("resolution: %dx%d\n", sps.Width(), sps.Height())
-	fmt.Printf("fps: %.2f (It's not mandatory)\n", sps.FPS())
 	fmt.Println("------------------------------")
-	return nil
 }
 
-func (p *FlvParser) OnHEVC(t *flv.VideoTag) error {
-	if !(showExtraData) {
-		return nil
+func (o flvObserver) OnTag(tag flv.TagI) {
+	p := o.p
+	if num > 0 && p.prober.Tags() > int64(num) && p.stop != nil {
+		p.stop()
 	}
-	decoderConfigurationRecord := new(hevc.HEVCDecoderConfigurationRecord)
-	if err := decoderConfigurationRecord.Read(t.Bytes); err != nil {
-		return err
+	if p.probe != nil {
+		p.probe.OnPacket(tag, packetFilter.Match(p.vars))
+		return
 	}
-	fmt.Println("-- sequence header of video --")
-	pretty.Println(decoderConfigurationRecord)
-	for _, ps := range decoderConfigurationRecord.NALUs {
-		t.NALUs = append(t.NALUs, ps.NALUs...)
-		if ps.NALUnitType != hevc.NalSPS {
-			continue
+	switch t := tag.(type) {
+	case *flv.AudioTag:
+		if !(flv.IsSequenceHeader(t)) {
+			p.onArrival("audio", p.audioCounter.LastTimestamp())
 		}
-		reader := utils.NewBitReader(ps.NALUs[0])
-		hevc.ParseNALUHeader(reader)
-		sps, err := hevc.ParseSPS(reader)
-		if err != nil {
-			logrus.Debugf("parse sps failed, the hex string of decoderConfigurationRecord is %s", hex.EncodeToString(t.Bytes))
+	case *flv.VideoTag:
+		if t.PacketType != flv.SequenceHeader {
+			p.onArrival("video", p.videoCounter.LastTimestamp())
 		}
-		p.sps = sps
-		fmt.Println("-- From SPS --")
-		fmt.Printf("resolution: %dx%d\n", sps.Width(), sps.Height())
-		fmt.Printf("fps: %.2f (It's not mandatory)\n", sps.FPS())
-		fmt.Println("------------------------------")
 	}
-	return nil
+	if !(showPacket || showSEI) {
+		return
+	}
+	if !packetFilter.Match(p.vars) {
+		return
+	}
+	p.Println(tag, p.vars)
+}
+
+func (o flvObserver) OnWarning(warning probe.Warning) {
+	switch {
+	case warning.Event != nil:
+		// the events are consumed by the sink of FlvParser
+	case warning.Issue != nil && warning.Issue.Severity == validate.SeverityInfo:
+		logrus.Info(warning.Message)
+	default:
+		logrus.Warn(warning.Message)
+	}
 }
 
-func NewFlvParser(format string) (*FlvParser, error) {
+// NewFlvParser returns a FlvParser analysing the stream by options, see proberOptions.
+func NewFlvParser(format string, options probe.Options) (*FlvParser, error) {
 	p := &FlvParser{
-		videoCounter: summary.NewCounter(summary.SetLogPrefix("video")),
-		audioCounter: summary.NewCounter(summary.SetLogPrefix("audio")),
+		streamVars: flv.NewStreamVars(),
+	}
+	options.Observer = flvObserver{p}
+	prober, err := probe.New(options)
+	if err != nil {
+		return nil, err
 	}
+	p.prober = prober
+	p.videoCounter, p.audioCounter = prober.VideoCounter(), prober.AudioCounter()
+	p.startup = prober.Startup()
+	p.streamVars.Offset = prober.TagOffset
 	switch format {
 	case DefaultFormat:
 		p.videoFormatter = defaultVideoTemplate
@@ -268,8 +471,42 @@ func NewFlvParser(format string) (*FlvParser, error) {
 		p.videoFormatter = csvVideoTemplate
 		p.audioFormatter = csvAudioTemplate
 		p.scriptFormatter = csvScriptTemplate
+	case formatJSON, formatNDJSON:
+		p.out = newJSONOutput(os.Stdout, format == formatNDJSON)
+	case formatFFprobe:
+		p.probe = newFFprobeOutput(os.Stdout)
+		p.probe.offset = prober.TagOffset
 	default:
 		return nil, fmt.Errorf("format %q not supported", format)
 	}
+	for _, custom := range []struct {
+		name      string
+		template  string
+		formatter *formatter.Formatter
+	}{
+		{"video", videoTemplate, &p.videoFormatter},
+		{"audio", audioTemplate, &p.audioFormatter},
+		{"script", scriptTemplate, &p.scriptFormatter},
+	} {
+		if custom.template == "" {
+			continue
+		}
+		t, err := formatter.ParseTemplate(custom.template)
+		if err != nil {
+			return nil, fmt.Errorf("%s template: %v", custom.name, err)
+		}
+		*custom.formatter = t
+	}
+	if p.out != nil {
+		p.hook = addWarningHook(p.out)
+	}
 	return p, nil
 }
+
+// Close stops writing the warnings of logrus to the output of p.
+func (p *FlvParser) Close() {
+	if p.hook != nil {
+		removeWarningHook(p.hook)
+		p.hook = nil
+	}
+}
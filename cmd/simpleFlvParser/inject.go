@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/codec"
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+)
+
+var metaDataCreator string
+
+var injectCmd = &cobra.Command{
+	Use:   "inject [flags] <input file path> <output file path>",
+	Short: "Inject onMetaData with duration, filesize and keyframes index to make the FLV file seekable",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			_ = cmd.Usage()
+			return errors.New("please specify the input and output file paths")
+		}
+		if err := checkOutput(args[1], args[0]); err != nil {
+			return err
+		}
+		in, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("open file err: %v", err)
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		out, err := createOutputFile(args[1])
+		if err != nil {
+			return err
+		}
+		metaData, err := injectMetaData(in, out, metaDataCreator)
+		if err := closeOutput(out, err); err != nil {
+			return err
+		}
+		fmt.Printf("duration: %.3fs, filesize: %.0f, keyframes: %d\n",
+			metaData["duration"], metaData["filesize"], len(metaData["keyframes"].(map[string]interface{})["times"].([]interface{})))
+		return nil
+	},
+}
+
+func initInjectFlags() {
+	injectCmd.Flags().StringVar(
+		&metaDataCreator,
+		"metadata_creator",
+		"simpleFlvParser",
+		"metadatacreator of onMetaData, not written if it's empty",
+	)
+}
+
+// metaDataBuilder computes onMetaData of the tags written after it
+type metaDataBuilder struct {
+	hasAudio bool
+	hasVideo bool
+
+	videoCodec  flv.CodecID
+	sps         codec.SPS
+	videoFrames int
+	videoSize   int64
+	firstVideo  int64
+	lastVideo   int64
+
+	audio     *flv.AudioTag // the last audio tag, for the sound parameters of non-AAC
+	asc       *codec.AACAudioSpecificConfig
+	audioSize int64
+
+	started   bool
+	first     int64
+	last      int64
+	size      int64 // bytes of the tags added, tag header and previousTagSize included
+	times     []float64
+	positions []int64 // relative to the first tag added
+}
+
+func (b *metaDataBuilder) add(tag flv.TagI) {
+	timestamp := int64(tag.Timestamp())
+	// the duration is of the audio and video frames only, a script tag may be timestamped anywhere
+	if tagType := tag.Type(); tagType != flv.TagScript && !flv.IsSequenceHeader(tag) {
+		if !b.started || timestamp < b.first {
+			b.first = timestamp
+		}
+		if !b.started || timestamp > b.last {
+			b.last = timestamp
+		}
+		b.started = true
+	}
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		b.hasVideo = true
+		b.videoCodec = t.CodecID
+		b.videoSize += int64(len(t.Bytes))
+		if flv.IsSequenceHeader(t) {
+			if sps := t.SPS(); sps != nil {
+				b.sps = sps
+			}
+			break
+		}
+		if b.videoFrames == 0 {
+			b.firstVideo = timestamp
+		}
+		b.videoFrames++
+		b.lastVideo = timestamp
+		if t.FrameType == flv.KeyFrame {
+			b.times = append(b.times, float64(timestamp)/1000)
+			b.positions = append(b.positions, b.size)
+		}
+	case *flv.AudioTag:
+		b.hasAudio = true
+		b.audio = t
+		b.audioSize += int64(len(t.Bytes))
+		if flv.IsSequenceHeader(t) {
+			asc := new(codec.AACAudioSpecificConfig)
+			if err := asc.Read(t.Bytes); err == nil {
+				b.asc = asc
+			}
+		}
+	}
+	b.size += int64(11 + tag.Len() + 4)
+}
+
+// build returns the onMetaData tag to be written after the FLV header,
+// the file positions are the offsets in file of the tags added written after it.
+func (b *metaDataBuilder) build(creator string) (*flv.ScriptTag, amf.ECMAArray, error) {
+	// numbers of AMF0 are fixed size, so the size of tag doesn't depend on the file positions
+	metaData := b.values(creator, 0)
+	data, err := encodeMetaData(metaData)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := int64(9+4) + int64(11+len(data)+4)
+	metaData = b.values(creator, start)
+	final, err := encodeMetaData(metaData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(final) != len(data) {
+		return nil, nil, fmt.Errorf("size of onMetaData changes from %d to %d", len(data), len(final))
+	}
+	return &flv.ScriptTag{Bytes: final}, metaData, nil
+}
+
+func encodeMetaData(metaData amf.ECMAArray) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := amf.NewEncoder(amf.Version0).EncodeBatch(&buf, "onMetaData", metaData); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// values returns onMetaData, start is the offset in file of the first tag added
+func (b *metaDataBuilder) values(creator string, start int64) amf.ECMAArray {
+	duration := float64(b.last-b.first) / 1000
+	metaData := amf.ECMAArray{
+		"duration":      duration,
+		"filesize":      float64(start + b.size),
+		"lasttimestamp": float64(b.last) / 1000,
+		"hasVideo":      b.hasVideo,
+		"hasAudio":      b.hasAudio,
+		"hasMetadata":   true,
+		"hasKeyframes":  len(b.times) > 0,
+	}
+	if creator != "" {
+		metaData["metadatacreator"] = creator
+	}
+	if b.hasVideo {
+		metaData["videocodecid"] = float64(b.videoCodec)
+		metaData["videosize"] = float64(b.videoSize)
+		if duration > 0 {
+			metaData["videodatarate"] = float64(b.videoSize) * 8 / 1000 / duration
+		}
+		if b.sps != nil {
+			metaData["width"] = float64(b.sps.Width())
+			metaData["height"] = float64(b.sps.Height())
+		}
+		if b.sps != nil && b.sps.FPS() > 0 {
+			metaData["framerate"] = b.sps.FPS()
+		} else if b.videoFrames > 1 && b.lastVideo > b.firstVideo {
+			metaData["framerate"] = float64(b.videoFrames-1) * 1000 / float64(b.lastVideo-b.firstVideo)
+		}
+	}
+	if b.hasAudio {
+		metaData["audiocodecid"] = float64(b.audio.SoundFormat)
+		metaData["audiosize"] = float64(b.audioSize)
+		if duration > 0 {
+			metaData["audiodatarate"] = float64(b.audioSize) * 8 / 1000 / duration
+		}
+		switch {
+		case b.audio.SoundFormat == flv.AAC && b.asc != nil:
+			metaData["audiosamplerate"] = float64(b.asc.Frequency())
+			metaData["audiosamplesize"] = float64(16)
+			metaData["stereo"] = b.asc.Channel >= 2
+		case b.audio.SoundFormat != flv.AAC:
+			metaData["audiosamplerate"] = float64([]int{5512, 11025, 22050, 44100}[b.audio.SampleRate&0x03])
+			metaData["audiosamplesize"] = float64(int(8) << (b.audio.BitPerSample & 0x01))
+			metaData["stereo"] = b.audio.Channels == 1
+		}
+	}
+	times := make([]interface{}, 0, len(b.times))
+	positions := make([]interface{}, 0, len(b.positions))
+	for i := range b.times {
+		times = append(times, b.times[i])
+		positions = append(positions, float64(start+b.positions[i]))
+	}
+	if len(b.times) > 0 {
+		metaData["lastkeyframetimestamp"] = b.times[len(b.times)-1]
+		metaData["lastkeyframelocation"] = positions[len(positions)-1]
+	}
+	metaData["keyframes"] = map[string]interface{}{
+		"times":         times,
+		"filepositions": positions,
+	}
+	return metaData
+}
+
+// readTagsForInject reads all tags except onMetaData
+func readTagsForInject(r io.Reader, onTag func(tag flv.TagI) error) error {
+	demuxer := &flv.Demuxer{MaxTagSize: maxTagSize}
+	if _, err := demuxer.ReadHeader(r); err != nil {
+		return err
+	}
+	for {
+		tag, err := demuxer.ReadTag(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%v (try the repair command first)", err)
+		}
+		if script, ok := tag.(*flv.ScriptTag); ok && flv.IsMetaData(script) {
+			continue
+		}
+		if err := onTag(tag); err != nil {
+			return err
+		}
+	}
+}
+
+// injectMetaData reads r twice like yamdi: the first pass computes onMetaData,
+// the second pass writes it followed by the tags of r except the original onMetaData.
+func injectMetaData(r io.ReadSeeker, w io.Writer, creator string) (amf.ECMAArray, error) {
+	builder := new(metaDataBuilder)
+	if err := readTagsForInject(r, func(tag flv.TagI) error {
+		builder.add(tag)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tag, metaData, err := builder.build(creator)
+	if err != nil {
+		return nil, err
+	}
+	muxer := new(flv.Muxer)
+	if err := muxer.WriteHeader(w, builder.hasAudio, builder.hasVideo); err != nil {
+		return nil, err
+	}
+	if err := muxer.WriteTag(w, tag); err != nil {
+		return nil, err
+	}
+	return metaData, readTagsForInject(r, func(tag flv.TagI) error {
+		return muxer.WriteTag(w, tag)
+	})
+}
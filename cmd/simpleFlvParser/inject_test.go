@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+)
+
+func TestInjectMetaData(t *testing.T) {
+	f, err := os.Open("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var output bytes.Buffer
+	metaData, err := injectMetaData(f, &output, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := output.Bytes()
+	assert.Equal(t, float64(len(file)), metaData["filesize"])
+	assert.Equal(t, float64(544), metaData["width"])
+	assert.Equal(t, float64(960), metaData["height"])
+
+	// the first tag is the onMetaData
+	tags := readAllTags(t, bytes.NewReader(file))
+	script, ok := tags[0].(*flv.ScriptTag)
+	assert.True(t, ok)
+	got, err := amf.NewDecoder(amf.Version0).DecodeBatch(bytes.NewReader(script.Bytes))
+	assert.Nil(t, err)
+	assert.Equal(t, "onMetaData", got[0])
+	assert.Equal(t, "test", got[1].(amf.ECMAArray)["metadatacreator"])
+
+	// every file position is a video keyframe at the time
+	keyframes := got[1].(amf.ECMAArray)["keyframes"].(map[string]interface{})
+	times, positions := keyframes["times"].([]interface{}), keyframes["filepositions"].([]interface{})
+	assert.Equal(t, len(times), len(positions))
+	assert.True(t, len(times) > 1)
+	for i := range positions {
+		position := int(positions[i].(float64))
+		assert.Equal(t, byte(flv.TagVideo), file[position])
+		timestamp := uint32(file[position+4])<<16 | uint32(file[position+5])<<8 | uint32(file[position+6])
+		assert.Equal(t, times[i].(float64), float64(timestamp)/1000)
+		assert.Equal(t, byte(flv.KeyFrame), file[position+11]>>4)
+		size := int(file[position+1])<<16 | int(file[position+2])<<8 | int(file[position+3])
+		assert.Equal(t, uint32(11+size), binary.BigEndian.Uint32(file[position+11+size:]))
+	}
+}
+
+func TestMetaDataDuration(t *testing.T) {
+	b := new(metaDataBuilder)
+	// the script tags and sequence headers out of the frames don't count
+	b.add(&flv.ScriptTag{PTS: 0})
+	b.add(&flv.VideoTag{FrameType: flv.KeyFrame, CodecID: flv.H264, PacketType: flv.SequenceHeader, DTS: 0})
+	b.add(&flv.VideoTag{FrameType: flv.KeyFrame, CodecID: flv.H264, PacketType: flv.AVPacket, DTS: 1000, PTS: 1000})
+	b.add(&flv.AudioTag{SoundFormat: flv.MP3, PTS: 1020})
+	b.add(&flv.VideoTag{FrameType: flv.InterFrame, CodecID: flv.H264, PacketType: flv.AVPacket, DTS: 3000, PTS: 3000})
+	b.add(&flv.ScriptTag{PTS: 90000})
+	metaData := b.values("", 0)
+	assert.Equal(t, 2.0, metaData["duration"])
+	assert.Equal(t, 3.0, metaData["lasttimestamp"])
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+var (
+	urlList      string
+	streams      int
+	rampRate     float64
+	pullDuration int
+	outliers     int
+)
+
+var loadCmd = &cobra.Command{
+	Use:   "load [flags] <http url>...",
+	Short: "Pull many streams concurrently and report the aggregated startup and stall metrics",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		urls := args
+		if urlList != "" {
+			list, err := readURLList(urlList)
+			if err != nil {
+				return err
+			}
+			urls = append(urls, list...)
+		}
+		if len(urls) == 0 {
+			_ = cmd.Usage()
+			return errors.New("please specify http urls or --url_list")
+		}
+		for _, u := range urls {
+			if !isValidURL(u) {
+				return fmt.Errorf("invalid http url %q", u)
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-c
+			cancel()
+		}()
+
+		options, err := proberOptions(summary.DiscardSink{})
+		if err != nil {
+			return err
+		}
+		config := loadConfig{
+			Streams:  streams,
+			RampRate: rampRate,
+			Duration: time.Duration(pullDuration) * time.Second,
+			Player:   playerConfig(),
+			Options:  options,
+		}
+		start := time.Now()
+		results := runLoad(ctx, urls, config)
+		printLoadReport(os.Stdout, results, time.Since(start), outliers)
+		return nil
+	},
+}
+
+func initLoadFlags() {
+	loadCmd.Flags().StringVar(
+		&urlList,
+		"url_list",
+		"",
+		"file of http urls, one url per line",
+	)
+	loadCmd.Flags().IntVarP(
+		&streams,
+		"streams",
+		"N",
+		1,
+		"pull every url N times",
+	)
+	loadCmd.Flags().Float64Var(
+		&rampRate,
+		"ramp_rate",
+		10,
+		"new connections per second (no limit if <=0)",
+	)
+	loadCmd.Flags().IntVar(
+		&pullDuration,
+		"pull_duration",
+		30,
+		"pull every stream for seconds",
+	)
+	loadCmd.Flags().IntVar(
+		&outliers,
+		"outliers",
+		5,
+		"show the worst n streams",
+	)
+}
+
+func readURLList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open url list err: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+type loadConfig struct {
+	Streams  int           // pull every url Streams times
+	RampRate float64       // new connections per second, no limit if <= 0
+	Duration time.Duration // pull every stream for Duration
+	Player   summary.PlayerConfig
+	Options  probe.Options // options of the prober of every stream
+}
+
+type loadResult struct {
+	Index int
+	URL   string
+	Err   error
+
+	TTFB          time.Duration
+	FirstKeyFrame time.Duration
+	GotKeyFrame   bool
+	Bytes         int64
+
+	Video         summary.Stats
+	Audio         summary.Stats
+	Stalls        int
+	StallDuration time.Duration
+}
+
+// runLoad pulls every url config.Streams times concurrently, the connections are started at config.RampRate.
+func runLoad(ctx context.Context, urls []string, config loadConfig) []loadResult {
+	if config.Streams < 1 {
+		config.Streams = 1
+	}
+	n := len(urls) * config.Streams
+	results := make([]loadResult, n)
+	var ticker *time.Ticker
+	if config.RampRate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / config.RampRate))
+		defer ticker.Stop()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		if ticker != nil && i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-ticker.C:
+			}
+		}
+		results[i] = loadResult{Index: i, URL: urls[i%len(urls)]}
+		if ctx.Err() != nil {
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(result *loadResult) {
+			defer wg.Done()
+			pullStream(ctx, result, config)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+func pullStream(ctx context.Context, result *loadResult, config loadConfig) {
+	ctx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+	observer := &loadObserver{player: summary.NewPlayer(config.Player)}
+	options := config.Options
+	options.Startup = summary.NewStartup()
+	options.EventSink = summary.DiscardSink{}
+	options.Observer = observer
+	prober, err := probe.New(options)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	observer.prober = prober
+	startup := prober.Startup()
+	observer.player.Start(startup.StartTime())
+	defer func() {
+		result.TTFB, _ = startup.Get(summary.StartupFirstByte)
+		result.FirstKeyFrame, result.GotKeyFrame = startup.Get(summary.StartupVideoKeyFrame)
+		result.Video = prober.VideoCounter().Snapshot()
+		result.Audio = prober.AudioCounter().Snapshot()
+		observer.player.Finish(time.Now())
+		result.Stalls = observer.player.Stalls
+		result.StallDuration = observer.player.StallDuration
+	}()
+
+	r, err := doRequest(ctx, result.URL, startup)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	reader := &countReader{r: r}
+	defer func() {
+		result.Bytes = reader.n
+	}()
+	if err := prober.Run(ctx, reader); err != nil {
+		err = reader.demuxError(err)
+		if !errors.Is(err, io.EOF) {
+			result.Err = err
+			return
+		}
+	}
+	result.Err = pullError(ctx, prober.Tags())
+}
+
+// loadObserver feeds the frames of a pulled stream to the player,
+// the tracks share one buffer, the audio-only streams stall by the audio.
+type loadObserver struct {
+	probe.NopObserver
+	prober *probe.Prober
+	player *summary.Player
+}
+
+func (o *loadObserver) OnTag(tag flv.TagI) {
+	if tag.Type() == flv.TagScript || flv.IsSequenceHeader(tag) {
+		return
+	}
+	now := time.Now()
+	if tag.Type() == flv.TagVideo {
+		o.player.FeedTrack(now, "video", o.prober.VideoCounter().LastTimestamp())
+	} else {
+		o.player.FeedTrack(now, "audio", o.prober.AudioCounter().LastTimestamp())
+	}
+}
+
+// errNoData is the error of a stream ended before any tag.
+var errNoData = errors.New("no data")
+
+// pullError returns the error of a stream pulled until the end or ctx is done, tags is the number of tags read.
+// The stream succeeds only if the FLV header and a tag at least are read before the end or the duration.
+func pullError(ctx context.Context, tags int64) error {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return ctx.Err()
+	case tags > 0:
+		return nil
+	case ctx.Err() != nil:
+		return fmt.Errorf("no data before the end of duration: %w", ctx.Err())
+	}
+	return errNoData
+}
+
+type countReader struct {
+	r   io.Reader
+	n   int64
+	err error // the last error of r
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// demuxError marks the error of demuxer as invalid FLV if it's not returned by the reader, e.g. the network errors.
+func (r *countReader) demuxError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || (r.err != nil && errors.Is(err, r.err)) {
+		return err
+	}
+	return &invalidFLVError{err: err}
+}
+
+type invalidFLVError struct {
+	err error
+}
+
+func (e *invalidFLVError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidFLVError) Unwrap() error {
+	return e.err
+}
+
+// errorClass groups the errors for report, e.g. "http 404", "connection refused".
+// The classes are a fixed set, the message of error isn't used because it has the URL.
+func errorClass(err error) string {
+	var se *statusError
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var flvErr *invalidFLVError
+	switch {
+	case errors.As(err, &se):
+		return fmt.Sprintf("http %d", se.code)
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns lookup"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.As(err, &certErr) || errors.As(err, &recordErr):
+		return "tls"
+	case errors.As(err, &flvErr):
+		return "invalid flv"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "unexpected EOF"
+	case errors.Is(err, errNoData):
+		return "no data"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+func printLoadReport(w io.Writer, results []loadResult, running time.Duration, outliers int) {
+	var succeeded []loadResult
+	errorCounts := make(map[string]int)
+	for _, result := range results {
+		if result.Err != nil {
+			errorCounts[errorClass(result.Err)]++
+			continue
+		}
+		succeeded = append(succeeded, result)
+	}
+	_, _ = fmt.Fprintln(w, "\nLoad test:")
+	_, _ = fmt.Fprintf(w, "  streams: %d, succeeded: %d, failed: %d, running time: %v\n",
+		len(results), len(succeeded), len(results)-len(succeeded), running)
+	if len(errorCounts) > 0 {
+		classes := make([]string, 0, len(errorCounts))
+		for class := range errorCounts {
+			classes = append(classes, class)
+		}
+		sort.Slice(classes, func(i, j int) bool {
+			if errorCounts[classes[i]] != errorCounts[classes[j]] {
+				return errorCounts[classes[i]] > errorCounts[classes[j]]
+			}
+			return classes[i] < classes[j]
+		})
+		_, _ = fmt.Fprintln(w, "  errors:")
+		for _, class := range classes {
+			_, _ = fmt.Fprintf(w, "    %6d %s\n", errorCounts[class], class)
+		}
+	}
+	if len(succeeded) == 0 {
+		return
+	}
+
+	var ttfb, keyframe []time.Duration
+	var stalled, stalls, noKeyFrame int
+	var stallDuration time.Duration
+	var bytes int64
+	for _, result := range succeeded {
+		ttfb = append(ttfb, result.TTFB)
+		if result.GotKeyFrame {
+			keyframe = append(keyframe, result.FirstKeyFrame)
+		} else {
+			noKeyFrame++
+		}
+		if result.Stalls > 0 {
+			stalled++
+		}
+		stalls += result.Stalls
+		stallDuration += result.StallDuration
+		bytes += result.Bytes
+	}
+	_, _ = fmt.Fprintf(w, "  TTFB:           %s\n", distribution(ttfb))
+	_, _ = fmt.Fprintf(w, "  first keyframe: %s", distribution(keyframe))
+	if noKeyFrame > 0 {
+		_, _ = fmt.Fprintf(w, ", no keyframe: %d", noKeyFrame)
+	}
+	_, _ = fmt.Fprintln(w)
+	_, _ = fmt.Fprintf(w, "  stall: %d streams stalled, %d stalls, duration: %v\n", stalled, stalls, stallDuration)
+	_, _ = fmt.Fprintf(w, "  received: %d bytes, %.2f kbps\n", bytes, float64(bytes)*8/1000/running.Seconds())
+
+	if outliers <= 0 {
+		return
+	}
+	_, _ = fmt.Fprintln(w, "  outliers:")
+	slowest := append([]loadResult(nil), succeeded...)
+	sort.SliceStable(slowest, func(i, j int) bool {
+		if slowest[i].GotKeyFrame != slowest[j].GotKeyFrame {
+			return !slowest[i].GotKeyFrame
+		}
+		return slowest[i].FirstKeyFrame > slowest[j].FirstKeyFrame
+	})
+	for _, result := range slowest[:min(outliers, len(slowest))] {
+		if !result.GotKeyFrame {
+			_, _ = fmt.Fprintf(w, "    #%d %s: no keyframe\n", result.Index, result.URL)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "    #%d %s: first keyframe %v, TTFB %v\n", result.Index, result.URL, result.FirstKeyFrame, result.TTFB)
+	}
+	stalledMost := append([]loadResult(nil), succeeded...)
+	sort.SliceStable(stalledMost, func(i, j int) bool {
+		return stalledMost[i].StallDuration > stalledMost[j].StallDuration
+	})
+	for _, result := range stalledMost[:min(outliers, len(stalledMost))] {
+		if result.Stalls == 0 {
+			break
+		}
+		_, _ = fmt.Fprintf(w, "    #%d %s: stall %d, stall duration %v, max hole %v\n",
+			result.Index, result.URL, result.Stalls, result.StallDuration, result.Video.MaxHole)
+	}
+}
+
+// distribution returns min, p50, p90, p99 and max of durations
+func distribution(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return "-"
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	percentile := func(p float64) time.Duration {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return sorted[max(i, 0)]
+	}
+	return fmt.Sprintf("min %v, p50 %v, p90 %v, p99 %v, max %v",
+		sorted[0], percentile(0.5), percentile(0.9), percentile(0.99), sorted[len(sorted)-1])
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/textproto"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,12 +22,18 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/filter"
+	"github.com/foolishCDN/AV-spy/formatter"
+	"github.com/foolishCDN/AV-spy/metrics"
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/summary"
 )
 
 var (
 	rootCmd = &cobra.Command{
 		Use:           "simpleFlvParser ...[flags] <file path of http url> ...[flags]",
 		Short:         "SimpleFlvParser is a simple tool to parse FLV stream",
+		Args:          cobra.ArbitraryArgs,
 		SilenceUsage:  true,
 		SilenceErrors: true,
 	}
@@ -36,6 +45,10 @@ var (
 	seiFormatByte   = "byte"
 	seiFormatString = "string"
 	seiFormatHex    = "hex"
+
+	timestampLayoutStandard = "standard"
+	timestampLayoutBE32     = "be32"
+	timestampLayoutAuto     = "auto"
 )
 
 var (
@@ -48,9 +61,21 @@ var (
 	showPacket    bool
 	showExtraData bool
 	showSEI       bool
-	seiFormat     string // default: hex
-	num           int
-	format        string
+	showStreams   bool
+
+	videoTemplate  string
+	audioTemplate  string
+	scriptTemplate string
+	listElements   bool
+	filterExpr     string
+	packetFilter   *filter.Filter // compiled filterExpr, nil matches all
+	showStartup    bool
+	startupOutput  string
+	seiFormat      string // default: hex
+	num            int
+	format         string
+	seekStart      int
+	seekDuration   int
 
 	// http options
 	timeout    int
@@ -63,6 +88,18 @@ var (
 	diffThreshold     int
 	hintGapThreshold  int
 	hintHoleThreshold int
+	eventOutput       string
+	timestampLayout   string
+	maxTagSize        uint32
+	resync            bool
+
+	// player simulation options
+	simulate         bool
+	startupBuffer    int
+	rebufferBuffer   int
+	catchUpThreshold int
+	catchUpSpeed     float64
+	arrivalLog       string
 )
 
 func initFlags() {
@@ -104,6 +141,24 @@ func initFlags() {
 		false,
 		"will show SEI(Supplemental Enhancement Information) and the packet info that carryed SEI",
 	)
+	rootCmd.PersistentFlags().BoolVar(
+		&showStreams,
+		"show_streams",
+		false,
+		"will show streams info (ffprobe format only)",
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&showStartup,
+		"show_startup",
+		false,
+		"will show startup metrics(time to first byte, first keyframe...) in summary",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&startupOutput,
+		"startup_output",
+		"",
+		"write startup metrics as JSON to file (\"-\" for stdout)",
+	)
 	rootCmd.PersistentFlags().StringVar(
 		&seiFormat,
 		"sei_format",
@@ -122,7 +177,39 @@ func initFlags() {
 		"format",
 		"f",
 		DefaultFormat,
-		"output format",
+		"output format: normal, csv, json, ndjson or ffprobe, json is written at the end "+
+			"so a live url needs --duration or --number, ndjson is written as it goes",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&videoTemplate,
+		"video_template",
+		"",
+		"template of video packet instead of the one of format, e.g. \"$dts:%7d $cts:%4d $keyframe $slice_types\"",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&audioTemplate,
+		"audio_template",
+		"",
+		"template of audio packet instead of the one of format",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&scriptTemplate,
+		"script_template",
+		"",
+		"template of script packet instead of the one of format",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&filterExpr,
+		"filter",
+		"",
+		"only show, record or write the packets match the expression, e.g. 'stream_type == \"VIDEO\" && keyframe && size > 200000', "+
+			"the sequence headers and script tags are always recorded and written, supported by the root, cut, split and concat commands",
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&listElements,
+		"list_elements",
+		false,
+		"list the elements can be used in template",
 	)
 	// http flags
 	rootCmd.PersistentFlags().IntVarP(
@@ -175,15 +262,128 @@ func initFlags() {
 		200,
 		"hint when the hole of data is larger than threshold",
 	)
+	rootCmd.PersistentFlags().StringVar(
+		&timestampLayout,
+		"timestamp_layout",
+		timestampLayoutAuto,
+		"how the extended timestamp byte is placed in tag header: standard, be32(32 bits big endian written by some servers), auto(detect be32)",
+	)
+	rootCmd.PersistentFlags().Uint32Var(
+		&maxTagSize,
+		"max_tag_size",
+		0,
+		"the max data size of tag, a larger one is treated as corruption (no limit if 0)",
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&resync,
+		"resync",
+		false,
+		"skip the corrupted bytes and continue with the next plausible tag instead of aborting",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&eventOutput,
+		"event_output",
+		"",
+		"write gap/rewind/duplicate/hole events as JSON lines to file (\"-\" for stdout) instead of log",
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&simulate,
+		"simulate",
+		false,
+		"simulate a player with the received stream and show the stalls and latency in summary",
+	)
+	rootCmd.PersistentFlags().IntVar(
+		&startupBuffer,
+		"startup_buffer",
+		1000,
+		"buffer(ms) of simulated player needed to show the first frame",
+	)
+	rootCmd.PersistentFlags().IntVar(
+		&rebufferBuffer,
+		"rebuffer_buffer",
+		1000,
+		"buffer(ms) of simulated player needed to resume playback after a stall",
+	)
+	rootCmd.PersistentFlags().IntVar(
+		&catchUpThreshold,
+		"catch_up_threshold",
+		0,
+		"simulated player speeds up when the buffer(ms) is larger than threshold (no catch up if threshold<=0)",
+	)
+	rootCmd.PersistentFlags().Float64Var(
+		&catchUpSpeed,
+		"catch_up_speed",
+		1.1,
+		"playback speed of simulated player while catching up",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&arrivalLog,
+		"arrival_log",
+		"",
+		"write the receive time and timestamp of every frame to file, it can be replayed by the simulate command",
+	)
+	// not persistent, subcommands have their own flags of duration
+	rootCmd.Flags().IntVar(
+		&seekStart,
+		"start",
+		0,
+		"start at the nearest keyframe at or before the timestamp(ms), a file seeks to it and a url skips the tags before it",
+	)
+	rootCmd.Flags().IntVar(
+		&seekDuration,
+		"duration",
+		0,
+		"stop after the tags of duration(ms) from --start (no limit if duration<=0)",
+	)
+	initLoadFlags()
+	initCompareFlags()
+	initDiffFlags()
+	initValidateFlags()
+	initRepairFlags()
+	initInjectFlags()
+	initCutFlags()
+	initSplitFlags()
+	initRecordFlags()
+	initReconnectFlags()
+	initDaemonFlags()
+	initServeFlags()
+}
+
+func playerConfig() summary.PlayerConfig {
+	return summary.PlayerConfig{
+		StartupBuffer:    time.Duration(startupBuffer) * time.Millisecond,
+		RebufferBuffer:   time.Duration(rebufferBuffer) * time.Millisecond,
+		CatchUpThreshold: time.Duration(catchUpThreshold) * time.Millisecond,
+		CatchUpSpeed:     catchUpSpeed,
+	}
 }
 
 func main() {
 	initFlags()
+	rootCmd.AddCommand(simulateCmd)
+	rootCmd.AddCommand(loadCmd)
+	rootCmd.AddCommand(compareCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(repairCmd)
+	rootCmd.AddCommand(injectCmd)
+	rootCmd.AddCommand(cutCmd)
+	rootCmd.AddCommand(splitCmd)
+	rootCmd.AddCommand(concatCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.PersistentPreRunE = compileFilter
 	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
 		if verbose {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
-		if !(showPacket || showHeader || showExtraData || showMetaData || showAll || showSEI) {
+		if listElements {
+			for _, name := range formatter.Elements() {
+				kind, _ := formatter.LookupElement(name)
+				fmt.Printf("$%s (%s)\n", name, kind)
+			}
+			return nil
+		}
+		if !(showPacket || showHeader || showExtraData || showMetaData || showAll || showSEI || showStreams || showStartup || startupOutput != "" || simulate || arrivalLog != "" || recordStream || recordBuffer > 0 || interval > 0 || metricsAddr != "") {
 			cmd.Usage()
 			return errors.New("please set one or more flags to show")
 		}
@@ -193,76 +393,217 @@ func main() {
 			showExtraData = true
 			showMetaData = true
 			showSEI = true
+			showStreams = true
+			showStartup = true
 		}
 		if len(args) < 1 {
 			cmd.Usage()
 			return errors.New("please specify a file path of http url")
 		}
 		path := args[0]
-		r, err := parseFilePathOrURL(path)
+		// json keeps every packet until the end, a live stream without limit would never end
+		if format == formatJSON && isValidURL(path) && seekDuration <= 0 && num <= 0 {
+			return errors.New("json format of a live url needs --duration or --number, use --format ndjson to stream the records")
+		}
+		var sink summary.EventSink = summary.LogrusSink{}
+		if eventOutput != "" {
+			w := io.Writer(os.Stdout)
+			if eventOutput != "-" {
+				f, err := os.Create(eventOutput)
+				if err != nil {
+					return fmt.Errorf("create event output err: %v", err)
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+				w = f
+			}
+			sink = summary.NewJSONLinesSink(w)
+		}
+		var reconnects *summary.Reconnects
+		if reconnect && isValidURL(path) {
+			reconnects = new(summary.Reconnects)
+			sink = summary.MultiSink{sink, reconnects}
+		}
+		recorder := newRecorder()
+		if recorder != nil {
+			defer func() {
+				if err := recorder.Close(); err != nil {
+					logrus.Errorf("close record file err: %v", err)
+				}
+			}()
+			sink = summary.MultiSink{sink, recorder}
+		}
+		options, err := proberOptions(sink)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			_ = r.Close()
-		}()
-
-		p, err := NewFlvParser(format)
+		p, err := NewFlvParser(format, options)
 		if err != nil {
 			return err
 		}
-		p.videoCounter.DiffThreshold = diffThreshold
-		p.videoCounter.HintGap = hintGapThreshold
-		p.videoCounter.HintHole = time.Duration(hintHoleThreshold) * time.Millisecond
-		p.audioCounter.DiffThreshold = diffThreshold
-		p.audioCounter.HintGap = hintGapThreshold
-		p.audioCounter.HintHole = time.Duration(hintHoleThreshold) * time.Millisecond
-
-		demuxer := new(flv.Demuxer)
-		header, err := demuxer.ReadHeader(r)
+		defer p.Close()
+		// a signal or an unhealthy stream cancels ctx, the summary is printed after Run returns
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		startup := p.startup
+		r, err := parseFilePathOrURL(ctx, path, startup)
 		if err != nil {
 			return err
 		}
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-c
-			p.Summary()
-			os.Exit(1)
-		}()
-		p.OnHeader(header)
-		count := 0
+		if reconnects != nil {
+			p.conn = newReconnector(ctx, path, r, reconnects)
+			r = p.conn
+		}
 		defer func() {
-			p.Summary()
+			_ = r.Close()
 		}()
-		for {
-			tag, err := demuxer.ReadTag(r)
+		p.reconnects = reconnects
+		p.recorder = recorder
+		if metricsAddr != "" {
+			exporter := metrics.NewExporter()
+			exporter.Add(&metrics.Stream{
+				URL:        path,
+				Video:      p.videoCounter,
+				Audio:      p.audioCounter,
+				Reconnects: reconnects,
+				Latency:    p.latency,
+			})
+			addr, err := serveMetrics(metricsAddr, exporter)
 			if err != nil {
-				if err == io.EOF {
-					return nil
-				} else {
-					return err
-				}
-			}
-			count++
-			if err := p.OnPacket(tag); err != nil {
 				return err
 			}
-			if num > 0 && count > num {
-				break
+			logrus.Infof("serve metrics on http://%s/metrics", addr)
+		}
+		if simulate {
+			p.player = summary.NewPlayer(playerConfig())
+			p.player.Start(p.startup.StartTime())
+		}
+		if arrivalLog != "" {
+			f, err := os.Create(arrivalLog)
+			if err != nil {
+				return fmt.Errorf("create arrival log err: %v", err)
 			}
+			defer func() {
+				_ = f.Close()
+			}()
+			p.arrivalWriter = summary.NewArrivalWriter(f)
+			p.arrivalWriter.Start(p.startup.StartTime())
 		}
-		return nil
+
+		var exit atomic.Pointer[exitError] // why the stream is stopped, nil if it ends
+		stop := func(e *exitError) {
+			exit.CompareAndSwap(nil, e)
+			cancel()
+			if f, ok := r.(*os.File); ok {
+				_ = f.Close() // e.g. a pipe blocks until it's closed, a request is aborted by ctx
+			}
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(c)
+		go func() {
+			select {
+			case <-c:
+				stop(&exitError{code: 1})
+			case <-ctx.Done():
+			}
+		}()
+		if interval > 0 {
+			out, jsonLines := io.Writer(os.Stdout), intervalOutput != ""
+			if intervalOutput != "" && intervalOutput != "-" {
+				f, err := os.Create(intervalOutput)
+				if err != nil {
+					return fmt.Errorf("create interval output err: %v", err)
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+				out = f
+			}
+			health := &healthChecker{config: healthConfig{
+				MinFPS:      healthMinFPS,
+				MaxGap:      healthMaxGap,
+				MaxHole:     time.Duration(healthMaxHole) * time.Millisecond,
+				MaxAVOffset: healthMaxAVOffset,
+				Grace:       time.Duration(healthGrace) * time.Second,
+			}}
+			go runDaemon(p, time.Duration(interval)*time.Second, out, jsonLines, health, ctx.Done(), func(err error) {
+				stop(&exitError{code: exitUnhealthy, err: err})
+			})
+		}
+		err = p.Run(ctx, r)
+		p.Summary()
+		if e := exit.Load(); e != nil {
+			return e
+		}
+		return err
 	}
 	if err := rootCmd.Execute(); err != nil {
-		logrus.Errorf("simpleFlvParser: %v", err)
-		os.Exit(1)
+		code := 1
+		var exit *exitError
+		if errors.As(err, &exit) {
+			code = exit.code
+			err = exit.err
+		}
+		if err != nil {
+			logrus.Errorf("simpleFlvParser: %v", err)
+		}
+		os.Exit(code)
+	}
+}
+
+// filterCommands are the subcommands writing the packets selected by --filter
+var filterCommands = map[*cobra.Command]bool{cutCmd: true, splitCmd: true, concatCmd: true}
+
+// compileFilter compiles --filter to packetFilter, it's an error if cmd ignores the packets filtered out.
+func compileFilter(cmd *cobra.Command, _ []string) error {
+	if filterExpr == "" {
+		return nil
+	}
+	if cmd != rootCmd && !filterCommands[cmd] {
+		return fmt.Errorf("--filter is not supported by the %s command", cmd.Name())
+	}
+	f, err := filter.Compile(filterExpr)
+	if err != nil {
+		return err
+	}
+	packetFilter = f
+	return nil
+}
+
+// passFilter returns true if tag matches packetFilter by vars, the sequence headers and script tags always pass.
+func passFilter(tag flv.TagI, vars map[formatter.ElementName]interface{}) bool {
+	return tag.Type() == flv.TagScript || flv.IsSequenceHeader(tag) || packetFilter.Match(vars)
+}
+
+// proberOptions returns the options of prober by the flags, the others are probe.DefaultOptions shared with AV-spy.
+func proberOptions(sink summary.EventSink) (probe.Options, error) {
+	options := probe.DefaultOptions()
+	options.MaxTagSize = maxTagSize
+	options.Resync = resync
+	options.Start, options.Duration = seekStart, seekDuration
+	options.HintGap = hintGapThreshold
+	options.HintHole = time.Duration(hintHoleThreshold) * time.Millisecond
+	options.DiffThreshold = diffThreshold
+	options.EventSink = sink
+	switch timestampLayout {
+	case timestampLayoutStandard:
+		options.DetectTimestampLayout = false
+	case timestampLayoutBE32:
+		options.DetectTimestampLayout = false
+		options.TimestampLayout = flv.TimestampBigEndian32
+	case timestampLayoutAuto:
+	default:
+		return options, fmt.Errorf("timestamp layout %q not supported", timestampLayout)
 	}
+	return options, nil
 }
 
-func parseFilePathOrURL(path string) (io.ReadCloser, error) {
+// parseFilePathOrURL opens the file of path or requests the url, the end of ctx aborts the request and its body.
+func parseFilePathOrURL(ctx context.Context, path string, startup *summary.Startup) (io.ReadCloser, error) {
 	if isValidURL(path) {
-		return doRequest(path)
+		return doRequest(ctx, path, startup)
 	}
 	f, err := os.Open(path)
 	if err != nil {
@@ -271,16 +612,57 @@ func parseFilePathOrURL(path string) (io.ReadCloser, error) {
 	return f, nil
 }
 
-func doRequest(url string) (io.ReadCloser, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// exitError makes the program exit with code, err is logged if it's not nil
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// statusError is returned by doRequest if the status code isn't 200
+type statusError struct {
+	code     int
+	location string
+}
+
+func (e *statusError) Error() string {
+	if isRedirect(e.code) {
+		return fmt.Sprintf("do request err: status code=%d, use -L to follow location: %s", e.code, e.location)
+	}
+	return fmt.Sprintf("do request err: status code=%d", e.code)
+}
+
+func doRequest(ctx context.Context, url string, startup *summary.Startup) (io.ReadCloser, error) {
+	headers := make(map[string]string, len(header))
+	for _, h := range header {
+		kv := strings.Split(h, ":")
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return doRequestWithHeaders(ctx, url, headers, startup)
+}
+
+// doRequestWithHeaders requests url with the headers instead of --header
+func doRequestWithHeaders(ctx context.Context, url string, headers map[string]string, startup *summary.Startup) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("new request err: %v", err)
 	}
+	if startup != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), startup.ClientTrace()))
+	}
 	req.Header.Set("User-Agent", "SimpleFlvParser")
-	for _, h := range header {
-		kv := strings.Split(h, ":")
-		name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(kv[0]))
-		value := strings.TrimSpace(kv[1])
+	for name, value := range headers {
+		name = textproto.CanonicalMIMEHeaderKey(name)
 		if name == "Host" {
 			req.Host = value
 		}
@@ -290,15 +672,12 @@ func doRequest(url string) (io.ReadCloser, error) {
 	client := makeClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("do request err: %v", err)
+		return nil, fmt.Errorf("do request err: %w", err)
 	}
 	dumpResponse(resp)
 	if resp.StatusCode != http.StatusOK {
 		_ = resp.Body.Close()
-		if isRedirect(resp.StatusCode) {
-			return nil, fmt.Errorf("do request err: status code=%d, use -L to follow location: %s", resp.StatusCode, resp.Header.Get("Location"))
-		}
-		return nil, fmt.Errorf("do request err: status code=%d", resp.StatusCode)
+		return nil, &statusError{code: resp.StatusCode, location: resp.Header.Get("Location")}
 	}
 	return resp.Body, nil
 }
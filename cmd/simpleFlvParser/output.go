@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/foolishCDN/AV-spy/formatter"
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+// Record types of JSON output.
+//
+// In ndjson format, every record is written as one line when it happens:
+//
+//	{"type": "<record type>", "data": {...}}
+//
+// In json format, one document is written at the end, so the records are kept in memory until then,
+// it's refused for a live url without --duration or --number:
+//
+//	{"header": {...}, "metadata": [...], "sequence_headers": [...], "packets": [...], "sei": [...], "warnings": [...], "summary": {...}}
+const (
+	recordHeader         = "header"          // probe.Header
+	recordMetaData       = "metadata"        // probe.MetaData
+	recordSequenceHeader = "sequence_header" // probe.SequenceHeader
+	recordPacket         = "packet"          // the variables of tag, see formatter.ElementName
+	recordSEI            = "sei"             // seiRecord
+	recordWarning        = "warning"         // warningRecord
+	recordSummary        = "summary"         // summaryRecord
+)
+
+type seiRecord struct {
+	PTS         uint32      `json:"pts"`
+	DTS         uint32      `json:"dts"`
+	PayloadType int         `json:"payload_type"`
+	PayloadSize int         `json:"payload_size"`
+	Payload     interface{} `json:"payload"` // hex string, string or array of byte by --sei_format
+}
+
+type warningRecord struct {
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+type summaryRecord struct {
+	RunningTimeMs int64                `json:"running_time_ms"`
+	Video         *probe.TrackSummary  `json:"video,omitempty"`
+	Audio         *probe.TrackSummary  `json:"audio,omitempty"`
+	Player        *probe.PlayerSummary `json:"player,omitempty"`
+	Startup       *summary.Startup     `json:"startup,omitempty"`
+	Reconnect     *reconnectSummary    `json:"reconnect,omitempty"`
+}
+
+type reconnectSummary struct {
+	Disconnections int                   `json:"disconnections"`
+	Reconnected    int                   `json:"reconnected"`
+	Attempts       int                   `json:"attempts"`
+	DowntimeMs     int64                 `json:"downtime_ms"`
+	MaxDowntimeMs  int64                 `json:"max_downtime_ms"`
+	BytesLost      int64                 `json:"bytes_lost"` // estimated by the average data rate before disconnection
+	Events         []disconnectionRecord `json:"events"`
+}
+
+type disconnectionRecord struct {
+	Time        time.Time        `json:"time"`
+	Reason      string           `json:"reason"`
+	Attempts    int              `json:"attempts"`
+	Reconnected bool             `json:"reconnected"`
+	DowntimeMs  int64            `json:"downtime_ms"`
+	BytesLost   int64            `json:"bytes_lost"`
+	Continuity  map[string]int64 `json:"continuity"` // the timestamp jump(ms) of every track after reconnect
+}
+
+func newReconnectSummary(s summary.ReconnectStats) *reconnectSummary {
+	r := &reconnectSummary{
+		Disconnections: s.Count,
+		Reconnected:    s.Reconnected,
+		Attempts:       s.Attempts,
+		DowntimeMs:     s.Downtime.Milliseconds(),
+		MaxDowntimeMs:  s.MaxDowntime.Milliseconds(),
+		BytesLost:      s.BytesLost,
+		Events:         []disconnectionRecord{},
+	}
+	for _, d := range s.Disconnections {
+		r.Events = append(r.Events, disconnectionRecord{
+			Time:        d.Time,
+			Reason:      d.Reason,
+			Attempts:    d.Attempts,
+			Reconnected: d.Reconnected,
+			DowntimeMs:  d.Downtime.Milliseconds(),
+			BytesLost:   d.BytesLost,
+			Continuity:  d.Continuity,
+		})
+	}
+	return r
+}
+
+type record struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type document struct {
+	Header          *probe.Header          `json:"header,omitempty"`
+	MetaData        []probe.MetaData       `json:"metadata"`
+	SequenceHeaders []probe.SequenceHeader `json:"sequence_headers"`
+	Packets         []interface{}          `json:"packets"`
+	SEI             []seiRecord            `json:"sei"`
+	Warnings        []warningRecord        `json:"warnings"`
+	Summary         *summaryRecord         `json:"summary,omitempty"`
+}
+
+// jsonOutput writes records as JSON lines, or collects them into one document.
+type jsonOutput struct {
+	mu      sync.Mutex
+	ndjson  bool
+	encoder *json.Encoder
+	doc     document
+}
+
+func newJSONOutput(w io.Writer, ndjson bool) *jsonOutput {
+	o := &jsonOutput{
+		ndjson:  ndjson,
+		encoder: json.NewEncoder(w),
+		doc: document{
+			MetaData:        []probe.MetaData{},
+			SequenceHeaders: []probe.SequenceHeader{},
+			Packets:         []interface{}{},
+			SEI:             []seiRecord{},
+			Warnings:        []warningRecord{},
+		},
+	}
+	if !ndjson {
+		o.encoder.SetIndent("", "  ")
+	}
+	return o
+}
+
+func (o *jsonOutput) emit(recordType string, data interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ndjson {
+		if err := o.encoder.Encode(record{Type: recordType, Data: data}); err != nil {
+			// don't log by logrus, it will be written to output again by warningHook
+			fmt.Fprintf(os.Stderr, "write %s record failed: %v\n", recordType, err)
+		}
+		return
+	}
+	switch d := data.(type) {
+	case probe.Header:
+		o.doc.Header = &d
+	case probe.MetaData:
+		o.doc.MetaData = append(o.doc.MetaData, d)
+	case probe.SequenceHeader:
+		o.doc.SequenceHeaders = append(o.doc.SequenceHeaders, d)
+	case seiRecord:
+		o.doc.SEI = append(o.doc.SEI, d)
+	case warningRecord:
+		o.doc.Warnings = append(o.doc.Warnings, d)
+	case summaryRecord:
+		o.doc.Summary = &d
+		if err := o.encoder.Encode(o.doc); err != nil {
+			fmt.Fprintf(os.Stderr, "write json document failed: %v\n", err)
+		}
+	default:
+		o.doc.Packets = append(o.doc.Packets, d)
+	}
+}
+
+// packetRecord converts the variables of tag to a JSON object, the keys are the same as the template elements,
+// NaN and ±Inf are written as null.
+func packetRecord(vars map[formatter.ElementName]interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(vars))
+	for k, v := range vars {
+		data[string(k)] = probe.FiniteValue(v)
+	}
+	return data
+}
+
+// seiPayload converts the payload of SEI by --sei_format.
+func seiPayload(payload []byte) interface{} {
+	switch seiFormat {
+	case seiFormatByte:
+		data := make([]int, len(payload))
+		for i, b := range payload {
+			data[i] = int(b)
+		}
+		return data
+	case seiFormatString:
+		return string(payload)
+	default:
+		return hex.EncodeToString(payload)
+	}
+}
+
+// warningHook writes the warnings and errors of logrus as warning records.
+// It's added to the standard logger by addWarningHook and must be removed by removeWarningHook,
+// otherwise the warnings are written to the output of a parser closed.
+type warningHook struct {
+	out *jsonOutput
+}
+
+func addWarningHook(out *jsonOutput) *warningHook {
+	h := &warningHook{out: out}
+	logrus.AddHook(h)
+	return h
+}
+
+func removeWarningHook(h *warningHook) {
+	logger := logrus.StandardLogger()
+	hooks := make(logrus.LevelHooks)
+	for level, levelHooks := range logger.Hooks {
+		for _, hook := range levelHooks {
+			if hook != logrus.Hook(h) {
+				hooks[level] = append(hooks[level], hook)
+			}
+		}
+	}
+	logger.ReplaceHooks(hooks)
+}
+
+func (h *warningHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (h *warningHook) Fire(entry *logrus.Entry) error {
+	w := warningRecord{
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+	if len(entry.Data) > 0 {
+		w.Fields = make(map[string]interface{}, len(entry.Data))
+		for k, v := range entry.Data {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			w.Fields[k] = probe.FiniteValue(v)
+		}
+	}
+	h.out.emit(recordWarning, w)
+	return nil
+}
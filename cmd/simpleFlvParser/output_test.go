@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+// recordShape is "<type>: <sorted keys of data>", the values change with the running time so they aren't pinned
+func recordShape(t *testing.T, line string) string {
+	var r struct {
+		Type string                     `json:"type"`
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		t.Fatalf("invalid record %q: %v", line, err)
+	}
+	keys := make([]string, 0, len(r.Data))
+	for k := range r.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return r.Type + ": " + strings.Join(keys, ",")
+}
+
+func TestNDJSONOutput(t *testing.T) {
+	defer func(packet, metaData, header, extraData bool) {
+		showPacket, showMetaData, showHeader, showExtraData = packet, metaData, header, extraData
+	}(showPacket, showMetaData, showHeader, showExtraData)
+	showPacket, showMetaData, showHeader, showExtraData = true, true, true, true
+
+	p, err := NewFlvParser(DefaultFormat, probe.Options{EventSink: summary.DiscardSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	p.out = newJSONOutput(&buf, true)
+	p.hook = addWarningHook(p.out)
+
+	data, err := os.ReadFile("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, p.Run(context.Background(), bytes.NewReader(data)))
+	logrus.WithField("offset", 100).Warn("previousTagSize mismatch")
+	p.Summary()
+	p.Close()
+	logrus.Warn("not written after Close")
+
+	var shapes []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		shape := recordShape(t, scanner.Text())
+		if !seen[shape] {
+			seen[shape] = true
+			shapes = append(shapes, shape)
+		}
+	}
+	assert.Equal(t, []string{
+		"header: data_offset,has_audio,has_video,version",
+		"metadata: timestamp,values",
+		"packet: arrival_ms,bitrate,byte_offset,delta_dts,dts,pts,size,stream_id,stream_type",
+		"sequence_header: config,fps,height,stream_type,timestamp,width",
+		"packet: arrival_ms,bitrate,byte_offset,codec_id,cts,delta_dts,dts,frame_type,keyframe,nalu_count,nalu_types,pts,sei_types,size,slice_types,stream_id,stream_type",
+		"packet: arrival_ms,bitrate,byte_offset,channels,cts,delta_dts,dts,keyframe,pts,sample_rate,size,sound_format,sound_size,stream_id,stream_type",
+		"warning: fields,level,message",
+		"summary: audio,running_time_ms,video",
+	}, shapes)
+	assert.NotContains(t, buf.String(), "not written after Close")
+}
+
+func TestFiniteOutput(t *testing.T) {
+	var buf bytes.Buffer
+	out := newJSONOutput(&buf, true)
+	out.emit(recordMetaData, probe.MetaData{Values: []interface{}{
+		"onMetaData",
+		map[string]interface{}{"framerate": math.NaN(), "duration": math.Inf(1), "width": 1280.0},
+	}})
+	out.emit(recordPacket, packetRecord(nil))
+	assert.Equal(t,
+		`{"type":"metadata","data":{"timestamp":0,"values":["onMetaData",{"duration":null,"framerate":null,"width":1280}]}}`+"\n"+
+			`{"type":"packet","data":{}}`+"\n",
+		buf.String())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+var (
+	reconnect         bool
+	reconnectAttempts int
+	reconnectDelay    int
+	reconnectMaxDelay int
+)
+
+func initReconnectFlags() {
+	rootCmd.Flags().BoolVar(
+		&reconnect,
+		"reconnect",
+		false,
+		"reconnect the url with backoff when the stream is disconnected, the counters are kept across sessions",
+	)
+	rootCmd.Flags().IntVar(
+		&reconnectAttempts,
+		"reconnect_attempts",
+		0,
+		"max reconnect attempts of a disconnection (no limit if attempts<=0)",
+	)
+	rootCmd.Flags().IntVar(
+		&reconnectDelay,
+		"reconnect_delay",
+		500,
+		"delay(ms) before the first reconnect attempt, it's doubled after every failed attempt",
+	)
+	rootCmd.Flags().IntVar(
+		&reconnectMaxDelay,
+		"reconnect_max_delay",
+		30000,
+		"max delay(ms) between reconnect attempts",
+	)
+}
+
+// reconnector reads a live stream from url, the url is requested again with backoff after disconnected
+type reconnector struct {
+	ctx        context.Context
+	url        string
+	reconnects *summary.Reconnects
+	backoff    summary.Backoff
+	attempts   int // max attempts of a disconnection, no limit if 0
+
+	body  io.ReadCloser
+	bytes int64     // bytes read in the session
+	start time.Time // start time of the session
+
+	down    bool // disconnected and no frame is read after reconnect yet
+	attempt int  // the reconnect attempts of the disconnection
+}
+
+func newReconnector(ctx context.Context, url string, body io.ReadCloser, reconnects *summary.Reconnects) *reconnector {
+	return &reconnector{
+		ctx:        ctx,
+		url:        url,
+		reconnects: reconnects,
+		backoff: summary.Backoff{
+			Initial: time.Duration(reconnectDelay) * time.Millisecond,
+			Max:     time.Duration(reconnectMaxDelay) * time.Millisecond,
+		},
+		attempts: reconnectAttempts,
+		body:     body,
+		start:    time.Now(),
+	}
+}
+
+func (c *reconnector) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+func (c *reconnector) Close() error {
+	return c.body.Close()
+}
+
+// reconnect records the disconnection by reason and requests the url until succeeded or the attempts are used up.
+// It goes on with the same disconnection if it's called again before a frame is read after reconnect,
+// e.g. the new session fails before the first frame.
+func (c *reconnector) reconnect(reason error) error {
+	if !c.down {
+		now := time.Now()
+		rate := 0.0
+		if elapsed := now.Sub(c.start).Seconds(); elapsed > 0 {
+			rate = float64(c.bytes) / elapsed
+		}
+		c.reconnects.Disconnect(reason, now, rate)
+		c.down, c.attempt = true, 0
+		c.backoff.Reset()
+	}
+	_ = c.body.Close()
+	for c.attempts <= 0 || c.attempt < c.attempts {
+		c.attempt++
+		attempt := c.attempt
+		delay := c.backoff.Next()
+		logrus.WithFields(logrus.Fields{"reason": reason, "attempt": attempt, "delay": delay}).Warn("disconnected, reconnect after delay")
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-time.After(delay):
+		}
+		c.reconnects.Attempt()
+		body, err := doRequest(c.ctx, c.url, nil)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"attempt": attempt, "error": err}).Warn("reconnect failed")
+			continue
+		}
+		c.body, c.bytes, c.start = body, 0, time.Now()
+		return nil
+	}
+	return fmt.Errorf("reconnect failed after %d attempts, disconnected by: %v", c.attempts, reason)
+}
+
+// onTag records the first frame after reconnect, the downtime of the disconnection ends at it.
+func (c *reconnector) onTag(tag flv.TagI) {
+	if !c.down || tag.Type() == flv.TagScript || flv.IsSequenceHeader(tag) {
+		return
+	}
+	c.down = false
+	c.reconnects.Reconnected(time.Now())
+}
+
+func printReconnects(s summary.ReconnectStats) {
+	if s.Count == 0 {
+		return
+	}
+	fmt.Println("  reconnect:")
+	fmt.Printf("    disconnections: %d, reconnected: %d, attempts: %d, downtime: %v, max downtime: %v, estimated bytes lost: %d\n",
+		s.Count, s.Reconnected, s.Attempts, s.Downtime, s.MaxDowntime, s.BytesLost)
+	for _, d := range s.Disconnections {
+		fmt.Printf("    %s: %s, attempts: %d, downtime: %v, bytes lost: %d, timestamp jump: video %d, audio %d\n",
+			d.Time.Format(time.RFC3339), d.Reason, d.Attempts, d.Downtime, d.BytesLost, d.Continuity["video"], d.Continuity["audio"])
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+func TestReconnect(t *testing.T) {
+	data, err := os.ReadFile("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			_, _ = w.Write(data[:len(data)/2]) // disconnected in the middle of a tag
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			_, _ = w.Write([]byte("not a FLV header")) // the new session fails before the first frame
+		case 4:
+			_, _ = w.Write(data)
+		default:
+			w.WriteHeader(http.StatusNotFound) // the stream is over
+		}
+	}))
+	defer server.Close()
+
+	reconnectDelay, reconnectMaxDelay, reconnectAttempts = 10, 20, 4
+	reconnects := new(summary.Reconnects)
+	p, err := NewFlvParser(DefaultFormat, probe.Options{EventSink: summary.MultiSink{summary.DiscardSink{}, reconnects}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.reconnects = reconnects
+	body, err := doRequest(context.Background(), server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.conn = newReconnector(context.Background(), server.URL, body, reconnects)
+	err = p.Run(context.Background(), p.conn)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "reconnect failed after 4 attempts, disconnected by: EOF", err.Error())
+	}
+
+	s := reconnects.Snapshot()
+	assert.Equal(t, 2, s.Count, "the failed session is a part of the same disconnection, the second one is the end of stream")
+	assert.Equal(t, 1, s.Reconnected)
+	assert.Equal(t, 3, s.Disconnections[0].Attempts, "the first attempt gets 503 and the second one gets an invalid FLV header")
+	assert.Equal(t, 7, s.Attempts)
+	assert.True(t, s.Disconnections[0].Downtime >= 30*time.Millisecond, "the delays are 10ms and 20ms at least")
+	assert.Equal(t, io.ErrUnexpectedEOF.Error(), s.Disconnections[0].Reason)
+	assert.True(t, s.BytesLost > 0)
+	// the stream restarts from the beginning after reconnect
+	assert.True(t, s.Disconnections[0].Continuity["video"] < 0)
+	v := p.videoCounter.Snapshot()
+	assert.Equal(t, 1, v.Resumes)
+	assert.Equal(t, int64(0), v.MaxRewind, "the jump after reconnect isn't a rewind")
+	assert.True(t, p.prober.Tags() > 946)
+	assert.Equal(t, int32(8), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	recorder "github.com/foolishCDN/AV-spy/record"
+)
+
+var (
+	recordStream   bool
+	recordDir      string
+	recordDuration int
+	recordSize     int
+	recordBuffer   int
+)
+
+func initRecordFlags() {
+	rootCmd.Flags().BoolVar(
+		&recordStream,
+		"record",
+		false,
+		"tee the stream to FLV files in --record_dir while it's parsed",
+	)
+	rootCmd.Flags().StringVar(
+		&recordDir,
+		"record_dir",
+		".",
+		"directory of the recorded files",
+	)
+	rootCmd.Flags().IntVar(
+		&recordDuration,
+		"record_duration",
+		0,
+		"rotate the recorded file on keyframe after duration(seconds) (no limit if 0)",
+	)
+	rootCmd.Flags().IntVar(
+		&recordSize,
+		"record_size",
+		0,
+		"rotate the recorded file on keyframe after size(MB) (no limit if 0)",
+	)
+	rootCmd.Flags().IntVar(
+		&recordBuffer,
+		"record_buffer",
+		0,
+		"keep the last duration(seconds) of stream and flush it to file on gap/rewind/hole (no buffer if 0)",
+	)
+}
+
+// newRecorder returns nil if neither --record nor --record_buffer is set
+func newRecorder() *recorder.Recorder {
+	if !recordStream && recordBuffer <= 0 {
+		return nil
+	}
+	r := recorder.New(recorder.Config{
+		Dir:         recordDir,
+		Prefix:      "simpleFlvParser",
+		MaxDuration: time.Duration(recordDuration) * time.Second,
+		MaxSize:     int64(recordSize) << 20,
+		Buffer:      time.Duration(recordBuffer) * time.Second,
+		OnFile: func(path string) {
+			logrus.Infof("record file %s", path)
+		},
+	})
+	if recordStream {
+		r.Start()
+	}
+	return r
+}
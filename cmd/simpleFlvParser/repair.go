@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+const (
+	// the frame durations used when a track jumps before the duration is known
+	defaultVideoDelta = 40
+	defaultAudioDelta = 23
+
+	// duplicateWindow is the number of recent tags to find exact duplicate tags
+	duplicateWindow = 64
+)
+
+var maxJump int64
+
+var repairCmd = &cobra.Command{
+	Use:   "repair [flags] <input file path> <output file path>",
+	Short: "Repair a broken FLV file and report every change",
+	Long: `Repair a broken FLV file and report every change:
+  skip the corrupted bytes and remove the truncated tail
+  rebase timestamps to zero and smooth rewinds/jumps into monotonic time
+  drop exact duplicate tags and repeated sequence headers
+  re-insert sequence headers before the first keyframe and drop the video frames before it
+  fix HasAudio/HasVideo of header by the tracks in file`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			_ = cmd.Usage()
+			return errors.New("please specify the input and output file paths")
+		}
+		if err := checkOutput(args[1], args[0]); err != nil {
+			return err
+		}
+		in, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("open file err: %v", err)
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		out, err := createOutputFile(args[1])
+		if err != nil {
+			return err
+		}
+		report, err := repairFLV(in, out, repairConfig{MaxJump: maxJump, MaxTagSize: maxTagSize})
+		if err := closeOutput(out, err); err != nil {
+			return err
+		}
+		report.Print(os.Stdout)
+		return nil
+	},
+}
+
+func initRepairFlags() {
+	repairCmd.Flags().Int64Var(
+		&maxJump,
+		"max_jump",
+		1000,
+		"a forward timestamp jump larger than ms is smoothed like a rewind",
+	)
+}
+
+type repairConfig struct {
+	MaxJump    int64  // ms, a forward jump larger than it is smoothed
+	MaxTagSize uint32 // see flv.Demuxer
+}
+
+type repairChange struct {
+	Offset  int64 // byte offset in the input file, -1 if it's about the whole file
+	Message string
+}
+
+type repairReport struct {
+	Read    int
+	Written int
+	Changes []repairChange
+}
+
+func (report *repairReport) add(offset int64, format string, args ...interface{}) {
+	report.Changes = append(report.Changes, repairChange{Offset: offset, Message: fmt.Sprintf(format, args...)})
+}
+
+func (report *repairReport) Print(w io.Writer) {
+	for _, change := range report.Changes {
+		if change.Offset < 0 {
+			fmt.Fprintf(w, "%s\n", change.Message)
+			continue
+		}
+		fmt.Fprintf(w, "offset %d: %s\n", change.Offset, change.Message)
+	}
+	fmt.Fprintf(w, "tags read: %d, written: %d, changes: %d\n", report.Read, report.Written, len(report.Changes))
+}
+
+// readTags reads the tags with resync, onSkip is called with the skipped byte range, tail is true if it's the truncated tail.
+func readTags(r io.Reader, maxTagSize uint32, onHeader func(*flv.Header) error, onTag func(tag flv.TagI, offset int64) error, onSkip func(start, end int64, tail bool, reason error)) error {
+	demuxer := &flv.Demuxer{Resync: true, MaxTagSize: maxTagSize}
+	header, err := demuxer.ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if err := onHeader(header); err != nil {
+		return err
+	}
+	end := int64(9 + 4) // end of the last tag
+	for {
+		tag, err := demuxer.ReadTag(r)
+		var sizeErr *flv.PreviousTagSizeError
+		var resyncErr *flv.ResyncError
+		if errors.As(err, &sizeErr) {
+			tag, err = sizeErr.Tag, nil
+		} else if errors.As(err, &resyncErr) {
+			onSkip(resyncErr.Start, resyncErr.End, resyncErr.Tag == nil, resyncErr.Reason)
+			if resyncErr.Tag == nil {
+				continue
+			}
+			tag, err = resyncErr.Tag, nil
+		}
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == io.ErrUnexpectedEOF:
+			onSkip(end, -1, true, err)
+			return nil
+		case err != nil:
+			return err
+		}
+		end = demuxer.TagOffset() + int64(11+len(tag.Data())+4)
+		if err := onTag(tag, demuxer.TagOffset()); err != nil {
+			return err
+		}
+	}
+}
+
+// repairScan is the result of the first pass
+type repairScan struct {
+	hasAudio    bool
+	hasVideo    bool
+	base        int64 // timestamp of the first audio/video tag
+	baseFound   bool
+	videoHeader *flv.VideoTag
+	audioHeader *flv.AudioTag
+}
+
+func scanForRepair(r io.Reader, maxTagSize uint32) (*repairScan, error) {
+	scan := new(repairScan)
+	err := readTags(r, maxTagSize, func(*flv.Header) error {
+		return nil
+	}, func(tag flv.TagI, _ int64) error {
+		switch t := tag.(type) {
+		case *flv.VideoTag:
+			scan.hasVideo = true
+			if flv.IsSequenceHeader(t) && scan.videoHeader == nil {
+				scan.videoHeader = t
+				return nil
+			}
+		case *flv.AudioTag:
+			scan.hasAudio = true
+			if flv.IsSequenceHeader(t) && scan.audioHeader == nil {
+				scan.audioHeader = t
+				return nil
+			}
+		default:
+			return nil
+		}
+		if !scan.baseFound {
+			scan.base, scan.baseFound = int64(tag.Timestamp()), true
+		}
+		return nil
+	}, func(int64, int64, bool, error) {})
+	return scan, err
+}
+
+// repairTrack makes the timestamps of a track start from zero and monotonic
+type repairTrack struct {
+	started      bool
+	lastIn       int64
+	lastOut      int64
+	shift        int64 // out = in + shift
+	delta        int64 // the last normal delta
+	defaultDelta int64
+}
+
+// next returns the output timestamp, jumped is true if the input timestamp rewinds or jumps.
+func (track *repairTrack) next(in, base, maxJump int64) (out int64, jumped bool) {
+	if !track.started {
+		track.started = true
+		track.shift = -base
+		if in+track.shift < 0 {
+			track.shift = -in
+		}
+	} else if delta := in - track.lastIn; delta < 0 || delta > maxJump {
+		jumped = true
+		step := track.delta
+		if step <= 0 {
+			step = track.defaultDelta
+		}
+		track.shift = track.lastOut + step - in
+	} else if delta > 0 {
+		track.delta = delta
+	}
+	out = in + track.shift
+	track.lastIn, track.lastOut = in, out
+	return out, jumped
+}
+
+// current returns the output timestamp for the tags not counted in track, e.g. sequence headers
+func (track *repairTrack) current(in, base int64) int64 {
+	if track.started {
+		return track.lastOut
+	}
+	if in-base < 0 {
+		return 0
+	}
+	return in - base
+}
+
+type duplicateKey struct {
+	tagType   flv.TagType
+	timestamp uint32
+	hash      [sha1.Size]byte
+}
+
+type repairer struct {
+	config repairConfig
+	scan   *repairScan
+	report *repairReport
+	muxer  *flv.Muxer
+	w      io.Writer
+
+	video repairTrack
+	audio repairTrack
+
+	videoHeader   []byte // the video sequence header written
+	audioHeader   []byte
+	seenKeyFrame  bool
+	droppedFrames int
+
+	recent     []duplicateKey
+	recentKeys map[duplicateKey]int
+}
+
+// repairFLV reads r twice: the first pass finds the tracks, the first timestamp and sequence headers,
+// the second pass writes the repaired tags to w.
+func repairFLV(r io.ReadSeeker, w io.Writer, config repairConfig) (*repairReport, error) {
+	scan, err := scanForRepair(r, config.MaxTagSize)
+	if err != nil {
+		return nil, err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	p := &repairer{
+		config:     config,
+		scan:       scan,
+		report:     new(repairReport),
+		muxer:      new(flv.Muxer),
+		w:          w,
+		video:      repairTrack{defaultDelta: defaultVideoDelta},
+		audio:      repairTrack{defaultDelta: defaultAudioDelta},
+		recentKeys: make(map[duplicateKey]int),
+	}
+	if scan.base != 0 {
+		p.report.add(-1, "rebase timestamps by %d", -scan.base)
+	}
+	err = readTags(r, config.MaxTagSize, p.onHeader, func(tag flv.TagI, offset int64) error {
+		p.report.Read++
+		return p.onTag(tag, offset)
+	}, func(start, end int64, tail bool, reason error) {
+		if end < 0 {
+			end = size
+		}
+		if tail {
+			p.report.add(start, "remove truncated tail of %d bytes: %v", end-start, reason)
+			return
+		}
+		p.report.add(start, "skip %d corrupted bytes: %v", end-start, reason)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.droppedFrames > 0 {
+		p.report.add(-1, "drop %d video frames before the first keyframe", p.droppedFrames)
+	}
+	return p.report, nil
+}
+
+func (p *repairer) onHeader(header *flv.Header) error {
+	if header.HasAudio != p.scan.hasAudio {
+		p.report.add(-1, "header: HasAudio %v -> %v", header.HasAudio, p.scan.hasAudio)
+	}
+	if header.HasVideo != p.scan.hasVideo {
+		p.report.add(-1, "header: HasVideo %v -> %v", header.HasVideo, p.scan.hasVideo)
+	}
+	return p.muxer.WriteHeader(p.w, p.scan.hasAudio, p.scan.hasVideo)
+}
+
+func (p *repairer) write(tag flv.TagI) error {
+	p.report.Written++
+	return p.muxer.WriteTag(p.w, tag)
+}
+
+// isDuplicate returns true if the same tag is in the recent tags
+func (p *repairer) isDuplicate(tag flv.TagI) bool {
+	key := duplicateKey{tagType: tag.Type(), timestamp: tag.Timestamp(), hash: sha1.Sum(tag.Data())}
+	if p.recentKeys[key] > 0 {
+		return true
+	}
+	p.recent = append(p.recent, key)
+	p.recentKeys[key]++
+	if len(p.recent) > duplicateWindow {
+		old := p.recent[0]
+		p.recent = p.recent[1:]
+		if p.recentKeys[old]--; p.recentKeys[old] == 0 {
+			delete(p.recentKeys, old)
+		}
+	}
+	return false
+}
+
+func (p *repairer) onTag(tag flv.TagI, offset int64) error {
+	if p.isDuplicate(tag) {
+		p.report.add(offset, "drop duplicate %s tag at timestamp %d", tag.Type(), tag.Timestamp())
+		return nil
+	}
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		return p.onVideo(t, offset)
+	case *flv.AudioTag:
+		return p.onAudio(t, offset)
+	case *flv.ScriptTag:
+		script := *t
+		script.PTS = uint32(p.video.current(int64(t.PTS), p.scan.base))
+		return p.write(&script)
+	}
+	return nil
+}
+
+func (p *repairer) onVideo(t *flv.VideoTag, offset int64) error {
+	video := *t
+	if flv.IsSequenceHeader(t) {
+		if bytes.Equal(p.videoHeader, t.Bytes) {
+			p.report.add(offset, "drop repeated video sequence header at timestamp %d", t.DTS)
+			return nil
+		}
+		p.videoHeader = t.Bytes
+		video.DTS = uint32(p.video.current(int64(t.DTS), p.scan.base))
+		video.PTS = video.DTS
+		return p.write(&video)
+	}
+	if !p.seenKeyFrame {
+		if t.FrameType != flv.KeyFrame {
+			p.droppedFrames++
+			return nil
+		}
+		p.seenKeyFrame = true
+	}
+	lastIn, lastOut := p.video.lastIn, p.video.lastOut
+	dts, jumped := p.video.next(int64(t.DTS), p.scan.base, p.config.MaxJump)
+	if jumped {
+		p.report.add(offset, "video timestamp %d -> %d after %d, shift to %d", lastIn, t.DTS, lastOut, dts)
+	}
+	video.DTS = uint32(dts)
+	video.PTS = uint32(dts + int64(int32(t.PTS-t.DTS)))
+	if (t.CodecID == flv.H264 || t.CodecID == flv.H265) && t.PacketType == flv.AVPacket && p.videoHeader == nil && p.scan.videoHeader != nil {
+		header := *p.scan.videoHeader
+		header.DTS, header.PTS = video.DTS, video.DTS
+		p.videoHeader = header.Bytes
+		p.report.add(offset, "insert video sequence header before the first keyframe")
+		if err := p.write(&header); err != nil {
+			return err
+		}
+	}
+	return p.write(&video)
+}
+
+func (p *repairer) onAudio(t *flv.AudioTag, offset int64) error {
+	audio := *t
+	if flv.IsSequenceHeader(t) {
+		if bytes.Equal(p.audioHeader, t.Bytes) {
+			p.report.add(offset, "drop repeated audio sequence header at timestamp %d", t.PTS)
+			return nil
+		}
+		p.audioHeader = t.Bytes
+		audio.PTS = uint32(p.audio.current(int64(t.PTS), p.scan.base))
+		return p.write(&audio)
+	}
+	lastIn, lastOut := p.audio.lastIn, p.audio.lastOut
+	pts, jumped := p.audio.next(int64(t.PTS), p.scan.base, p.config.MaxJump)
+	if jumped {
+		p.report.add(offset, "audio timestamp %d -> %d after %d, shift to %d", lastIn, t.PTS, lastOut, pts)
+	}
+	audio.PTS = uint32(pts)
+	if t.SoundFormat == flv.AAC && p.audioHeader == nil && p.scan.audioHeader != nil {
+		header := *p.scan.audioHeader
+		header.PTS = audio.PTS
+		p.audioHeader = header.Bytes
+		p.report.add(offset, "insert audio sequence header before the first frame")
+		if err := p.write(&header); err != nil {
+			return err
+		}
+	}
+	return p.write(&audio)
+}
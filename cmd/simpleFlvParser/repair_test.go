@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+func readAllTags(t *testing.T, r io.Reader) []flv.TagI {
+	demuxer := new(flv.Demuxer)
+	if _, err := demuxer.ReadHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	var tags []flv.TagI
+	for {
+		tag, err := demuxer.ReadTag(r)
+		if err == io.EOF {
+			return tags
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	f, err := os.Open("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := readAllTags(t, f)
+	_ = f.Close()
+
+	// the broken file starts at 100s, the video sequence header is after the first keyframe,
+	// a tag is duplicated, timestamps rewind by 5s at the 60th tag and the last tag is truncated
+	var videoHeader flv.TagI
+	var broken []flv.TagI
+	for i, tag := range tags {
+		shift := uint32(100000)
+		if i >= 60 {
+			shift -= 5000
+		}
+		switch v := tag.(type) {
+		case *flv.VideoTag:
+			video := *v
+			video.DTS += shift
+			video.PTS += shift
+			if video.PacketType == flv.SequenceHeader && videoHeader == nil {
+				videoHeader = &video
+				continue
+			}
+			tag = &video
+		case *flv.AudioTag:
+			audio := *v
+			audio.PTS += shift
+			tag = &audio
+		}
+		broken = append(broken, tag)
+		if i == 30 {
+			broken = append(broken, tag)
+		}
+		if videoHeader != nil && len(broken) == 20 {
+			broken = append(broken, videoHeader)
+		}
+	}
+	var buf bytes.Buffer
+	muxer := new(flv.Muxer)
+	if err := muxer.WriteHeader(&buf, true, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range broken {
+		if err := muxer.WriteTag(&buf, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := buf.Bytes()[:buf.Len()-7]
+
+	var output bytes.Buffer
+	report, err := repairFLV(bytes.NewReader(input), &output, repairConfig{MaxJump: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text strings.Builder
+	report.Print(&text)
+	assert.Contains(t, text.String(), "rebase timestamps by -100000")
+	assert.Contains(t, text.String(), "drop duplicate")
+	assert.Contains(t, text.String(), "insert video sequence header before the first keyframe")
+	assert.Contains(t, text.String(), "remove truncated tail")
+	assert.Contains(t, text.String(), "video timestamp 100888 -> 95929")
+	assert.Equal(t, len(broken)-1, report.Read)
+
+	repaired := readAllTags(t, &output)
+	assert.Equal(t, report.Written, len(repaired))
+	last := map[flv.TagType]uint32{}
+	seenHeader := false
+	for _, tag := range repaired {
+		assert.True(t, tag.Timestamp() >= last[tag.Type()], "timestamps should be monotonic")
+		last[tag.Type()] = tag.Timestamp()
+		if video, ok := tag.(*flv.VideoTag); ok && !seenHeader {
+			assert.Equal(t, byte(flv.SequenceHeader), video.PacketType)
+			seenHeader = true
+		}
+	}
+	assert.True(t, last[flv.TagVideo] < 100000)
+}
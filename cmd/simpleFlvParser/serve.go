@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/probe"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+var (
+	serveAddr            string
+	maxProbes            int
+	maxQueuedProbes      int
+	defaultProbeDuration int
+	maxProbeDuration     int
+	keepProbes           int
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve [flags]",
+	Short: "Serve the probes of streams over a HTTP API",
+	Long: `Serve the probes of streams over a HTTP API:
+
+  POST   /probes              start a probe, the body is {"url": ..., "duration_ms": ..., "headers": {...}, "hint_gap": ..., "hint_hole_ms": ..., "disable_rules": [...], "max_tag_size": ...}
+  GET    /probes              list the probes
+  GET    /probes/<id>         get the status of probe
+  GET    /probes/<id>/report  get the report of a finished probe
+  DELETE /probes/<id>         cancel the probe
+
+At most --max_probes probes run at the same time, the others are queued.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		s := newProbeServer(ctx, probeServerConfig{
+			MaxProbes:       maxProbes,
+			MaxQueued:       maxQueuedProbes,
+			DefaultDuration: time.Duration(defaultProbeDuration) * time.Second,
+			MaxDuration:     time.Duration(maxProbeDuration) * time.Second,
+			Keep:            keepProbes,
+		})
+		server := &http.Server{Addr: serveAddr, Handler: s}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = server.Shutdown(shutdownCtx)
+		}()
+		logrus.Infof("serve probes on %s", serveAddr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	},
+}
+
+func initServeFlags() {
+	serveCmd.Flags().StringVar(
+		&serveAddr,
+		"listen",
+		":8080",
+		"address to listen",
+	)
+	serveCmd.Flags().IntVar(
+		&maxProbes,
+		"max_probes",
+		4,
+		"max probes running at the same time",
+	)
+	serveCmd.Flags().IntVar(
+		&maxQueuedProbes,
+		"max_queued_probes",
+		100,
+		"max probes waiting to run, a new probe is rejected with 429 if the queue is full",
+	)
+	serveCmd.Flags().IntVar(
+		&defaultProbeDuration,
+		"default_duration",
+		10,
+		"duration(seconds) of a probe if it's not specified",
+	)
+	serveCmd.Flags().IntVar(
+		&maxProbeDuration,
+		"max_duration",
+		60,
+		"max duration(seconds) of a probe",
+	)
+	serveCmd.Flags().IntVar(
+		&keepProbes,
+		"keep_probes",
+		100,
+		"number of finished probes kept for query, the oldest one is removed first",
+	)
+}
+
+// probeOptions are the options of a probe in the request body
+type probeOptions struct {
+	URL          string            `json:"url"`
+	DurationMs   int64             `json:"duration_ms,omitempty"` // stop after the duration, the server decides if 0
+	Headers      map[string]string `json:"headers,omitempty"`
+	HintGap      int               `json:"hint_gap,omitempty"`
+	HintHoleMs   int               `json:"hint_hole_ms,omitempty"`
+	DisableRules []string          `json:"disable_rules,omitempty"`
+	MaxTagSize   uint32            `json:"max_tag_size,omitempty"`
+}
+
+// newProber returns the prober of options, the stream is requested by client like the root command
+func (o probeOptions) newProber(client *http.Client) (*probe.Prober, error) {
+	headers := map[string]string{"User-Agent": "SimpleFlvParser"}
+	for name, value := range o.Headers {
+		headers[name] = value
+	}
+	options := probe.DefaultOptions()
+	options.Headers, options.Client = headers, client
+	options.MaxTagSize = o.MaxTagSize
+	options.HintGap = o.HintGap
+	options.HintHole = time.Duration(o.HintHoleMs) * time.Millisecond
+	options.Validate.Disabled = o.DisableRules
+	options.EventSink = summary.DiscardSink{}
+	return probe.New(options)
+}
+
+type probeState string
+
+const (
+	probeQueued   probeState = "queued"
+	probeRunning  probeState = "running"
+	probeDone     probeState = "done"
+	probeFailed   probeState = "failed"
+	probeCanceled probeState = "canceled"
+)
+
+// probeJob is a probe submitted to probeServer
+type probeJob struct {
+	id      string
+	options probeOptions
+	prober  *probe.Prober
+	cancel  context.CancelFunc
+	created time.Time
+
+	// protected by probeServer.mu
+	state    probeState
+	started  time.Time
+	finished time.Time
+	report   *probe.Report
+}
+
+type probeStatus struct {
+	ID         string       `json:"id"`
+	URL        string       `json:"url"`
+	State      probeState   `json:"state"`
+	DurationMs int64        `json:"duration_ms"`
+	Tags       int64        `json:"tags"`
+	Error      string       `json:"error,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	StartedAt  *time.Time   `json:"started_at,omitempty"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Report     string       `json:"report,omitempty"` // the path of report if finished
+	Options    probeOptions `json:"options"`
+}
+
+type probeServerConfig struct {
+	MaxProbes       int
+	MaxQueued       int
+	DefaultDuration time.Duration
+	MaxDuration     time.Duration
+	Keep            int
+}
+
+// probeServer runs the probes submitted by HTTP API, the probes are canceled when ctx is done.
+type probeServer struct {
+	ctx    context.Context
+	config probeServerConfig
+	slots  chan struct{} // a probe runs after it gets a slot
+	client *http.Client  // shared by the probes to reuse the connections
+
+	mu       sync.Mutex
+	jobs     map[string]*probeJob
+	order    []string // ids in the order of creation
+	nextID   int
+	queued   int
+	finished []string // ids of finished jobs, the oldest first
+}
+
+func newProbeServer(ctx context.Context, config probeServerConfig) *probeServer {
+	if config.MaxProbes <= 0 {
+		config.MaxProbes = 1
+	}
+	return &probeServer{
+		ctx:    ctx,
+		config: config,
+		slots:  make(chan struct{}, config.MaxProbes),
+		client: makeClient(),
+		jobs:   make(map[string]*probeJob),
+	}
+}
+
+func (s *probeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "probes" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.create(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.list(w)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.get(w, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		s.delete(w, parts[1])
+	case len(parts) == 3 && parts[2] == "report" && r.Method == http.MethodGet:
+		s.getReport(w, parts[1])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *probeServer) create(w http.ResponseWriter, r *http.Request) {
+	var options probeOptions
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("decode options err: %v", err))
+		return
+	}
+	if !isValidURL(options.URL) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid url %q", options.URL))
+		return
+	}
+	duration := time.Duration(options.DurationMs) * time.Millisecond
+	if duration <= 0 {
+		duration = s.config.DefaultDuration
+	}
+	if s.config.MaxDuration > 0 && duration > s.config.MaxDuration {
+		duration = s.config.MaxDuration
+	}
+	options.DurationMs = duration.Milliseconds()
+	p, err := options.newProber(s.client)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	if s.config.MaxQueued > 0 && s.queued >= s.config.MaxQueued {
+		s.mu.Unlock()
+		writeError(w, http.StatusTooManyRequests, "too many probes queued")
+		return
+	}
+	s.nextID++
+	ctx, cancel := context.WithCancel(s.ctx)
+	job := &probeJob{
+		id:      strconv.Itoa(s.nextID),
+		options: options,
+		prober:  p,
+		cancel:  cancel,
+		created: time.Now(),
+		state:   probeQueued,
+	}
+	s.jobs[job.id] = job
+	s.order = append(s.order, job.id)
+	s.queued++
+	status := s.status(job)
+	s.mu.Unlock()
+
+	go s.run(ctx, job, duration)
+	w.Header().Set("Location", "/probes/"+job.id)
+	writeJSONResponse(w, http.StatusAccepted, status)
+}
+
+// run waits for a slot and runs the probe for duration
+func (s *probeServer) run(ctx context.Context, job *probeJob, duration time.Duration) {
+	defer job.cancel()
+	select {
+	case s.slots <- struct{}{}:
+		defer func() {
+			<-s.slots
+		}()
+	case <-ctx.Done():
+		s.finish(job, probeCanceled, nil)
+		return
+	}
+	s.mu.Lock()
+	s.queued--
+	job.state, job.started = probeRunning, time.Now()
+	s.mu.Unlock()
+
+	runCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	report, _ := job.prober.Probe(runCtx, job.options.URL)
+	state := probeDone
+	switch {
+	case ctx.Err() != nil:
+		state = probeCanceled
+	case report.Error != "":
+		state = probeFailed
+	}
+	s.finish(job, state, report)
+}
+
+func (s *probeServer) finish(job *probeJob, state probeState, report *probe.Report) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job.state == probeQueued {
+		s.queued--
+	}
+	job.state, job.finished, job.report = state, time.Now(), report
+	s.finished = append(s.finished, job.id)
+	for s.config.Keep > 0 && len(s.finished) > s.config.Keep {
+		id := s.finished[0]
+		s.finished = s.finished[1:]
+		delete(s.jobs, id)
+		for i, v := range s.order {
+			if v == id {
+				s.order = append(s.order[:i], s.order[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// status returns the status of job with s.mu held
+func (s *probeServer) status(job *probeJob) probeStatus {
+	status := probeStatus{
+		ID:        job.id,
+		URL:       job.options.URL,
+		State:     job.state,
+		Tags:      job.prober.Tags(),
+		CreatedAt: job.created,
+		Options:   job.options,
+	}
+	if !job.started.IsZero() {
+		started := job.started
+		status.StartedAt = &started
+		status.DurationMs = time.Since(started).Milliseconds()
+	}
+	if !job.finished.IsZero() {
+		finished := job.finished
+		status.FinishedAt = &finished
+	}
+	if job.report != nil {
+		status.DurationMs = job.report.DurationMs
+		status.Error = job.report.Error
+		status.Report = "/probes/" + job.id + "/report"
+	}
+	return status
+}
+
+func (s *probeServer) list(w http.ResponseWriter) {
+	s.mu.Lock()
+	statuses := make([]probeStatus, 0, len(s.order))
+	for _, id := range s.order {
+		statuses = append(statuses, s.status(s.jobs[id]))
+	}
+	s.mu.Unlock()
+	writeJSONResponse(w, http.StatusOK, statuses)
+}
+
+func (s *probeServer) get(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	var status probeStatus
+	if ok {
+		status = s.status(job)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("probe %s not found", id))
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, status)
+}
+
+func (s *probeServer) getReport(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	var report *probe.Report
+	var state probeState
+	if ok {
+		report, state = job.report, job.state
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("probe %s not found", id))
+	case report == nil:
+		writeError(w, http.StatusConflict, fmt.Sprintf("probe %s is %s", id, state))
+	default:
+		writeJSONResponse(w, http.StatusOK, report)
+	}
+}
+
+func (s *probeServer) delete(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("probe %s not found", id))
+		return
+	}
+	job.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSONResponse writes v with code, v is encoded before the status is written,
+// so it's 500 instead if v can't be encoded.
+func writeJSONResponse(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logrus.WithField("error", err).Error("encode response failed")
+		code = http.StatusInternalServerError
+		data, _ = json.Marshal(map[string]string{"error": fmt.Sprintf("encode response err: %v", err)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		logrus.WithField("error", err).Error("write response failed")
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSONResponse(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/probe"
+)
+
+func postProbe(t *testing.T, url string, options probeOptions) probeStatus {
+	body, _ := json.Marshal(options)
+	resp, err := http.Post(url+"/probes", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var status probeStatus
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	return status
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+	return resp.StatusCode
+}
+
+func waitProbe(t *testing.T, url string, id string, state probeState) probeStatus {
+	var status probeStatus
+	for i := 0; i < 100; i++ {
+		getJSON(t, url+"/probes/"+id, &status)
+		if status.State == state {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("probe %s is %s, expect %s", id, status.State, state)
+	return status
+}
+
+func TestServe(t *testing.T) {
+	data, err := os.ReadFile("../../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/live.flv" {
+			_, _ = w.Write(data[:13]) // only the header, then hangs up
+			w.(http.Flusher).Flush()
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		assert.Equal(t, "token", r.Header.Get("X-Token"))
+		_, _ = w.Write(data)
+	}))
+	defer upstream.Close()
+	defer close(block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(newProbeServer(ctx, probeServerConfig{
+		MaxProbes:       1,
+		DefaultDuration: 10 * time.Second,
+		MaxDuration:     20 * time.Second,
+		Keep:            10,
+	}))
+	defer server.Close()
+
+	// the live probe holds the only slot, so the file probe is queued until it's canceled
+	live := postProbe(t, server.URL, probeOptions{URL: upstream.URL + "/live.flv"})
+	waitProbe(t, server.URL, live.ID, probeRunning)
+	file := postProbe(t, server.URL, probeOptions{
+		URL:        upstream.URL + "/test.flv",
+		DurationMs: 60000,
+		Headers:    map[string]string{"X-Token": "token"},
+	})
+	assert.Equal(t, probeQueued, file.State)
+	assert.Equal(t, int64(20000), file.Options.DurationMs, "the duration is limited by MaxDuration")
+
+	var e map[string]string
+	assert.Equal(t, http.StatusConflict, getJSON(t, server.URL+"/probes/"+live.ID+"/report", &e))
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/probes/"+live.ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	status := waitProbe(t, server.URL, live.ID, probeCanceled)
+	assert.Empty(t, status.Error)
+
+	status = waitProbe(t, server.URL, file.ID, probeDone)
+	assert.True(t, status.Tags > 900, status.Tags)
+	var report probe.Report
+	assert.Equal(t, http.StatusOK, getJSON(t, server.URL+status.Report, &report))
+	assert.Empty(t, report.Error)
+	assert.NotNil(t, report.Header)
+	assert.NotEmpty(t, report.MetaData)
+	assert.Len(t, report.SequenceHeaders, 1)
+	assert.Equal(t, "AVC", report.SequenceHeaders[0].StreamType)
+	if assert.NotNil(t, report.GOP) {
+		assert.True(t, report.GOP.Count > 0)
+	}
+	if assert.NotNil(t, report.Video) {
+		assert.Equal(t, "avc", report.Video.Codec)
+		assert.True(t, report.Video.Count > 0)
+	}
+	assert.NotNil(t, report.Audio)
+	assert.NotNil(t, report.Validation)
+
+	var statuses []probeStatus
+	assert.Equal(t, http.StatusOK, getJSON(t, server.URL+"/probes", &statuses))
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, http.StatusNotFound, getJSON(t, server.URL+"/probes/100", &e))
+	resp, err = http.Post(server.URL+"/probes", "application/json", bytes.NewReader([]byte(`{"url": "test.flv"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWriteJSONResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSONResponse(w, http.StatusOK, map[string]int{"tags": 1})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{\n  \"tags\": 1\n}\n", w.Body.String())
+
+	// the status isn't written before the value is encoded
+	w = httptest.NewRecorder()
+	writeJSONResponse(w, http.StatusOK, map[string]float64{"fps": math.NaN()})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var body map[string]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Contains(t, body["error"], "encode response err")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate <arrival log>",
+	Short: "Replay an arrival log recorded by --arrival_log with a simulated player",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			_ = cmd.Usage()
+			return errors.New("please specify a file path of arrival log")
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("open file err: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		arrivals, err := summary.ReadArrivals(f)
+		if err != nil {
+			return err
+		}
+		if len(arrivals) == 0 {
+			return errors.New("arrival log is empty")
+		}
+
+		// the arrival log records the time relative to the request
+		base := time.Unix(0, 0)
+		player := summary.NewPlayer(playerConfig())
+		player.Start(base)
+		for _, arrival := range arrivals {
+			player.FeedTrack(base.Add(arrival.Time), arrival.Track, arrival.Timestamp)
+		}
+		player.Finish(base.Add(arrivals[len(arrivals)-1].Time))
+
+		fmt.Println("\nSummary:")
+		fmt.Printf("  Running time: %v\n", arrivals[len(arrivals)-1].Time)
+		printPlayer(player)
+		return nil
+	},
+}
+
+func printPlayer(player *summary.Player) {
+	if player == nil {
+		return
+	}
+	if !player.Started() {
+		fmt.Printf("  Simulated player: not started, buffered: %v\n", player.Latency())
+		return
+	}
+	fmt.Printf("  Simulated player: time to first frame: %v, stall: %d, stall duration: %v, latency: %v\n",
+		player.TimeToFirstFrame, player.Stalls, player.StallDuration, player.Latency())
+}
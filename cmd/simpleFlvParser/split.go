@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+var (
+	segmentDuration int
+	segmentSize     int
+)
+
+var splitCmd = &cobra.Command{
+	Use:   "split [flags] <input file path> <output file pattern>",
+	Short: "Split a FLV file into N-second or N-MB files on keyframe boundaries",
+	Long: `Split a FLV file into N-second or N-MB files on keyframe boundaries,
+a file ends before the first keyframe after it reaches --segment_duration or --segment_size,
+every file starts with the active sequence headers.
+The output pattern is a format of the segment number like out_%03d.flv, _%03d is added before the extension if there isn't a verb.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			_ = cmd.Usage()
+			return errors.New("please specify the input file path and output file pattern")
+		}
+		if segmentDuration <= 0 && segmentSize <= 0 {
+			return errors.New("please specify --segment_duration or --segment_size")
+		}
+		in, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("open file err: %v", err)
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		return splitFLV(in, segmentPattern(args[1]), int64(segmentDuration)*1000, int64(segmentSize)<<20, func(w *flvWriter) {
+			w.Print(os.Stdout)
+		})
+	},
+}
+
+func initSplitFlags() {
+	splitCmd.Flags().IntVar(
+		&segmentDuration,
+		"segment_duration",
+		0,
+		"duration(seconds) of every file",
+	)
+	splitCmd.Flags().IntVar(
+		&segmentSize,
+		"segment_size",
+		0,
+		"size(MB) of every file",
+	)
+	splitCmd.Flags().BoolVar(
+		&keepTimestamps,
+		"keep_timestamps",
+		false,
+		"keep the original timestamps instead of starting every file from zero",
+	)
+}
+
+// segmentPattern adds _%03d before the extension if pattern has no verb
+func segmentPattern(pattern string) string {
+	if strings.Contains(pattern, "%") {
+		return pattern
+	}
+	ext := filepath.Ext(pattern)
+	return strings.TrimSuffix(pattern, ext) + "_%03d" + ext
+}
+
+// splitFLV writes the tags of in to files named by pattern, a file ends before the first keyframe after it reaches
+// duration(ms) or size(bytes), onClose is called with every file written.
+func splitFLV(in *os.File, pattern string, duration, size int64, onClose func(w *flvWriter)) error {
+	demuxer := &flv.Demuxer{MaxTagSize: maxTagSize}
+	header, err := demuxer.ReadHeader(in)
+	if err != nil {
+		return err
+	}
+	var w *flvWriter
+	var held []flv.TagI // the tags before the first audio/video frame
+	headers := make(map[flv.TagType]flv.TagI)
+	closeSegment := func(err error) error {
+		if w == nil {
+			return err
+		}
+		if err := w.Close(err); err != nil {
+			return err
+		}
+		onClose(w)
+		return nil
+	}
+	openSegment := func(tag flv.TagI) error {
+		number, vars := 0, flv.NewStreamVars()
+		if w != nil {
+			number, vars = w.number+1, w.vars
+		}
+		path := fmt.Sprintf(pattern, number)
+		if err := checkOutput(path, in.Name()); err != nil {
+			return err
+		}
+		if err := closeSegment(nil); err != nil {
+			return err
+		}
+		if w, err = createFLVWriter(path, header.HasAudio, header.HasVideo); err != nil {
+			return err
+		}
+		w.number, w.vars = number, vars
+		if !keepTimestamps {
+			w.shift = -int64(tag.Timestamp())
+		}
+		for _, tagType := range []flv.TagType{flv.TagVideo, flv.TagAudio} {
+			if h, ok := headers[tagType]; ok {
+				if err := w.writeTag(h); err != nil {
+					return err
+				}
+			}
+		}
+		for _, t := range held {
+			if err := w.writeTag(t); err != nil {
+				return err
+			}
+		}
+		held = nil
+		return nil
+	}
+	err = readAll(func() (flv.TagI, error) {
+		return demuxer.ReadTag(in)
+	}, func(tag flv.TagI) error {
+		if flv.IsSequenceHeader(tag) {
+			headers[tag.Type()] = tag
+			if w == nil {
+				return nil
+			}
+			return w.writeTag(tag)
+		}
+		if tag.Type() == flv.TagScript {
+			if w == nil {
+				held = append(held, tag)
+				return nil
+			}
+			return w.writeTag(tag)
+		}
+		full := w != nil && (duration > 0 && w.duration() >= duration || size > 0 && w.size >= size)
+		if w == nil || full && isKeyFrameTag(tag, header.HasVideo) {
+			if err := openSegment(tag); err != nil {
+				return err
+			}
+		}
+		return w.writeTag(tag)
+	})
+	return closeSegment(err)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/foolishCDN/AV-spy/validate"
+)
+
+var (
+	disableRules []string
+	failOn       string
+	maxIssues    int
+	listRules    bool
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [flags] <file path or http url>",
+	Short: "Check the conformance of stream, exit with 0 if passed, 1 if there are issues of --fail_on or higher severity and 2 if trouble",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if listRules {
+			for _, rule := range validate.Rules() {
+				fmt.Printf("%-26s %-8s %s\n", rule.Name, rule.Severity, rule.Description)
+			}
+			return nil
+		}
+		if len(args) != 1 {
+			_ = cmd.Usage()
+			return &exitError{code: 2, err: errors.New("please specify a file path or http url")}
+		}
+		severity, err := validate.ParseSeverity(failOn)
+		if err != nil {
+			return &exitError{code: 2, err: err}
+		}
+		r, err := parseFilePathOrURL(context.Background(), args[0], nil)
+		if err != nil {
+			return &exitError{code: 2, err: err}
+		}
+		defer func() {
+			_ = r.Close()
+		}()
+		// stop live stream by closing it
+		var interrupted int32
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-c
+			atomic.StoreInt32(&interrupted, 1)
+			_ = r.Close()
+		}()
+
+		report, err := validate.Validate(r, validate.Config{Disabled: disableRules, MaxIssues: maxIssues})
+		if report == nil {
+			return &exitError{code: 2, err: err}
+		}
+		if format == formatJSON || format == formatNDJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(report); err != nil {
+				return &exitError{code: 2, err: err}
+			}
+		} else {
+			report.Print(os.Stdout)
+		}
+		if err != nil && atomic.LoadInt32(&interrupted) == 0 {
+			return &exitError{code: 2, err: err}
+		}
+		if code := report.ExitCode(severity); code != 0 {
+			return &exitError{code: code}
+		}
+		return nil
+	},
+}
+
+func initValidateFlags() {
+	validateCmd.Flags().StringSliceVar(
+		&disableRules,
+		"disable_rules",
+		nil,
+		"rules not checked, see --list_rules",
+	)
+	validateCmd.Flags().StringVar(
+		&failOn,
+		"fail_on",
+		validate.SeverityWarning.String(),
+		"fail if there is an issue of the severity(info, warning or error) or higher",
+	)
+	validateCmd.Flags().IntVar(
+		&maxIssues,
+		"max_issues",
+		20,
+		"show the first n issues of every rule, all of them are counted (no limit if n<=0)",
+	)
+	validateCmd.Flags().BoolVar(
+		&listRules,
+		"list_rules",
+		false,
+		"list the rules",
+	)
+}
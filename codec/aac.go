@@ -27,3 +27,13 @@ func (aac *AACAudioSpecificConfig) Read(data []byte) error {
 	aac.Channel = (data[1] >> 3) & 0x0f
 	return nil
 }
+
+var aacFrequencies = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// Frequency returns the sample rate indicated by frequency index, 0 if it's unknown.
+func (aac *AACAudioSpecificConfig) Frequency() int {
+	if int(aac.SampleRate) >= len(aacFrequencies) {
+		return 0
+	}
+	return aacFrequencies[aac.SampleRate]
+}
@@ -8,7 +8,9 @@ import (
 )
 
 const (
-	NalSEI = 6
+	NalSlice    = 1
+	NalIDRSlice = 5
+	NalSEI      = 6
 )
 
 type NALUType int
@@ -0,0 +1,43 @@
+package avc
+
+import (
+	"fmt"
+
+	"github.com/foolishCDN/AV-spy/utils"
+)
+
+// SliceType is slice_type of slice header, 5~9 mean the same types as 0~4 and are mapped to them.
+type SliceType uint
+
+const (
+	SliceP SliceType = iota
+	SliceB
+	SliceI
+	SliceSP
+	SliceSI
+)
+
+func (t SliceType) String() string {
+	switch t {
+	case SliceP:
+		return "P"
+	case SliceB:
+		return "B"
+	case SliceI:
+		return "I"
+	case SliceSP:
+		return "SP"
+	case SliceSI:
+		return "SI"
+	}
+	return fmt.Sprintf("SliceType(%d)", uint(t))
+}
+
+// ParseSliceType reads slice_type from slice header, the reader should be after NALU header.
+//
+//	first_mb_in_slice ue(v)
+//	slice_type ue(v)
+func ParseSliceType(reader *utils.BitReader) SliceType {
+	reader.ReadUE() // first_mb_in_slice
+	return SliceType(reader.ReadUE() % 5)
+}
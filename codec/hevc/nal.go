@@ -6,6 +6,8 @@ import (
 )
 
 const (
+	NalBLAWLP    = 16 // the first IRAP(intra random access point) type
+	NalRsvIRAP23 = 23 // the last IRAP type
 	NalVPS       = 32
 	NalSPS       = 33
 	NalPPS       = 34
@@ -0,0 +1,28 @@
+package codec
+
+// RBSP returns the raw byte sequence payload of nalu, that is the emulation_prevention_three_byte
+// (0x03 of 0x000003) removed. nalu is returned if there is nothing to remove.
+func RBSP(nalu []byte) []byte {
+	var rbsp []byte
+	zeros, start := 0, 0
+	for i, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			if rbsp == nil {
+				rbsp = make([]byte, 0, len(nalu))
+			}
+			rbsp = append(rbsp, nalu[start:i]...)
+			start = i + 1
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	if rbsp == nil {
+		return nalu
+	}
+	return append(rbsp, nalu[start:]...)
+}
@@ -0,0 +1,114 @@
+// Package demux is the container-agnostic view of media streams: the tracks are described by Stream
+// and the frames are read as Packet, so the analyzers don't depend on FLV tags or WAV chunks.
+//
+// Open detects the format by the first bytes of stream, e.g.
+//
+//	d, err := demux.Open(r)
+//	if err != nil {
+//		return err
+//	}
+//	for {
+//		pkt, err := d.ReadPacket()
+//		if err != nil {
+//			return err // io.EOF at the end of stream
+//		}
+//		stream := d.Streams()[pkt.StreamIndex]
+//		fmt.Println(stream.Codec, pkt.DTS, pkt.KeyFrame, len(pkt.Data))
+//	}
+//
+// The other containers plug in by Register.
+package demux
+
+import (
+	"fmt"
+	"time"
+)
+
+type MediaType byte
+
+const (
+	MediaUnknown MediaType = iota
+	MediaVideo
+	MediaAudio
+	MediaData // metadata, e.g. script tag of FLV
+)
+
+func (t MediaType) String() string {
+	switch t {
+	case MediaVideo:
+		return "video"
+	case MediaAudio:
+		return "audio"
+	case MediaData:
+		return "data"
+	}
+	return "unknown"
+}
+
+// Codec is the lower case name of codec, e.g. "avc", "aac", "pcm"
+type Codec string
+
+const (
+	CodecAVC      Codec = "avc"
+	CodecHEVC     Codec = "hevc"
+	CodecAAC      Codec = "aac"
+	CodecMP3      Codec = "mp3"
+	CodecPCM      Codec = "pcm"
+	CodecPCMFloat Codec = "pcm_float"
+	CodecAMF      Codec = "amf" // FLV metadata
+)
+
+// Stream is a track of container with the codec parameters known so far,
+// the parameters may be filled later, e.g. by the sequence header of FLV.
+type Stream struct {
+	Index int // the index of Demuxer.Streams
+	Type  MediaType
+	Codec Codec
+
+	// Extradata is the codec configuration, e.g. AVCDecoderConfigurationRecord, AudioSpecificConfig or WAV format chunk
+	Extradata []byte
+
+	// video
+	Width  int
+	Height int
+	FPS    float64
+
+	// audio
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+}
+
+func (s *Stream) String() string {
+	switch s.Type {
+	case MediaVideo:
+		return fmt.Sprintf("#%d %s %s %dx%d", s.Index, s.Type, s.Codec, s.Width, s.Height)
+	case MediaAudio:
+		return fmt.Sprintf("#%d %s %s %dHz %dch", s.Index, s.Type, s.Codec, s.SampleRate, s.Channels)
+	}
+	return fmt.Sprintf("#%d %s %s", s.Index, s.Type, s.Codec)
+}
+
+// Packet is a frame of Stream, the timestamps of all containers are converted to time.Duration.
+type Packet struct {
+	StreamIndex int
+	DTS         time.Duration
+	PTS         time.Duration
+	KeyFrame    bool
+	// Config marks the packet carrying codec configuration instead of frame, e.g. the sequence header of FLV
+	Config bool
+	// Data is the payload without container headers, e.g. AVCC NALUs, raw AAC or PCM samples
+	Data []byte
+	// Offset is the byte offset of packet from the start of stream, -1 if it's unknown
+	Offset int64
+}
+
+// Demuxer reads the packets of a container.
+type Demuxer interface {
+	// Format is the name of container, e.g. "flv"
+	Format() string
+	// Streams returns the streams found so far, new streams may be appended by ReadPacket
+	Streams() []*Stream
+	// ReadPacket returns the next packet, io.EOF at the end of stream
+	ReadPacket() (*Packet, error)
+}
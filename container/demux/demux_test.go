@@ -0,0 +1,161 @@
+package demux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+func readAll(t *testing.T, d Demuxer) []*Packet {
+	var packets []*Packet
+	for {
+		pkt, err := d.ReadPacket()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, pkt)
+	}
+}
+
+func TestFLV(t *testing.T) {
+	f, err := os.Open("../flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	d, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "flv", d.Format())
+	assert.Equal(t, &flv.Header{Version: 1, HasVideo: true, HasAudio: true, DataOffset: 9}, d.(*FLV).Header())
+	packets := readAll(t, d)
+
+	streams := d.Streams()
+	if !assert.Len(t, streams, 3) {
+		return
+	}
+	counts := make(map[MediaType]int)
+	keyFrames, configs := 0, 0
+	for _, pkt := range packets {
+		stream := streams[pkt.StreamIndex]
+		counts[stream.Type]++
+		if stream.Type == MediaVideo && pkt.KeyFrame {
+			keyFrames++
+		}
+		if pkt.Config {
+			configs++
+		}
+		assert.True(t, pkt.PTS >= pkt.DTS)
+		assert.True(t, pkt.Offset >= 13)
+	}
+	for _, s := range streams {
+		switch s.Type {
+		case MediaVideo:
+			assert.Equal(t, CodecAVC, s.Codec)
+			assert.Equal(t, 544, s.Width)
+			assert.Equal(t, 960, s.Height)
+			assert.NotEmpty(t, s.Extradata)
+		case MediaAudio:
+			assert.Equal(t, CodecMP3, s.Codec)
+			assert.Equal(t, 44100, s.SampleRate)
+		case MediaData:
+			assert.Equal(t, CodecAMF, s.Codec)
+		}
+	}
+	assert.True(t, counts[MediaVideo] > 0)
+	assert.True(t, counts[MediaAudio] > 0)
+	assert.True(t, keyFrames > 0)
+	assert.Equal(t, 1, configs, "the audio is MP3, there is only the sequence header of video")
+}
+
+func TestWAV(t *testing.T) {
+	f, err := os.Open("../../encoding/riff/test.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	d, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "wav", d.Format())
+	packets := readAll(t, d)
+	if !assert.Len(t, d.Streams(), 1) {
+		return
+	}
+	s := d.Streams()[0]
+	assert.Equal(t, MediaAudio, s.Type)
+	assert.Equal(t, CodecPCM, s.Codec)
+	assert.Equal(t, 44100, s.SampleRate)
+	assert.Equal(t, 2, s.Channels)
+	assert.Equal(t, 16, s.BitsPerSample)
+
+	if assert.True(t, len(packets) > 1) {
+		assert.Equal(t, time.Duration(0), packets[0].DTS)
+		assert.Len(t, packets[0].Data, 4*WAVPacketSamples)
+		assert.Equal(t, time.Duration(WAVPacketSamples)*time.Second/44100, packets[1].DTS)
+	}
+}
+
+func TestWAVPacketTimestamps(t *testing.T) {
+	pcm := make([]byte, 8000*2*3/2) // 1.5s of 8kHz 16bit mono
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(4+8+16+8+len(pcm)))
+	buf.WriteString("WAVEfmt ")
+	_ = binary.Write(&buf, binary.LittleEndian, []uint32{16, 1<<16 | 1, 8000, 16000, 16<<16 | 2})
+	buf.WriteString("data")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+
+	d, err := Open(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := readAll(t, d)
+	total := 0
+	for i, pkt := range packets {
+		assert.Equal(t, time.Duration(i*WAVPacketSamples)*time.Second/8000, pkt.DTS)
+		total += len(pkt.Data)
+	}
+	assert.Equal(t, len(pcm), total)
+}
+
+func TestOpen(t *testing.T) {
+	_, err := Open(bytes.NewReader([]byte("unknown format")))
+	assert.Equal(t, ErrUnknownFormat, err)
+	_, err = Open(bytes.NewReader(nil))
+	assert.Equal(t, io.EOF, err)
+
+	format, ok := Detect([]byte("FLV\x01"))
+	assert.True(t, ok)
+	assert.Equal(t, "flv", format.Name)
+	_, ok = Detect([]byte("RIFF\x00\x00\x00\x00AVI "))
+	assert.False(t, ok)
+}
+
+func TestFLVStreams(t *testing.T) {
+	f := NewFLVStreams()
+	_, err := f.ReadPacket()
+	assert.Equal(t, ErrNoReader, err)
+
+	pkt := f.Packet(&flv.VideoTag{DTS: 40, PTS: 80, FrameType: flv.KeyFrame, CodecID: flv.H264, PacketType: flv.AVPacket}, 100)
+	assert.Equal(t, &Packet{StreamIndex: 0, DTS: 40 * time.Millisecond, PTS: 80 * time.Millisecond, KeyFrame: true, Offset: 100}, pkt)
+	pkt = f.Packet(&flv.AudioTag{PTS: 20, SoundFormat: flv.MP3}, 200)
+	assert.Equal(t, 1, pkt.StreamIndex)
+	assert.Equal(t, []MediaType{MediaVideo, MediaAudio}, []MediaType{f.Streams()[0].Type, f.Streams()[1].Type})
+	assert.Equal(t, CodecAVC, f.Streams()[0].Codec)
+}
@@ -0,0 +1,185 @@
+package demux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/foolishCDN/AV-spy/codec"
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+func init() {
+	Register(Format{
+		Name:  "flv",
+		Match: func(head []byte) bool { return bytes.HasPrefix(head, flv.Signature) },
+		New: func(r io.Reader) (Demuxer, error) {
+			return NewFLV(r, new(flv.Demuxer))
+		},
+	})
+}
+
+// ErrNoReader is returned by ReadPacket of the FLV returned by NewFLVStreams
+var ErrNoReader = errors.New("demux: no reader, the tags are converted by Packet")
+
+// FLV adapts flv.Demuxer to Demuxer, there are at most one video, one audio and one data stream.
+type FLV struct {
+	r       io.Reader
+	demuxer *flv.Demuxer
+	header  *flv.Header
+	streams []*Stream
+	indexes map[flv.TagType]int
+}
+
+// NewFLV reads the FLV header from r, demuxer is configured by the caller, e.g. Resync.
+func NewFLV(r io.Reader, demuxer *flv.Demuxer) (*FLV, error) {
+	header, err := demuxer.ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &FLV{
+		r:       r,
+		demuxer: demuxer,
+		header:  header,
+		indexes: make(map[flv.TagType]int),
+	}, nil
+}
+
+// NewFLVStreams returns a FLV converting the tags read by the caller to packets by Packet,
+// e.g. the tags of flv.Reader or the tags of a live stream fed one by one.
+func NewFLVStreams() *FLV {
+	return &FLV{indexes: make(map[flv.TagType]int)}
+}
+
+func (f *FLV) Format() string {
+	return "flv"
+}
+
+func (f *FLV) Header() *flv.Header {
+	return f.header
+}
+
+func (f *FLV) Streams() []*Stream {
+	return f.streams
+}
+
+// ReadPacket reads the next tag as packet. The tag recovered from *flv.PreviousTagSizeError or *flv.ResyncError
+// is returned together with the error, so the caller decides whether the corruption is fatal.
+func (f *FLV) ReadPacket() (*Packet, error) {
+	if f.demuxer == nil {
+		return nil, ErrNoReader
+	}
+	tag, err := f.demuxer.ReadTag(f.r)
+	if tag == nil {
+		var sizeErr *flv.PreviousTagSizeError
+		var resyncErr *flv.ResyncError
+		switch {
+		case errors.As(err, &sizeErr):
+			tag = sizeErr.Tag
+		case errors.As(err, &resyncErr):
+			tag = resyncErr.Tag
+		}
+		if tag == nil {
+			return nil, err
+		}
+	}
+	return f.Packet(tag, f.demuxer.TagOffset()), err
+}
+
+// Packet converts tag read at offset to packet, the stream of tag is added or updated like ReadPacket.
+func (f *FLV) Packet(tag flv.TagI, offset int64) *Packet {
+	stream := f.stream(tag.Type())
+	pkt := &Packet{
+		StreamIndex: stream.Index,
+		DTS:         time.Duration(tag.Timestamp()) * time.Millisecond,
+		PTS:         time.Duration(tag.Timestamp()) * time.Millisecond,
+		Data:        tag.Data(),
+		Offset:      offset,
+	}
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		pkt.PTS = time.Duration(t.PTS) * time.Millisecond
+		pkt.KeyFrame = t.FrameType == flv.KeyFrame
+		stream.Codec = flvVideoCodec(t.CodecID)
+		if flv.IsSequenceHeader(t) {
+			pkt.Config = true
+			stream.Extradata = t.Bytes
+			setVideoConfig(stream, t)
+		} else if t.CodecID != flv.H264 && t.CodecID != flv.H265 {
+			pkt.PTS = pkt.DTS
+		}
+	case *flv.AudioTag:
+		pkt.KeyFrame = true
+		stream.Codec = flvAudioCodec(t.SoundFormat)
+		if t.SoundFormat == flv.AAC {
+			if t.PacketType == flv.SequenceHeader {
+				pkt.Config = true
+				stream.Extradata = t.Bytes
+				aac := new(codec.AACAudioSpecificConfig)
+				if aac.Read(t.Bytes) == nil {
+					stream.SampleRate, stream.Channels = aac.Frequency(), int(aac.Channel)
+				}
+			}
+			break
+		}
+		stream.SampleRate = flvSampleRates[t.SampleRate&0x03]
+		stream.Channels = int(t.Channels) + 1
+		stream.BitsPerSample = 8 << t.BitPerSample
+	default:
+		pkt.KeyFrame = true
+	}
+	return pkt
+}
+
+// stream returns the stream of tag type, it's added when the first tag of the type is read
+func (f *FLV) stream(tagType flv.TagType) *Stream {
+	if i, ok := f.indexes[tagType]; ok {
+		return f.streams[i]
+	}
+	stream := &Stream{Index: len(f.streams)}
+	switch tagType {
+	case flv.TagVideo:
+		stream.Type = MediaVideo
+	case flv.TagAudio:
+		stream.Type = MediaAudio
+	case flv.TagScript:
+		stream.Type = MediaData
+		stream.Codec = CodecAMF
+	}
+	f.indexes[tagType] = stream.Index
+	f.streams = append(f.streams, stream)
+	return stream
+}
+
+var flvSampleRates = [4]int{5512, 11025, 22050, 44100}
+
+func flvVideoCodec(id flv.CodecID) Codec {
+	switch id {
+	case flv.H264:
+		return CodecAVC
+	case flv.H265:
+		return CodecHEVC
+	}
+	return Codec(strings.ToLower(id.String()))
+}
+
+func flvAudioCodec(format flv.SoundFormat) Codec {
+	switch format {
+	case flv.AAC:
+		return CodecAAC
+	case flv.MP3, flv.MP38KHz:
+		return CodecMP3
+	case flv.LinearPCM, flv.PCM:
+		return CodecPCM
+	}
+	return Codec(strings.ToLower(format.String()))
+}
+
+// setVideoConfig sets the resolution and fps of stream by the SPS in sequence header, it's ignored if SPS can't be parsed
+func setVideoConfig(stream *Stream, tag *flv.VideoTag) {
+	if sps := tag.SPS(); sps != nil {
+		stream.Width, stream.Height, stream.FPS = sps.Width(), sps.Height(), sps.FPS()
+	}
+}
@@ -0,0 +1,61 @@
+package demux
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ProbeSize is the number of bytes peeked to detect the format
+const ProbeSize = 16
+
+// ErrUnknownFormat is returned by Open if no format matches the first bytes of stream
+var ErrUnknownFormat = errors.New("demux: unknown format")
+
+// Format is a container which can be detected and demuxed.
+type Format struct {
+	Name string
+	// Match reports whether the first bytes of stream are the format, head may be shorter than ProbeSize
+	Match func(head []byte) bool
+	// New returns a Demuxer reading r from the start of stream
+	New func(r io.Reader) (Demuxer, error)
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   []Format
+)
+
+// Register adds a format, the formats are matched in the order of registering.
+func Register(format Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats = append(formats, format)
+}
+
+// Detect returns the format matching the first bytes of stream.
+func Detect(head []byte) (Format, bool) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	for _, format := range formats {
+		if format.Match(head) {
+			return format, true
+		}
+	}
+	return Format{}, false
+}
+
+// Open detects the format of r by peeking the first ProbeSize bytes and returns its Demuxer.
+func Open(r io.Reader) (Demuxer, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(ProbeSize)
+	if err != nil && (err != io.EOF || len(head) == 0) {
+		return nil, err
+	}
+	format, ok := Detect(head)
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return format.New(br)
+}
@@ -0,0 +1,147 @@
+package demux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/foolishCDN/AV-spy/container/wav"
+	"github.com/foolishCDN/AV-spy/encoding/riff"
+)
+
+func init() {
+	Register(Format{
+		Name: "wav",
+		Match: func(head []byte) bool {
+			return len(head) >= 12 && bytes.Equal(head[0:4], riff.ChunkIDRIFF) && bytes.Equal(head[8:12], wav.RIFFTypeIDWAVE)
+		},
+		New: func(r io.Reader) (Demuxer, error) {
+			return NewWAV(r), nil
+		},
+	})
+}
+
+// WAVPacketSamples is the number of samples per channel in a packet of WAV
+const WAVPacketSamples = 1024
+
+// WAV adapts wav.Parser to Demuxer, the samples of data chunk are split into packets of WAVPacketSamples.
+type WAV struct {
+	r       io.Reader
+	parser  *wav.Parser
+	buf     []byte
+	stream  *Stream
+	format  *wav.Format
+	samples int64 // the samples per channel before queued packets
+	queue   []*Packet
+	eof     bool
+}
+
+func NewWAV(r io.Reader) *WAV {
+	w := &WAV{
+		r:   r,
+		buf: make([]byte, 32*1024),
+	}
+	w.parser = wav.NewParser((*wavHandler)(w))
+	return w
+}
+
+func (w *WAV) Format() string {
+	return "wav"
+}
+
+// Streams returns the audio stream after the format chunk is read.
+func (w *WAV) Streams() []*Stream {
+	if w.stream == nil {
+		return nil
+	}
+	return []*Stream{w.stream}
+}
+
+func (w *WAV) ReadPacket() (*Packet, error) {
+	for len(w.queue) == 0 {
+		if w.eof {
+			return nil, io.EOF
+		}
+		n, err := w.r.Read(w.buf)
+		if n > 0 {
+			if err := w.parser.Input(w.buf[:n]); err != nil && err != io.EOF {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			w.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	pkt := w.queue[0]
+	w.queue = w.queue[1:]
+	return pkt, nil
+}
+
+// wavHandler receives the chunks of wav.Parser, it's not exported by WAV
+type wavHandler WAV
+
+func (w *wavHandler) OnFormat(format *wav.Format) error {
+	if format.BlocKAlign == 0 {
+		format.BlocKAlign = format.NumOfChannels * format.BitPerSample / 8
+	}
+	if format.BlocKAlign == 0 || format.SampleRate == 0 {
+		return fmt.Errorf("demux: invalid wav format, block align %d, sample rate %d", format.BlocKAlign, format.SampleRate)
+	}
+	w.format = format
+	w.stream = &Stream{
+		Type:          MediaAudio,
+		Codec:         wavCodec(format.Format),
+		Extradata:     format.ExtraFormat,
+		SampleRate:    int(format.SampleRate),
+		Channels:      int(format.NumOfChannels),
+		BitsPerSample: int(format.BitPerSample),
+	}
+	return nil
+}
+
+func (w *wavHandler) OnPCM(data []byte) error {
+	if w.format == nil {
+		return errors.New("demux: wav data chunk before format chunk")
+	}
+	data = append([]byte(nil), data...) // the buffer of chunk is reused by parser
+	size := int(w.format.BlocKAlign) * WAVPacketSamples
+	for len(data) > 0 {
+		n := size
+		if len(data) < n {
+			n = len(data)
+		}
+		ts := time.Duration(w.samples) * time.Second / time.Duration(w.format.SampleRate)
+		w.queue = append(w.queue, &Packet{
+			DTS:      ts,
+			PTS:      ts,
+			KeyFrame: true,
+			Data:     data[:n:n],
+			Offset:   -1,
+		})
+		w.samples += int64(n / int(w.format.BlocKAlign))
+		data = data[n:]
+	}
+	return nil
+}
+
+func (w *wavHandler) OnMIDISample(*wav.MIDISample) error {
+	return nil
+}
+
+func (w *wavHandler) OnUnknownChunk(*riff.Chunk) error {
+	return nil
+}
+
+func wavCodec(format uint16) Codec {
+	switch format {
+	case wav.FormatPCM:
+		return CodecPCM
+	case wav.FormatIEEEFloat:
+		return CodecPCMFloat
+	}
+	return Codec(fmt.Sprintf("wav_format_%d", format))
+}
@@ -9,8 +9,50 @@ import (
 	"github.com/foolishCDN/AV-spy/utils"
 )
 
+// TimestampLayout is how timestamp and timestampExtended are placed in tag header.
+type TimestampLayout byte
+
+const (
+	// TimestampStandard is 24 bits timestamp followed by the extended byte as upper 8 bits
+	TimestampStandard TimestampLayout = iota
+	// TimestampBigEndian32 is 32 bits big endian timestamp, written by some servers by mistake
+	TimestampBigEndian32
+)
+
+// timestampLayoutVotes is the number of consecutive tags needed to detect TimestampBigEndian32
+const timestampLayoutVotes = 3
+
 type Demuxer struct {
 	readTagHeaderBuf [11]byte
+
+	// TimestampLayout is used to decode the timestamp of tag
+	TimestampLayout TimestampLayout
+	// DetectTimestampLayout switches TimestampLayout to TimestampBigEndian32 if the extended byte looks misplaced,
+	// that is the standard timestamps of a tag type jump by 2^24 or more while the big endian ones are continuous.
+	// The tags before switching keep the standard timestamp.
+	DetectTimestampLayout bool
+
+	lastTimestamps [32]struct {
+		seen      bool
+		standard  uint32
+		bigEndian uint32
+	}
+	layoutVotes int
+
+	// MaxTagSize is the max data size of tag, a larger one is treated as corruption (no limit if 0).
+	// It avoids allocating huge buffer for a corrupted size field.
+	MaxTagSize uint32
+	// Resync makes ReadTag scan forward for the next plausible tag if a tag is corrupted, see ResyncError.
+	Resync bool
+
+	offset    int64 // bytes read by ReadHeader and ReadTag
+	tagOffset int64
+	pending   []byte // bytes read ahead by resync, they are read before r
+}
+
+// TagOffset returns the byte offset of the last tag read by ReadTag from the start of the stream.
+func (demuxer *Demuxer) TagOffset() int64 {
+	return demuxer.tagOffset
 }
 
 // ReadHeader read flv file header
@@ -39,6 +81,8 @@ func (demuxer *Demuxer) ReadHeader(r io.Reader) (*Header, error) {
 	if binary.BigEndian.Uint32(temp) != 0 {
 		return nil, fmt.Errorf("flv demuxer previousTagSize0 should be 0, but there is: %v", binary.BigEndian.Uint32(temp))
 	}
+	demuxer.offset = 9 + 4
+	demuxer.pending = nil // the stream is restarted, e.g. reconnected
 	return h, nil
 }
 
@@ -66,35 +110,102 @@ func (demuxer *Demuxer) parseHeader(header []byte) (*Header, error) {
 //	streamID (3 byte) always 0
 //	data
 func (demuxer *Demuxer) ReadTag(r io.Reader) (TagI, error) {
+	start := demuxer.offset
 	tagHeader := demuxer.readTagHeaderBuf[:]
-	if _, err := io.ReadFull(r, tagHeader[:11]); err != nil {
+	if err := demuxer.readFull(r, tagHeader[:11]); err != nil {
 		return nil, err
 	}
 	size := utils.BigEndianUint24(tagHeader[1:4])
-	data := make([]byte, size+4) // has previousTagSizeN
-	if _, err := io.ReadFull(r, data); err != nil {
+	if demuxer.Resync && !demuxer.validHeader(tagHeader) {
+		return demuxer.resync(r, start, tagHeader[:11], fmt.Errorf("flv demuxer invalid tag header, type %d, size %d", tagHeader[0], size))
+	}
+	if demuxer.MaxTagSize > 0 && size > demuxer.MaxTagSize {
+		return nil, fmt.Errorf("flv demuxer tag size %d exceeds the max %d", size, demuxer.MaxTagSize)
+	}
+	data, err := demuxer.readAhead(r, int(size)+4) // has previousTagSizeN
+	if err != nil {
+		if demuxer.Resync && len(data) > 0 {
+			return demuxer.resync(r, start, append(tagHeader[:11:11], data...), fmt.Errorf("flv demuxer tag size %d exceeds the end of stream", size))
+		}
 		return nil, err
 	}
-	return demuxer.parseTag(size, tagHeader, data)
-}
-func (demuxer *Demuxer) parseTag(size uint32, tagHeader []byte, data []byte) (TagI, error) {
-	if size+11 != binary.BigEndian.Uint32(data[size:]) { // verified by previousTagSizeN
-		return nil, fmt.Errorf("flv demuxer read tag size %d + 11 != %d", size, binary.BigEndian.Uint32(data[size:]))
+	demuxer.tagOffset = start
+	demuxer.offset = start + int64(11+len(data))
+	tag, err := demuxer.parseTag(size, tagHeader, data)
+	if e, ok := err.(*PreviousTagSizeError); ok {
+		e.Offset = demuxer.tagOffset
+		// only the size field is wrong if it's followed by a plausible tag
+		if demuxer.Resync && !demuxer.followedByTag(r) {
+			return demuxer.resync(r, start, append(tagHeader[:11:11], data...), err)
+		}
+	} else if err != nil && demuxer.Resync {
+		return demuxer.resync(r, start, append(tagHeader[:11:11], data...), err)
 	}
+	return tag, err
+}
 
+// PreviousTagSizeError is returned if previousTagSize doesn't match the size of tag,
+// the tag is still parsed since only the size field following it is wrong.
+type PreviousTagSizeError struct {
+	Offset          int64 // byte offset of the tag
+	Size            uint32
+	PreviousTagSize uint32
+	Tag             TagI
+}
+
+func (e *PreviousTagSizeError) Error() string {
+	return fmt.Sprintf("flv demuxer read tag size %d + 11 != %d", e.Size, e.PreviousTagSize)
+}
+
+func (demuxer *Demuxer) parseTag(size uint32, tagHeader []byte, data []byte) (TagI, error) {
+	tagType := TagType(tagHeader[0] & 0x1f)
 	tag, err := demuxer.demux(
-		TagType(tagHeader[0]&0x1f),             // tag type
+		tagType,                                // tag type
 		utils.BigEndianUint24(tagHeader[8:11]), // streamID
-		(uint32(tagHeader[4])<<16)|uint32(tagHeader[5])<<8|uint32(tagHeader[6])|uint32(tagHeader[7])<<24, // timestamp
+		demuxer.timestamp(tagType, tagHeader[4:8]), // timestamp
 		data[:size], // data
 	)
 	if err != nil {
 		return nil, err
 	}
+	if previousTagSize := binary.BigEndian.Uint32(data[size:]); size+11 != previousTagSize { // verified by previousTagSizeN
+		return nil, &PreviousTagSizeError{Size: size, PreviousTagSize: previousTagSize, Tag: tag}
+	}
 	return tag, nil
 }
 
+// timestamp decodes timestamp (3 byte) and timestampExtended (1 byte) by TimestampLayout
+func (demuxer *Demuxer) timestamp(tagType TagType, b []byte) uint32 {
+	standard := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]) | uint32(b[3])<<24
+	bigEndian := binary.BigEndian.Uint32(b)
+	if demuxer.DetectTimestampLayout && demuxer.TimestampLayout == TimestampStandard {
+		last := &demuxer.lastTimestamps[tagType]
+		if last.seen {
+			standardDiff := int64(standard) - int64(last.standard)
+			bigEndianDiff := int64(bigEndian) - int64(last.bigEndian)
+			if (standardDiff >= 1<<24 || standardDiff <= -(1<<24)) && bigEndianDiff >= 0 && bigEndianDiff < 1<<16 {
+				demuxer.layoutVotes++
+			} else {
+				demuxer.layoutVotes = 0
+			}
+			if demuxer.layoutVotes >= timestampLayoutVotes {
+				demuxer.TimestampLayout = TimestampBigEndian32
+			}
+		}
+		last.seen = true
+		last.standard = standard
+		last.bigEndian = bigEndian
+	}
+	if demuxer.TimestampLayout == TimestampBigEndian32 {
+		return bigEndian
+	}
+	return standard
+}
+
 func (demuxer *Demuxer) demux(tagType TagType, streamID, timestamp uint32, data []byte) (t TagI, err error) {
+	if len(data) < minTagSize(tagType, data) {
+		return nil, fmt.Errorf("flv demuxer %s tag is too short, size %d", tagType, len(data))
+	}
 	switch tagType {
 	case TagAudio:
 		t = demuxer.audioTag(data, streamID, timestamp)
@@ -108,6 +219,23 @@ func (demuxer *Demuxer) demux(tagType TagType, streamID, timestamp uint32, data
 	return t, nil
 }
 
+// minTagSize returns the size of the fields before payload in data
+func minTagSize(tagType TagType, data []byte) int {
+	if tagType != TagAudio && tagType != TagVideo {
+		return 0
+	}
+	if len(data) == 0 {
+		return 1
+	}
+	switch {
+	case tagType == TagAudio && SoundFormat((data[0]>>4)&0x0f) == AAC:
+		return 2
+	case tagType == TagVideo && (CodecID(data[0]&0xf) == H264 || CodecID(data[0]&0xf) == H265):
+		return 5
+	}
+	return 1
+}
+
 func (demuxer *Demuxer) audioTag(data []byte, streamID, timestamp uint32) *AudioTag {
 	a := &AudioTag{}
 	a.PTS = timestamp
@@ -1,10 +1,15 @@
 package flv
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
 	"testing"
+
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+	"github.com/foolishCDN/AV-spy/formatter"
 )
 
 func TestMuxerAndDemuxer(t *testing.T) {
@@ -87,3 +92,445 @@ func TestParser(t *testing.T) {
 		}
 	}
 }
+
+func TestDemuxerDetectTimestampLayout(t *testing.T) {
+	var buf bytes.Buffer
+	muxer := new(Muxer)
+	if err := muxer.WriteHeader(&buf, true, false); err != nil {
+		t.Fatal(err)
+	}
+	timestamps := []uint32{1000, 1023, 1046, 1069, 1092, 1115}
+	for _, timestamp := range timestamps {
+		start := buf.Len()
+		if err := muxer.WriteTag(&buf, &AudioTag{SoundFormat: MP3, PTS: timestamp, Bytes: []byte{0xff}}); err != nil {
+			t.Fatal(err)
+		}
+		// the server writes 32 bits big endian timestamp by mistake
+		binary.BigEndian.PutUint32(buf.Bytes()[start+4:start+8], timestamp)
+	}
+
+	demuxer := &Demuxer{DetectTimestampLayout: true}
+	if _, err := demuxer.ReadHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got []uint32
+	for {
+		tag, err := demuxer.ReadTag(&buf)
+		if err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+		got = append(got, tag.Timestamp())
+	}
+	if demuxer.TimestampLayout != TimestampBigEndian32 {
+		t.Fatalf("timestamp layout should be detected as big endian")
+	}
+	if got[len(got)-1] != timestamps[len(timestamps)-1] {
+		t.Fatalf("timestamp should be %d, but got %d", timestamps[len(timestamps)-1], got[len(got)-1])
+	}
+}
+
+func TestDemuxerPreviousTagSize(t *testing.T) {
+	var buf bytes.Buffer
+	muxer := new(Muxer)
+	if err := muxer.WriteHeader(&buf, true, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, timestamp := range []uint32{0, 23} {
+		if err := muxer.WriteTag(&buf, &AudioTag{SoundFormat: MP3, PTS: timestamp, Bytes: []byte{0xff}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// corrupt previousTagSize of the first tag
+	binary.BigEndian.PutUint32(buf.Bytes()[13+11+2:], 100)
+
+	demuxer := new(Demuxer)
+	if _, err := demuxer.ReadHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, err := demuxer.ReadTag(&buf)
+	e, ok := err.(*PreviousTagSizeError)
+	if !ok {
+		t.Fatalf("should return PreviousTagSizeError, but got %v", err)
+	}
+	if e.Offset != 13 || e.Size != 2 || e.PreviousTagSize != 100 || e.Tag == nil {
+		t.Fatalf("unexpected error %+v", e)
+	}
+	tag, err := demuxer.ReadTag(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Timestamp() != 23 {
+		t.Fatalf("timestamp should be 23, but got %d", tag.Timestamp())
+	}
+}
+
+func TestDemuxerResync(t *testing.T) {
+	var buf bytes.Buffer
+	muxer := new(Muxer)
+	if err := muxer.WriteHeader(&buf, true, false); err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int
+	for i, timestamp := range []uint32{0, 23, 46, 69, 92} {
+		if i == 1 {
+			buf.Write(bytes.Repeat([]byte{0xaa}, 7)) // garbage between tags
+		}
+		offsets = append(offsets, buf.Len())
+		if err := muxer.WriteTag(&buf, &AudioTag{SoundFormat: MP3, PTS: timestamp, Bytes: []byte{0xff, 0xfe}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Write(bytes.Repeat([]byte{0xaa}, 15)) // garbage tail
+	total := buf.Len()
+	// corrupt the size of the 3rd tag
+	copy(buf.Bytes()[offsets[2]+1:], []byte{0xff, 0xff, 0xff})
+
+	demuxer := &Demuxer{Resync: true, MaxTagSize: 1 << 20}
+	if _, err := demuxer.ReadHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		timestamp  uint32
+		start, end int64
+	}
+	var got []result
+	for {
+		tag, err := demuxer.ReadTag(&buf)
+		if err == io.EOF {
+			break
+		}
+		var res result
+		if e, ok := err.(*ResyncError); ok {
+			res.start, res.end = e.Start, e.End
+			tag = e.Tag
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if tag != nil {
+			res.timestamp = tag.Timestamp()
+		}
+		got = append(got, res)
+	}
+	expected := []result{
+		{0, 0, 0},
+		{23, int64(offsets[1] - 7), int64(offsets[1])},
+		{69, int64(offsets[2]), int64(offsets[3])},
+		{92, 0, 0},
+		{0, int64(total - 15), int64(total)},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	data, err := os.ReadFile("test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keyframes and their offsets read by demuxer
+	type keyFrame struct {
+		timestamp uint32
+		offset    int64
+	}
+	var keyFrames []keyFrame
+	demuxer := new(Demuxer)
+	r := bytes.NewReader(data)
+	if _, err := demuxer.ReadHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		tag, err := demuxer.ReadTag(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if video, ok := tag.(*VideoTag); ok && video.FrameType == KeyFrame && video.PacketType == AVPacket {
+			keyFrames = append(keyFrames, keyFrame{video.DTS, demuxer.TagOffset()})
+		}
+	}
+	if len(keyFrames) < 3 {
+		t.Fatalf("there should be 3 keyframes at least, but got %d", len(keyFrames))
+	}
+
+	reader, err := NewReader(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Index() != nil {
+		t.Fatal("test.flv has no keyframes index")
+	}
+	for _, k := range keyFrames {
+		for _, timestamp := range []uint32{k.timestamp, k.timestamp + 500} {
+			if err := reader.Seek(timestamp); err != nil {
+				t.Fatal(err)
+			}
+			// the sequence header of video comes first
+			tag, err := reader.ReadTag()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if video, ok := tag.(*VideoTag); !ok || video.PacketType != SequenceHeader {
+				t.Fatalf("seek %d: the first tag should be the sequence header of video, but got %#v", timestamp, tag)
+			}
+			tag, err = reader.ReadTag()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected keyFrame
+			for _, e := range keyFrames {
+				if e.timestamp <= timestamp {
+					expected = e
+				}
+			}
+			if tag.Timestamp() != expected.timestamp || reader.demuxer.TagOffset() != expected.offset {
+				t.Fatalf("seek %d: expected the keyframe %v, but got %d at %d", timestamp, expected, tag.Timestamp(), reader.demuxer.TagOffset())
+			}
+		}
+	}
+
+	// add the keyframes index to onMetaData, the offsets are shifted by the size of the script tag
+	index := func(shift int64) []byte {
+		var times, positions []interface{}
+		for _, k := range keyFrames {
+			times = append(times, float64(k.timestamp)/1000)
+			positions = append(positions, float64(k.offset+shift))
+		}
+		var buf bytes.Buffer
+		encoder := amf.NewEncoder(amf.Version0)
+		keyframes := map[string]interface{}{"times": times, "filepositions": positions}
+		if err := encoder.EncodeBatch(&buf, "onMetaData", amf.ECMAArray{"keyframes": keyframes}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	script := &ScriptTag{Bytes: index(0)}
+	script.Bytes = index(int64(11 + script.Len() + 4))
+	var buf bytes.Buffer
+	muxer := new(Muxer)
+	buf.Write(data[:13])
+	if err := muxer.WriteTag(&buf, script); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(data[13:])
+	reader, err = NewReader(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reader.Index()) != len(keyFrames) {
+		t.Fatalf("the index should have %d entries, but got %d", len(keyFrames), len(reader.Index()))
+	}
+	if _, _, err := reader.seekByIndex(keyFrames[2].timestamp + 1); err != nil {
+		t.Fatalf("seek by index err, %v", err)
+	}
+	if err := reader.Seek(keyFrames[2].timestamp + 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadTag(); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := reader.ReadTag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Timestamp() != keyFrames[2].timestamp || reader.demuxer.TagOffset() != reader.Index()[2].Offset {
+		t.Fatalf("expected the keyframe at %d, but got %d at %d", keyFrames[2].timestamp, tag.Timestamp(), reader.demuxer.TagOffset())
+	}
+}
+
+func TestReaderSeekHeaders(t *testing.T) {
+	// the sequence header of video changes at 3000ms, 10KB frames every 100ms make the file larger than bisectWindow
+	headerA := &VideoTag{FrameType: KeyFrame, CodecID: H264, PacketType: SequenceHeader, Bytes: []byte{1, 'A'}}
+	headerB := &VideoTag{FrameType: KeyFrame, CodecID: H264, PacketType: SequenceHeader, DTS: 3000, PTS: 3000, Bytes: []byte{1, 'B'}}
+	// build returns the file and the keyframes, script is written before the frames if it isn't nil
+	build := func(script *ScriptTag) ([]byte, []interface{}, []int64) {
+		var buf bytes.Buffer
+		muxer := new(Muxer)
+		if err := muxer.WriteHeader(&buf, false, true); err != nil {
+			t.Fatal(err)
+		}
+		if script != nil {
+			if err := muxer.WriteTag(&buf, script); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var times []interface{}
+		var offsets []int64
+		for timestamp := uint32(0); timestamp < 6000; timestamp += 100 {
+			for _, header := range []*VideoTag{headerA, headerB} {
+				if header.DTS == timestamp {
+					if err := muxer.WriteTag(&buf, header); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			frame := &VideoTag{FrameType: InterFrame, CodecID: H264, PacketType: AVPacket, DTS: timestamp, PTS: timestamp, Bytes: make([]byte, 10<<10)}
+			if timestamp%1000 == 0 {
+				frame.FrameType = KeyFrame
+				times = append(times, float64(timestamp)/1000)
+				offsets = append(offsets, int64(buf.Len()))
+			}
+			if err := muxer.WriteTag(&buf, frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes(), times, offsets
+	}
+	// index returns onMetaData of the keyframes index, the offsets are shifted by shift
+	index := func(times []interface{}, offsets []int64, shift int64) *ScriptTag {
+		var positions []interface{}
+		for _, offset := range offsets {
+			positions = append(positions, float64(offset+shift))
+		}
+		var buf bytes.Buffer
+		keyframes := map[string]interface{}{"times": times, "filepositions": positions}
+		if err := amf.NewEncoder(amf.Version0).EncodeBatch(&buf, "onMetaData", amf.ECMAArray{"keyframes": keyframes}); err != nil {
+			t.Fatal(err)
+		}
+		return &ScriptTag{Bytes: buf.Bytes()}
+	}
+	withoutIndex, times, offsets := build(nil)
+	script := index(times, offsets, 0)
+	withIndex, _, _ := build(index(times, offsets, int64(11+script.Len()+4)))
+
+	for i, data := range [][]byte{withoutIndex, withIndex} {
+		hasIndex := i == 1
+		if len(data) <= bisectWindow {
+			t.Fatalf("the file should be larger than %d, but got %d", bisectWindow, len(data))
+		}
+		reader, err := NewReader(bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasIndex != (reader.Index() != nil) {
+			t.Fatalf("the index should be present: %v", hasIndex)
+		}
+		// it's seeked back and forth, the headers read before the keyframe don't matter
+		for _, c := range []struct {
+			timestamp uint32
+			header    byte
+		}{{3500, 'B'}, {5500, 'B'}, {1500, 'A'}, {2999, 'A'}, {3000, 'B'}, {1000, 'A'}} {
+			if err := reader.Seek(c.timestamp); err != nil {
+				t.Fatal(err)
+			}
+			tag, err := reader.ReadTag()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if video, ok := tag.(*VideoTag); !ok || video.PacketType != SequenceHeader || video.Bytes[1] != c.header {
+				t.Fatalf("index %v, seek %d: the first tag should be the sequence header %c, but got %#v", hasIndex, c.timestamp, c.header, tag)
+			}
+			tag, err = reader.ReadTag()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag.Timestamp() != c.timestamp/1000*1000 {
+				t.Fatalf("index %v, seek %d: expected the keyframe at %d, but got %d", hasIndex, c.timestamp, c.timestamp/1000*1000, tag.Timestamp())
+			}
+			// read to the end, the headers read last are after the keyframe of the next seek
+			for {
+				if _, err := reader.ReadTag(); err != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestTagHelpers(t *testing.T) {
+	f, err := os.Open("test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	demuxer := new(Demuxer)
+	if _, err := demuxer.ReadHeader(f); err != nil {
+		t.Fatal(err)
+	}
+	var metaData, headers int
+	for {
+		tag, err := demuxer.ReadTag(f)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if script, ok := tag.(*ScriptTag); ok && IsMetaData(script) {
+			metaData++
+		}
+		if !IsSequenceHeader(tag) {
+			continue
+		}
+		headers++
+		video, ok := tag.(*VideoTag)
+		if !ok {
+			t.Fatalf("the audio is MP3, unexpected sequence header %s", tag.Type())
+		}
+		sps := video.SPS()
+		if sps == nil || sps.Width() != 544 || sps.Height() != 960 {
+			t.Fatalf("unexpected SPS %v", sps)
+		}
+	}
+	if metaData != 1 || headers != 1 {
+		t.Fatalf("onMetaData %d, sequence headers %d, want 1 and 1", metaData, headers)
+	}
+	if IsSequenceHeader(&VideoTag{CodecID: H263, PacketType: SequenceHeader}) {
+		t.Fatal("H263 has no sequence header")
+	}
+	if (&VideoTag{CodecID: H264, PacketType: AVPacket}).SPS() != nil {
+		t.Fatal("SPS of a frame should be nil")
+	}
+}
+
+func TestSEIAndSliceTypes(t *testing.T) {
+	// user_data_unregistered(5) of 3 bytes 0x000001 and recovery_point(4), escaped as 0x00000301
+	sei := []byte{0x06, 0x05, 0x03, 0x00, 0x00, 0x03, 0x01, 0x04, 0x01, 0xAA, 0x80}
+	// first_mb_in_slice 2^22-1 has 22 leading zero bits, slice_type 2(I), escaped twice
+	idr := []byte{0x65, 0x00, 0x00, 0x03, 0x02, 0x00, 0x00, 0x03, 0x03, 0x80}
+	// first_mb_in_slice 0, slice_type 0(P)
+	slice := []byte{0x41, 0xE0}
+	tag := &VideoTag{CodecID: H264, FrameType: KeyFrame, NALUs: [][]byte{sei, idr, slice}}
+	vars := tag.ToVars()
+	if got := vars[formatter.ElementSEITypes]; got != "[5 4]" {
+		t.Fatalf("sei_types %v, want [5 4]", got)
+	}
+	if got := vars[formatter.ElementSliceTypes]; got != "[I P]" {
+		t.Fatalf("slice_types %v, want [I P]", got)
+	}
+	if payloadType, payloadSize, payload := tag.SEI(); payloadType != 5 || payloadSize != 3 || !bytes.Equal(payload, []byte{0, 0, 1}) {
+		t.Fatalf("SEI %d %d %x, want 5 3 000001", payloadType, payloadSize, payload)
+	}
+
+	// SEI prefix of HEVC, the NALU header is 2 bytes
+	hevcSEI := []byte{0x4E, 0x01, 0x05, 0x03, 0x00, 0x00, 0x03, 0x01, 0x80}
+	tag = &VideoTag{CodecID: H265, NALUs: [][]byte{hevcSEI}}
+	vars = tag.ToVars()
+	if got := vars[formatter.ElementSEITypes]; got != "[5]" {
+		t.Fatalf("sei_types of HEVC %v, want [5]", got)
+	}
+	if got := vars[formatter.ElementSliceTypes]; got != "[]" {
+		t.Fatalf("slice_types of HEVC %v, want []", got)
+	}
+}
+
+func TestBitrateWindowRewind(t *testing.T) {
+	var w bitrateWindow
+	for timestamp := int64(0); timestamp < 10000; timestamp += 100 {
+		w.add(timestamp, 1000)
+	}
+	// the stream restarts from 0, e.g. after reconnect, the samples before are dropped
+	for timestamp := int64(0); timestamp < 500; timestamp += 100 {
+		if got, want := w.add(timestamp, 1000), float64(timestamp/100+1)*8; got != want {
+			t.Fatalf("bitrate at %d after rewind: got %v, want %v", timestamp, got, want)
+		}
+	}
+	if len(w.timestamps) != 5 || len(w.sizes) != 5 {
+		t.Fatalf("window should only keep the samples after rewind, got %d", len(w.timestamps))
+	}
+}
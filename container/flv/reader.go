@@ -0,0 +1,466 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+	"github.com/foolishCDN/AV-spy/utils"
+)
+
+const (
+	// bisectWindow is the size of byte range scanned linearly when binary searching a timestamp
+	bisectWindow = 64 << 10
+	// maxLeadingTags is the number of tags read by NewReader to find onMetaData and sequence headers
+	maxLeadingTags = 64
+)
+
+// IndexEntry is an entry of the keyframes index of onMetaData.
+type IndexEntry struct {
+	Timestamp uint32 // ms
+	Offset    int64  // byte offset of the tag in file
+}
+
+// Reader reads tags of a FLV file like Demuxer, and it can seek to a timestamp.
+//
+// Seek uses the keyframes index (times/filepositions) of onMetaData if it's present and valid,
+// otherwise it binary searches the file by timestamps and resynchronizes on tags.
+type Reader struct {
+	r         io.ReadSeeker
+	demuxer   *Demuxer
+	header    *Header
+	dataStart int64
+	size      int64
+	hasVideo  bool
+
+	index   []IndexEntry
+	headers map[TagType][]headerAt // the sequence headers read, in the order of offset
+	queue   []TagI                 // the sequence headers returned before the tags after Seek
+}
+
+// headerAt is a sequence header and its offset in file
+type headerAt struct {
+	offset int64
+	tag    TagI
+}
+
+// NewReader reads the FLV header and the leading tags to find onMetaData and the sequence headers,
+// demuxer decides how the tags are read, e.g. MaxTagSize and Resync, a new one is used if it's nil.
+func NewReader(r io.ReadSeeker, demuxer *Demuxer) (*Reader, error) {
+	if demuxer == nil {
+		demuxer = new(Demuxer)
+	}
+	reader := &Reader{r: r, demuxer: demuxer, headers: make(map[TagType][]headerAt)}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	reader.size = size
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if reader.header, err = demuxer.ReadHeader(r); err != nil {
+		return nil, err
+	}
+	reader.dataStart = demuxer.offset
+	reader.hasVideo = reader.header.HasVideo
+	for i := 0; i < maxLeadingTags; i++ {
+		tag, err := unwrapTag(demuxer.ReadTag(r))
+		if err != nil {
+			break
+		}
+		reader.track(tag, demuxer.TagOffset())
+		if script, ok := tag.(*ScriptTag); ok && reader.index == nil {
+			reader.index = reader.parseIndex(script)
+		}
+		if video, ok := tag.(*VideoTag); ok {
+			reader.hasVideo = true
+			if !IsSequenceHeader(video) {
+				break
+			}
+		}
+	}
+	return reader, reader.reposition(reader.dataStart)
+}
+
+// Header returns the FLV header.
+func (reader *Reader) Header() *Header {
+	return reader.header
+}
+
+// Index returns the keyframes index of onMetaData, nil if it's absent or invalid.
+func (reader *Reader) Index() []IndexEntry {
+	return reader.index
+}
+
+// ReadTag reads the next tag like Demuxer.ReadTag, the active sequence headers are returned first after Seek.
+func (reader *Reader) ReadTag() (TagI, error) {
+	if len(reader.queue) > 0 {
+		tag := reader.queue[0]
+		reader.queue = reader.queue[1:]
+		return tag, nil
+	}
+	tag, err := reader.demuxer.ReadTag(reader.r)
+	if t, _ := unwrapTag(tag, err); t != nil {
+		reader.track(t, reader.demuxer.TagOffset())
+	}
+	return tag, err
+}
+
+// Seek positions the reader at the nearest keyframe at or before timestamp (ms), the first tag if there isn't one.
+// The next ReadTag returns the active sequence headers, then the keyframe and the tags after it.
+// If there is no video, every audio frame is a keyframe.
+func (reader *Reader) Seek(timestamp uint32) error {
+	offset, headers, err := reader.seekByIndex(timestamp)
+	if err != nil {
+		if offset, headers, err = reader.search(timestamp); err != nil {
+			return err
+		}
+	}
+	reader.queue = reader.queue[:0]
+	for _, tagType := range []TagType{TagVideo, TagAudio} {
+		if tag, ok := headers[tagType]; ok {
+			reader.queue = append(reader.queue, tag)
+		}
+	}
+	return reader.reposition(offset)
+}
+
+var (
+	errInvalidIndex           = errors.New("flv reader keyframes index of onMetaData is invalid")
+	errInvalidPreviousTagSize = errors.New("flv reader previousTagSize doesn't point to a tag")
+)
+
+// seekByIndex returns the offset of keyframe by the index and the sequence headers active at it.
+func (reader *Reader) seekByIndex(timestamp uint32) (int64, map[TagType]TagI, error) {
+	if len(reader.index) == 0 {
+		return 0, nil, errInvalidIndex
+	}
+	i := sort.Search(len(reader.index), func(i int) bool {
+		return reader.index[i].Timestamp > timestamp
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	keyFrame := reader.index[i]
+	demuxer, err := reader.scanner(keyFrame.Offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	tag, offset, err := nextTag(demuxer, reader.r)
+	if err != nil || offset != keyFrame.Offset || !reader.isKeyFrame(tag) {
+		return 0, nil, errInvalidIndex
+	}
+	// the times of index are seconds in float, allow the rounding error
+	if diff := int64(tag.Timestamp()) - int64(keyFrame.Timestamp); diff < -1 || diff > 1 {
+		return 0, nil, errInvalidIndex
+	}
+	return keyFrame.Offset, reader.headersAt(keyFrame.Offset), nil
+}
+
+// search returns the offset of keyframe by binary searching timestamp, the sequence headers are found by scanning forward.
+func (reader *Reader) search(timestamp uint32) (int64, map[TagType]TagI, error) {
+	end, target := reader.size, timestamp
+	for {
+		start, err := reader.bisect(target)
+		if err != nil {
+			return 0, nil, err
+		}
+		if start >= end {
+			start = reader.dataStart
+		}
+		headers := reader.headersAt(start)
+		demuxer, err := reader.scanner(start)
+		if err != nil {
+			return 0, nil, err
+		}
+		var found int64 = -1
+		var foundHeaders map[TagType]TagI
+		var first TagI // the first media tag scanned
+		for {
+			tag, offset, err := nextTag(demuxer, reader.r)
+			if err == io.EOF || err == io.ErrUnexpectedEOF || offset >= end {
+				break
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			if tag.Type() == TagScript {
+				continue
+			}
+			if first == nil {
+				first = tag
+			}
+			if tag.Timestamp() > timestamp {
+				break
+			}
+			if IsSequenceHeader(tag) {
+				reader.track(tag, offset)
+				headers[tag.Type()] = tag
+				continue
+			}
+			if reader.isKeyFrame(tag) {
+				found = offset
+				foundHeaders = make(map[TagType]TagI, len(headers))
+				for tagType, header := range headers {
+					foundHeaders[tagType] = header
+				}
+			}
+		}
+		if found >= 0 {
+			return found, foundHeaders, nil
+		}
+		if start == reader.dataStart {
+			// the sequence headers are read from the first tag
+			return reader.dataStart, nil, nil
+		}
+		// the keyframe is before start
+		end = start
+		if first == nil || first.Timestamp() == 0 {
+			target = 0
+		} else {
+			target = first.Timestamp() - 1
+		}
+	}
+}
+
+// bisect returns the offset of a media tag whose timestamp is at or before target and close to it,
+// the tags are supposed to be in the order of timestamp.
+func (reader *Reader) bisect(target uint32) (int64, error) {
+	lo, hi := reader.dataStart, reader.size
+	for hi-lo > bisectWindow {
+		mid := lo + (hi-lo)/2
+		demuxer, err := reader.scanner(mid)
+		if err != nil {
+			return 0, err
+		}
+		var tag TagI
+		var offset int64
+		for {
+			if tag, offset, err = nextTag(demuxer, reader.r); err != nil || tag.Type() != TagScript {
+				break
+			}
+		}
+		if err != nil || tag.Timestamp() > target || offset >= hi {
+			hi = mid
+			continue
+		}
+		lo = offset
+	}
+	return lo, nil
+}
+
+// scanner returns a demuxer reading from offset, it resynchronizes if offset isn't the start of a tag.
+func (reader *Reader) scanner(offset int64) (*Demuxer, error) {
+	if _, err := reader.r.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &Demuxer{
+		TimestampLayout: reader.demuxer.TimestampLayout,
+		MaxTagSize:      reader.demuxer.MaxTagSize,
+		Resync:          true,
+		offset:          offset,
+	}, nil
+}
+
+// nextTag reads the next plausible tag and its offset
+func nextTag(demuxer *Demuxer, r io.Reader) (TagI, int64, error) {
+	for {
+		tag, err := demuxer.ReadTag(r)
+		var resyncErr *ResyncError
+		if errors.As(err, &resyncErr) {
+			if resyncErr.Tag == nil {
+				continue
+			}
+			return resyncErr.Tag, resyncErr.End, nil
+		}
+		if tag, err = unwrapTag(tag, err); err != nil {
+			return nil, 0, err
+		}
+		return tag, demuxer.TagOffset(), nil
+	}
+}
+
+// unwrapTag returns the tag of PreviousTagSizeError and ResyncError
+func unwrapTag(tag TagI, err error) (TagI, error) {
+	var sizeErr *PreviousTagSizeError
+	var resyncErr *ResyncError
+	switch {
+	case errors.As(err, &sizeErr):
+		return sizeErr.Tag, nil
+	case errors.As(err, &resyncErr) && resyncErr.Tag != nil:
+		return resyncErr.Tag, nil
+	}
+	return tag, err
+}
+
+// reposition makes the demuxer of reader read from offset
+func (reader *Reader) reposition(offset int64) error {
+	if _, err := reader.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	demuxer := reader.demuxer
+	demuxer.offset = offset
+	demuxer.pending = nil
+	demuxer.layoutVotes = 0
+	for i := range demuxer.lastTimestamps {
+		demuxer.lastTimestamps[i].seen = false
+	}
+	return nil
+}
+
+// track records tag at offset if it's a sequence header
+func (reader *Reader) track(tag TagI, offset int64) {
+	if !IsSequenceHeader(tag) {
+		return
+	}
+	headers := reader.headers[tag.Type()]
+	i := sort.Search(len(headers), func(i int) bool {
+		return headers[i].offset >= offset
+	})
+	if i < len(headers) && headers[i].offset == offset {
+		return
+	}
+	headers = append(headers, headerAt{})
+	copy(headers[i+1:], headers[i:])
+	headers[i] = headerAt{offset: offset, tag: tag}
+	reader.headers[tag.Type()] = headers
+}
+
+// headersAt returns the sequence headers active at the tag at offset, that are the last ones before it.
+// The tags before offset are read backwards by previousTagSize, until the sequence header of every track having one
+// is found or the one read before is reached, so a header between them that isn't read yet isn't missed.
+// The ones read before are used if the tags can't be read backwards, e.g. previousTagSize is broken.
+func (reader *Reader) headersAt(offset int64) map[TagType]TagI {
+	headers := make(map[TagType]TagI, len(reader.headers))
+	known := make(map[TagType]int64, len(reader.headers)) // offset of the header read last before offset
+	for tagType, read := range reader.headers {
+		known[tagType] = reader.dataStart
+		i := sort.Search(len(read), func(i int) bool {
+			return read[i].offset >= offset
+		}) - 1
+		if i >= 0 {
+			headers[tagType], known[tagType] = read[i].tag, read[i].offset
+		}
+	}
+	for len(known) > 0 {
+		prev, tagType, header, err := reader.previousTag(offset)
+		if err != nil {
+			break
+		}
+		if _, ok := known[tagType]; ok && header != nil {
+			reader.track(header, prev)
+			headers[tagType] = header
+			delete(known, tagType)
+		}
+		for tagType, at := range known {
+			if prev <= at {
+				delete(known, tagType)
+			}
+		}
+		offset = prev
+	}
+	return headers
+}
+
+// previousTag returns the offset and type of the tag before the one at offset by previousTagSize,
+// and the tag if it's a sequence header, the other tags aren't read.
+func (reader *Reader) previousTag(offset int64) (int64, TagType, TagI, error) {
+	if offset-4 <= reader.dataStart {
+		return 0, 0, nil, io.EOF
+	}
+	var b [11 + 2]byte
+	if _, err := reader.r.Seek(offset-4, io.SeekStart); err != nil {
+		return 0, 0, nil, err
+	}
+	if _, err := io.ReadFull(reader.r, b[:4]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(b[:4]))
+	prev := offset - 4 - size
+	if size < 11 || prev < reader.dataStart {
+		return 0, 0, nil, errInvalidPreviousTagSize
+	}
+	if _, err := reader.r.Seek(prev, io.SeekStart); err != nil {
+		return 0, 0, nil, err
+	}
+	if _, err := io.ReadFull(reader.r, b[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	tagType := TagType(b[0])
+	if (tagType != TagAudio && tagType != TagVideo && tagType != TagScript) || int64(utils.BigEndianUint24(b[1:4]))+11 != size {
+		return 0, 0, nil, errInvalidPreviousTagSize
+	}
+	// the sequence headers of AVC/HEVC/AAC are marked by the packet type 0 after the first byte
+	isHeader := b[12] == SequenceHeader && size > 11+1 &&
+		(tagType == TagVideo && (CodecID(b[11]&0x0f) == H264 || CodecID(b[11]&0x0f) == H265) ||
+			tagType == TagAudio && SoundFormat(b[11]>>4) == AAC)
+	if !isHeader {
+		return prev, tagType, nil, nil
+	}
+	demuxer, err := reader.scanner(prev)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	demuxer.Resync = false
+	tag, err := unwrapTag(demuxer.ReadTag(reader.r))
+	if err != nil || !IsSequenceHeader(tag) {
+		return 0, 0, nil, errInvalidPreviousTagSize
+	}
+	return prev, tagType, tag, nil
+}
+
+func (reader *Reader) isKeyFrame(tag TagI) bool {
+	switch t := tag.(type) {
+	case *VideoTag:
+		return t.FrameType == KeyFrame && !IsSequenceHeader(t)
+	case *AudioTag:
+		return !reader.hasVideo && !IsSequenceHeader(t)
+	}
+	return false
+}
+
+// parseIndex returns the keyframes index of onMetaData, nil if it isn't onMetaData or the index is invalid.
+func (reader *Reader) parseIndex(tag *ScriptTag) []IndexEntry {
+	values, err := amf.NewDecoder(amf.Version0).DecodeBatch(bytes.NewReader(tag.Bytes))
+	if err != nil || len(values) < 2 || values[0] != "onMetaData" {
+		return nil
+	}
+	var metaData map[string]interface{}
+	switch t := values[1].(type) {
+	case amf.ECMAArray:
+		metaData = t
+	case map[string]interface{}:
+		metaData = t
+	}
+	var keyframes map[string]interface{}
+	switch t := metaData["keyframes"].(type) {
+	case amf.ECMAArray:
+		keyframes = t
+	case map[string]interface{}:
+		keyframes = t
+	}
+	times, _ := keyframes["times"].([]interface{})
+	positions, _ := keyframes["filepositions"].([]interface{})
+	if len(times) == 0 || len(times) != len(positions) {
+		return nil
+	}
+	index := make([]IndexEntry, 0, len(times))
+	for i := range times {
+		t, ok1 := times[i].(float64)
+		position, ok2 := positions[i].(float64)
+		if !ok1 || !ok2 || t < 0 || position < float64(reader.dataStart) || position >= float64(reader.size) {
+			return nil
+		}
+		keyFrame := IndexEntry{Timestamp: uint32(math.Round(t * 1000)), Offset: int64(position)}
+		if len(index) > 0 && keyFrame.Timestamp < index[len(index)-1].Timestamp {
+			return nil
+		}
+		index = append(index, keyFrame)
+	}
+	return index
+}
@@ -0,0 +1,122 @@
+package flv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/foolishCDN/AV-spy/utils"
+)
+
+// ResyncError is returned by ReadTag in Resync mode if the bytes [Start, End) are skipped to find the next plausible tag,
+// that is a tag of valid type, sane size and StreamID 0 followed by the matched previousTagSize.
+// Tag is the tag found, it's nil if the stream ends before finding a plausible tag.
+type ResyncError struct {
+	Start  int64
+	End    int64
+	Reason error // why the tag at Start is treated as corruption
+	Tag    TagI
+}
+
+func (e *ResyncError) Error() string {
+	return fmt.Sprintf("flv demuxer skipped corrupted bytes [%d, %d): %v", e.Start, e.End, e.Reason)
+}
+
+// resync scans forward from the byte after start for a plausible tag, bad are the bytes read from start.
+func (demuxer *Demuxer) resync(r io.Reader, start int64, bad []byte, reason error) (TagI, error) {
+	e := &ResyncError{Start: start, Reason: reason}
+	window := append([]byte(nil), bad[1:]...)
+	offset := start + 1 // offset of window[0]
+	for {
+		if len(window) < 11 {
+			b, err := demuxer.readAhead(r, 11-len(window))
+			window = append(window, b...)
+			if err != nil {
+				e.End = offset + int64(len(window))
+				demuxer.offset = e.End
+				return nil, e
+			}
+		}
+		if demuxer.validHeader(window) && window[8] == 0 && window[9] == 0 && window[10] == 0 {
+			need := 11 + int(utils.BigEndianUint24(window[1:4])) + 4
+			if len(window) < need {
+				b, _ := demuxer.readAhead(r, need-len(window))
+				window = append(window, b...)
+			}
+			if len(window) >= need && binary.BigEndian.Uint32(window[need-4:need]) == uint32(need-4) {
+				demuxer.unread(window)
+				demuxer.offset = offset
+				e.End = offset
+				tag, err := demuxer.ReadTag(r)
+				if err != nil {
+					return nil, err
+				}
+				e.Tag = tag
+				return tag, e
+			}
+		}
+		window = window[1:]
+		offset++
+	}
+}
+
+// validHeader returns true if the tag header has valid type and sane size
+func (demuxer *Demuxer) validHeader(header []byte) bool {
+	tagType := TagType(header[0])
+	if tagType != TagAudio && tagType != TagVideo && tagType != TagScript {
+		return false
+	}
+	size := utils.BigEndianUint24(header[1:4])
+	if demuxer.MaxTagSize > 0 && size > demuxer.MaxTagSize {
+		return false
+	}
+	return size >= uint32(minTagSize(tagType, nil))
+}
+
+// followedByTag returns true if the next bytes are a valid tag header or the stream ends
+func (demuxer *Demuxer) followedByTag(r io.Reader) bool {
+	b, err := demuxer.readAhead(r, 11)
+	demuxer.unread(b)
+	return err != nil || demuxer.validHeader(b)
+}
+
+// readFull is io.ReadFull of the bytes read ahead followed by r
+func (demuxer *Demuxer) readFull(r io.Reader, p []byte) error {
+	n := copy(p, demuxer.pending)
+	demuxer.pending = demuxer.pending[n:]
+	if n == len(p) {
+		return nil
+	}
+	if _, err := io.ReadFull(r, p[n:]); err != nil {
+		if n > 0 && err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// readAhead reads n bytes like io.ReadFull, it returns the bytes read and an error if fewer than n bytes are read.
+func (demuxer *Demuxer) readAhead(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	m := copy(b, demuxer.pending)
+	demuxer.pending = demuxer.pending[m:]
+	if m < n {
+		k, err := io.ReadFull(r, b[m:])
+		if err != nil {
+			if m > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return b[:m+k], err
+		}
+	}
+	return b, nil
+}
+
+// unread puts b back to be read before the pending bytes
+func (demuxer *Demuxer) unread(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	demuxer.pending = append(append([]byte(nil), b...), demuxer.pending...)
+}
@@ -1,11 +1,13 @@
 package flv
 
 import (
+	"bytes"
 	"fmt"
 
 	"github.com/foolishCDN/AV-spy/codec"
 	"github.com/foolishCDN/AV-spy/codec/avc"
 	"github.com/foolishCDN/AV-spy/codec/hevc"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
 	"github.com/foolishCDN/AV-spy/formatter"
 	"github.com/foolishCDN/AV-spy/utils"
 )
@@ -26,6 +28,23 @@ type TagI interface {
 	Timestamp() uint32
 }
 
+// IsSequenceHeader returns true if the tag is the sequence header of AVC/HEVC/AAC.
+func IsSequenceHeader(tag TagI) bool {
+	switch t := tag.(type) {
+	case *VideoTag:
+		return (t.CodecID == H264 || t.CodecID == H265) && t.PacketType == SequenceHeader
+	case *AudioTag:
+		return t.SoundFormat == AAC && t.PacketType == SequenceHeader
+	}
+	return false
+}
+
+// IsMetaData returns true if the script tag is onMetaData.
+func IsMetaData(tag *ScriptTag) bool {
+	name, err := amf.NewDecoder(amf.Version0).Decode(bytes.NewReader(tag.Bytes))
+	return err == nil && name == "onMetaData"
+}
+
 // AudioTag ...
 type AudioTag struct {
 	SoundFormat  SoundFormat
@@ -69,7 +88,9 @@ func (tag *AudioTag) ToVars() map[formatter.ElementName]interface{} {
 		formatter.ElementStreamID:          tag.StreamID,
 		formatter.ElementPTS:               tag.PTS,
 		formatter.ElementDTS:               tag.PTS,
+		formatter.ElementCTS:               0,
 		formatter.ElementSize:              len(tag.Data()),
+		formatter.ElementKeyFrame:          true,
 		formatter.ElementAudioSoundFormant: tag.SoundFormat.String(),
 		formatter.ElementAudioChannels:     tag.Channels.String(),
 		formatter.ElementAudioSampleRate:   tag.SampleRate.String(),
@@ -170,36 +191,136 @@ func (tag *VideoTag) NALUTypes() ([]uint8, string) {
 	return nil, "unsupported"
 }
 
+// SEI returns the payload type, size and payload of the first SEI message in the tag,
+// the payload is in RBSP, that is the emulation prevention bytes are removed.
 func (tag *VideoTag) SEI() (int, int, []byte) {
+	naluTypes, _ := tag.NALUTypes()
+	for i, naluType := range naluTypes {
+		data, ok := tag.seiRBSP(naluType, tag.NALUs[i])
+		if !ok {
+			continue
+		}
+		payloadType, data := readSEIValue(data)
+		payloadSize, data := readSEIValue(data)
+		return payloadType, payloadSize, data[:min(payloadSize, len(data))]
+	}
+	return 0, 0, nil
+}
+
+// SEITypes returns the payload types of all SEI messages in the tag.
+func (tag *VideoTag) SEITypes() []int {
+	var types []int
+	naluTypes, _ := tag.NALUTypes()
+	for i, naluType := range naluTypes {
+		if data, ok := tag.seiRBSP(naluType, tag.NALUs[i]); ok {
+			types = append(types, seiPayloadTypes(data)...)
+		}
+	}
+	return types
+}
+
+// seiRBSP returns sei_rbsp() of nalu without NALU header, ok is false if nalu isn't SEI.
+// The payload sizes count the bytes of RBSP, so the emulation prevention bytes are removed first.
+func (tag *VideoTag) seiRBSP(naluType uint8, nalu []byte) (data []byte, ok bool) {
+	headerSize := 0
+	switch {
+	case tag.CodecID == H264 && naluType == avc.NalSEI:
+		headerSize = 1
+	case tag.CodecID == H265 && (naluType == hevc.NalSEIPrefix || naluType == hevc.NalSEISuffix):
+		headerSize = 2
+	default:
+		return nil, false
+	}
+	rbsp := codec.RBSP(nalu)
+	if len(rbsp) < headerSize {
+		return nil, false
+	}
+	return rbsp[headerSize:], true
+}
+
+// seiPayloadTypes reads the sei_message()s of sei_rbsp() until rbsp_trailing_bits.
+func seiPayloadTypes(data []byte) []int {
+	var types []int
+	for len(data) >= 2 && data[0] != 0x80 {
+		payloadType, rest := readSEIValue(data)
+		payloadSize, rest := readSEIValue(rest)
+		types = append(types, payloadType)
+		if payloadSize > len(rest) {
+			break
+		}
+		data = rest[payloadSize:]
+	}
+	return types
+}
+
+// readSEIValue reads payloadType or payloadSize of sei_message(), it's the sum of the 0xFF bytes and the byte after.
+func readSEIValue(data []byte) (int, []byte) {
+	v := 0
+	for len(data) > 0 {
+		b := data[0]
+		data = data[1:]
+		v += int(b)
+		if b != 0xFF {
+			break
+		}
+	}
+	return v, data
+}
+
+// SliceTypes returns the slice types of all slices in the tag, it only supports AVC now
+// because the slice header of HEVC can't be parsed without PPS.
+func (tag *VideoTag) SliceTypes() []avc.SliceType {
+	if tag.CodecID != H264 {
+		return nil
+	}
+	var types []avc.SliceType
+	naluTypes, _ := tag.NALUTypes()
+	for i, naluType := range naluTypes {
+		if naluType != avc.NalSlice && naluType != avc.NalIDRSlice {
+			continue
+		}
+		// BitReader skips the emulation prevention bytes itself
+		reader := utils.NewBitReader(tag.NALUs[i])
+		avc.ParseNALUHeader(reader)
+		types = append(types, avc.ParseSliceType(reader))
+	}
+	return types
+}
+
+// SPS returns the first SPS of AVC/HEVC sequence header, nil if it isn't a sequence header or the SPS can't be parsed.
+func (tag *VideoTag) SPS() codec.SPS {
+	if !IsSequenceHeader(tag) {
+		return nil
+	}
 	switch tag.CodecID {
 	case H264:
-		naluTypes, _ := tag.NALUTypes()
-		for i, naluType := range naluTypes {
-			if naluType != avc.NalSEI {
-				continue
-			}
-			nalu := tag.NALUs[i]
-			reader := utils.NewBitReader(nalu)
-			avc.ParseNALUHeader(reader)
-			payloadType := reader.Read8BitsUntilNot0xFF()
-			payloadSize := reader.Read8BitsUntilNot0xFF()
-			return payloadType, payloadSize, reader.LastData()[:payloadSize]
+		record := new(avc.AVCDecoderConfigurationRecord)
+		if err := record.Read(tag.Bytes); err != nil || len(record.SPS) == 0 {
+			return nil
+		}
+		reader := utils.NewBitReader(record.SPS[0])
+		avc.ParseNALUHeader(reader)
+		if sps, err := avc.ParseSPS(reader); err == nil {
+			return sps
 		}
 	case H265:
-		naluTypes, _ := tag.NALUTypes()
-		for i, naluType := range naluTypes {
-			if naluType != hevc.NalSEIPrefix && naluType != hevc.NalSEISuffix {
+		record := new(hevc.HEVCDecoderConfigurationRecord)
+		if err := record.Read(tag.Bytes); err != nil {
+			return nil
+		}
+		for _, ps := range record.NALUs {
+			if ps.NALUnitType != hevc.NalSPS || len(ps.NALUs) == 0 {
 				continue
 			}
-			nalu := tag.NALUs[i]
-			reader := utils.NewBitReader(nalu)
+			reader := utils.NewBitReader(ps.NALUs[0])
 			hevc.ParseNALUHeader(reader)
-			payloadType := reader.Read8BitsUntilNot0xFF()
-			payloadSize := reader.Read8BitsUntilNot0xFF()
-			return payloadType, payloadSize, reader.LastData()[:payloadSize]
+			if sps, err := hevc.ParseSPS(reader); err == nil {
+				return sps
+			}
+			return nil
 		}
 	}
-	return 0, 0, nil
+	return nil
 }
 
 func (tag *VideoTag) ToVars() map[formatter.ElementName]interface{} {
@@ -216,8 +337,13 @@ func (tag *VideoTag) ToVars() map[formatter.ElementName]interface{} {
 		formatter.ElementStreamID:       tag.StreamID,
 		formatter.ElementPTS:            tag.PTS,
 		formatter.ElementDTS:            tag.DTS,
+		formatter.ElementCTS:            int64(tag.PTS) - int64(tag.DTS),
 		formatter.ElementSize:           len(tag.Data()),
+		formatter.ElementKeyFrame:       tag.FrameType == KeyFrame,
 		formatter.ElementNALUTypes:      fmt.Sprintf("%s %v", t, naluTypes),
+		formatter.ElementNALUCount:      len(naluTypes),
+		formatter.ElementSEITypes:       fmt.Sprint(tag.SEITypes()),
+		formatter.ElementSliceTypes:     fmt.Sprint(tag.SliceTypes()),
 		formatter.ElementVideoFrameType: tag.FrameType.String(),
 		formatter.ElementVideoCodecID:   tag.CodecID.String(),
 	}
@@ -0,0 +1,84 @@
+package flv
+
+import (
+	"time"
+
+	"github.com/foolishCDN/AV-spy/formatter"
+)
+
+// StreamVars returns the variables of tags with the elements depend on the stream,
+// e.g. formatter.ElementDeltaDTS, the tags should be passed in the order of stream.
+type StreamVars struct {
+	// Offset returns the offset of the current tag, e.g. Demuxer.TagOffset
+	Offset func() int64
+
+	firstArrival time.Time
+	tracks       map[TagType]*trackVars
+}
+
+type trackVars struct {
+	lastDTS int64
+	bitrate bitrateWindow
+}
+
+func NewStreamVars() *StreamVars {
+	return &StreamVars{
+		tracks: make(map[TagType]*trackVars),
+	}
+}
+
+// Vars returns the variables of tag received at now.
+func (s *StreamVars) Vars(tag TagI, now time.Time) map[formatter.ElementName]interface{} {
+	var vars map[formatter.ElementName]interface{}
+	switch t := tag.(type) {
+	case *AudioTag:
+		vars = t.ToVars()
+	case *VideoTag:
+		vars = t.ToVars()
+	case *ScriptTag:
+		vars = t.ToVars()
+	default:
+		vars = make(map[formatter.ElementName]interface{})
+	}
+	if s.firstArrival.IsZero() {
+		s.firstArrival = now
+	}
+	vars[formatter.ElementArrivalMs] = float64(now.Sub(s.firstArrival)) / float64(time.Millisecond)
+	if s.Offset != nil {
+		vars[formatter.ElementByteOffset] = s.Offset()
+	}
+	dts := int64(tag.Timestamp())
+	track, ok := s.tracks[tag.Type()]
+	if !ok {
+		track = &trackVars{lastDTS: dts}
+		s.tracks[tag.Type()] = track
+	}
+	vars[formatter.ElementDeltaDTS] = dts - track.lastDTS
+	vars[formatter.ElementBitrate] = track.bitrate.add(dts, len(tag.Data()))
+	track.lastDTS = dts
+	return vars
+}
+
+// bitrateWindow sums the size of tags in the last second by timestamp.
+type bitrateWindow struct {
+	timestamps []int64
+	sizes      []int
+	bytes      int
+}
+
+// add adds a tag and returns the bitrate(kbps) of the last second,
+// the window restarts if the timestamp rewinds, e.g. after reconnect.
+func (w *bitrateWindow) add(timestamp int64, size int) float64 {
+	if n := len(w.timestamps); n > 0 && timestamp < w.timestamps[n-1] {
+		w.timestamps, w.sizes, w.bytes = w.timestamps[:0], w.sizes[:0], 0
+	}
+	w.timestamps = append(w.timestamps, timestamp)
+	w.sizes = append(w.sizes, size)
+	w.bytes += size
+	for len(w.timestamps) > 1 && timestamp-w.timestamps[0] >= 1000 {
+		w.bytes -= w.sizes[0]
+		w.timestamps = w.timestamps[1:]
+		w.sizes = w.sizes[1:]
+	}
+	return float64(w.bytes) * 8 / 1000
+}
@@ -0,0 +1,89 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func roundTrip(t *testing.T, v interface{}) ([]byte, interface{}) {
+	var buf bytes.Buffer
+	if err := NewEncoder(Version0).Encode(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+	got, err := NewDecoder(Version0).Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, buf.Len(), "all bytes should be decoded")
+	return data, got
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	object := map[string]interface{}{
+		"b":      true,
+		"a":      1.5,
+		"nested": map[string]interface{}{"s": "x"},
+		"array":  []interface{}{1.0, "y", NullType{}},
+	}
+	_, got := roundTrip(t, object)
+	assert.Equal(t, object, got)
+
+	// the marker is written once before the properties, and the properties are in the order of keys
+	data, _ := roundTrip(t, map[string]interface{}{"b": true, "a": 1.0})
+	assert.Equal(t, []byte{
+		ObjectMarker,
+		0x00, 0x01, 'a', NumberMarker, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0,
+		0x00, 0x01, 'b', BooleanMarker, 0x01,
+		0x00, 0x00, ObjectEndMarker,
+	}, data)
+}
+
+func TestECMAArrayRoundTrip(t *testing.T) {
+	array := ECMAArray{
+		"duration":  10.0,
+		"hasVideo":  true,
+		"encoder":   "test",
+		"keyframes": map[string]interface{}{"times": []interface{}{0.0, 2.0}},
+	}
+	_, got := roundTrip(t, array)
+	assert.Equal(t, array, got)
+
+	data, _ := roundTrip(t, ECMAArray{"b": "", "a": ""})
+	assert.Equal(t, []byte{
+		ECMAArrayMarker, 0x00, 0x00, 0x00, 0x02,
+		0x00, 0x01, 'a', StringMarker, 0x00, 0x00,
+		0x00, 0x01, 'b', StringMarker, 0x00, 0x00,
+		0x00, 0x00, ObjectEndMarker,
+	}, data)
+}
+
+func TestTypedObjectRoundTrip(t *testing.T) {
+	object := &TypedObjectType{
+		ClassName: "Point",
+		Object:    map[string]interface{}{"y": 2.0, "x": 1.0},
+	}
+	_, got := roundTrip(t, object)
+	assert.Equal(t, object, got)
+
+	data, _ := roundTrip(t, &TypedObjectType{ClassName: "C", Object: map[string]interface{}{"b": NullType{}, "a": UndefinedType{}}})
+	assert.Equal(t, []byte{
+		TypedObjectMarker, 0x00, 0x01, 'C',
+		0x00, 0x01, 'a', UndefinedMarker,
+		0x00, 0x01, 'b', NullMarker,
+		0x00, 0x00, ObjectEndMarker,
+	}, data)
+}
+
+func TestEncodeBatchRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	values := []interface{}{"onMetaData", ECMAArray{"width": 1280.0, "height": 720.0}}
+	if err := NewEncoder(Version0).EncodeBatch(&buf, values...); err != nil {
+		t.Fatal(err)
+	}
+	got, err := NewDecoder(Version0).DecodeBatch(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, values, got)
+}
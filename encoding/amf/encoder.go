@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 )
 
 func NewEncoder(version int) *Encoder {
@@ -130,6 +131,9 @@ func (encoder *Encoder) EncodeString(w io.Writer, str string) error {
 
 func (encoder *Encoder) EncodeObject(w io.Writer, m map[string]interface{}) error {
 	encoder.refObjects = append(encoder.refObjects, m)
+	if err := encoder.EncodeMarker(w, ObjectMarker); err != nil {
+		return err
+	}
 	return encoder.writeObject(w, m)
 }
 
@@ -212,11 +216,14 @@ func (encoder *Encoder) EncodeTypedObject(w io.Writer, object *TypedObjectType)
 	return encoder.writeObject(w, object.Object)
 }
 
+// writeObject writes the object-properties in the order of keys
 func (encoder *Encoder) writeObject(w io.Writer, m map[string]interface{}) error {
-	if err := encoder.EncodeMarker(w, ObjectMarker); err != nil {
-		return err
-	}
+	keys := make([]string, 0, len(m))
 	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
 		if len(k) > math.MaxUint16 {
 			return errors.New("object key too long")
 		}
@@ -0,0 +1,252 @@
+// Package filter implements the expressions to select tags by their variables, e.g.
+//
+//	stream_type == "VIDEO" && frame_type == "KeyFrame" && size > 200000
+//	delta_dts > 100 || nalu_types =~ "\[.*6.*\]"
+//
+// An expression consists of
+//
+//   - element names registered in package formatter, e.g. pts, size, keyframe
+//   - literals: numbers, double quoted strings, true and false
+//   - comparisons: == != < <= > >= and =~ !~ to match a regular expression
+//   - logical operators: && || ! and parentheses
+//
+// A bare element is true if it is true, non-zero or non-empty.
+// Any comparison with an element which doesn't exist in the variables of tag is false.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/foolishCDN/AV-spy/formatter"
+)
+
+// Filter is a compiled expression, it's safe for concurrent use.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile parses the expression, the element names and the types of comparison are checked.
+func Compile(expr string) (*Filter, error) {
+	p := &parser{lexer: lexer{input: expr}}
+	if err := p.next(); err != nil {
+		return nil, fmt.Errorf("filter %q: %v", expr, err)
+	}
+	root, err := p.parseOr()
+	if err == nil && p.token.kind != tokenEOF {
+		err = fmt.Errorf("unexpected %s at %d", p.token, p.token.pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %v", expr, err)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// MustCompile is like Compile but panics if the expression is invalid.
+func MustCompile(expr string) *Filter {
+	f, err := Compile(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match reports whether the variables of tag match the expression, a nil Filter matches all.
+func (f *Filter) Match(vars map[formatter.ElementName]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	return f.root.eval(vars).truth()
+}
+
+type valueKind int
+
+const (
+	valueMissing valueKind = iota
+	valueNumber
+	valueString
+	valueBool
+)
+
+type value struct {
+	kind valueKind
+	num  float64
+	str  string
+	b    bool
+}
+
+func (v value) truth() bool {
+	switch v.kind {
+	case valueNumber:
+		return v.num != 0
+	case valueString:
+		return v.str != ""
+	case valueBool:
+		return v.b
+	}
+	return false
+}
+
+func toValue(i interface{}) value {
+	switch v := i.(type) {
+	case nil:
+		return value{}
+	case bool:
+		return value{kind: valueBool, b: v}
+	case string:
+		return value{kind: valueString, str: v}
+	case int:
+		return value{kind: valueNumber, num: float64(v)}
+	case int8:
+		return value{kind: valueNumber, num: float64(v)}
+	case int16:
+		return value{kind: valueNumber, num: float64(v)}
+	case int32:
+		return value{kind: valueNumber, num: float64(v)}
+	case int64:
+		return value{kind: valueNumber, num: float64(v)}
+	case uint:
+		return value{kind: valueNumber, num: float64(v)}
+	case uint8:
+		return value{kind: valueNumber, num: float64(v)}
+	case uint16:
+		return value{kind: valueNumber, num: float64(v)}
+	case uint32:
+		return value{kind: valueNumber, num: float64(v)}
+	case uint64:
+		return value{kind: valueNumber, num: float64(v)}
+	case float32:
+		return value{kind: valueNumber, num: float64(v)}
+	case float64:
+		return value{kind: valueNumber, num: v}
+	case fmt.Stringer:
+		return value{kind: valueString, str: v.String()}
+	}
+	return value{kind: valueString, str: fmt.Sprint(i)}
+}
+
+type node interface {
+	eval(vars map[formatter.ElementName]interface{}) value
+}
+
+type literalNode struct {
+	v value
+}
+
+func (n *literalNode) eval(map[formatter.ElementName]interface{}) value {
+	return n.v
+}
+
+type elementNode struct {
+	name formatter.ElementName
+	kind formatter.Kind
+}
+
+func (n *elementNode) eval(vars map[formatter.ElementName]interface{}) value {
+	v, ok := vars[n.name]
+	if !ok {
+		return value{}
+	}
+	return toValue(v)
+}
+
+type notNode struct {
+	x node
+}
+
+func (n *notNode) eval(vars map[formatter.ElementName]interface{}) value {
+	return value{kind: valueBool, b: !n.x.eval(vars).truth()}
+}
+
+type logicalNode struct {
+	and  bool
+	x, y node
+}
+
+func (n *logicalNode) eval(vars map[formatter.ElementName]interface{}) value {
+	x := n.x.eval(vars).truth()
+	if n.and && !x || !n.and && x {
+		return value{kind: valueBool, b: x}
+	}
+	return value{kind: valueBool, b: n.y.eval(vars).truth()}
+}
+
+type compareNode struct {
+	op   string
+	x, y node
+}
+
+func (n *compareNode) eval(vars map[formatter.ElementName]interface{}) value {
+	x, y := n.x.eval(vars), n.y.eval(vars)
+	if x.kind == valueMissing || y.kind == valueMissing || x.kind != y.kind {
+		return value{kind: valueBool}
+	}
+	var c int
+	switch x.kind {
+	case valueNumber:
+		c = compare(x.num < y.num, x.num > y.num)
+	case valueString:
+		c = compare(x.str < y.str, x.str > y.str)
+	case valueBool:
+		c = compare(!x.b && y.b, x.b && !y.b)
+	}
+	var b bool
+	switch n.op {
+	case "==":
+		b = c == 0
+	case "!=":
+		b = c != 0
+	case "<":
+		b = c < 0
+	case "<=":
+		b = c <= 0
+	case ">":
+		b = c > 0
+	case ">=":
+		b = c >= 0
+	}
+	return value{kind: valueBool, b: b}
+}
+
+func compare(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
+type matchNode struct {
+	not bool
+	x   node
+	re  *regexp.Regexp
+}
+
+func (n *matchNode) eval(vars map[formatter.ElementName]interface{}) value {
+	x := n.x.eval(vars)
+	if x.kind == valueMissing {
+		return value{kind: valueBool}
+	}
+	s := x.str
+	if x.kind != valueString {
+		s = fmt.Sprint(toInterface(x))
+	}
+	return value{kind: valueBool, b: n.re.MatchString(s) != n.not}
+}
+
+func toInterface(v value) interface{} {
+	switch v.kind {
+	case valueNumber:
+		return v.num
+	case valueBool:
+		return v.b
+	}
+	return v.str
+}
@@ -0,0 +1,64 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/formatter"
+)
+
+func TestFilter(t *testing.T) {
+	video := map[formatter.ElementName]interface{}{
+		formatter.ElementStreamType:     "VIDEO",
+		formatter.ElementDTS:            uint32(1000),
+		formatter.ElementSize:           250000,
+		formatter.ElementKeyFrame:       true,
+		formatter.ElementVideoFrameType: "KeyFrame",
+		formatter.ElementNALUTypes:      "AVCC [6 5]",
+		formatter.ElementDeltaDTS:       int64(120),
+	}
+	audio := map[formatter.ElementName]interface{}{
+		formatter.ElementStreamType: "AUDIO",
+		formatter.ElementDTS:        uint32(1000),
+		formatter.ElementSize:       400,
+	}
+	for _, c := range []struct {
+		expr  string
+		video bool
+		audio bool
+	}{
+		{`stream_type == "VIDEO" && frame_type == "KeyFrame" && size > 200000`, true, false},
+		{`delta_dts > 100`, true, false},
+		{`!(delta_dts > 100)`, false, true},
+		{`keyframe || size <= 400`, true, true},
+		{`nalu_types =~ "\\[.*5.*\\]"`, true, false},
+		{`stream_type !~ "^V"`, false, true},
+		{`dts >= 1e3 && dts != -1`, true, true},
+		{`keyframe == false`, false, false},
+	} {
+		f, err := Compile(c.expr)
+		if !assert.Nil(t, err, c.expr) {
+			continue
+		}
+		assert.Equal(t, c.video, f.Match(video), c.expr)
+		assert.Equal(t, c.audio, f.Match(audio), c.expr)
+	}
+
+	for _, bad := range []string{
+		`unknown > 1`,
+		`size > "1"`,
+		`keyframe < true`,
+		`size >`,
+		`(size > 1`,
+		`size > 1)`,
+		`stream_type =~ "("`,
+		`stream_type == "VIDEO`,
+	} {
+		_, err := Compile(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	var f *Filter
+	assert.True(t, f.Match(audio))
+}
@@ -0,0 +1,290 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/foolishCDN/AV-spy/formatter"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", "-"}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && strings.ContainsRune(" \t\r\n", rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+	c := l.input[l.pos]
+	switch {
+	case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_':
+		for l.pos < len(l.input) && isIdentChar(l.input[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokenIdent, text: l.input[start:l.pos], pos: start}, nil
+	case c >= '0' && c <= '9' || c == '.':
+		for l.pos < len(l.input) && (isIdentChar(l.input[l.pos]) || l.input[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokenNumber, text: l.input[start:l.pos], pos: start}, nil
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.input) && l.input[l.pos] != '"' {
+			if l.input[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.input) {
+			return token{}, fmt.Errorf("unterminated string at %d", start)
+		}
+		l.pos++
+		s, err := strconv.Unquote(l.input[start:l.pos])
+		if err != nil {
+			return token{}, fmt.Errorf("invalid string %s at %d", l.input[start:l.pos], start)
+		}
+		return token{kind: tokenString, text: s, pos: start}, nil
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.input[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokenOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected %q at %d", c, start)
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+type parser struct {
+	lexer lexer
+	token token
+}
+
+func (p *parser) next() error {
+	t, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.token = t
+	return nil
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	if p.token.kind != tokenOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.token.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+// or := and ( "||" and )*
+func (p *parser) parseOr() (node, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &logicalNode{x: x, y: y}
+	}
+	return x, nil
+}
+
+// and := not ( "&&" not )*
+func (p *parser) parseAnd() (node, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = &logicalNode{and: true, x: x, y: y}
+	}
+	return x, nil
+}
+
+// not := "!" not | comparison
+func (p *parser) parseNot() (node, error) {
+	if p.isOp("!") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+// comparison := operand ( op operand )?
+func (p *parser) parseComparison() (node, error) {
+	x, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOp("==", "!=", "<", "<=", ">", ">=", "=~", "!~") {
+		return x, nil
+	}
+	op := p.token
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if op.text == "=~" || op.text == "!~" {
+		if p.token.kind != tokenString {
+			return nil, fmt.Errorf("%s needs a string of regular expression at %d", op.text, p.token.pos)
+		}
+		re, err := regexp.Compile(p.token.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at %d: %v", p.token.pos, err)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return &matchNode{not: op.text == "!~", x: x, re: re}, nil
+	}
+	y, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	kx, ky := kindOf(x), kindOf(y)
+	if kx != ky {
+		return nil, fmt.Errorf("mismatched types %s and %s of %s at %d", kindName(kx), kindName(ky), op.text, op.pos)
+	}
+	if kx == valueBool && op.text != "==" && op.text != "!=" {
+		return nil, fmt.Errorf("operator %s not defined on bool at %d", op.text, op.pos)
+	}
+	return &compareNode{op: op.text, x: x, y: y}, nil
+}
+
+// operand := "(" or ")" | element | number | "-" number | string | true | false
+func (p *parser) parseOperand() (node, error) {
+	t := p.token
+	switch {
+	case t.kind == tokenOp && t.text == "(":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, fmt.Errorf("expect \")\" but got %s at %d", p.token, p.token.pos)
+		}
+		return x, p.next()
+	case t.kind == tokenOp && t.text == "-":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.token.kind != tokenNumber {
+			return nil, fmt.Errorf("expect number after \"-\" at %d", p.token.pos)
+		}
+		n, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		literal := n.(*literalNode)
+		literal.v.num = -literal.v.num
+		return literal, nil
+	case t.kind == tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return &literalNode{v: value{kind: valueNumber, num: f}}, p.next()
+	case t.kind == tokenString:
+		return &literalNode{v: value{kind: valueString, str: t.text}}, p.next()
+	case t.kind == tokenIdent && (t.text == "true" || t.text == "false"):
+		return &literalNode{v: value{kind: valueBool, b: t.text == "true"}}, p.next()
+	case t.kind == tokenIdent:
+		name := formatter.ElementName(t.text)
+		kind, ok := formatter.LookupElement(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown element %q at %d", t.text, t.pos)
+		}
+		return &elementNode{name: name, kind: kind}, p.next()
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
+
+// kindOf returns the static kind of node
+func kindOf(n node) valueKind {
+	switch n := n.(type) {
+	case *literalNode:
+		return n.v.kind
+	case *elementNode:
+		switch n.kind {
+		case formatter.KindInt, formatter.KindFloat:
+			return valueNumber
+		case formatter.KindBool:
+			return valueBool
+		}
+		return valueString
+	}
+	return valueBool
+}
+
+func kindName(k valueKind) string {
+	switch k {
+	case valueNumber:
+		return "number"
+	case valueString:
+		return "string"
+	case valueBool:
+		return "bool"
+	}
+	return "missing"
+}
@@ -0,0 +1,120 @@
+package formatter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type ElementName string
+
+// Kind is the kind of element value, it decides which verbs can be used in template.
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindInt
+	KindFloat
+	KindBool
+)
+
+var kindVerbs = map[Kind]string{
+	KindString: "vsqxX",
+	KindInt:    "vdboOxXcqU",
+	KindFloat:  "vbeEfFgGxX",
+	KindBool:   "vt",
+}
+
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindInt:
+		return "int"
+	case KindFloat:
+		return "float"
+	case KindBool:
+		return "bool"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+var registry = struct {
+	sync.RWMutex
+	kinds map[ElementName]Kind
+}{
+	kinds: make(map[ElementName]Kind),
+}
+
+func init() {
+	RegisterElement(ElementStreamType, KindString)
+	RegisterElement(ElementStreamID, KindInt)
+	RegisterElement(ElementDTS, KindInt)
+	RegisterElement(ElementPTS, KindInt)
+	RegisterElement(ElementCTS, KindInt)
+	RegisterElement(ElementSize, KindInt)
+	RegisterElement(ElementKeyFrame, KindBool)
+	RegisterElement(ElementNALUTypes, KindString)
+	RegisterElement(ElementNALUCount, KindInt)
+	RegisterElement(ElementSEITypes, KindString)
+	RegisterElement(ElementSliceTypes, KindString)
+
+	RegisterElement(ElementAudioSoundFormant, KindString)
+	RegisterElement(ElementAudioChannels, KindString)
+	RegisterElement(ElementAudioSoundSize, KindString)
+	RegisterElement(ElementAudioSampleRate, KindString)
+
+	RegisterElement(ElementVideoFrameType, KindString)
+	RegisterElement(ElementVideoCodecID, KindString)
+
+	RegisterElement(ElementArrivalMs, KindFloat)
+	RegisterElement(ElementByteOffset, KindInt)
+	RegisterElement(ElementDeltaDTS, KindInt)
+	RegisterElement(ElementBitrate, KindFloat)
+}
+
+// RegisterElement registers an element so that it can be used as $name in template,
+// the name consists of lower case letters, digits and '_'.
+// It panics if the name is invalid or already registered.
+func RegisterElement(name ElementName, kind Kind) {
+	if len(name) == 0 {
+		panic("formatter: empty element name")
+	}
+	for _, c := range name {
+		if !isNameChar(c) {
+			panic(fmt.Sprintf("formatter: invalid element name %q", name))
+		}
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.kinds[name]; ok {
+		panic(fmt.Sprintf("formatter: element %q registered twice", name))
+	}
+	registry.kinds[name] = kind
+}
+
+// LookupElement returns the kind of a registered element.
+func LookupElement(name ElementName) (Kind, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	kind, ok := registry.kinds[name]
+	return kind, ok
+}
+
+// Elements returns the names of all registered elements in order.
+func Elements() []ElementName {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := make([]ElementName, 0, len(registry.kinds))
+	for name := range registry.kinds {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] < names[j]
+	})
+	return names
+}
+
+func isNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_'
+}
@@ -2,43 +2,22 @@ package formatter
 
 import (
 	"fmt"
-	"sort"
+	"regexp"
 	"strings"
 )
 
-type ElementName string
-
-var definedElements []ElementName
-
-func init() {
-	definedElements = []ElementName{
-		ElementStreamType,
-		ElementStreamID,
-		ElementDTS,
-		ElementPTS,
-		ElementSize,
-		ElementNALUTypes,
-
-		ElementAudioSoundFormant,
-		ElementAudioChannels,
-		ElementAudioSoundSize,
-		ElementAudioSampleRate,
-
-		ElementVideoFrameType,
-		ElementVideoCodecID,
-	}
-	sort.Slice(definedElements, func(i, j int) bool {
-		return len(definedElements[i]) > len(definedElements[j]) // 按字符串长度 降序 排列
-	})
-}
-
 const (
 	ElementStreamType ElementName = "stream_type" // AUDIO/VIDEO/SCRIPT AAC/AVC/HEVC
 	ElementStreamID   ElementName = "stream_id"
 	ElementPTS        ElementName = "pts"
 	ElementDTS        ElementName = "dts"
+	ElementCTS        ElementName = "cts" // composition time offset, pts - dts
 	ElementSize       ElementName = "size"
+	ElementKeyFrame   ElementName = "keyframe"
 	ElementNALUTypes  ElementName = "nalu_types"
+	ElementNALUCount  ElementName = "nalu_count"
+	ElementSEITypes   ElementName = "sei_types"   // payload types of all SEI messages
+	ElementSliceTypes ElementName = "slice_types" // slice types of all slices, AVC only
 
 	ElementAudioSoundFormant ElementName = "sound_format"
 	ElementAudioChannels     ElementName = "channels"
@@ -47,21 +26,32 @@ const (
 
 	ElementVideoFrameType ElementName = "frame_type"
 	ElementVideoCodecID   ElementName = "codec_id"
+
+	// the elements depend on the stream rather than a single tag
+	ElementArrivalMs  ElementName = "arrival_ms"  // time(ms) since the first tag received
+	ElementByteOffset ElementName = "byte_offset" // offset of tag from the start of stream
+	ElementDeltaDTS   ElementName = "delta_dts"   // dts diff to the previous tag of the same type
+	ElementBitrate    ElementName = "bitrate"     // kbps of the same type of tags in the last second by timestamp
 )
 
+// verbPattern matches a fmt verb with flags, width and precision
+var verbPattern = regexp.MustCompile(`^%[-+# 0]*[0-9]*(\.[0-9]+)?[a-zA-Z]`)
+
 type Template struct {
 	Template    string
 	OriTemplate string
 	Elements    []Element
 }
 
+// Format formats the template with vars, the element which is not in vars is shown as "-".
 func (t *Template) Format(vars map[ElementName]interface{}) string {
 	values := make([]interface{}, 0, len(t.Elements))
 	for _, element := range t.Elements {
 		v, ok := vars[element.Name]
-		if ok {
-			values = append(values, v)
+		if !ok {
+			v = missing{}
 		}
+		values = append(values, v)
 	}
 	return fmt.Sprintf(t.Template, values...)
 }
@@ -72,46 +62,89 @@ type Element struct {
 	FormatExist bool
 }
 
-func splitElements(template string) []Element {
-	elements := strings.Split(template, "$")
-	res := make([]Element, 0, len(elements))
-	for _, element := range elements {
-		if len(element) == 0 {
+// NewTemplate is like ParseTemplate but panics if the template is invalid,
+// it's used to define the builtin templates.
+func NewTemplate(origin string) *Template {
+	t, err := ParseTemplate(origin)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// ParseTemplate parses a template like "$stream_type:%6s $pts:%7d $frame_type".
+//
+// An element is $ followed by a registered element name, optionally followed by :%verb to format its value,
+// the verb must fit the kind of element, e.g. %d can't be used for string. The default verb is %v.
+// Use $$ to write a '$'.
+func ParseTemplate(origin string) (*Template, error) {
+	var template strings.Builder
+	var elements []Element
+	for i := 0; i < len(origin); {
+		c := origin[i]
+		switch {
+		case c == '%':
+			template.WriteString("%%")
+			i++
+			continue
+		case c != '$':
+			template.WriteByte(c)
+			i++
 			continue
+		case i+1 < len(origin) && origin[i+1] == '$':
+			template.WriteByte('$')
+			i += 2
+			continue
+		}
+		i++
+		start := i
+		for i < len(origin) && isNameChar(rune(origin[i])) {
+			i++
+		}
+		name := ElementName(origin[start:i])
+		if len(name) == 0 {
+			return nil, fmt.Errorf("template %q: missing element name after '$' at %d", origin, start-1)
+		}
+		kind, ok := LookupElement(name)
+		if !ok {
+			return nil, fmt.Errorf("template %q: unknown element $%s", origin, name)
 		}
-		for _, defined := range definedElements {
-			if strings.Contains(element, string(defined)) {
-				var format string
-				index := strings.Index(element, ":")
-				if index != -1 {
-					format = element[index+1:]
+		element := Element{Name: name, Format: "%v"}
+		if i+1 < len(origin) && origin[i] == ':' && origin[i+1] == '%' {
+			verb := verbPattern.FindString(origin[i+1:])
+			if verb == "" || !strings.ContainsRune(kindVerbs[kind], rune(verb[len(verb)-1])) {
+				verb = origin[i+1:]
+				if n := strings.IndexAny(verb[1:], " \t,;|$"); n >= 0 {
+					verb = verb[:n+1]
 				}
-				res = append(res, Element{
-					Name:   defined,
-					Format: format,
-				})
-				break
+				return nil, fmt.Errorf("template %q: bad verb %q for $%s(%s)", origin, verb, name, kind)
 			}
+			element.Format = verb
+			element.FormatExist = true
+			i += 1 + len(verb)
 		}
+		template.WriteString(element.Format)
+		elements = append(elements, element)
 	}
-	return res
+	return &Template{
+		Elements:    elements,
+		Template:    template.String(),
+		OriTemplate: origin,
+	}, nil
 }
 
-func NewTemplate(origin string) *Template {
-	template := origin
-	elements := splitElements(template)
-	for _, element := range elements {
-		replaced := "$" + string(element.Name)
-		if len(element.Format) > 0 {
-			replaced = replaced + ":" + element.Format
+// missing is the value of element which doesn't exist, it's formatted as "-" with the width of verb.
+type missing struct{}
+
+func (missing) Format(f fmt.State, verb rune) {
+	s := "-"
+	if width, ok := f.Width(); ok && width > len(s) {
+		padding := strings.Repeat(" ", width-len(s))
+		if f.Flag('-') {
+			s += padding
 		} else {
-			element.Format = "%s"
+			s = padding + s
 		}
-		template = strings.Replace(template, replaced, element.Format, 1)
-	}
-	return &Template{
-		Elements:    elements,
-		Template:    template,
-		OriTemplate: origin,
 	}
+	_, _ = f.Write([]byte(s))
 }
@@ -32,3 +32,24 @@ func TestTemplate(t *testing.T) {
 		})
 	assert.Equal(t, "audio       2    1000    1000     123 MP3 stereo 16 44KHz", got)
 }
+
+func TestParseTemplate(t *testing.T) {
+	template, err := ParseTemplate("$pts:%-5d|$cts:%3d|$keyframe|$$100%|$frame_type:%q")
+	assert.Nil(t, err)
+	got := template.Format(map[ElementName]interface{}{
+		ElementPTS:      40,
+		ElementKeyFrame: true,
+	})
+	assert.Equal(t, `40   |  -|true|$100%|-`, got)
+
+	for _, bad := range []string{
+		"$pts $unknown",
+		"$pts:%7s",
+		"$stream_type:%d",
+		"$keyframe:%7z",
+		"$ pts",
+	} {
+		_, err := ParseTemplate(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
@@ -0,0 +1,255 @@
+// Package metrics exposes the health of streams in the Prometheus text exposition format.
+//
+// The values are read from summary.Counter when scraped, so an Exporter can be served
+// while the streams are analysed, e.g.
+//
+//	exporter := metrics.NewExporter()
+//	exporter.Add(&metrics.Stream{URL: url, Video: videoCounter, Audio: audioCounter})
+//	http.Handle("/metrics", exporter)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+const namespace = "avspy"
+
+// ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Stream is a stream exported, the fields except URL are optional.
+type Stream struct {
+	// URL is the url label without the query and userinfo, they may have the tokens and credentials
+	URL        string
+	Video      *summary.Counter
+	Audio      *summary.Counter
+	Reconnects *summary.Reconnects
+	// Latency returns the latency of track("video" or "audio"), ok is false if it's unknown
+	Latency func(track string) (latency time.Duration, ok bool)
+}
+
+// Exporter is a http.Handler writing the metrics of streams, it's safe for concurrent use.
+type Exporter struct {
+	mu      sync.Mutex
+	streams []*Stream
+}
+
+func NewExporter() *Exporter {
+	return new(Exporter)
+}
+
+// Add adds stream to the exporter.
+func (e *Exporter) Add(stream *Stream) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.streams = append(e.streams, stream)
+}
+
+// Remove removes stream from the exporter, e.g. the stream is stopped.
+func (e *Exporter) Remove(stream *Stream) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, s := range e.streams {
+		if s == stream {
+			e.streams = append(e.streams[:i:i], e.streams[i+1:]...)
+			return
+		}
+	}
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = e.WriteTo(w)
+}
+
+// sample is a value of a metric with labels
+type sample struct {
+	labels []string // name, value, name, value ...
+	value  float64
+}
+
+// family is a metric and its samples of all streams
+type family struct {
+	name    string
+	help    string
+	kind    string // counter or gauge
+	samples []sample
+}
+
+// trackMetrics are the metrics of a track, value returns the value from the stats of Counter
+var trackMetrics = []struct {
+	name  string
+	help  string
+	kind  string
+	value func(s summary.Stats) float64
+}{
+	{"frames_total", "Frames received.", "counter", func(s summary.Stats) float64 { return float64(s.Total) }},
+	{"bytes_total", "Data bytes of the frames received.", "counter", func(s summary.Stats) float64 { return float64(s.Bytes) }},
+	{"gaps_total", "Timestamp gaps larger than the hint threshold.", "counter", func(s summary.Stats) float64 { return float64(s.Gaps) }},
+	{"max_gap_milliseconds", "Max timestamp gap.", "gauge", func(s summary.Stats) float64 { return float64(s.MaxGap) }},
+	{"rewinds_total", "Timestamp rewinds.", "counter", func(s summary.Stats) float64 { return float64(s.Rewinds) }},
+	{"max_rewind_milliseconds", "Max timestamp rewind.", "gauge", func(s summary.Stats) float64 { return float64(s.MaxRewind) }},
+	{"duplicates_total", "Frames with the same timestamp as the last one.", "counter", func(s summary.Stats) float64 { return float64(s.Duplicate) }},
+	{"holes_total", "Arrival holes larger than the hint threshold.", "counter", func(s summary.Stats) float64 { return float64(s.Holes) }},
+	{"max_hole_milliseconds", "Max arrival hole.", "gauge", func(s summary.Stats) float64 { return float64(s.MaxHole.Milliseconds()) }},
+	{"rollovers_total", "Timestamp rollovers.", "counter", func(s summary.Stats) float64 { return float64(s.Rollovers) }},
+	{"fps", "Frames per second computed by timestamp.", "gauge", func(s summary.Stats) float64 { return s.Rate }},
+	{"real_fps", "Frames per second computed by running time.", "gauge", func(s summary.Stats) float64 { return s.RealRate }},
+	{"bitrate_bits_per_second", "Bitrate computed by running time.", "gauge", func(s summary.Stats) float64 {
+		if s.Duration <= 0 {
+			return 0
+		}
+		return float64(s.Bytes*8) / s.Duration.Seconds()
+	}},
+	{"cache_milliseconds", "Estimated timestamp duration of the content cached by server.", "gauge", func(s summary.Stats) float64 { return float64(s.Cache.Duration) }},
+}
+
+// families collects the samples of all streams
+func (e *Exporter) families() []*family {
+	e.mu.Lock()
+	streams := append([]*Stream(nil), e.streams...)
+	e.mu.Unlock()
+
+	families := make([]*family, 0, len(trackMetrics)+4)
+	for _, m := range trackMetrics {
+		families = append(families, &family{name: m.name, help: m.help, kind: m.kind})
+	}
+	latency := &family{name: "latency_milliseconds", help: "Latency of the simulated player.", kind: "gauge"}
+	reconnects := &family{name: "reconnects_total", help: "Reconnections after disconnected.", kind: "counter"}
+	disconnections := &family{name: "disconnections_total", help: "Disconnections of stream.", kind: "counter"}
+	downtime := &family{name: "downtime_seconds_total", help: "Downtime of the disconnections.", kind: "counter"}
+	families = append(families, latency, reconnects, disconnections, downtime)
+
+	for _, stream := range streams {
+		for _, track := range []struct {
+			name    string
+			counter *summary.Counter
+		}{{"video", stream.Video}, {"audio", stream.Audio}} {
+			if track.counter == nil {
+				continue
+			}
+			labels := []string{"url", urlLabel(stream.URL), "track", track.name}
+			s := track.counter.Snapshot()
+			for i, m := range trackMetrics {
+				families[i].samples = append(families[i].samples, sample{labels: labels, value: m.value(s)})
+			}
+			if stream.Latency != nil {
+				if d, ok := stream.Latency(track.name); ok {
+					latency.samples = append(latency.samples, sample{labels: labels, value: float64(d.Milliseconds())})
+				}
+			}
+		}
+		if stream.Reconnects != nil {
+			labels := []string{"url", urlLabel(stream.URL)}
+			s := stream.Reconnects.Snapshot()
+			reconnects.samples = append(reconnects.samples, sample{labels: labels, value: float64(s.Reconnected)})
+			disconnections.samples = append(disconnections.samples, sample{labels: labels, value: float64(s.Count)})
+			downtime.samples = append(downtime.samples, sample{labels: labels, value: s.Downtime.Seconds()})
+		}
+	}
+	return families
+}
+
+// WriteTo writes the metrics in the text exposition format, the families without samples are omitted.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{w: bw}
+	for _, f := range e.families() {
+		if len(f.samples) == 0 {
+			continue
+		}
+		name := namespace + "_" + f.name
+		fmt.Fprintf(cw, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(cw, "# TYPE %s %s\n", name, f.kind)
+		for _, s := range f.samples {
+			fmt.Fprintf(cw, "%s%s %s\n", name, formatLabels(s.labels), formatValue(s.value))
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+// urlLabel returns rawURL without the query, fragment and userinfo, it's returned as is if it isn't a url, e.g. a file path.
+func urlLabel(rawURL string) string {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+	if i := strings.IndexAny(rest, "?#"); i >= 0 {
+		rest = rest[:i]
+	}
+	authority, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		authority, path = rest[:i], rest[i:]
+	}
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		authority = authority[i+1:]
+	}
+	return scheme + "://" + authority + path
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countWriter counts the bytes written, the first error is kept
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,567 @@
+// Package probe analyses FLV streams: the header, metadata, codec configurations, GOP,
+// the timestamp and arrival anomalies of tracks and the conformance checked by package validate.
+//
+// Probe reads a stream from a URL or file until the context is done or the stream ends, e.g.
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//	defer cancel()
+//	report, err := probe.Probe(ctx, "http://example.com/live/stream.flv", probe.Options{})
+//
+// Prober analyses the tags one by one for the tools reading the stream by themselves,
+// and an Observer is told what's found while the stream is analysed. The tools build
+// their options from DefaultOptions, so a stream is analysed the same in all of them.
+package probe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/foolishCDN/AV-spy/container/demux"
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+	"github.com/foolishCDN/AV-spy/summary"
+	"github.com/foolishCDN/AV-spy/validate"
+)
+
+// DefaultMaxEvents is the number of events kept in Report if Options.MaxEvents is zero
+const DefaultMaxEvents = 100
+
+type Options struct {
+	// Headers are the headers of HTTP request, "Host" sets the host of request
+	Headers map[string]string
+	// Client requests the URL, http.DefaultClient is used if it's nil
+	Client *http.Client
+
+	// MaxTagSize, Resync, DetectTimestampLayout and TimestampLayout configure flv.Demuxer of Run
+	MaxTagSize            uint32
+	Resync                bool
+	DetectTimestampLayout bool
+	TimestampLayout       flv.TimestampLayout
+
+	// Start(ms) and Duration(ms) select the tags analysed by Run, the script tags and sequence headers are always analysed.
+	// A stream which can seek, e.g. a file, seeks to the keyframe at or before Start, the others skip the tags before it.
+	// Run stops after the tags of Duration from Start if Duration is positive.
+	Start    int
+	Duration int
+
+	// HintGap(ms), HintHole and DiffThreshold(percent) are the thresholds of counters,
+	// the defaults of summary.Counter are used if zero
+	HintGap       int
+	HintHole      time.Duration
+	DiffThreshold int
+
+	// Validate checks the conformance if it's not nil, the issues are reported to Observer.OnWarning after OnIssue
+	Validate *validate.Config
+	// MaxEvents is the max number of events kept in Report, DefaultMaxEvents if zero, none if negative
+	MaxEvents int
+	// EventSink consumes the events of counters besides Report and Observer, e.g. summary.LogrusSink
+	EventSink summary.EventSink
+	Observer  Observer
+	// Startup records the startup of stream, set it if the request is made before Prober, a new one is used if nil
+	Startup *summary.Startup
+}
+
+// DefaultOptions returns the options of the tools: the corrupted bytes are skipped, the timestamp layout is detected,
+// the conformance is validated and the thresholds of counters are the defaults of summary.Counter.
+func DefaultOptions() Options {
+	return Options{
+		Resync:                true,
+		DetectTimestampLayout: true,
+		Validate:              &validate.Config{MaxIssues: DefaultMaxEvents},
+	}
+}
+
+// Warning is an anomaly found while probing, Issue or Event is set if it's found by validator or counters.
+type Warning struct {
+	Message string
+	Issue   *validate.Issue
+	Event   *summary.Event
+}
+
+// Observer is told what Prober finds, the methods are called in the goroutine feeding Prober.
+type Observer interface {
+	OnHeader(header *flv.Header)
+	// OnMetadata is called for every script tag, values may be partial if the tag is corrupted
+	OnMetadata(tag *flv.ScriptTag, values []interface{})
+	// OnSequenceHeader is called for the sequence headers decoded, the others are warned
+	OnSequenceHeader(tag flv.TagI, header *SequenceHeader)
+	// OnTag is called for every tag after the methods above
+	OnTag(tag flv.TagI)
+	OnWarning(warning Warning)
+}
+
+// Receiver is implemented by an Observer which needs the tags of Run before they are analysed,
+// e.g. a recorder whose buffer flushed on the events of counters should contain the tag of event.
+// Run stops with the error returned.
+type Receiver interface {
+	OnReceive(tag flv.TagI) error
+}
+
+// Reconnector is implemented by an Observer which reconnects a live stream read by Run.
+// Reconnect is called when the stream fails or ends by reason, the reader of Run reads the new session after it returns nil,
+// and it's called again if the new session fails before its FLV header. Run returns the error returned, nil if it's io.EOF.
+type Reconnector interface {
+	Reconnect(reason error) error
+}
+
+// NopObserver ignores everything, embed it to implement a part of Observer.
+type NopObserver struct{}
+
+func (NopObserver) OnHeader(*flv.Header)                       {}
+func (NopObserver) OnMetadata(*flv.ScriptTag, []interface{})   {}
+func (NopObserver) OnSequenceHeader(flv.TagI, *SequenceHeader) {}
+func (NopObserver) OnTag(flv.TagI)                             {}
+func (NopObserver) OnWarning(Warning)                          {}
+
+// Probe reads the stream of source, a http(s) URL or file path, until ctx is done or the stream ends.
+// The report is returned even if there is an error, the end of ctx isn't an error.
+func Probe(ctx context.Context, source string, options Options) (*Report, error) {
+	p, err := New(options)
+	if err != nil {
+		return nil, err
+	}
+	return p.Probe(ctx, source)
+}
+
+// Prober analyses the tags one by one, it's not safe for concurrent use except Tags and the counters.
+type Prober struct {
+	options   Options
+	observer  Observer
+	tags      atomic.Int64
+	maxEvents int
+	offset    int64      // offset of the last tag
+	streams   *demux.FLV // converts the tags to packets
+
+	videoCounter *summary.Counter
+	audioCounter *summary.Counter
+	validator    *validate.Validator // nil if not validate
+	startup      *summary.Startup
+	gop          gopCounter
+	report       Report
+}
+
+// New returns a Prober, it returns an error if Options.Validate is invalid.
+func New(options Options) (*Prober, error) {
+	p := &Prober{
+		options:   options,
+		observer:  options.Observer,
+		maxEvents: options.MaxEvents,
+		offset:    -1,
+		streams:   demux.NewFLVStreams(),
+		startup:   options.Startup,
+		report: Report{
+			StartTime:       time.Now(),
+			MetaData:        []MetaData{},
+			SequenceHeaders: []SequenceHeader{},
+			Events:          []summary.Event{},
+		},
+	}
+	if p.observer == nil {
+		p.observer = NopObserver{}
+	}
+	if p.maxEvents == 0 {
+		p.maxEvents = DefaultMaxEvents
+	}
+	if p.startup == nil {
+		p.startup = summary.NewStartup()
+	}
+	p.report.Startup = p.startup
+	if options.Validate != nil {
+		config := *options.Validate
+		onIssue := config.OnIssue
+		config.OnIssue = func(issue validate.Issue) {
+			if onIssue != nil {
+				onIssue(issue)
+			}
+			p.observer.OnWarning(Warning{Message: issue.String(), Issue: &issue})
+		}
+		validator, err := validate.New(config)
+		if err != nil {
+			return nil, err
+		}
+		p.validator = validator
+	}
+	sink := summary.SetEventSink(eventSink{p})
+	p.videoCounter = summary.NewCounter(summary.SetLogPrefix("video"), sink)
+	p.audioCounter = summary.NewCounter(summary.SetLogPrefix("audio"), sink)
+	for _, c := range []*summary.Counter{p.videoCounter, p.audioCounter} {
+		if options.HintGap > 0 {
+			c.HintGap = options.HintGap
+		}
+		if options.HintHole > 0 {
+			c.HintHole = options.HintHole
+		}
+		if options.DiffThreshold > 0 {
+			c.DiffThreshold = options.DiffThreshold
+		}
+	}
+	return p, nil
+}
+
+// eventSink keeps the events of counters in report and sends them to Options.EventSink and Observer
+type eventSink struct {
+	p *Prober
+}
+
+func (s eventSink) OnEvent(event summary.Event) {
+	p := s.p
+	if len(p.report.Events) < p.maxEvents {
+		p.report.Events = append(p.report.Events, event)
+	}
+	if p.options.EventSink != nil {
+		p.options.EventSink.OnEvent(event)
+	}
+	message := fmt.Sprintf("%s: %s, timestamp %d -> %d, value %d", event.Track, event.Type, event.LastTimestamp, event.Timestamp, event.Value)
+	p.observer.OnWarning(Warning{Message: message, Event: &event})
+}
+
+// Tags returns the number of tags analysed.
+func (p *Prober) Tags() int64 {
+	return p.tags.Load()
+}
+
+// TagOffset returns the offset of the last tag analysed in the stream, -1 if it's unknown.
+func (p *Prober) TagOffset() int64 {
+	return p.offset
+}
+
+// VideoCounter returns the counter of video frames, the sequence headers aren't counted.
+func (p *Prober) VideoCounter() *summary.Counter {
+	return p.videoCounter
+}
+
+// AudioCounter returns the counter of audio frames, the sequence headers aren't counted.
+func (p *Prober) AudioCounter() *summary.Counter {
+	return p.audioCounter
+}
+
+func (p *Prober) Startup() *summary.Startup {
+	return p.startup
+}
+
+// Probe reads the stream of source like the function Probe.
+func (p *Prober) Probe(ctx context.Context, source string) (*Report, error) {
+	p.report.Source = source
+	err := p.probe(ctx, source)
+	report := p.Report()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report, err
+}
+
+func (p *Prober) probe(ctx context.Context, source string) error {
+	r, err := p.open(ctx, source)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return p.Run(ctx, r)
+}
+
+// open requests source if it's a http(s) URL, otherwise it's opened as a file
+func (p *Prober) open(ctx context.Context, source string) (io.ReadCloser, error) {
+	if u, err := url.Parse(source); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("open file err: %w", err)
+		}
+		return f, nil
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, p.startup.ClientTrace()), http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request err: %w", err)
+	}
+	for name, value := range p.options.Headers {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if name == "Host" {
+			req.Host = value
+		}
+		req.Header.Set(name, value)
+	}
+	client := p.options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request err: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("do request err: status code=%d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// Run reads the stream from r until ctx is done or EOF, it returns nil if the stream ends or ctx is done.
+// Observer is told the tags received if it's a Receiver, and it's asked to reconnect if it's a Reconnector.
+func (p *Prober) Run(ctx context.Context, r io.Reader) error {
+	reader := p.startup.WrapReader(r)
+	demuxer := &flv.Demuxer{
+		MaxTagSize:            p.options.MaxTagSize,
+		Resync:                p.options.Resync,
+		DetectTimestampLayout: p.options.DetectTimestampLayout,
+		TimestampLayout:       p.options.TimestampLayout,
+	}
+	var header *flv.Header
+	var err error
+	readTag := func() (flv.TagI, error) {
+		return demuxer.ReadTag(reader)
+	}
+	skipBefore := int64(p.options.Start) // the tags before it are skipped if the stream can't seek
+	if seeker, ok := r.(io.ReadSeeker); ok && p.options.Start > 0 && canSeek(seeker) {
+		flvReader, err := flv.NewReader(seeker, demuxer)
+		if err != nil {
+			return runError(ctx, err)
+		}
+		if err := flvReader.Seek(uint32(p.options.Start)); err != nil {
+			return runError(ctx, err)
+		}
+		header, readTag, skipBefore = flvReader.Header(), flvReader.ReadTag, 0
+	} else if header, err = demuxer.ReadHeader(reader); err != nil {
+		return runError(ctx, err)
+	}
+	p.OnHeader(header)
+	receiver, _ := p.observer.(Receiver)
+	for ctx.Err() == nil {
+		tag, err := readTag()
+		var sizeErr *flv.PreviousTagSizeError
+		var resyncErr *flv.ResyncError
+		if errors.As(err, &sizeErr) {
+			p.OnPreviousTagSize(sizeErr)
+			tag, err = sizeErr.Tag, nil
+		} else if errors.As(err, &resyncErr) {
+			p.OnResync(resyncErr)
+			if resyncErr.Tag == nil {
+				continue
+			}
+			tag, err = resyncErr.Tag, nil
+		}
+		if err != nil && ctx.Err() == nil {
+			if err = p.reconnect(demuxer, reader, err); err == nil {
+				continue
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return runError(ctx, err)
+		}
+		if demuxer.DetectTimestampLayout && demuxer.TimestampLayout == flv.TimestampBigEndian32 {
+			p.observer.OnWarning(Warning{Message: "the extended timestamp byte is misplaced, decode timestamp as 32 bits big endian"})
+			demuxer.DetectTimestampLayout = false
+		}
+		if inRange, ended := p.inRange(tag, skipBefore); ended {
+			return nil
+		} else if !inRange {
+			continue
+		}
+		p.offset = demuxer.TagOffset() // for the receiver
+		if receiver != nil {
+			if err := receiver.OnReceive(tag); err != nil {
+				return err
+			}
+		}
+		p.OnTag(tag, demuxer.TagOffset())
+	}
+	return nil
+}
+
+// canSeek returns false if r can't seek though it's an io.ReadSeeker, e.g. a pipe is a file but can't seek
+func canSeek(r io.ReadSeeker) bool {
+	_, err := r.Seek(0, io.SeekCurrent)
+	return err == nil
+}
+
+// reconnect asks the Reconnector observer to reconnect after reading failed by reason and reads the FLV header
+// of the new session, the counters go on with it. It returns reason if the observer isn't a Reconnector.
+func (p *Prober) reconnect(demuxer *flv.Demuxer, r io.Reader, reason error) error {
+	reconnector, ok := p.observer.(Reconnector)
+	if !ok {
+		return reason
+	}
+	for {
+		if err := reconnector.Reconnect(reason); err != nil {
+			return err
+		}
+		header, err := demuxer.ReadHeader(r)
+		if err != nil {
+			reason = err
+			continue
+		}
+		p.Resume()
+		p.OnHeader(header)
+		return nil
+	}
+}
+
+// inRange returns whether tag is in the range of Options.Start and Duration, ended is true if the range ends.
+// The sequence headers and script tags are always in range, the other tags before skipBefore aren't.
+func (p *Prober) inRange(tag flv.TagI, skipBefore int64) (inRange, ended bool) {
+	if tag.Type() == flv.TagScript || flv.IsSequenceHeader(tag) {
+		return true, false
+	}
+	timestamp := int64(tag.Timestamp())
+	if p.options.Duration > 0 && timestamp > int64(p.options.Start)+int64(p.options.Duration) {
+		return false, true
+	}
+	return timestamp >= skipBefore, false
+}
+
+// runError returns nil if err is caused by the end of ctx
+func runError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (p *Prober) OnHeader(header *flv.Header) {
+	p.startup.Mark(summary.StartupHeader, time.Now())
+	if p.validator != nil {
+		p.validator.OnHeader(header)
+	}
+	p.report.Header = &Header{
+		Version:    header.Version,
+		HasVideo:   header.HasVideo,
+		HasAudio:   header.HasAudio,
+		DataOffset: header.DataOffset,
+	}
+	p.observer.OnHeader(header)
+}
+
+// OnPreviousTagSize checks the mismatch returned by flv.Demuxer, its tag is passed to OnTag after.
+func (p *Prober) OnPreviousTagSize(err *flv.PreviousTagSizeError) {
+	if p.validator != nil {
+		p.validator.OnPreviousTagSize(err)
+		return
+	}
+	p.observer.OnWarning(Warning{Message: err.Error()})
+}
+
+// OnResync checks the corrupted bytes skipped by flv.Demuxer, its tag is passed to OnTag after if it's not nil.
+func (p *Prober) OnResync(err *flv.ResyncError) {
+	if p.validator != nil {
+		p.validator.OnResync(err)
+		return
+	}
+	p.observer.OnWarning(Warning{Message: err.Error()})
+}
+
+// Resume tells that the stream is reconnected, see summary.Counter.Resume.
+func (p *Prober) Resume() {
+	p.videoCounter.Resume()
+	p.audioCounter.Resume()
+}
+
+// OnTag analyses tag at offset of the stream, offset is used by validator and returned by TagOffset.
+func (p *Prober) OnTag(tag flv.TagI, offset int64) {
+	p.tags.Add(1)
+	p.offset = offset
+	if p.validator != nil {
+		p.validator.OnTag(tag, offset)
+	}
+	pkt := p.streams.Packet(tag, offset)
+	p.OnPacket(p.streams.Streams()[pkt.StreamIndex], pkt)
+	switch t := tag.(type) {
+	case *flv.AudioTag, *flv.VideoTag:
+		if flv.IsSequenceHeader(t) {
+			p.onSequenceHeader(tag)
+		}
+	case *flv.ScriptTag:
+		now := time.Now()
+		values, err := amf.NewDecoder(amf.Version0).DecodeBatch(bytes.NewBuffer(t.Bytes))
+		if err != nil && err != io.EOF {
+			p.observer.OnWarning(Warning{Message: fmt.Sprintf("parse script tag failed: %v", err)})
+		}
+		if len(values) > 0 && values[0] == "onMetaData" {
+			p.startup.Mark(summary.StartupMetaData, now)
+		}
+		p.report.MetaData = append(p.report.MetaData, MetaData{Timestamp: t.PTS, Values: values})
+		p.observer.OnMetadata(t, values)
+	}
+	p.observer.OnTag(tag)
+}
+
+// OnPacket counts the frames of pkt and measures the GOP of video, the packets of any container read by package demux
+// are analysed the same. OnTag calls it, the metadata, sequence headers and conformance of FLV are analysed by OnTag.
+func (p *Prober) OnPacket(stream *demux.Stream, pkt *demux.Packet) {
+	now := time.Now()
+	timestamp := uint32(pkt.DTS / time.Millisecond)
+	switch stream.Type {
+	case demux.MediaAudio:
+		if pkt.Config {
+			p.startup.Mark(summary.StartupAudioSequenceHeader, now)
+			break
+		}
+		p.startup.Mark(summary.StartupAudioFrame, now)
+		p.audioCounter.CountAt(timestamp, now)
+		p.audioCounter.AddBytes(len(pkt.Data))
+	case demux.MediaVideo:
+		if pkt.Config {
+			p.startup.Mark(summary.StartupVideoSequenceHeader, now)
+			break
+		}
+		if pkt.KeyFrame {
+			p.startup.Mark(summary.StartupVideoKeyFrame, now)
+		}
+		p.videoCounter.CountAt(timestamp, now)
+		p.videoCounter.AddBytes(len(pkt.Data))
+		p.gop.onFrame(int(timestamp), pkt.KeyFrame)
+	}
+}
+
+func (p *Prober) onSequenceHeader(tag flv.TagI) {
+	header, err := DecodeSequenceHeader(tag)
+	if err != nil {
+		p.observer.OnWarning(Warning{Message: err.Error()})
+		return
+	}
+	p.report.SequenceHeaders = append(p.report.SequenceHeaders, *header)
+	p.observer.OnSequenceHeader(tag, header)
+}
+
+// Report returns the report of the tags analysed, the checks of validator which need the whole stream
+// are run, so the Prober shouldn't be fed after if it validates.
+func (p *Prober) Report() *Report {
+	report := p.report
+	report.DurationMs = time.Since(report.StartTime).Milliseconds()
+	report.MetaData = append([]MetaData{}, p.report.MetaData...)
+	report.SequenceHeaders = append([]SequenceHeader{}, p.report.SequenceHeaders...)
+	report.Events = append([]summary.Event{}, p.report.Events...)
+	if v := p.videoCounter.Snapshot(); v.Total > 0 {
+		report.Video = NewTrackSummary(v)
+		for _, header := range report.SequenceHeaders {
+			if header.StreamType == "AVC" || header.StreamType == "HEVC" {
+				report.Video.Codec = strings.ToLower(header.StreamType)
+				report.Video.Width, report.Video.Height, report.Video.SPSFPS = header.Width, header.Height, header.FPS
+			}
+		}
+	}
+	if a := p.audioCounter.Snapshot(); a.Total > 0 {
+		report.Audio = NewTrackSummary(a)
+	}
+	if p.gop.gop.Count > 0 {
+		gop := p.gop.gop
+		report.GOP = &gop
+	}
+	if p.validator != nil {
+		report.Validation = p.validator.Report()
+	}
+	return &report
+}
@@ -0,0 +1,268 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/demux"
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/summary"
+	"github.com/foolishCDN/AV-spy/validate"
+)
+
+type countObserver struct {
+	NopObserver
+	headers         int
+	metadata        int
+	sequenceHeaders []*SequenceHeader
+	tags            int
+}
+
+func (o *countObserver) OnHeader(*flv.Header) {
+	o.headers++
+}
+
+func (o *countObserver) OnMetadata(*flv.ScriptTag, []interface{}) {
+	o.metadata++
+}
+
+func (o *countObserver) OnSequenceHeader(_ flv.TagI, header *SequenceHeader) {
+	o.sequenceHeaders = append(o.sequenceHeaders, header)
+}
+
+func (o *countObserver) OnTag(flv.TagI) {
+	o.tags++
+}
+
+func TestProbe(t *testing.T) {
+	observer := new(countObserver)
+	report, err := Probe(context.Background(), "../container/flv/test.flv", Options{
+		Validate: &validate.Config{},
+		Observer: observer,
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, report.Error)
+	assert.Equal(t, &Header{Version: 1, HasVideo: true, HasAudio: true, DataOffset: 9}, report.Header)
+	assert.NotEmpty(t, report.MetaData)
+	assert.Equal(t, "onMetaData", report.MetaData[0].Values[0])
+	// the audio is MP3, there is no sequence header of audio
+	if assert.Len(t, report.SequenceHeaders, 1) {
+		h := report.SequenceHeaders[0]
+		assert.Equal(t, "AVC", h.StreamType)
+		assert.Equal(t, 544, h.Width)
+		assert.Equal(t, 960, h.Height)
+		assert.NotNil(t, h.SPS)
+	}
+	if assert.NotNil(t, report.Video) {
+		assert.Equal(t, "avc", report.Video.Codec)
+		assert.Equal(t, 544, report.Video.Width)
+	}
+	assert.NotNil(t, report.Audio)
+	if assert.NotNil(t, report.GOP) {
+		assert.True(t, report.GOP.Count > 0)
+		assert.True(t, report.GOP.MinFrames <= report.GOP.MaxFrames)
+	}
+	if assert.NotNil(t, report.Validation) {
+		assert.Equal(t, report.Validation.Tags, observer.tags)
+	}
+
+	assert.Equal(t, 1, observer.headers)
+	assert.Equal(t, len(report.MetaData), observer.metadata)
+	assert.Len(t, observer.sequenceHeaders, 1)
+	assert.Equal(t, 1+report.Video.Count+report.Audio.Count+len(report.MetaData), observer.tags)
+}
+
+func TestProbeURL(t *testing.T) {
+	data, err := os.ReadFile("../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // a live stream never ends
+	}))
+	defer server.Close()
+
+	report, err := Probe(context.Background(), server.URL, Options{})
+	assert.NotNil(t, err)
+	assert.Equal(t, err.Error(), report.Error)
+	assert.Nil(t, report.Header)
+
+	p, err := New(Options{Headers: map[string]string{"x-token": "token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	report, err = p.Probe(ctx, server.URL)
+	assert.Nil(t, err, "the end of context isn't an error")
+	assert.Equal(t, server.URL, report.Source)
+	assert.NotNil(t, report.Header)
+	assert.True(t, p.Tags() > 0)
+	assert.Nil(t, report.Validation)
+	_, ok := report.Startup.Get(summary.StartupHeader)
+	assert.True(t, ok)
+}
+
+func TestDecodeSequenceHeader(t *testing.T) {
+	_, err := DecodeSequenceHeader(&flv.VideoTag{PacketType: flv.AVPacket, CodecID: flv.H264})
+	assert.NotNil(t, err)
+	_, err = DecodeSequenceHeader(&flv.AudioTag{SoundFormat: flv.AAC, PacketType: flv.SequenceHeader, Bytes: []byte{}})
+	assert.NotNil(t, err)
+}
+
+// rangeObserver receives the frames and reconnects the stream once
+type rangeObserver struct {
+	NopObserver
+	headers    int
+	timestamps []uint32
+	session    *sessionReader
+	data       []byte
+	reconnects int
+}
+
+func (o *rangeObserver) OnHeader(*flv.Header) {
+	o.headers++
+}
+
+func (o *rangeObserver) OnReceive(tag flv.TagI) error {
+	if tag.Type() != flv.TagScript && !flv.IsSequenceHeader(tag) {
+		o.timestamps = append(o.timestamps, tag.Timestamp())
+	}
+	return nil
+}
+
+func (o *rangeObserver) Reconnect(reason error) error {
+	if o.session == nil || o.reconnects > 0 {
+		return reason
+	}
+	o.reconnects++
+	o.session.r = bytes.NewReader(o.data)
+	return nil
+}
+
+// sessionReader reads the current session of a stream, it can't seek
+type sessionReader struct {
+	r io.Reader
+}
+
+func (r *sessionReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func TestRunRange(t *testing.T) {
+	data, err := os.ReadFile("../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seekable := range []bool{true, false} {
+		observer := new(rangeObserver)
+		p, err := New(Options{Start: 2000, Duration: 1000, Observer: observer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = bytes.NewReader(data)
+		if !seekable {
+			r = &sessionReader{r: r}
+		}
+		assert.Nil(t, p.Run(context.Background(), r))
+		if assert.NotEmpty(t, observer.timestamps) {
+			first := observer.timestamps[0]
+			if seekable {
+				assert.True(t, first <= 2000 && first > 1000, "start at the keyframe before 2000, got %d", first)
+			} else {
+				assert.True(t, first >= 2000, "skip the tags before 2000, got %d", first)
+			}
+			for _, timestamp := range observer.timestamps {
+				assert.True(t, timestamp <= 3000)
+			}
+		}
+		assert.Equal(t, int64(len(observer.timestamps)), int64(p.VideoCounter().Snapshot().Total+p.AudioCounter().Snapshot().Total))
+		assert.True(t, p.TagOffset() > 0)
+	}
+}
+
+func TestRunReconnect(t *testing.T) {
+	data, err := os.ReadFile("../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &sessionReader{r: bytes.NewReader(data[:len(data)/2])}
+	observer := &rangeObserver{session: session, data: data}
+	p, err := New(Options{Observer: observer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, p.Run(context.Background(), session), "the stream ends with io.EOF after reconnect")
+	assert.Equal(t, 1, observer.reconnects)
+	assert.Equal(t, 2, observer.headers)
+	assert.Equal(t, 1, p.VideoCounter().Snapshot().Resumes)
+
+	// the error of reconnect is returned
+	failed := errors.New("failed")
+	p, err = New(Options{Observer: &failedReconnector{err: failed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, failed, p.Run(context.Background(), bytes.NewReader(data[:len(data)/2])))
+}
+
+type failedReconnector struct {
+	NopObserver
+	err error
+}
+
+func (o *failedReconnector) Reconnect(error) error {
+	return o.err
+}
+
+func TestOnPacket(t *testing.T) {
+	f, err := os.Open("../encoding/riff/test.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	d, err := demux.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := 0
+	for {
+		pkt, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.OnPacket(d.Streams()[pkt.StreamIndex], pkt)
+		packets++
+	}
+	report := p.Report()
+	if assert.NotNil(t, report.Audio) {
+		assert.Equal(t, packets, report.Audio.Count)
+	}
+	assert.Nil(t, report.Video)
+	_, ok := p.Startup().Get(summary.StartupAudioFrame)
+	assert.True(t, ok)
+}
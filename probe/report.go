@@ -0,0 +1,234 @@
+package probe
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/foolishCDN/AV-spy/codec"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+	"github.com/foolishCDN/AV-spy/summary"
+	"github.com/foolishCDN/AV-spy/validate"
+)
+
+// Report is the result of a probe.
+type Report struct {
+	Source          string           `json:"source"`
+	StartTime       time.Time        `json:"start_time"`
+	DurationMs      int64            `json:"duration_ms"`
+	Error           string           `json:"error,omitempty"` // the error returned by Probe
+	Header          *Header          `json:"header,omitempty"`
+	MetaData        []MetaData       `json:"metadata"`
+	SequenceHeaders []SequenceHeader `json:"sequence_headers"`
+	GOP             *GOP             `json:"gop,omitempty"`
+	Video           *TrackSummary    `json:"video,omitempty"`
+	Audio           *TrackSummary    `json:"audio,omitempty"`
+	Events          []summary.Event  `json:"events"`               // the first Options.MaxEvents events of counters
+	Validation      *validate.Report `json:"validation,omitempty"` // nil if not validate
+	Startup         *summary.Startup `json:"startup,omitempty"`
+}
+
+type Header struct {
+	Version    byte   `json:"version"`
+	HasVideo   bool   `json:"has_video"`
+	HasAudio   bool   `json:"has_audio"`
+	DataOffset uint32 `json:"data_offset"`
+}
+
+type MetaData struct {
+	Timestamp uint32        `json:"timestamp"`
+	Values    []interface{} `json:"values"` // AMF0 values, e.g. ["onMetaData", {"width": 1280, ...}]
+}
+
+// MarshalJSON encodes the NaN and ±Inf numbers of values as null.
+func (m MetaData) MarshalJSON() ([]byte, error) {
+	type metaData MetaData
+	m.Values = FiniteValue(m.Values).([]interface{})
+	return json.Marshal(metaData(m))
+}
+
+type SequenceHeader struct {
+	StreamType string      `json:"stream_type"` // AVC/HEVC/AAC
+	Timestamp  uint32      `json:"timestamp"`
+	Config     interface{} `json:"config"` // the decoded AVCDecoderConfigurationRecord/HEVCDecoderConfigurationRecord/AACAudioSpecificConfig
+	Width      int         `json:"width,omitempty"`
+	Height     int         `json:"height,omitempty"`
+	FPS        float64     `json:"fps,omitempty"` // from SPS, it's not mandatory
+	// SPS is the first SPS of video, nil if there is no SPS or it can't be parsed
+	SPS codec.SPS `json:"-"`
+}
+
+// GOP is computed by the DTS of keyframes, only the complete GOPs are counted.
+type GOP struct {
+	Count         int     `json:"count"`
+	MinDurationMs int     `json:"min_duration_ms"`
+	MaxDurationMs int     `json:"max_duration_ms"`
+	AvgDurationMs float64 `json:"avg_duration_ms"`
+	MinFrames     int     `json:"min_frames"`
+	MaxFrames     int     `json:"max_frames"`
+	AvgFrames     float64 `json:"avg_frames"`
+}
+
+// gopCounter counts the GOPs of video
+type gopCounter struct {
+	started bool
+	start   int // DTS of the keyframe starting current GOP
+	frames  int
+
+	gop           GOP
+	totalDuration int
+	totalFrames   int
+}
+
+func (c *gopCounter) onFrame(dts int, keyFrame bool) {
+	if keyFrame && c.started {
+		duration := dts - c.start
+		g := &c.gop
+		if g.Count == 0 || duration < g.MinDurationMs {
+			g.MinDurationMs = duration
+		}
+		if g.Count == 0 || c.frames < g.MinFrames {
+			g.MinFrames = c.frames
+		}
+		g.MaxDurationMs = max(g.MaxDurationMs, duration)
+		g.MaxFrames = max(g.MaxFrames, c.frames)
+		g.Count++
+		c.totalDuration += duration
+		c.totalFrames += c.frames
+		g.AvgDurationMs = float64(c.totalDuration) / float64(g.Count)
+		g.AvgFrames = float64(c.totalFrames) / float64(g.Count)
+	}
+	if keyFrame {
+		c.started, c.start, c.frames = true, dts, 0
+	}
+	if c.started {
+		c.frames++
+	}
+}
+
+type TrackSummary struct {
+	Codec             string       `json:"codec,omitempty"`
+	Width             int          `json:"width,omitempty"`
+	Height            int          `json:"height,omitempty"`
+	SPSFPS            float64      `json:"sps_fps,omitempty"`
+	Count             int          `json:"count"`
+	TimestampDuration int64        `json:"timestamp_duration"`
+	Rate              float64      `json:"rate"`      // frames per second by timestamp
+	RealRate          float64      `json:"real_rate"` // frames per second by running time
+	MaxGap            int64        `json:"max_gap"`
+	MaxRewind         int64        `json:"max_rewind"`
+	Duplicate         int          `json:"duplicate"`
+	MaxHoleMs         int64        `json:"max_hole_ms"`
+	Rollovers         int          `json:"rollovers"`
+	Cache             CacheSummary `json:"cache"`
+}
+
+type CacheSummary struct {
+	Converged  bool    `json:"converged"`
+	Duration   int     `json:"duration"`
+	Frames     int     `json:"frames"`
+	SendTimeMs int64   `json:"send_time_ms"`
+	Speed      float64 `json:"speed"`
+	Rate       float64 `json:"rate"`
+	Confidence float64 `json:"confidence"`
+}
+
+type PlayerSummary struct {
+	Started            bool  `json:"started"`
+	TimeToFirstFrameMs int64 `json:"time_to_first_frame_ms"`
+	Stalls             int   `json:"stalls"`
+	StallDurationMs    int64 `json:"stall_duration_ms"`
+	LatencyMs          int64 `json:"latency_ms"`
+}
+
+// NewTrackSummary returns the summary of the stats of a track.
+func NewTrackSummary(s summary.Stats) *TrackSummary {
+	t := &TrackSummary{
+		Count:             s.Total,
+		TimestampDuration: s.TimestampDuration,
+		Rate:              finite(s.Rate),
+		RealRate:          finite(s.RealRate),
+		MaxGap:            s.MaxGap,
+		MaxRewind:         s.MaxRewind,
+		Duplicate:         s.Duplicate,
+		MaxHoleMs:         s.MaxHole.Milliseconds(),
+		Rollovers:         s.Rollovers,
+		Cache: CacheSummary{
+			Converged:  s.Cache.Converged,
+			Duration:   s.Cache.Duration,
+			Frames:     s.Cache.Frames,
+			SendTimeMs: s.Cache.SendTime.Milliseconds(),
+			Speed:      finite(s.Cache.Speed),
+			Rate:       finite(s.Cache.Rate),
+			Confidence: finite(s.Cache.Confidence),
+		},
+	}
+	return t
+}
+
+// NewPlayerSummary returns the summary of a simulated player.
+func NewPlayerSummary(player *summary.Player) *PlayerSummary {
+	return &PlayerSummary{
+		Started:            player.Started(),
+		TimeToFirstFrameMs: player.TimeToFirstFrame.Milliseconds(),
+		Stalls:             player.Stalls,
+		StallDurationMs:    player.StallDuration.Milliseconds(),
+		LatencyMs:          player.Latency().Milliseconds(),
+	}
+}
+
+// finite returns 0 if f is NaN or ±Inf, which can't be encoded by JSON.
+func finite(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+// FiniteValue returns a copy of the AMF value v whose NaN and ±Inf numbers are replaced by nil,
+// so it can be encoded by JSON. The numbers come from the stream, e.g. a broken onMetaData.
+func FiniteValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return nil
+		}
+	case float32:
+		if math.IsNaN(float64(t)) || math.IsInf(float64(t), 0) {
+			return nil
+		}
+	case amf.DateType:
+		if math.IsNaN(float64(t)) || math.IsInf(float64(t), 0) {
+			return nil
+		}
+	case []interface{}:
+		if t == nil {
+			return t
+		}
+		values := make([]interface{}, len(t))
+		for i := range t {
+			values[i] = FiniteValue(t[i])
+		}
+		return values
+	case map[string]interface{}:
+		return finiteMap(t)
+	case amf.ECMAArray:
+		return amf.ECMAArray(finiteMap(t))
+	case *amf.TypedObjectType:
+		if t != nil {
+			return &amf.TypedObjectType{ClassName: t.ClassName, Object: finiteMap(t.Object)}
+		}
+	}
+	return v
+}
+
+func finiteMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	values := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		values[k] = FiniteValue(v)
+	}
+	return values
+}
@@ -0,0 +1,60 @@
+package probe
+
+import (
+	"fmt"
+
+	"github.com/foolishCDN/AV-spy/codec"
+	"github.com/foolishCDN/AV-spy/codec/avc"
+	"github.com/foolishCDN/AV-spy/codec/hevc"
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+// DecodeSequenceHeader decodes the configuration record of AVC/HEVC/AAC sequence header,
+// the width, height and fps are from SPS of video. It's not an error if the SPS can't be parsed.
+func DecodeSequenceHeader(tag flv.TagI) (*SequenceHeader, error) {
+	switch t := tag.(type) {
+	case *flv.AudioTag:
+		if t.SoundFormat != flv.AAC || t.PacketType != flv.SequenceHeader {
+			break
+		}
+		aac := new(codec.AACAudioSpecificConfig)
+		if err := aac.Read(t.Bytes); err != nil {
+			return nil, fmt.Errorf("parse sequence header of audio AACAudioSpecificConfig failed: %w", err)
+		}
+		return &SequenceHeader{StreamType: "AAC", Timestamp: t.PTS, Config: aac}, nil
+	case *flv.VideoTag:
+		if t.PacketType != flv.SequenceHeader {
+			break
+		}
+		switch t.CodecID {
+		case flv.H264:
+			config := new(avc.AVCDecoderConfigurationRecord)
+			if err := config.Read(t.Bytes); err != nil {
+				return nil, fmt.Errorf("parse sequence header of video AVCDecoderConfigurationRecord failed: %w", err)
+			}
+			header := &SequenceHeader{StreamType: "AVC", Timestamp: t.DTS, Config: config}
+			if sps := t.SPS(); sps != nil {
+				header.setSPS(sps)
+			}
+			return header, nil
+		case flv.H265:
+			config := new(hevc.HEVCDecoderConfigurationRecord)
+			if err := config.Read(t.Bytes); err != nil {
+				return nil, fmt.Errorf("parse sequence header of video HEVCDecoderConfigurationRecord failed: %w", err)
+			}
+			header := &SequenceHeader{StreamType: "HEVC", Timestamp: t.DTS, Config: config}
+			if sps := t.SPS(); sps != nil {
+				header.setSPS(sps)
+			}
+			return header, nil
+		default:
+			return nil, fmt.Errorf("unknown sequence header type of video %s", t.CodecID)
+		}
+	}
+	return nil, fmt.Errorf("%s is not a sequence header", tag.Type())
+}
+
+func (h *SequenceHeader) setSPS(sps codec.SPS) {
+	h.SPS = sps
+	h.Width, h.Height, h.FPS = sps.Width(), sps.Height(), finite(sps.FPS())
+}
@@ -0,0 +1,370 @@
+// Package record tees a live FLV stream to disk while it's analysed.
+//
+// Recorder writes the tags to files rotated by duration/size on keyframes, every file starts with
+// the onMetaData and sequence headers of stream. It also keeps a rolling buffer of the last tags,
+// which is flushed to a file when an anomaly of summary.Counter is found, see OnEvent.
+package record
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+type Config struct {
+	// Dir is the directory of files
+	Dir string
+	// Prefix is the prefix of file names, a file is named <prefix>-<time>-<n>.flv,
+	// and a flushed buffer is named <prefix>-<time>-<n>-<reason>.flv
+	Prefix string
+	// MaxDuration and MaxSize rotate the file on the next keyframe if one of them is reached, no limit if 0.
+	MaxDuration time.Duration
+	MaxSize     int64
+	// Buffer is the duration of rolling buffer, no buffer if 0.
+	Buffer time.Duration
+	// FlushOn are the events flushing the buffer, gap/rewind/hole if nil.
+	FlushOn []summary.EventType
+	// OnFile is called with the path of every file closed, it's optional.
+	OnFile func(path string)
+}
+
+// Recorder is safe for concurrent use, e.g. the tags are written by the reading goroutine
+// while the recording is toggled by UI.
+type Recorder struct {
+	config Config
+
+	mu        sync.Mutex
+	header    *flv.Header
+	metaData  *flv.ScriptTag
+	headers   map[flv.TagType]flv.TagI // the active sequence headers
+	recording bool
+	file      *file
+	number    int
+
+	buffer        []bufferedTag
+	bufferHeaders map[flv.TagType]flv.TagI // the sequence headers active at the start of buffer
+	flushedAt     int64                    // clock of the last flush, -1 if never
+	clock         bufferClock
+}
+
+// bufferedTag is a tag of rolling buffer with the clock when it's buffered
+type bufferedTag struct {
+	tag   flv.TagI
+	clock int64
+}
+
+// maxInterleave(ms) is how far the timestamps of tags may go backwards by the interleaving of tracks,
+// a larger step back is a rewind which restarts the timeline of bufferClock.
+const maxInterleave = 1000
+
+// bufferClock is the duration(ms) of stream buffered, it only advances with the timestamps,
+// so the buffer is trimmed after a rewind as usual instead of waiting for the stream to catch up.
+type bufferClock struct {
+	started   bool
+	now       int64
+	timestamp int64 // the largest timestamp of the current timeline
+}
+
+func (c *bufferClock) advance(timestamp int64) int64 {
+	switch {
+	case !c.started:
+		c.started = true
+	case timestamp > c.timestamp:
+		c.now += timestamp - c.timestamp
+	case c.timestamp-timestamp <= maxInterleave:
+		return c.now
+	}
+	c.timestamp = timestamp
+	return c.now
+}
+
+func New(config Config) *Recorder {
+	if config.FlushOn == nil {
+		config.FlushOn = []summary.EventType{summary.EventGap, summary.EventRewind, summary.EventHole}
+	}
+	if config.Prefix == "" {
+		config.Prefix = "record"
+	}
+	return &Recorder{
+		config:        config,
+		headers:       make(map[flv.TagType]flv.TagI),
+		bufferHeaders: make(map[flv.TagType]flv.TagI),
+		flushedAt:     -1,
+	}
+}
+
+// OnHeader sets the FLV header of stream, it resets the recorder for a new stream and closes the file.
+func (r *Recorder) OnHeader(header *flv.Header) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.header = header
+	r.metaData = nil
+	r.headers = make(map[flv.TagType]flv.TagI)
+	r.buffer = nil
+	r.bufferHeaders = make(map[flv.TagType]flv.TagI)
+	r.flushedAt = -1
+	r.clock = bufferClock{}
+	return r.closeFile()
+}
+
+// Recording returns true if the tags are written to file.
+func (r *Recorder) Recording() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.recording
+}
+
+// Start starts recording, the first file is created on the next keyframe.
+func (r *Recorder) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recording = true
+}
+
+// Stop stops recording and closes the file.
+func (r *Recorder) Stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recording = false
+	return r.closeFile()
+}
+
+// Close is Stop.
+func (r *Recorder) Close() error {
+	return r.Stop()
+}
+
+// WriteTag tees tag to the file if recording, and to the rolling buffer except onMetaData.
+func (r *Recorder) WriteTag(tag flv.TagI) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if script, ok := tag.(*flv.ScriptTag); ok && flv.IsMetaData(script) {
+		// the new files start with the last onMetaData, the file recording gets the update too
+		r.metaData = script
+		if r.recording && r.file != nil {
+			return r.file.writeTag(tag)
+		}
+		return nil
+	}
+	if flv.IsSequenceHeader(tag) {
+		r.headers[tag.Type()] = tag
+	}
+	r.buffered(tag)
+	if !r.recording {
+		return nil
+	}
+	keyFrame := r.isKeyFrame(tag)
+	if r.file != nil && keyFrame && r.file.full(r.config.MaxDuration, r.config.MaxSize) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+	}
+	if r.file == nil {
+		if !keyFrame {
+			return nil
+		}
+		f, err := r.createFile("", r.headers)
+		if err != nil {
+			return err
+		}
+		r.file = f
+	}
+	return r.file.writeTag(tag)
+}
+
+// buffered adds tag to the rolling buffer, the buffer starts at a keyframe
+func (r *Recorder) buffered(tag flv.TagI) {
+	if r.config.Buffer <= 0 {
+		return
+	}
+	clock := r.clock.advance(int64(tag.Timestamp()))
+	if len(r.buffer) == 0 && !r.isKeyFrame(tag) {
+		if flv.IsSequenceHeader(tag) {
+			r.bufferHeaders[tag.Type()] = tag
+		}
+		return
+	}
+	r.buffer = append(r.buffer, bufferedTag{tag: tag, clock: clock})
+	limit := clock - r.config.Buffer.Milliseconds()
+	// drop the GOPs out of buffer
+	for {
+		next := -1
+		for i := 1; i < len(r.buffer); i++ {
+			if r.isKeyFrame(r.buffer[i].tag) {
+				next = i
+				break
+			}
+		}
+		if next < 0 || r.buffer[next].clock > limit {
+			return
+		}
+		for _, b := range r.buffer[:next] {
+			if flv.IsSequenceHeader(b.tag) {
+				r.bufferHeaders[b.tag.Type()] = b.tag
+			}
+		}
+		r.buffer = append(r.buffer[:0:0], r.buffer[next:]...)
+	}
+}
+
+// Flush writes the rolling buffer to a file named with reason, it returns the path.
+func (r *Recorder) Flush(reason string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flush(reason)
+}
+
+func (r *Recorder) flush(reason string) (string, error) {
+	if len(r.buffer) == 0 {
+		return "", nil
+	}
+	f, err := r.createFile(reason, r.bufferHeaders)
+	if err != nil {
+		return "", err
+	}
+	for _, b := range r.buffer {
+		if err := f.writeTag(b.tag); err != nil {
+			_ = f.close()
+			return "", err
+		}
+	}
+	r.flushedAt = r.buffer[len(r.buffer)-1].clock
+	if err := f.close(); err != nil {
+		return "", err
+	}
+	if r.config.OnFile != nil {
+		r.config.OnFile(f.path)
+	}
+	return f.path, nil
+}
+
+// OnEvent flushes the rolling buffer if the event is one of FlushOn, it implements summary.EventSink.
+// The buffer isn't flushed again until it's full of the tags after the last flush.
+func (r *Recorder) OnEvent(event summary.Event) {
+	flush := false
+	for _, t := range r.config.FlushOn {
+		flush = flush || t == event.Type
+	}
+	if !flush {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.config.Buffer <= 0 || len(r.buffer) == 0 {
+		return
+	}
+	if last := r.buffer[len(r.buffer)-1].clock; r.flushedAt >= 0 && last-r.flushedAt < r.config.Buffer.Milliseconds() {
+		return
+	}
+	_, _ = r.flush(fmt.Sprintf("%s-%s", event.Track, event.Type))
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	f := r.file
+	r.file = nil
+	if err := f.close(); err != nil {
+		return err
+	}
+	if r.config.OnFile != nil {
+		r.config.OnFile(f.path)
+	}
+	return nil
+}
+
+// createFile creates a file starting with the onMetaData and sequence headers
+func (r *Recorder) createFile(reason string, headers map[flv.TagType]flv.TagI) (*file, error) {
+	name := fmt.Sprintf("%s-%s-%d", r.config.Prefix, time.Now().Format("20060102-150405"), r.number)
+	if reason != "" {
+		name += "-" + reason
+	}
+	r.number++
+	hasAudio, hasVideo := true, true
+	if r.header != nil {
+		hasAudio, hasVideo = r.header.HasAudio, r.header.HasVideo
+	}
+	f, err := createFile(filepath.Join(r.config.Dir, name+".flv"), hasAudio, hasVideo)
+	if err != nil {
+		return nil, err
+	}
+	var leading []flv.TagI
+	if r.metaData != nil {
+		leading = append(leading, r.metaData)
+	}
+	for _, tagType := range []flv.TagType{flv.TagVideo, flv.TagAudio} {
+		if tag, ok := headers[tagType]; ok {
+			leading = append(leading, tag)
+		}
+	}
+	for _, tag := range leading {
+		if err := f.writeTag(tag); err != nil {
+			_ = f.close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (r *Recorder) isKeyFrame(tag flv.TagI) bool {
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		return t.FrameType == flv.KeyFrame && !flv.IsSequenceHeader(t)
+	case *flv.AudioTag:
+		return (r.header == nil || !r.header.HasVideo) && !flv.IsSequenceHeader(t)
+	}
+	return false
+}
+
+// file is a FLV file being written
+type file struct {
+	path    string
+	f       *os.File
+	muxer   *flv.Muxer
+	size    int64
+	started bool
+	first   uint32 // timestamp of the first audio/video tag
+	last    uint32
+}
+
+func createFile(path string, hasAudio, hasVideo bool) (*file, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &file{path: path, f: f, muxer: new(flv.Muxer), size: 9 + 4}
+	if err := w.muxer.WriteHeader(f, hasAudio, hasVideo); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *file) writeTag(tag flv.TagI) error {
+	if err := w.muxer.WriteTag(w.f, tag); err != nil {
+		return err
+	}
+	w.size += int64(11 + tag.Len() + 4)
+	if tag.Type() != flv.TagScript && !flv.IsSequenceHeader(tag) {
+		if !w.started {
+			w.started, w.first = true, tag.Timestamp()
+		}
+		w.last = tag.Timestamp()
+	}
+	return nil
+}
+
+// full returns true if the file reaches duration or size
+func (w *file) full(duration time.Duration, size int64) bool {
+	return duration > 0 && int64(w.last)-int64(w.first) >= duration.Milliseconds() || size > 0 && w.size >= size
+}
+
+func (w *file) close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,150 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/summary"
+)
+
+func readTags(t *testing.T, path string) (*flv.Header, []flv.TagI) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(data)
+	demuxer := new(flv.Demuxer)
+	header, err := demuxer.ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []flv.TagI
+	for {
+		tag, err := demuxer.ReadTag(r)
+		if err == io.EOF {
+			return header, tags
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	header, tags := readTags(t, "../container/flv/test.flv")
+	dir := t.TempDir()
+	var files []string
+	recorder := New(Config{
+		Dir:         dir,
+		MaxDuration: 4 * time.Second,
+		Buffer:      3 * time.Second,
+		OnFile: func(path string) {
+			files = append(files, path)
+		},
+	})
+	assert.Nil(t, recorder.OnHeader(header))
+	recorder.Start()
+	assert.True(t, recorder.Recording())
+	flushed := false
+	for _, tag := range tags {
+		assert.Nil(t, recorder.WriteTag(tag))
+		if !flushed && tag.Timestamp() > 6000 {
+			flushed = true
+			recorder.OnEvent(summary.Event{Type: summary.EventGap, Track: "video"})
+			// the buffer isn't flushed again until it's full of new tags
+			recorder.OnEvent(summary.Event{Type: summary.EventRewind, Track: "video"})
+			recorder.OnEvent(summary.Event{Type: summary.EventDuplicate, Track: "video"})
+		}
+	}
+	assert.Nil(t, recorder.Stop())
+	assert.False(t, recorder.Recording())
+
+	var recorded, buffered []string
+	for _, path := range files {
+		if strings.HasSuffix(path, "-video-gap.flv") {
+			buffered = append(buffered, path)
+		} else {
+			recorded = append(recorded, path)
+		}
+	}
+	assert.Len(t, buffered, 1)
+	assert.True(t, len(recorded) >= 3)
+	for _, path := range files {
+		_, tags := readTags(t, path)
+		// every file starts with onMetaData, the video sequence header and a keyframe, the audio of test.flv is MP3
+		script, ok := tags[0].(*flv.ScriptTag)
+		assert.True(t, ok && flv.IsMetaData(script), path)
+		assert.True(t, flv.IsSequenceHeader(tags[1]) && tags[1].Type() == flv.TagVideo, path)
+		assert.True(t, recorder.isKeyFrame(tags[2]), path)
+	}
+
+	_, tags = readTags(t, buffered[0])
+	last := tags[len(tags)-1].Timestamp()
+	assert.True(t, last > 6000)
+	assert.True(t, last-tags[2].Timestamp() < 3000+4000, "the buffer keeps the GOPs of the last 3 seconds")
+}
+
+func TestRecorderBufferAfterRewind(t *testing.T) {
+	header, tags := readTags(t, "../container/flv/test.flv")
+	_, replayed := readTags(t, "../container/flv/test.flv")
+	recorder := New(Config{Dir: t.TempDir(), Buffer: 3 * time.Second})
+	assert.Nil(t, recorder.OnHeader(header))
+	// the stream rewinds to 0 after 15 seconds
+	for _, tag := range tags {
+		assert.Nil(t, recorder.WriteTag(tag))
+	}
+	after := make(map[flv.TagI]bool)
+	for _, tag := range replayed {
+		after[tag] = true
+		assert.Nil(t, recorder.WriteTag(tag))
+		if tag.Timestamp() < 8000 {
+			continue
+		}
+		// the GOPs before rewind are dropped although their timestamps are larger
+		assert.True(t, after[recorder.buffer[0].tag], "buffer starts at %d before rewind", recorder.buffer[0].tag.Timestamp())
+	}
+}
+
+func TestRecorderMetaDataUpdate(t *testing.T) {
+	header, tags := readTags(t, "../container/flv/test.flv")
+	var files []string
+	recorder := New(Config{
+		Dir: t.TempDir(),
+		OnFile: func(path string) {
+			files = append(files, path)
+		},
+	})
+	assert.Nil(t, recorder.OnHeader(header))
+	recorder.Start()
+	// onMetaData is updated at 5s
+	update := *tags[0].(*flv.ScriptTag)
+	update.PTS = 5000
+	updated := false
+	for _, tag := range tags {
+		if !updated && tag.Timestamp() > update.PTS {
+			updated = true
+			assert.Nil(t, recorder.WriteTag(&update))
+		}
+		assert.Nil(t, recorder.WriteTag(tag))
+	}
+	assert.Nil(t, recorder.Stop())
+
+	if assert.Len(t, files, 1) {
+		_, recorded := readTags(t, files[0])
+		var metaData []uint32
+		for _, tag := range recorded {
+			if script, ok := tag.(*flv.ScriptTag); ok && flv.IsMetaData(script) {
+				metaData = append(metaData, script.PTS)
+			}
+		}
+		assert.Equal(t, []uint32{0, 5000}, metaData)
+	}
+}
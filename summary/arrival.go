@@ -0,0 +1,79 @@
+package summary
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Arrival records when a frame of a track was received.
+//
+// An arrival log is a text file with one arrival per line:
+//
+//	<receive time(ms) since the request, or the first arrival if the request time is unknown>,<track>,<timestamp>
+type Arrival struct {
+	Time      time.Duration
+	Track     string
+	Timestamp int64
+}
+
+type ArrivalWriter struct {
+	w     io.Writer
+	start time.Time
+}
+
+func NewArrivalWriter(w io.Writer) *ArrivalWriter {
+	return &ArrivalWriter{w: w}
+}
+
+// Start sets when the stream is requested, the receive times are relative to it.
+// It should be called before the first Write, the first arrival is used otherwise.
+func (aw *ArrivalWriter) Start(now time.Time) {
+	aw.start = now
+}
+
+func (aw *ArrivalWriter) Write(now time.Time, track string, timestamp int64) error {
+	if aw.start.IsZero() {
+		aw.start = now
+	}
+	ms := float64(now.Sub(aw.start)) / float64(time.Millisecond)
+	_, err := fmt.Fprintf(aw.w, "%.3f,%s,%d\n", ms, track, timestamp)
+	return err
+}
+
+func ReadArrivals(r io.Reader) ([]Arrival, error) {
+	var arrivals []Arrival
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("arrival log line %d: expect 3 fields, got %d", line, len(fields))
+		}
+		ms, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("arrival log line %d: invalid time %q", line, fields[0])
+		}
+		timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("arrival log line %d: invalid timestamp %q", line, fields[2])
+		}
+		arrivals = append(arrivals, Arrival{
+			Time:      time.Duration(ms * float64(time.Millisecond)),
+			Track:     fields[1],
+			Timestamp: timestamp,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return arrivals, nil
+}
@@ -0,0 +1,156 @@
+package summary
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// maxCacheSamples limits the memory used to estimate the cache
+	maxCacheSamples = 1 << 14
+	// maxCacheSampleSpan stops sampling when the cache should have been consumed long ago
+	maxCacheSampleSpan = 60 * time.Second
+	// cacheConfirmDuration is how long the stream must be received in real time after the burst
+	// to consider the estimation converged
+	cacheConfirmDuration = 2 * time.Second
+)
+
+// CacheEstimate is the estimation of the content cached by server (e.g. GOP cache) and sent in a burst
+// at the start of a live stream.
+//
+// It's estimated by a two-segment regression of timestamp against arrival time: the cache is received
+// faster than real time (the burst, possibly throttled by server), then the stream is received in real time.
+// The knee between the two segments is where the cache is over.
+type CacheEstimate struct {
+	Converged  bool          // the stream has been received in real time long enough after the knee
+	Duration   int           // timestamp duration(ms) of the cached content
+	Frames     int           // frames received before the knee
+	SendTime   time.Duration // time used to receive the cached content
+	Speed      float64       // timestamp speed relative to real time while receiving the cache, 0 if received at once
+	Rate       float64       // frames per second while receiving the cache, 0 if received at once
+	Confidence float64       // 0~1
+}
+
+type cacheSample struct {
+	arrival   float64 // ms since the first frame
+	timestamp float64 // ms since the first frame
+}
+
+type cacheEstimator struct {
+	samples []cacheSample
+	frozen  bool
+}
+
+func (e *cacheEstimator) add(arrival time.Duration, timestamp int64) {
+	if e.frozen {
+		return
+	}
+	if len(e.samples) >= maxCacheSamples || arrival > maxCacheSampleSpan {
+		e.frozen = true
+		return
+	}
+	if n := len(e.samples); n > 0 && float64(timestamp) < e.samples[n-1].timestamp {
+		return // rewind can't be explained by cache
+	}
+	e.samples = append(e.samples, cacheSample{
+		arrival:   float64(arrival) / float64(time.Millisecond),
+		timestamp: float64(timestamp),
+	})
+}
+
+// estimate finds the knee k which minimizes the squared error of
+//
+//	timestamp = a + b * arrival            for samples before k (the burst)
+//	timestamp = arrival + lead             for samples from k (real time)
+//
+// diffThreshold is the tolerance(percent) of the real time segment speed to 1.
+func (e *cacheEstimator) estimate(diffThreshold int) CacheEstimate {
+	n := len(e.samples)
+	if n < 3 {
+		return CacheEstimate{}
+	}
+	// prefix sums, index i is the sum of samples[:i]
+	sx := make([]float64, n+1)
+	sy := make([]float64, n+1)
+	sxx := make([]float64, n+1)
+	sxy := make([]float64, n+1)
+	syy := make([]float64, n+1)
+	sl := make([]float64, n+1)
+	sll := make([]float64, n+1)
+	for i, s := range e.samples {
+		lead := s.timestamp - s.arrival
+		sx[i+1] = sx[i] + s.arrival
+		sy[i+1] = sy[i] + s.timestamp
+		sxx[i+1] = sxx[i] + s.arrival*s.arrival
+		sxy[i+1] = sxy[i] + s.arrival*s.timestamp
+		syy[i+1] = syy[i] + s.timestamp*s.timestamp
+		sl[i+1] = sl[i] + lead
+		sll[i+1] = sll[i] + lead*lead
+	}
+	// free linear fit of samples[i:j], returns slope and squared error
+	fit := func(i, j int) (float64, float64) {
+		m := float64(j - i)
+		if m < 2 {
+			return 0, 0
+		}
+		x, y := sx[j]-sx[i], sy[j]-sy[i]
+		cxx := sxx[j] - sxx[i] - x*x/m
+		cxy := sxy[j] - sxy[i] - x*y/m
+		cyy := syy[j] - syy[i] - y*y/m
+		if cxx <= 0 {
+			return math.Inf(1), cyy
+		}
+		return cxy / cxx, math.Max(cyy-cxy*cxy/cxx, 0)
+	}
+	// real time fit of samples[i:j], returns the lead and squared error
+	realTime := func(i, j int) (float64, float64) {
+		m := float64(j - i)
+		l := sl[j] - sl[i]
+		return l / m, math.Max(sll[j]-sll[i]-l*l/m, 0)
+	}
+
+	knee, best := 0, math.Inf(1)
+	for k := 0; k <= n-2; k++ {
+		_, e1 := fit(0, k)
+		_, e2 := realTime(k, n)
+		if e1+e2 < best {
+			knee, best = k, e1+e2
+		}
+	}
+
+	res := CacheEstimate{}
+	lead, _ := realTime(knee, n)
+	speed, _ := fit(knee, n)
+	span := e.samples[n-1].arrival - e.samples[knee].arrival
+	tolerance := float64(diffThreshold) / 100
+	if tolerance <= 0 {
+		tolerance = 0.05
+	}
+	res.Converged = span >= float64(cacheConfirmDuration/time.Millisecond) && math.Abs(speed-1) < tolerance
+
+	coverage := math.Min(span/float64(cacheConfirmDuration/time.Millisecond), 1)
+	linearity := math.Max(1-math.Abs(speed-1)/tolerance, 0)
+	if knee == 0 || lead <= 0 {
+		// no burst, nothing cached
+		res.Confidence = coverage * linearity
+		return res
+	}
+	res.Duration = int(math.Round(lead))
+	res.Frames = knee
+	last := e.samples[knee-1]
+	res.SendTime = time.Duration(last.arrival * float64(time.Millisecond))
+	if last.arrival > 0 {
+		res.Speed = last.timestamp / last.arrival
+		res.Rate = float64(knee-1) / last.arrival * 1000
+	}
+	if burst, _ := fit(0, knee); knee >= 2 && !math.IsInf(burst, 1) {
+		res.Speed = burst
+	}
+	// the burst must be distinguishable from real time
+	separation := 1.0
+	if res.Speed > 0 {
+		separation = math.Min(math.Max((res.Speed-1)/(2*tolerance), 0), 1)
+	}
+	res.Confidence = coverage * linearity * separation
+	return res
+}
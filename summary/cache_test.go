@@ -0,0 +1,59 @@
+package summary
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// feed sends a stream with interval(ms), the first cache(ms) of timestamp is sent at speed,
+// then the stream is sent in real time with jitter(ms).
+func feed(c *Counter, interval, cache int, speed float64, total int, jitter int) {
+	base := time.Unix(0, 0)
+	r := rand.New(rand.NewSource(1))
+	for ts := 0; ts <= total; ts += interval {
+		var arrival float64
+		if ts <= cache {
+			arrival = float64(ts) / speed
+		} else {
+			arrival = float64(cache)/speed + float64(ts-cache)
+			if jitter > 0 {
+				arrival += float64(r.Intn(jitter))
+			}
+		}
+		c.CountAt(uint32(ts), base.Add(time.Duration(arrival*float64(time.Millisecond))))
+	}
+}
+
+func TestCacheEstimate(t *testing.T) {
+	c := NewCounter(SetEventSink(DiscardSink{}))
+	feed(c, 40, 2000, 10, 8000, 20)
+	estimate := c.Snapshot().Cache
+	assert.True(t, estimate.Converged)
+	assert.InDelta(t, 1800, estimate.Duration, 60)
+	assert.InDelta(t, 50, estimate.Frames, 2)
+	assert.InDelta(t, 10, estimate.Speed, 1)
+	assert.Greater(t, estimate.Confidence, 0.8)
+
+	// throttled by server
+	c = NewCounter(SetEventSink(DiscardSink{}))
+	feed(c, 40, 4000, 2, 12000, 20)
+	estimate = c.Snapshot().Cache
+	assert.True(t, estimate.Converged)
+	assert.InDelta(t, 2000, estimate.Duration, 60)
+	assert.InDelta(t, 2, estimate.Speed, 0.2)
+
+	// low fps and not yet converged
+	c = NewCounter(SetEventSink(DiscardSink{}))
+	feed(c, 1000, 3000, 100, 4000, 0)
+	estimate = c.Snapshot().Cache
+	assert.False(t, estimate.Converged)
+	c = NewCounter(SetEventSink(DiscardSink{}))
+	feed(c, 1000, 3000, 100, 8000, 0)
+	estimate = c.Snapshot().Cache
+	assert.True(t, estimate.Converged)
+	assert.InDelta(t, 2970, estimate.Duration, 10)
+	assert.Equal(t, 3, estimate.Frames)
+}
@@ -1,16 +1,16 @@
 package summary
 
 import (
-	"math"
+	"sync"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 func NewCounter(opts ...CounterOption) *Counter {
 	c := &Counter{
-		HintGap:  200,
-		HintHole: 200 * time.Millisecond,
+		HintGap:       200,
+		HintHole:      200 * time.Millisecond,
+		DiffThreshold: 5,
+		sink:          LogrusSink{},
 	}
 	for _, opt := range opts {
 		opt(c)
@@ -19,126 +19,248 @@ func NewCounter(opts ...CounterOption) *Counter {
 	return c
 }
 
+// Counter counts the frames of a track and reports the timestamp and arrival anomalies as events.
+// It's safe to call Count and Snapshot from different goroutines.
 type Counter struct {
 	LogPrefix string
-	Total     int
-	MaxGap    int
-	MaxRewind int
-	Duplicate int
-	MaxHole   time.Duration
 
-	HintGap  int
+	// HintGap(ms) is the largest timestamp step of one frame not reported as EventGap,
+	// it's compared with every step, not with the max gap so far which warned every frame after a large gap.
+	HintGap int
+	// HintHole is the longest arrival interval of one frame not reported as EventHole.
 	HintHole time.Duration
 
-	firstTimestamp  int
-	lastTimestamp   int
+	// DiffThreshold is the tolerance(percent) between the timestamp speed and the real time speed,
+	// the cache is considered over when the stream is received in real time within this tolerance.
+	DiffThreshold int
+
+	mu   sync.Mutex
+	sink EventSink
+
+	total     int
+	gaps      int
+	maxGap    int64
+	rewinds   int
+	maxRewind int64
+	duplicate int
+	holes     int
+	maxHole   time.Duration
+	rollovers int
+	resumes   int
+
+	unwrapper       TimestampUnwrapper
+	firstTimestamp  int64
+	lastTimestamp   int64
 	lastReceiveTime time.Time
 
+	// for the sessions after reconnect, see Resume
+	resume          bool
+	sessionFirst    int64 // the first timestamp of current session
+	resumedDuration int64 // the timestamp duration of the sessions before current one
+
 	// for computing the cache content of live stream in server
-	startTime              time.Time
-	realTimeStart          time.Time
-	realTimeCount          int
-	estimatedCacheFps      float64
-	cacheTimestampDuration int
-	cacheDuration          time.Duration
+	startTime time.Time
+	cache     cacheEstimator
 
-	DiffThreshold int
+	bytes    int64
+	interval interval
 }
 
-func (c *Counter) TimestampDuration() int {
-	return c.lastTimestamp - c.firstTimestamp
+// Stats is a snapshot of Counter.
+type Stats struct {
+	Track     string
+	Total     int
+	Gaps      int // the gaps larger than HintGap
+	MaxGap    int64
+	Rewinds   int
+	MaxRewind int64
+	Duplicate int
+	Holes     int // the holes larger than HintHole
+	MaxHole   time.Duration
+	Rollovers int
+	Resumes   int   // the sessions resumed after reconnect
+	Bytes     int64 // the data size of frames, see AddBytes
+
+	FirstTimestamp    int64
+	LastTimestamp     int64
+	TimestampDuration int64 // the sum of all sessions if resumed
+	StartTime         time.Time
+	LastReceiveTime   time.Time
+	Duration          time.Duration // running time since the first frame
+
+	Rate     float64 // frames per second computed by timestamp
+	RealRate float64 // frames per second computed by running time
+	Cache    CacheEstimate
 }
 
-func (c *Counter) Duration() time.Duration {
-	return time.Since(c.startTime)
+// Snapshot returns the stats at now.
+func (c *Counter) Snapshot() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := Stats{
+		Track:             c.LogPrefix,
+		Total:             c.total,
+		Gaps:              c.gaps,
+		MaxGap:            c.maxGap,
+		Rewinds:           c.rewinds,
+		MaxRewind:         c.maxRewind,
+		Duplicate:         c.duplicate,
+		Holes:             c.holes,
+		MaxHole:           c.maxHole,
+		Rollovers:         c.rollovers,
+		Resumes:           c.resumes,
+		Bytes:             c.bytes,
+		FirstTimestamp:    c.firstTimestamp,
+		LastTimestamp:     c.lastTimestamp,
+		TimestampDuration: c.resumedDuration + c.lastTimestamp - c.sessionFirst,
+		StartTime:         c.startTime,
+		LastReceiveTime:   c.lastReceiveTime,
+	}
+	if c.startTime.IsZero() {
+		return s
+	}
+	s.Duration = time.Since(c.startTime)
+	if s.TimestampDuration > 0 {
+		s.Rate = float64(s.Total) / float64(s.TimestampDuration) * float64(1000)
+	}
+	if s.Duration > 0 {
+		s.RealRate = float64(s.Total) / s.Duration.Seconds()
+	}
+	s.Cache = c.cache.estimate(c.DiffThreshold)
+	return s
 }
 
-func (c *Counter) EstimatedCacheFps() float64 {
-	return c.estimatedCacheFps
+// LastTimestamp returns the unwrapped timestamp of the last frame counted, it's the one returned by CountAt.
+func (c *Counter) LastTimestamp() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastTimestamp
 }
 
-func (c *Counter) Rate() float64 {
-	return float64(c.Total) / float64(c.TimestampDuration()) * float64(1000)
+// Resume tells that the stream is reconnected, the next frame starts a new session of the track.
+// The timestamp jump to it isn't counted as gap or rewind and the downtime isn't counted as hole,
+// they are reported by an EventResume instead, the cache isn't estimated any more.
+func (c *Counter) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.startTime.IsZero() {
+		c.resume = true
+	}
 }
 
-func (c *Counter) RealRate() float64 {
-	return float64(c.Total) / float64(c.Duration().Seconds())
+// AddBytes adds the data size of a frame, it's counted separately from Count as the size is optional.
+func (c *Counter) AddBytes(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytes += int64(n)
+	c.interval.bytes += int64(n)
 }
 
-func (c *Counter) CacheTimestampDuration() int {
-	return c.cacheTimestampDuration
+// Count counts a frame with the 32 bits timestamp of tag received now, see CountAt.
+func (c *Counter) Count(timestamp int) int64 {
+	return c.CountAt(uint32(timestamp), time.Now())
 }
 
-func (c *Counter) CacheDuration() time.Duration {
-	return c.cacheDuration
+// CountAt counts a frame with the 32 bits timestamp of tag received at now,
+// it returns the timestamp unwrapped to a monotonic timeline.
+func (c *Counter) CountAt(timestamp uint32, now time.Time) int64 {
+	unwrapped, events := c.count(timestamp, now)
+	for _, event := range events {
+		c.sink.OnEvent(event)
+	}
+	return unwrapped
 }
 
-func (c *Counter) Count(timestamp int) {
+// count updates the stats with lock held, the events are sent to sink after unlock
+// so that the sink can call Snapshot.
+func (c *Counter) count(raw uint32, now time.Time) (int64, []Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timestamp, rollover := c.unwrapper.Unwrap(raw)
 	if c.startTime.IsZero() {
-		now := time.Now()
 		c.startTime = now
-		c.realTimeStart = now
-		c.realTimeCount++
+		c.cache.add(0, 0)
 
 		c.firstTimestamp = timestamp
+		c.sessionFirst = timestamp
 		c.lastTimestamp = timestamp
 		c.lastReceiveTime = now
-		c.Total++
-		return
+		c.total++
+		c.interval.count(timestamp, 0, nil)
+		return timestamp, nil
 	}
 
-	// compute real time fps
-	if c.cacheTimestampDuration == 0 {
-		c.realTimeCount++
-		if time.Since(c.realTimeStart) >= time.Millisecond*100 {
-			c.estimatedCacheFps = float64(c.realTimeCount) / time.Since(c.realTimeStart).Seconds()
-			if math.Abs(float64(c.estimatedCacheFps)-c.Rate())/c.Rate()*100 < float64(c.DiffThreshold) {
-				// it is considered that all the server cache has been consumed
-				c.cacheTimestampDuration = c.TimestampDuration()
-				c.cacheDuration = c.Duration()
-			}
-			c.realTimeStart = time.Now()
-			c.realTimeCount = 0
+	var events []Event
+	newEvent := func(t EventType, value, maxValue int64) Event {
+		return Event{
+			Type:          t,
+			Track:         c.LogPrefix,
+			Time:          now,
+			LastTimestamp: c.lastTimestamp,
+			Timestamp:     timestamp,
+			Value:         value,
+			Max:           maxValue,
 		}
 	}
-
+	if c.resume {
+		return c.resumeSession(raw, now, newEvent)
+	}
+	c.cache.add(now.Sub(c.startTime), timestamp-c.firstTimestamp)
+	if rollover != 0 {
+		c.rollovers++
+		event := newEvent(EventRollover, rollover, int64(c.rollovers))
+		event.LastTimestamp = int64(uint32(c.lastTimestamp))
+		event.Timestamp = int64(raw)
+		events = append(events, event)
+	}
 	diff := timestamp - c.lastTimestamp
 	if diff > 0 {
-		c.MaxGap = max(c.MaxGap, diff)
-		if c.MaxGap > c.HintGap {
-			logrus.WithFields(logrus.Fields{
-				"gap":  diff,
-				"max":  c.MaxGap,
-				"last": c.lastTimestamp,
-				"now":  timestamp,
-			}).Warnf("%s: dts jump", c.LogPrefix)
+		c.maxGap = max(c.maxGap, diff)
+		if diff > int64(c.HintGap) {
+			c.gaps++
+			events = append(events, newEvent(EventGap, diff, c.maxGap))
 		}
 	} else if diff < 0 {
-		c.MaxRewind = max(c.MaxRewind, -diff)
-		logrus.WithFields(logrus.Fields{
-			"rewind": diff,
-			"max":    c.MaxRewind,
-			"last":   c.lastTimestamp,
-			"now":    timestamp,
-		}).Warnf("%s: dts rewind", c.LogPrefix)
+		c.rewinds++
+		c.maxRewind = max(c.maxRewind, -diff)
+		events = append(events, newEvent(EventRewind, diff, c.maxRewind))
 	} else {
-		c.Duplicate++
-		logrus.WithFields(logrus.Fields{
-			"last": c.lastTimestamp,
-			"now":  timestamp,
-		}).Warnf("%s: dts duplicate", c.LogPrefix)
+		c.duplicate++
+		events = append(events, newEvent(EventDuplicate, 0, int64(c.duplicate)))
 	}
-	hole := time.Since(c.lastReceiveTime)
+	hole := now.Sub(c.lastReceiveTime)
 	if hole > c.HintHole {
-		c.MaxHole = max(c.MaxHole, hole)
-		logrus.WithFields(logrus.Fields{
-			"hole": hole.Milliseconds(),
-			"max":  c.MaxHole.Milliseconds(),
-			"last": c.lastReceiveTime.Format(time.RFC3339Nano),
-			"now":  time.Now().Format(time.RFC3339Nano),
-		}).Warnf("%s: data has hole", c.LogPrefix)
+		c.holes++
+		c.maxHole = max(c.maxHole, hole)
+		event := newEvent(EventHole, hole.Milliseconds(), c.maxHole.Milliseconds())
+		lastReceiveTime := c.lastReceiveTime
+		event.LastReceiveTime = &lastReceiveTime
+		events = append(events, event)
 	}
-	c.Total++
+	c.total++
+	c.lastTimestamp = timestamp
+	c.lastReceiveTime = now
+	c.interval.count(timestamp, diff, events)
+	return timestamp, events
+}
+
+// resumeSession counts the first frame after reconnect, the timestamps of new session are unwrapped from raw
+func (c *Counter) resumeSession(raw uint32, now time.Time, newEvent func(EventType, int64, int64) Event) (int64, []Event) {
+	c.resume = false
+	c.resumes++
+	c.cache.frozen = true
+	c.resumedDuration += c.lastTimestamp - c.sessionFirst
+	c.unwrapper = TimestampUnwrapper{Window: c.unwrapper.Window}
+	timestamp, _ := c.unwrapper.Unwrap(raw)
+	event := newEvent(EventResume, timestamp-c.lastTimestamp, int64(c.resumes))
+	event.Timestamp = timestamp
+	lastReceiveTime := c.lastReceiveTime
+	event.LastReceiveTime = &lastReceiveTime
+
+	c.sessionFirst = timestamp
+	c.total++
 	c.lastTimestamp = timestamp
-	c.lastReceiveTime = time.Now()
+	c.lastReceiveTime = now
+	c.interval.count(timestamp, 0, nil)
+	return timestamp, []Event{event}
 }
@@ -0,0 +1,139 @@
+package summary
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterEvents(t *testing.T) {
+	events := make(chan Event, 10)
+	c := NewCounter(SetLogPrefix("video"), SetEventSink(ChannelSink(events)))
+	base := time.Unix(0, 0)
+	for i, ts := range []uint32{0, 40, 80, 80, 40, 400} {
+		c.CountAt(ts, base.Add(time.Duration(i)*40*time.Millisecond))
+	}
+	c.CountAt(440, base.Add(time.Second))
+	close(events)
+
+	var types []EventType
+	for event := range events {
+		assert.Equal(t, "video", event.Track)
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []EventType{EventDuplicate, EventRewind, EventGap, EventHole}, types)
+
+	s := c.Snapshot()
+	assert.Equal(t, 7, s.Total)
+	assert.Equal(t, int64(360), s.MaxGap)
+	assert.Equal(t, int64(40), s.MaxRewind)
+	assert.Equal(t, 1, s.Gaps)
+	assert.Equal(t, 1, s.Rewinds)
+	assert.Equal(t, 1, s.Holes)
+	assert.Equal(t, 1, s.Duplicate)
+	assert.Equal(t, 800*time.Millisecond, s.MaxHole)
+	assert.Equal(t, int64(440), s.TimestampDuration)
+}
+
+func TestCounterConcurrency(t *testing.T) {
+	c := NewCounter(SetEventSink(DiscardSink{}))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			c.Count(i * 40)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_ = c.Snapshot()
+	}
+	wg.Wait()
+	assert.Equal(t, 1000, c.Snapshot().Total)
+}
+
+func TestCounterRollover(t *testing.T) {
+	events := make(chan Event, 10)
+	c := NewCounter(SetEventSink(ChannelSink(events)))
+	base := time.Unix(0, 0)
+	var got []int64
+	// 32 bits rollover, 24 bits rollover (extended byte is not sent) then a genuine rewind
+	for i, ts := range []uint32{1<<32 - 80, 1<<32 - 40, 0, 40, 80} {
+		got = append(got, c.CountAt(ts, base.Add(time.Duration(i)*40*time.Millisecond)))
+	}
+	assert.Equal(t, []int64{1<<32 - 80, 1<<32 - 40, 1 << 32, 1<<32 + 40, 1<<32 + 80}, got)
+
+	c = NewCounter(SetEventSink(ChannelSink(events)))
+	got = got[:0]
+	for i, ts := range []uint32{1<<24 - 40, 0, 40, 0} {
+		got = append(got, c.CountAt(ts, base.Add(time.Duration(i)*40*time.Millisecond)))
+	}
+	assert.Equal(t, []int64{1<<24 - 40, 1 << 24, 1<<24 + 40, 1 << 24}, got)
+	close(events)
+
+	var types []EventType
+	for event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []EventType{EventRollover, EventRollover, EventRewind}, types)
+	assert.Equal(t, 1, c.Snapshot().Rollovers)
+	assert.Equal(t, int64(40), c.Snapshot().MaxRewind)
+}
+
+func TestCounterResume(t *testing.T) {
+	events := make(chan Event, 10)
+	c := NewCounter(SetLogPrefix("video"), SetEventSink(ChannelSink(events)))
+	base := time.Unix(0, 0)
+	for i, ts := range []uint32{1000, 1040, 1080} {
+		c.CountAt(ts, base.Add(time.Duration(i)*40*time.Millisecond))
+	}
+	// reconnected after 5 seconds, the new session starts from 0
+	c.Resume()
+	for i, ts := range []uint32{0, 40} {
+		c.CountAt(ts, base.Add(5*time.Second+time.Duration(i)*40*time.Millisecond))
+	}
+	close(events)
+
+	var got []Event
+	for event := range events {
+		got = append(got, event)
+	}
+	assert.Len(t, got, 1)
+	assert.Equal(t, EventResume, got[0].Type)
+	assert.Equal(t, int64(-1080), got[0].Value)
+	s := c.Snapshot()
+	assert.Equal(t, 1, s.Resumes)
+	assert.Equal(t, int64(0), s.MaxRewind)
+	assert.Equal(t, time.Duration(0), s.MaxHole)
+	assert.Equal(t, int64(80+40), s.TimestampDuration)
+}
+
+func TestCounterInterval(t *testing.T) {
+	c := NewCounter(SetEventSink(DiscardSink{}))
+	base := time.Unix(0, 0)
+	for i, ts := range []uint32{0, 40, 80, 400, 440} {
+		c.CountAt(ts, base.Add(time.Duration(i)*40*time.Millisecond))
+		c.AddBytes(1000)
+	}
+	s := c.Interval(base.Add(time.Second))
+	assert.Equal(t, 5, s.Frames)
+	assert.Equal(t, int64(5000), s.Bytes)
+	assert.Equal(t, 1, s.Gaps)
+	assert.Equal(t, int64(320), s.MaxGap)
+	assert.Equal(t, int64(440), s.TimestampDuration)
+	assert.Equal(t, 5.0, s.Rate)
+	assert.Equal(t, 40000.0, s.Bitrate)
+
+	// the interval-scoped stats are reset, the cumulative ones are kept
+	c.CountAt(480, base.Add(2*time.Second))
+	s = c.Interval(base.Add(3 * time.Second))
+	assert.Equal(t, 1, s.Frames)
+	assert.Equal(t, 0, s.Gaps)
+	assert.Equal(t, 1, s.Holes)
+	assert.Equal(t, 2*time.Second-160*time.Millisecond, s.MaxHole)
+	assert.Equal(t, 2*time.Second, s.Duration)
+	assert.Equal(t, 6, c.Snapshot().Total)
+	assert.Equal(t, int64(5000), c.Snapshot().Bytes)
+}
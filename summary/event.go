@@ -0,0 +1,171 @@
+package summary
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type EventType int
+
+const (
+	EventGap EventType = iota
+	EventRewind
+	EventDuplicate
+	EventHole
+	EventRollover
+	EventResume
+)
+
+var eventTypeNames = []string{"gap", "rewind", "duplicate", "hole", "rollover", "resume"}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventTypeNames) {
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+	return eventTypeNames[t]
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *EventType) UnmarshalText(text []byte) error {
+	for i, name := range eventTypeNames {
+		if name == string(text) {
+			*t = EventType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event type %q", text)
+}
+
+// Event is an anomaly found by Counter.
+type Event struct {
+	Type  EventType `json:"type"`
+	Track string    `json:"track"`
+	Time  time.Time `json:"time"`
+	// LastTimestamp and Timestamp are unwrapped, except for EventRollover which are the raw timestamps of tag
+	LastTimestamp int64 `json:"last_timestamp"`
+	Timestamp     int64 `json:"timestamp"`
+	// Value is the gap or rewind(negative) of timestamp(ms), the hole(ms) of arrival time,
+	// the rollover(Rollover24 or Rollover32) added to the timeline,
+	// or the timestamp jump(ms) from the last frame before reconnect to the first frame after it
+	Value int64 `json:"value"`
+	// Max is the max value of this type so far, it is the count for EventDuplicate, EventRollover and EventResume
+	Max int64 `json:"max"`
+	// LastReceiveTime is set for EventHole and EventResume
+	LastReceiveTime *time.Time `json:"last_receive_time,omitempty"`
+}
+
+// EventSink consumes the events of Counter, OnEvent may be called from different goroutines.
+type EventSink interface {
+	OnEvent(event Event)
+}
+
+func SetEventSink(sink EventSink) CounterOption {
+	return func(c *Counter) {
+		c.sink = sink
+	}
+}
+
+// MultiSink sends events to all sinks.
+type MultiSink []EventSink
+
+func (sinks MultiSink) OnEvent(event Event) {
+	for _, sink := range sinks {
+		sink.OnEvent(event)
+	}
+}
+
+// LogrusSink logs events as warnings, it is the default sink of Counter.
+type LogrusSink struct{}
+
+func (LogrusSink) OnEvent(event Event) {
+	switch event.Type {
+	case EventGap:
+		logrus.WithFields(logrus.Fields{
+			"gap":  event.Value,
+			"max":  event.Max,
+			"last": event.LastTimestamp,
+			"now":  event.Timestamp,
+		}).Warnf("%s: dts jump", event.Track)
+	case EventRewind:
+		logrus.WithFields(logrus.Fields{
+			"rewind": event.Value,
+			"max":    event.Max,
+			"last":   event.LastTimestamp,
+			"now":    event.Timestamp,
+		}).Warnf("%s: dts rewind", event.Track)
+	case EventDuplicate:
+		logrus.WithFields(logrus.Fields{
+			"last": event.LastTimestamp,
+			"now":  event.Timestamp,
+		}).Warnf("%s: dts duplicate", event.Track)
+	case EventHole:
+		fields := logrus.Fields{
+			"hole": event.Value,
+			"max":  event.Max,
+			"now":  event.Time.Format(time.RFC3339Nano),
+		}
+		if event.LastReceiveTime != nil {
+			fields["last"] = event.LastReceiveTime.Format(time.RFC3339Nano)
+		}
+		logrus.WithFields(fields).Warnf("%s: data has hole", event.Track)
+	case EventRollover:
+		logrus.WithFields(logrus.Fields{
+			"rollover": event.Value,
+			"count":    event.Max,
+			"last":     event.LastTimestamp,
+			"now":      event.Timestamp,
+		}).Warnf("%s: timestamp rollover", event.Track)
+	case EventResume:
+		fields := logrus.Fields{
+			"jump":  event.Value,
+			"count": event.Max,
+			"last":  event.LastTimestamp,
+			"now":   event.Timestamp,
+		}
+		if event.LastReceiveTime != nil {
+			fields["downtime"] = event.Time.Sub(*event.LastReceiveTime).String()
+		}
+		logrus.WithFields(fields).Warnf("%s: resume after reconnect", event.Track)
+	}
+}
+
+// JSONLinesSink writes one JSON object per event.
+type JSONLinesSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *JSONLinesSink) OnEvent(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.encoder.Encode(event); err != nil {
+		logrus.WithField("error", err).Error("write event failed")
+	}
+}
+
+// ChannelSink sends events to channel without blocking Counter, the event is dropped if channel is full.
+type ChannelSink chan<- Event
+
+func (s ChannelSink) OnEvent(event Event) {
+	select {
+	case s <- event:
+	default:
+	}
+}
+
+// DiscardSink drops all events.
+type DiscardSink struct{}
+
+func (DiscardSink) OnEvent(Event) {}
@@ -0,0 +1,103 @@
+package summary
+
+import "time"
+
+// IntervalStats are the stats of a track in an interval, see Counter.Interval.
+type IntervalStats struct {
+	Track    string
+	Start    time.Time
+	Duration time.Duration
+
+	Frames     int
+	Bytes      int64
+	Gaps       int // the gaps larger than HintGap
+	Rewinds    int
+	Duplicates int
+	Holes      int // the holes larger than HintHole
+	MaxGap     int64
+	MaxHole    time.Duration
+
+	// TimestampDuration is from the first frame to the last frame of the interval
+	TimestampDuration int64
+	LastTimestamp     int64
+
+	Rate    float64 // frames per second by real time
+	Bitrate float64 // bits per second by real time
+}
+
+// interval is the interval-scoped part of Counter, it's reset by Counter.Interval
+type interval struct {
+	start time.Time
+
+	frames     int
+	bytes      int64
+	gaps       int
+	rewinds    int
+	duplicates int
+	holes      int
+	maxGap     int64
+	maxHole    time.Duration
+
+	started        bool
+	firstTimestamp int64
+	lastTimestamp  int64
+}
+
+// count adds a frame, diff is the timestamp diff from the last frame and events are found by the frame
+func (i *interval) count(timestamp, diff int64, events []Event) {
+	i.frames++
+	if !i.started {
+		i.started = true
+		i.firstTimestamp = timestamp
+	}
+	i.lastTimestamp = timestamp
+	i.maxGap = max(i.maxGap, diff)
+	for _, event := range events {
+		switch event.Type {
+		case EventGap:
+			i.gaps++
+		case EventRewind:
+			i.rewinds++
+		case EventDuplicate:
+			i.duplicates++
+		case EventHole:
+			i.holes++
+			i.maxHole = max(i.maxHole, time.Duration(event.Value)*time.Millisecond)
+		}
+	}
+}
+
+// Interval returns the stats since the last call (or the first frame) to now and starts a new interval,
+// the cumulative stats of Snapshot aren't reset.
+func (c *Counter) Interval(now time.Time) IntervalStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.interval
+	start := i.start
+	if start.IsZero() {
+		start = c.startTime
+	}
+	s := IntervalStats{
+		Track:             c.LogPrefix,
+		Start:             start,
+		Frames:            i.frames,
+		Bytes:             i.bytes,
+		Gaps:              i.gaps,
+		Rewinds:           i.rewinds,
+		Duplicates:        i.duplicates,
+		Holes:             i.holes,
+		MaxGap:            i.maxGap,
+		MaxHole:           i.maxHole,
+		TimestampDuration: i.lastTimestamp - i.firstTimestamp,
+		LastTimestamp:     c.lastTimestamp,
+	}
+	if !start.IsZero() {
+		s.Duration = now.Sub(start)
+	}
+	if s.Duration > 0 {
+		s.Rate = float64(s.Frames) / s.Duration.Seconds()
+		s.Bitrate = float64(s.Bytes*8) / s.Duration.Seconds()
+	}
+	c.interval = interval{start: now}
+	return s
+}
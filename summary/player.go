@@ -0,0 +1,196 @@
+package summary
+
+import (
+	"time"
+)
+
+// PlayerConfig describes the player model used by Player.
+type PlayerConfig struct {
+	// StartupBuffer is the amount of media that must be buffered before the first frame is shown.
+	StartupBuffer time.Duration
+	// RebufferBuffer is the amount of media that must be buffered to resume playback after a stall.
+	RebufferBuffer time.Duration
+	// CatchUpThreshold is the buffer level above which the player speeds up to reduce latency,
+	// catching up is disabled if it is 0.
+	CatchUpThreshold time.Duration
+	// CatchUpSpeed is the playback speed used while catching up, e.g. 1.1.
+	CatchUpSpeed float64
+}
+
+func DefaultPlayerConfig() PlayerConfig {
+	return PlayerConfig{
+		StartupBuffer:  1000 * time.Millisecond,
+		RebufferBuffer: 1000 * time.Millisecond,
+		CatchUpSpeed:   1.1,
+	}
+}
+
+const (
+	playerStateStartup = iota
+	playerStatePlaying
+	playerStateStalled
+)
+
+// Player simulates a player which consumes the received stream,
+// it replays the receive time and the timestamp of every frame and
+// reports the time to first frame, the stalls and the latency that a viewer would experience.
+//
+// The tracks share one playback position like a real player, so the buffer is the one of the track
+// buffered least, and the player stalls when any track runs out.
+type Player struct {
+	Config PlayerConfig
+
+	// TimeToFirstFrame is measured from Start, or from the first frame received if Start isn't called
+	TimeToFirstFrame time.Duration
+	Stalls           int
+	StallDuration    time.Duration
+
+	state      int
+	startTime  time.Time
+	lastTime   time.Time
+	stallStart time.Time
+	fed        bool
+	tracks     map[string]int64 // the last timestamp received of every track
+	position   float64          // playback position in timestamp(ms)
+}
+
+func NewPlayer(config PlayerConfig) *Player {
+	return &Player{Config: config, tracks: make(map[string]int64)}
+}
+
+// Start tells when the stream is requested, it should be called before the first frame.
+func (p *Player) Start(now time.Time) {
+	if !p.fed {
+		p.startTime = now
+	}
+}
+
+// Feed receives a frame with timestamp(ms) at time now, it's FeedTrack of a player with one track.
+func (p *Player) Feed(now time.Time, timestamp int64) {
+	p.FeedTrack(now, "", timestamp)
+}
+
+// FeedTrack receives a frame of track with timestamp(ms) at time now,
+// the timestamps of all tracks are on the same timeline.
+func (p *Player) FeedTrack(now time.Time, track string, timestamp int64) {
+	if p.tracks == nil {
+		p.tracks = make(map[string]int64)
+	}
+	if !p.fed {
+		p.fed = true
+		if p.startTime.IsZero() {
+			p.startTime = now
+		}
+		p.lastTime = now
+		p.position = float64(timestamp)
+		p.tracks[track] = timestamp
+		if p.Config.StartupBuffer <= 0 {
+			p.state = playerStatePlaying
+			p.TimeToFirstFrame = now.Sub(p.startTime)
+		}
+		return
+	}
+	p.advance(now)
+	if last, ok := p.tracks[track]; !ok || timestamp > last {
+		p.tracks[track] = timestamp
+	}
+	switch p.state {
+	case playerStateStartup:
+		if p.buffered() >= p.Config.StartupBuffer {
+			p.state = playerStatePlaying
+			p.TimeToFirstFrame = now.Sub(p.startTime)
+		}
+	case playerStateStalled:
+		if p.buffered() >= p.Config.RebufferBuffer {
+			p.state = playerStatePlaying
+			p.StallDuration += now.Sub(p.stallStart)
+		}
+	}
+}
+
+// end returns the timestamp that can be played to, that is the last timestamp of the track buffered least
+func (p *Player) end() float64 {
+	end, found := 0.0, false
+	for _, last := range p.tracks {
+		if !found || float64(last) < end {
+			end, found = float64(last), true
+		}
+	}
+	if !found {
+		return p.position
+	}
+	return end
+}
+
+// advance plays the buffered media from the last event to now.
+func (p *Player) advance(now time.Time) {
+	elapsed := float64(now.Sub(p.lastTime)) / float64(time.Millisecond)
+	p.lastTime = now
+	if p.state != playerStatePlaying || elapsed <= 0 {
+		return
+	}
+	end := p.end()
+	buffer := end - p.position
+	threshold := float64(p.Config.CatchUpThreshold) / float64(time.Millisecond)
+	speed := p.Config.CatchUpSpeed
+	if p.Config.CatchUpThreshold > 0 && speed > 1 && buffer > threshold {
+		catchUp := (buffer - threshold) / speed // time to consume the extra buffer
+		if elapsed <= catchUp {
+			p.position += elapsed * speed
+			return
+		}
+		p.position += catchUp * speed
+		elapsed -= catchUp
+		buffer = threshold
+	}
+	if elapsed < buffer {
+		p.position += elapsed
+		return
+	}
+	// the buffer runs out
+	p.position = end
+	p.state = playerStateStalled
+	p.Stalls++
+	p.stallStart = now.Add(-time.Duration((elapsed - buffer) * float64(time.Millisecond)))
+}
+
+func (p *Player) buffered() time.Duration {
+	buffer := time.Duration((p.end() - p.position) * float64(time.Millisecond))
+	if buffer < 0 {
+		return 0
+	}
+	return buffer
+}
+
+// Finish plays the stream until now, it should be called before reading the result.
+func (p *Player) Finish(now time.Time) {
+	if !p.fed {
+		return
+	}
+	p.advance(now)
+	if p.state == playerStateStalled {
+		p.StallDuration += now.Sub(p.stallStart)
+		p.stallStart = now
+	}
+}
+
+// Started reports whether the first frame has been shown.
+func (p *Player) Started() bool {
+	return p.state != playerStateStartup
+}
+
+// Latency returns the distance between the playback position and the latest frame playable,
+// that is the buffer of the track buffered least.
+func (p *Player) Latency() time.Duration {
+	return p.buffered()
+}
+
+// TrackLatency returns the distance between the playback position and the latest received frame of track,
+// ok is false if no frame of track is received.
+func (p *Player) TrackLatency(track string) (latency time.Duration, ok bool) {
+	last, ok := p.tracks[track]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration((float64(last) - p.position) * float64(time.Millisecond)), true
+}
@@ -0,0 +1,151 @@
+package summary
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func TestPlayerStartup(t *testing.T) {
+	base := time.Unix(0, 0)
+	config := PlayerConfig{StartupBuffer: ms(200)}
+
+	// the first frame is received 300ms after the request, 40ms per frame in real time
+	player := NewPlayer(config)
+	player.Start(base)
+	for i := 0; i <= 5; i++ {
+		player.Feed(base.Add(ms(300+i*40)), int64(i*40))
+	}
+	assert.True(t, player.Started())
+	assert.Equal(t, ms(500), player.TimeToFirstFrame)
+
+	// without Start, it's measured from the first frame
+	player = NewPlayer(config)
+	for i := 0; i <= 5; i++ {
+		player.Feed(base.Add(ms(300+i*40)), int64(i*40))
+	}
+	assert.Equal(t, ms(200), player.TimeToFirstFrame)
+}
+
+func TestPlayerStall(t *testing.T) {
+	base := time.Unix(0, 0)
+	player := NewPlayer(PlayerConfig{
+		StartupBuffer:  ms(200),
+		RebufferBuffer: ms(100),
+	})
+	// 40ms per frame, received in real time
+	for i := 0; i <= 10; i++ {
+		player.Feed(base.Add(ms(i*40)), int64(i*40))
+	}
+	assert.True(t, player.Started())
+	assert.Equal(t, ms(200), player.TimeToFirstFrame)
+	assert.Equal(t, 0, player.Stalls)
+
+	// no data for 500ms, the buffer(200ms) runs out
+	player.Feed(base.Add(ms(900)), 440)
+	assert.Equal(t, 1, player.Stalls)
+	player.Feed(base.Add(ms(1000)), 600)
+	assert.Equal(t, 1, player.Stalls)
+	assert.Equal(t, ms(400), player.StallDuration)
+
+	player.Finish(base.Add(ms(1000)))
+	assert.Equal(t, ms(200), player.Latency())
+}
+
+func TestPlayerCatchUp(t *testing.T) {
+	base := time.Unix(0, 0)
+	player := NewPlayer(PlayerConfig{
+		CatchUpThreshold: ms(100),
+		CatchUpSpeed:     2,
+	})
+	// a burst of 1s cache
+	player.Feed(base, 0)
+	player.Feed(base, 1000)
+	assert.True(t, player.Started())
+	assert.Equal(t, time.Duration(0), player.TimeToFirstFrame)
+
+	player.Finish(base.Add(ms(100)))
+	assert.Equal(t, ms(800), player.Latency())
+	player.Finish(base.Add(ms(400)))
+	assert.Equal(t, ms(200), player.Latency())
+	// 50ms at 2x reaches the threshold, then 50ms at 1x
+	player.Finish(base.Add(ms(500)))
+	assert.Equal(t, ms(50), player.Latency())
+	assert.Equal(t, 0, player.Stalls)
+}
+
+func TestPlayerJointBuffer(t *testing.T) {
+	base := time.Unix(0, 0)
+	player := NewPlayer(PlayerConfig{
+		StartupBuffer:  ms(200),
+		RebufferBuffer: ms(100),
+	})
+	// the audio is received up to 120ms only, the player waits for it
+	for i := 0; i <= 10; i++ {
+		now := base.Add(ms(i * 40))
+		player.FeedTrack(now, "video", int64(i*40))
+		if i*40 <= 120 {
+			player.FeedTrack(now, "audio", int64(i*40))
+		}
+	}
+	assert.False(t, player.Started())
+	assert.Equal(t, ms(120), player.Latency())
+	latency, ok := player.TrackLatency("video")
+	assert.True(t, ok)
+	assert.Equal(t, ms(400), latency)
+	_, ok = player.TrackLatency("data")
+	assert.False(t, ok)
+
+	player.FeedTrack(base.Add(ms(400)), "audio", 400)
+	assert.True(t, player.Started())
+	assert.Equal(t, ms(400), player.TimeToFirstFrame)
+
+	// the audio stops, the player stalls although the video keeps coming
+	for i := 11; i <= 25; i++ {
+		player.FeedTrack(base.Add(ms(i*40)), "video", int64(i*40))
+	}
+	assert.Equal(t, 1, player.Stalls)
+	latency, _ = player.TrackLatency("audio")
+	assert.Equal(t, time.Duration(0), latency)
+	latency, _ = player.TrackLatency("video")
+	assert.Equal(t, ms(600), latency)
+}
+
+func TestArrivalLog(t *testing.T) {
+	base := time.Unix(0, 0)
+	var buf bytes.Buffer
+	w := NewArrivalWriter(&buf)
+	w.Start(base)
+	assert.NoError(t, w.Write(base.Add(ms(300)), "video", 0))
+	assert.NoError(t, w.Write(base.Add(ms(320)), "audio", 5))
+	assert.NoError(t, w.Write(base.Add(ms(340)), "video", 40))
+	assert.Equal(t, "300.000,video,0\n320.000,audio,5\n340.000,video,40\n", buf.String())
+
+	arrivals, err := ReadArrivals(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []Arrival{
+		{Time: ms(300), Track: "video", Timestamp: 0},
+		{Time: ms(320), Track: "audio", Timestamp: 5},
+		{Time: ms(340), Track: "video", Timestamp: 40},
+	}, arrivals)
+
+	// replayed from the request, the time to first frame includes the time before the first arrival
+	player := NewPlayer(PlayerConfig{StartupBuffer: ms(40)})
+	player.Start(base)
+	for _, arrival := range arrivals {
+		player.FeedTrack(base.Add(arrival.Time), arrival.Track, arrival.Timestamp)
+	}
+	assert.False(t, player.Started(), "the audio is buffered 5ms only")
+	player.FeedTrack(base.Add(ms(360)), "audio", 60)
+	assert.True(t, player.Started())
+	assert.Equal(t, ms(360), player.TimeToFirstFrame)
+
+	_, err = ReadArrivals(bytes.NewBufferString("1,video\n"))
+	assert.Error(t, err)
+}
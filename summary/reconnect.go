@@ -0,0 +1,154 @@
+package summary
+
+import (
+	"sync"
+	"time"
+)
+
+// Backoff is the exponential backoff between reconnect attempts.
+type Backoff struct {
+	Initial    time.Duration // the delay of the first attempt
+	Max        time.Duration // the max delay, no limit if 0
+	Multiplier float64       // the delay is multiplied after every attempt, 2 if <= 1
+
+	next time.Duration
+}
+
+// Next returns the delay before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	if b.next <= 0 {
+		b.next = b.Initial
+	}
+	d := b.next
+	multiplier := b.Multiplier
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+	b.next = time.Duration(float64(b.next) * multiplier)
+	if b.Max > 0 && b.next > b.Max {
+		b.next = b.Max
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// Reset starts from Initial again, it's called after reconnected.
+func (b *Backoff) Reset() {
+	b.next = 0
+}
+
+// Disconnection is a disconnection of live stream and the reconnection after it.
+type Disconnection struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Attempts int       `json:"attempts"` // the reconnect attempts, the last one succeeded if Reconnected
+	// Reconnected is false if the stream isn't reconnected, e.g. the attempts are used up
+	Reconnected bool `json:"reconnected"`
+	// Downtime is the time from the disconnection to the first frame after reconnect
+	Downtime time.Duration `json:"downtime"`
+	// BytesLost is estimated by the average data rate before the disconnection
+	BytesLost int64 `json:"bytes_lost"`
+	// Continuity is the timestamp jump(ms) of every track from the last frame before the disconnection
+	// to the first frame after reconnect, see EventResume
+	Continuity map[string]int64 `json:"continuity,omitempty"`
+
+	rate float64 // the average data rate(bytes per second) before the disconnection
+}
+
+// ReconnectStats is a snapshot of Reconnects.
+type ReconnectStats struct {
+	Count          int           // the disconnections
+	Reconnected    int           // the disconnections reconnected
+	Attempts       int           // the reconnect attempts
+	Downtime       time.Duration // the sum of downtime
+	MaxDowntime    time.Duration
+	BytesLost      int64
+	Disconnections []Disconnection
+}
+
+// Reconnects records the disconnections of a live stream, it implements EventSink to record
+// the timestamp continuity after reconnect by EventResume. It's safe for concurrent use.
+type Reconnects struct {
+	mu             sync.Mutex
+	disconnections []Disconnection
+	pending        bool // the last disconnection is waiting for the first frame after reconnect
+}
+
+// Disconnect records a disconnection at now, rate is the average data rate(bytes per second) before it.
+func (r *Reconnects) Disconnect(reason error, now time.Time, rate float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := Disconnection{Time: now, rate: rate}
+	if reason != nil {
+		d.Reason = reason.Error()
+	}
+	r.disconnections = append(r.disconnections, d)
+	r.pending = true
+}
+
+// Attempt records a reconnect attempt of the last disconnection.
+func (r *Reconnects) Attempt() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := len(r.disconnections); n > 0 && r.pending {
+		r.disconnections[n-1].Attempts++
+	}
+}
+
+// Reconnected records the first frame after reconnect at now, it computes the downtime and bytes lost.
+func (r *Reconnects) Reconnected(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.disconnections)
+	if n == 0 || !r.pending {
+		return
+	}
+	r.pending = false
+	d := &r.disconnections[n-1]
+	d.Reconnected = true
+	d.Downtime = now.Sub(d.Time)
+	d.BytesLost = int64(d.rate * d.Downtime.Seconds())
+}
+
+// OnEvent records the timestamp continuity of EventResume.
+func (r *Reconnects) OnEvent(event Event) {
+	if event.Type != EventResume {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.disconnections)
+	if n == 0 {
+		return
+	}
+	d := &r.disconnections[n-1]
+	if d.Continuity == nil {
+		d.Continuity = make(map[string]int64)
+	}
+	d.Continuity[event.Track] = event.Value
+}
+
+// Snapshot returns the stats, the downtime and bytes lost of a pending disconnection are 0.
+func (r *Reconnects) Snapshot() ReconnectStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := ReconnectStats{Count: len(r.disconnections)}
+	for _, d := range r.disconnections {
+		continuity := d.Continuity
+		d.Continuity = make(map[string]int64, len(continuity))
+		for track, jump := range continuity {
+			d.Continuity[track] = jump
+		}
+		s.Attempts += d.Attempts
+		if d.Reconnected {
+			s.Reconnected++
+		}
+		s.Downtime += d.Downtime
+		s.MaxDowntime = max(s.MaxDowntime, d.Downtime)
+		s.BytesLost += d.BytesLost
+		s.Disconnections = append(s.Disconnections, d)
+	}
+	return s
+}
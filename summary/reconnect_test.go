@@ -0,0 +1,41 @@
+package summary
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnects(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second}
+	var delays []time.Duration
+	for i := 0; i < 6; i++ {
+		delays = append(delays, b.Next())
+	}
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{100 * ms, 200 * ms, 400 * ms, 800 * ms, time.Second, time.Second}, delays)
+	b.Reset()
+	assert.Equal(t, 100*time.Millisecond, b.Next())
+
+	r := new(Reconnects)
+	base := time.Unix(0, 0)
+	r.Disconnect(errors.New("unexpected EOF"), base, 1000)
+	r.Attempt()
+	r.Attempt()
+	r.Reconnected(base.Add(2 * time.Second))
+	r.OnEvent(Event{Type: EventResume, Track: "video", Value: -1080})
+	r.OnEvent(Event{Type: EventGap, Track: "video", Value: 500})
+	r.Disconnect(errors.New("connection reset"), base.Add(time.Minute), 1000)
+	r.Attempt()
+
+	s := r.Snapshot()
+	assert.Equal(t, 2, s.Count)
+	assert.Equal(t, 1, s.Reconnected)
+	assert.Equal(t, 3, s.Attempts)
+	assert.Equal(t, 2*time.Second, s.Downtime)
+	assert.Equal(t, int64(2000), s.BytesLost)
+	assert.Equal(t, map[string]int64{"video": -1080}, s.Disconnections[0].Continuity)
+	assert.False(t, s.Disconnections[1].Reconnected)
+}
@@ -0,0 +1,168 @@
+package summary
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+type StartupEvent int
+
+const (
+	StartupDNSLookup StartupEvent = iota
+	StartupConnect
+	StartupTLSHandshake
+	StartupFirstByte
+	StartupHeader
+	StartupMetaData
+	StartupVideoSequenceHeader
+	StartupAudioSequenceHeader
+	StartupVideoKeyFrame
+	StartupAudioFrame
+	startupEventCount
+)
+
+var startupEventNames = [startupEventCount]string{
+	"dns_lookup",
+	"connect",
+	"tls_handshake",
+	"first_byte",
+	"flv_header",
+	"metadata",
+	"video_sequence_header",
+	"audio_sequence_header",
+	"video_keyframe",
+	"audio_frame",
+}
+
+func (e StartupEvent) String() string {
+	if e < 0 || e >= startupEventCount {
+		return fmt.Sprintf("StartupEvent(%d)", int(e))
+	}
+	return startupEventNames[e]
+}
+
+// Startup records when the events needed to show the first picture happen,
+// all durations are measured from the start of the request.
+type Startup struct {
+	mu       sync.Mutex
+	start    time.Time
+	events   [startupEventCount]time.Time
+	received int64
+
+	// BytesBeforeKeyFrame is the size of the bytes received until the first video keyframe
+	BytesBeforeKeyFrame int64
+}
+
+func NewStartup() *Startup {
+	return &Startup{start: time.Now()}
+}
+
+// StartTime returns when the request is started.
+func (s *Startup) StartTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.start
+}
+
+// Mark records the time of event, only the first one is recorded.
+func (s *Startup) Mark(event StartupEvent, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.events[event].IsZero() {
+		return
+	}
+	s.events[event] = now
+	if event == StartupVideoKeyFrame {
+		s.BytesBeforeKeyFrame = s.received
+	}
+}
+
+// Get returns the duration from the start of the request to event, ok is false if event has not happened.
+func (s *Startup) Get(event StartupEvent) (d time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events[event].IsZero() {
+		return 0, false
+	}
+	return s.events[event].Sub(s.start), true
+}
+
+// WrapReader returns a reader which counts the bytes received for BytesBeforeKeyFrame.
+func (s *Startup) WrapReader(r io.Reader) io.Reader {
+	return &startupReader{r: r, s: s}
+}
+
+type startupReader struct {
+	r io.Reader
+	s *Startup
+}
+
+func (r *startupReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.s.mu.Lock()
+	r.s.received += int64(n)
+	r.s.mu.Unlock()
+	return n, err
+}
+
+// ClientTrace returns the hooks to record the network events of the request.
+func (s *Startup) ClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			s.Mark(StartupDNSLookup, time.Now())
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				s.Mark(StartupConnect, time.Now())
+			}
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				s.Mark(StartupTLSHandshake, time.Now())
+			}
+		},
+		GotFirstResponseByte: func() {
+			s.Mark(StartupFirstByte, time.Now())
+		},
+	}
+}
+
+func (s *Startup) String() string {
+	var buf bytes.Buffer
+	for event := StartupEvent(0); event < startupEventCount; event++ {
+		d, ok := s.Get(event)
+		if !ok {
+			continue
+		}
+		_, _ = fmt.Fprintf(&buf, "%s: %dms\n", event, d.Milliseconds())
+	}
+	if _, ok := s.Get(StartupVideoKeyFrame); ok {
+		_, _ = fmt.Fprintf(&buf, "bytes_before_keyframe: %d\n", s.BytesBeforeKeyFrame)
+	}
+	return buf.String()
+}
+
+// MarshalJSON encodes the durations as "<event>_ms" in milliseconds, the event not happened is null.
+func (s *Startup) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, startupEventCount+1)
+	for event := StartupEvent(0); event < startupEventCount; event++ {
+		d, ok := s.Get(event)
+		if !ok {
+			m[event.String()+"_ms"] = nil
+			continue
+		}
+		m[event.String()+"_ms"] = float64(d.Microseconds()) / 1000
+	}
+	if _, ok := s.Get(StartupVideoKeyFrame); ok {
+		m["bytes_before_keyframe"] = s.BytesBeforeKeyFrame
+	} else {
+		m["bytes_before_keyframe"] = nil
+	}
+	return json.Marshal(m)
+}
@@ -0,0 +1,102 @@
+package summary
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartupMark(t *testing.T) {
+	s := NewStartup()
+	start := s.StartTime()
+
+	_, ok := s.Get(StartupFirstByte)
+	assert.False(t, ok)
+
+	s.Mark(StartupFirstByte, start.Add(100*time.Millisecond))
+	s.Mark(StartupFirstByte, start.Add(200*time.Millisecond)) // only the first one is recorded
+	d, ok := s.Get(StartupFirstByte)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, d)
+
+	assert.Equal(t, "first_byte", StartupFirstByte.String())
+	assert.Equal(t, "StartupEvent(100)", StartupEvent(100).String())
+}
+
+func TestStartupWrapReader(t *testing.T) {
+	s := NewStartup()
+	r := s.WrapReader(bytes.NewReader(make([]byte, 100)))
+	buf := make([]byte, 30)
+	_, _ = io.ReadFull(r, buf)
+	s.Mark(StartupVideoKeyFrame, s.StartTime().Add(time.Millisecond))
+	_, _ = io.ReadAll(r)
+	assert.Equal(t, int64(30), s.BytesBeforeKeyFrame)
+}
+
+func TestStartupString(t *testing.T) {
+	s := NewStartup()
+	s.Mark(StartupFirstByte, s.StartTime().Add(10*time.Millisecond))
+	assert.Equal(t, "first_byte: 10ms\n", s.String())
+
+	s.Mark(StartupVideoKeyFrame, s.StartTime().Add(25*time.Millisecond))
+	assert.Equal(t, "first_byte: 10ms\nvideo_keyframe: 25ms\nbytes_before_keyframe: 0\n", s.String())
+}
+
+func TestStartupMarshalJSON(t *testing.T) {
+	s := NewStartup()
+	s.Mark(StartupHeader, s.StartTime().Add(1500*time.Microsecond))
+
+	data, err := json.Marshal(s)
+	assert.NoError(t, err)
+	var m map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &m))
+	assert.Len(t, m, int(startupEventCount)+1)
+	assert.Equal(t, 1.5, m["flv_header_ms"])
+	assert.Nil(t, m["video_keyframe_ms"])
+	assert.Contains(t, m, "video_keyframe_ms")
+	assert.Nil(t, m["bytes_before_keyframe"])
+
+	s.Mark(StartupVideoKeyFrame, s.StartTime().Add(2*time.Millisecond))
+	data, err = json.Marshal(s)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &m))
+	assert.Equal(t, 2.0, m["video_keyframe_ms"])
+	assert.Equal(t, 0.0, m["bytes_before_keyframe"])
+}
+
+func TestStartupClientTrace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("FLV"))
+	}))
+	defer server.Close()
+
+	s := NewStartup()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), s.ClientTrace()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	connect, ok := s.Get(StartupConnect)
+	assert.True(t, ok)
+	firstByte, ok := s.Get(StartupFirstByte)
+	assert.True(t, ok)
+	assert.True(t, firstByte >= connect)
+	_, ok = s.Get(StartupDNSLookup)
+	assert.False(t, ok, "the server is an IP address")
+	_, ok = s.Get(StartupTLSHandshake)
+	assert.False(t, ok)
+}
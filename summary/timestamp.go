@@ -0,0 +1,48 @@
+package summary
+
+const (
+	// Rollover24 is the rollover of the 24 bits timestamp, it happens when the server doesn't send the extended byte
+	Rollover24 int64 = 1 << 24
+	// Rollover32 is the rollover of the 32 bits timestamp (timestamp + timestampExtended)
+	Rollover32 int64 = 1 << 32
+
+	DefaultRolloverWindow int64 = 60 * 1000
+)
+
+// TimestampUnwrapper converts the 32 bits timestamp(ms) of a track to a monotonic 64 bits timeline.
+//
+// A backward jump is considered a rollover if the forward distance across the rollover is within Window,
+// otherwise it is a genuine rewind and kept as is.
+type TimestampUnwrapper struct {
+	// Window is the max forward distance(ms) across a rollover, DefaultRolloverWindow is used if it is 0.
+	Window int64
+
+	started bool
+	last    uint32
+	offset  int64
+}
+
+// Unwrap returns the unwrapped timestamp and the rollover(Rollover24 or Rollover32) if happened, otherwise 0.
+func (u *TimestampUnwrapper) Unwrap(timestamp uint32) (int64, int64) {
+	if !u.started {
+		u.started = true
+		u.last = timestamp
+		return int64(timestamp), 0
+	}
+	var rollover int64
+	if timestamp < u.last {
+		window := u.Window
+		if window <= 0 {
+			window = DefaultRolloverWindow
+		}
+		switch {
+		case int64(timestamp)+Rollover32-int64(u.last) <= window:
+			rollover = Rollover32
+		case int64(u.last) < Rollover24 && int64(timestamp)+Rollover24-int64(u.last) <= window:
+			rollover = Rollover24
+		}
+		u.offset += rollover
+	}
+	u.last = timestamp
+	return int64(timestamp) + u.offset, rollover
+}
@@ -0,0 +1,95 @@
+package validate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is how serious a problem is.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseSeverity parses the name of severity, e.g. "warning"
+func ParseSeverity(name string) (Severity, error) {
+	for s := SeverityInfo; s <= SeverityError; s++ {
+		if strings.EqualFold(name, s.String()) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q", name)
+}
+
+// Rule is a check of FLV conformance.
+type Rule struct {
+	Name        string
+	Severity    Severity
+	Description string
+}
+
+const (
+	RulePreviousTagSize         = "previous_tag_size"
+	RuleCorruptedData           = "corrupted_data"
+	RuleStreamID                = "stream_id"
+	RuleHeaderFlags             = "header_flags"
+	RuleMissingSequenceHeader   = "missing_sequence_header"
+	RuleDuplicateSequenceHeader = "duplicate_sequence_header"
+	RuleSequenceHeaderChanged   = "sequence_header_changed"
+	RuleFirstFrameNotKeyFrame   = "first_frame_not_keyframe"
+	RuleKeyFrameMismatch        = "keyframe_mismatch"
+	RuleAVCCLengthSize          = "avcc_length_size"
+	RuleAnnexBInAVCC            = "annexb_in_avcc"
+	RuleNegativeCTS             = "negative_cts"
+	RuleMetaDataMismatch        = "metadata_mismatch"
+)
+
+var rules = []Rule{
+	{RulePreviousTagSize, SeverityError, "previousTagSize doesn't equal the size of the tag before it"},
+	{RuleCorruptedData, SeverityError, "bytes are skipped to find the next plausible tag"},
+	{RuleStreamID, SeverityWarning, "StreamID of tag isn't 0"},
+	{RuleHeaderFlags, SeverityWarning, "HasAudio/HasVideo of header disagree with the tracks in stream"},
+	{RuleMissingSequenceHeader, SeverityError, "AVC/HEVC/AAC frame before any sequence header"},
+	{RuleDuplicateSequenceHeader, SeverityWarning, "the same sequence header is sent again"},
+	{RuleSequenceHeaderChanged, SeverityInfo, "a different sequence header is sent, the decoder will be reset"},
+	{RuleFirstFrameNotKeyFrame, SeverityWarning, "the first video frame isn't a keyframe"},
+	{RuleKeyFrameMismatch, SeverityWarning, "keyframe flag of tag disagrees with the IDR/IRAP NALUs"},
+	{RuleAVCCLengthSize, SeverityError, "NALU length fields don't fit LengthSizeMinusOne of the decoder configuration record"},
+	{RuleAnnexBInAVCC, SeverityError, "NALUs are separated by Annex B start code instead of length"},
+	{RuleNegativeCTS, SeverityWarning, "composition time offset is negative, that is pts < dts"},
+	{RuleMetaDataMismatch, SeverityWarning, "onMetaData disagrees with SPS/AudioSpecificConfig/codec of tags"},
+}
+
+// Rules returns the catalog of rules.
+func Rules() []Rule {
+	return append([]Rule(nil), rules...)
+}
+
+// LookupRule returns the rule by name.
+func LookupRule(name string) (Rule, bool) {
+	for _, rule := range rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
@@ -0,0 +1,460 @@
+// Package validate checks the conformance of FLV streams by a catalog of named rules, see Rules.
+//
+// Validate checks a whole stream, Validator checks the tags one by one for live streams.
+// The Report tells the issues found and the exit code for CI.
+package validate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/foolishCDN/AV-spy/codec"
+	"github.com/foolishCDN/AV-spy/codec/avc"
+	"github.com/foolishCDN/AV-spy/codec/hevc"
+	"github.com/foolishCDN/AV-spy/container/flv"
+	"github.com/foolishCDN/AV-spy/encoding/amf"
+	"github.com/foolishCDN/AV-spy/utils"
+)
+
+// Issue is a violation of rule.
+type Issue struct {
+	Rule      string   `json:"rule"`
+	Severity  Severity `json:"severity"`
+	Offset    int64    `json:"offset"` // byte offset of the tag, -1 if the issue is about the whole stream
+	Timestamp int64    `json:"timestamp"`
+	Message   string   `json:"message"`
+}
+
+func (issue Issue) String() string {
+	if issue.Offset < 0 {
+		return fmt.Sprintf("[%s] %s: %s", issue.Severity, issue.Rule, issue.Message)
+	}
+	return fmt.Sprintf("[%s] %s at offset %d, timestamp %d: %s", issue.Severity, issue.Rule, issue.Offset, issue.Timestamp, issue.Message)
+}
+
+type Config struct {
+	// Disabled are the names of rules not checked
+	Disabled []string
+	// MaxIssues is the max number of issues of a rule kept in Report.Issues (no limit if <=0),
+	// all of them are counted in Report.Counts.
+	MaxIssues int
+	// OnIssue is called when an issue is found if it's not nil
+	OnIssue func(Issue)
+}
+
+type Report struct {
+	Tags   int            `json:"tags"`
+	Issues []Issue        `json:"issues"`
+	Counts map[string]int `json:"counts"` // number of issues by rule
+}
+
+// Worst returns the highest severity of issues, ok is false if there is no issue.
+func (r *Report) Worst() (severity Severity, ok bool) {
+	for name, count := range r.Counts {
+		rule, _ := LookupRule(name)
+		if count > 0 && (!ok || rule.Severity > severity) {
+			severity, ok = rule.Severity, true
+		}
+	}
+	return severity, ok
+}
+
+// ExitCode returns 1 if there is an issue of failOn or higher severity, otherwise 0.
+func (r *Report) ExitCode(failOn Severity) int {
+	if worst, ok := r.Worst(); ok && worst >= failOn {
+		return 1
+	}
+	return 0
+}
+
+func (r *Report) Print(w io.Writer) {
+	for _, issue := range r.Issues {
+		fmt.Fprintln(w, issue)
+	}
+	var counts [SeverityError + 1]int
+	for name, count := range r.Counts {
+		rule, _ := LookupRule(name)
+		counts[rule.Severity] += count
+	}
+	fmt.Fprintf(w, "tags: %d, issues: %d error, %d warning, %d info\n", r.Tags, counts[SeverityError], counts[SeverityWarning], counts[SeverityInfo])
+	for _, rule := range rules {
+		if count := r.Counts[rule.Name]; count > 0 {
+			fmt.Fprintf(w, "  %-26s %-8s %d\n", rule.Name, rule.Severity, count)
+		}
+	}
+}
+
+// Validate reads the stream until EOF and checks it, the corrupted bytes are skipped by flv.Demuxer in Resync mode.
+// The report is returned even if there is an error.
+func Validate(r io.Reader, config Config) (*Report, error) {
+	v, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	demuxer := &flv.Demuxer{Resync: true}
+	header, err := demuxer.ReadHeader(r)
+	if err != nil {
+		return v.Report(), err
+	}
+	v.OnHeader(header)
+	for {
+		tag, err := demuxer.ReadTag(r)
+		var sizeErr *flv.PreviousTagSizeError
+		var resyncErr *flv.ResyncError
+		if errors.As(err, &sizeErr) {
+			v.OnPreviousTagSize(sizeErr)
+			tag, err = sizeErr.Tag, nil
+		} else if errors.As(err, &resyncErr) {
+			v.OnResync(resyncErr)
+			if resyncErr.Tag == nil {
+				continue
+			}
+			tag, err = resyncErr.Tag, nil
+		}
+		if err == io.EOF {
+			return v.Report(), nil
+		}
+		if err != nil {
+			return v.Report(), err
+		}
+		v.OnTag(tag, demuxer.TagOffset())
+	}
+}
+
+// Validator checks the tags one by one, it's not safe for concurrent use.
+type Validator struct {
+	config   Config
+	disabled map[string]bool
+	report   Report
+	finished bool
+
+	header   *flv.Header
+	hasVideo bool
+	hasAudio bool
+
+	videoCodec     flv.CodecID
+	videoHeader    []byte
+	lengthSize     int // NALU length size of AVCC/HVCC, 0 if unknown
+	sps            codec.SPS
+	seenVideoFrame bool
+
+	soundFormat flv.SoundFormat
+	audioHeader []byte
+	asc         *codec.AACAudioSpecificConfig
+
+	missingReported map[string]bool
+
+	metaData       amf.ECMAArray
+	metaDataOffset int64
+	metaDataTime   int64
+}
+
+// New returns a Validator, it returns an error if there is an unknown rule in config.Disabled.
+func New(config Config) (*Validator, error) {
+	v := &Validator{
+		config:          config,
+		disabled:        make(map[string]bool),
+		report:          Report{Issues: []Issue{}, Counts: make(map[string]int)},
+		missingReported: make(map[string]bool),
+	}
+	for _, name := range config.Disabled {
+		if _, ok := LookupRule(name); !ok {
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+		v.disabled[name] = true
+	}
+	return v, nil
+}
+
+func (v *Validator) addIssue(name string, offset, timestamp int64, format string, args ...interface{}) {
+	if v.disabled[name] {
+		return
+	}
+	rule, _ := LookupRule(name)
+	issue := Issue{
+		Rule:      name,
+		Severity:  rule.Severity,
+		Offset:    offset,
+		Timestamp: timestamp,
+		Message:   fmt.Sprintf(format, args...),
+	}
+	v.report.Counts[name]++
+	if v.config.MaxIssues <= 0 || v.report.Counts[name] <= v.config.MaxIssues {
+		v.report.Issues = append(v.report.Issues, issue)
+	}
+	if v.config.OnIssue != nil {
+		v.config.OnIssue(issue)
+	}
+}
+
+func (v *Validator) OnHeader(header *flv.Header) {
+	v.header = header
+}
+
+// OnPreviousTagSize reports the error, the tag in it should be passed to OnTag after.
+func (v *Validator) OnPreviousTagSize(err *flv.PreviousTagSizeError) {
+	v.addIssue(RulePreviousTagSize, err.Offset, int64(err.Tag.Timestamp()),
+		"previousTagSize is %d, but the tag size is %d + 11", err.PreviousTagSize, err.Size)
+}
+
+// OnResync reports the skipped bytes, the tag in it should be passed to OnTag after if it's not nil.
+func (v *Validator) OnResync(err *flv.ResyncError) {
+	var timestamp int64
+	if err.Tag != nil {
+		timestamp = int64(err.Tag.Timestamp())
+	}
+	v.addIssue(RuleCorruptedData, err.Start, timestamp, "%d bytes skipped: %v", err.End-err.Start, err.Reason)
+}
+
+// OnTag checks a tag, offset is the byte offset of it which is only used in issues.
+func (v *Validator) OnTag(tag flv.TagI, offset int64) {
+	v.report.Tags++
+	var streamID uint32
+	switch t := tag.(type) {
+	case *flv.VideoTag:
+		streamID = t.StreamID
+		v.onVideo(t, offset)
+	case *flv.AudioTag:
+		streamID = t.StreamID
+		v.onAudio(t, offset)
+	case *flv.ScriptTag:
+		streamID = t.StreamID
+		v.onScript(t, offset)
+	}
+	if streamID != 0 {
+		v.addIssue(RuleStreamID, offset, int64(tag.Timestamp()), "StreamID is %d", streamID)
+	}
+}
+
+func (v *Validator) onVideo(t *flv.VideoTag, offset int64) {
+	v.hasVideo = true
+	v.videoCodec = t.CodecID
+	timestamp := int64(t.DTS)
+	isAVC := t.CodecID == flv.H264 || t.CodecID == flv.H265
+	if flv.IsSequenceHeader(t) {
+		if v.checkSequenceHeader("video", v.videoHeader, t.Bytes, offset, timestamp) {
+			v.videoHeader = t.Bytes
+			v.parseVideoHeader(t)
+		}
+		return
+	}
+	if isAVC && t.PacketType != flv.AVPacket {
+		return
+	}
+	if isAVC && v.videoHeader == nil && !v.missingReported["video"] {
+		v.missingReported["video"] = true
+		v.addIssue(RuleMissingSequenceHeader, offset, timestamp, "%s frame before sequence header", t.CodecID)
+	}
+	if !v.seenVideoFrame {
+		v.seenVideoFrame = true
+		if t.FrameType != flv.KeyFrame {
+			v.addIssue(RuleFirstFrameNotKeyFrame, offset, timestamp, "the first video frame is %s", t.FrameType)
+		}
+	}
+	if !isAVC {
+		return
+	}
+	if cts := int32(t.PTS - t.DTS); cts < 0 {
+		v.addIssue(RuleNegativeCTS, offset, timestamp, "pts %d < dts %d", t.PTS, t.DTS)
+	}
+	nalus := v.splitNALUs(t, offset)
+	if len(nalus) == 0 {
+		return
+	}
+	irap := false
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		reader := utils.NewBitReader(nalu)
+		if t.CodecID == flv.H264 {
+			irap = irap || avc.ParseNALUHeader(reader).NalUnitType == avc.NalIDRSlice
+		} else {
+			naluType := hevc.ParseNALUHeader(reader).NALUnitType
+			irap = irap || naluType >= hevc.NalBLAWLP && naluType <= hevc.NalRsvIRAP23
+		}
+	}
+	if keyFrame := t.FrameType == flv.KeyFrame; keyFrame && !irap {
+		v.addIssue(RuleKeyFrameMismatch, offset, timestamp, "keyframe without IDR/IRAP NALU")
+	} else if !keyFrame && irap {
+		v.addIssue(RuleKeyFrameMismatch, offset, timestamp, "%s with IDR/IRAP NALU", t.FrameType)
+	}
+}
+
+// splitNALUs splits the NALUs by the length size of sequence header, and reports if they are not well-formed.
+func (v *Validator) splitNALUs(t *flv.VideoTag, offset int64) [][]byte {
+	timestamp := int64(t.DTS)
+	lengthSize := v.lengthSize
+	if lengthSize == 0 {
+		lengthSize = 4
+	}
+	if nalus, ok := splitAVCC(t.Bytes, lengthSize); ok {
+		return nalus
+	}
+	if bytes.HasPrefix(t.Bytes, []byte{0, 0, 1}) || bytes.HasPrefix(t.Bytes, []byte{0, 0, 0, 1}) {
+		v.addIssue(RuleAnnexBInAVCC, offset, timestamp, "NALUs start with Annex B start code")
+		return avc.SplitNALUsAnnexB(t.Bytes)
+	}
+	if v.lengthSize == 0 {
+		return nil
+	}
+	for _, size := range []int{1, 2, 4} {
+		if _, ok := splitAVCC(t.Bytes, size); ok && size != lengthSize {
+			v.addIssue(RuleAVCCLengthSize, offset, timestamp, "NALU length fields are %d bytes, but LengthSizeMinusOne is %d", size, lengthSize-1)
+			return nil
+		}
+	}
+	v.addIssue(RuleAVCCLengthSize, offset, timestamp, "NALU length fields don't fit the data with LengthSizeMinusOne %d", lengthSize-1)
+	return nil
+}
+
+func splitAVCC(data []byte, lengthSize int) ([][]byte, bool) {
+	var nalus [][]byte
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nil, false
+		}
+		length := 0
+		for _, b := range data[:lengthSize] {
+			length = length<<8 | int(b)
+		}
+		data = data[lengthSize:]
+		if length > len(data) {
+			return nil, false
+		}
+		nalus = append(nalus, data[:length])
+		data = data[length:]
+	}
+	return nalus, len(nalus) > 0
+}
+
+func (v *Validator) parseVideoHeader(t *flv.VideoTag) {
+	v.lengthSize, v.sps = 0, t.SPS()
+	switch t.CodecID {
+	case flv.H264:
+		record := new(avc.AVCDecoderConfigurationRecord)
+		if err := record.Read(t.Bytes); err == nil {
+			v.lengthSize = int(record.LengthSizeMinusOne) + 1
+		}
+	case flv.H265:
+		record := new(hevc.HEVCDecoderConfigurationRecord)
+		if err := record.Read(t.Bytes); err == nil {
+			v.lengthSize = int(record.LengthSizeMinusOne) + 1
+		}
+	}
+}
+
+// checkSequenceHeader reports the duplicate or changed sequence header, it returns true if it's new.
+func (v *Validator) checkSequenceHeader(track string, last, data []byte, offset, timestamp int64) bool {
+	switch {
+	case last == nil:
+		return true
+	case bytes.Equal(last, data):
+		v.addIssue(RuleDuplicateSequenceHeader, offset, timestamp, "%s sequence header is sent again", track)
+		return false
+	}
+	v.addIssue(RuleSequenceHeaderChanged, offset, timestamp, "%s sequence header changed", track)
+	return true
+}
+
+func (v *Validator) onAudio(t *flv.AudioTag, offset int64) {
+	v.hasAudio = true
+	v.soundFormat = t.SoundFormat
+	timestamp := int64(t.PTS)
+	if t.SoundFormat != flv.AAC {
+		return
+	}
+	if t.PacketType == flv.SequenceHeader {
+		if v.checkSequenceHeader("audio", v.audioHeader, t.Bytes, offset, timestamp) {
+			v.audioHeader = t.Bytes
+			v.asc = new(codec.AACAudioSpecificConfig)
+			if err := v.asc.Read(t.Bytes); err != nil {
+				v.asc = nil
+			}
+		}
+		return
+	}
+	if v.audioHeader == nil && !v.missingReported["audio"] {
+		v.missingReported["audio"] = true
+		v.addIssue(RuleMissingSequenceHeader, offset, timestamp, "AAC frame before sequence header")
+	}
+}
+
+func (v *Validator) onScript(t *flv.ScriptTag, offset int64) {
+	if v.metaData != nil {
+		return
+	}
+	got, _ := amf.NewDecoder(amf.Version0).DecodeBatch(bytes.NewReader(t.Bytes))
+	if len(got) < 2 || got[0] != "onMetaData" {
+		return
+	}
+	switch values := got[1].(type) {
+	case amf.ECMAArray:
+		v.metaData = values
+	case map[string]interface{}:
+		v.metaData = values
+	default:
+		return
+	}
+	v.metaDataOffset, v.metaDataTime = offset, int64(t.PTS)
+}
+
+// Report runs the checks which need the whole stream and returns the report,
+// the Validator shouldn't be used after.
+func (v *Validator) Report() *Report {
+	if v.finished {
+		return &v.report
+	}
+	v.finished = true
+	if v.header != nil && v.report.Tags > 0 {
+		if v.header.HasVideo != v.hasVideo {
+			v.addIssue(RuleHeaderFlags, -1, 0, "HasVideo is %v, but video tags exist: %v", v.header.HasVideo, v.hasVideo)
+		}
+		if v.header.HasAudio != v.hasAudio {
+			v.addIssue(RuleHeaderFlags, -1, 0, "HasAudio is %v, but audio tags exist: %v", v.header.HasAudio, v.hasAudio)
+		}
+	}
+	if v.metaData != nil {
+		v.checkMetaData()
+	}
+	return &v.report
+}
+
+func (v *Validator) checkMetaData() {
+	mismatch := func(key string, value interface{}, format string, args ...interface{}) {
+		v.addIssue(RuleMetaDataMismatch, v.metaDataOffset, v.metaDataTime, "%s is %v, but %s", key, value, fmt.Sprintf(format, args...))
+	}
+	number := func(key string) (float64, bool) {
+		n, ok := v.metaData[key].(float64)
+		return n, ok
+	}
+	if v.sps != nil {
+		if width, ok := number("width"); ok && v.sps.Width() > 0 && int(width) != v.sps.Width() {
+			mismatch("width", width, "%d in SPS", v.sps.Width())
+		}
+		if height, ok := number("height"); ok && v.sps.Height() > 0 && int(height) != v.sps.Height() {
+			mismatch("height", height, "%d in SPS", v.sps.Height())
+		}
+		if fps, ok := number("framerate"); ok && fps > 0 && v.sps.FPS() > 0 && math.Abs(fps-v.sps.FPS())/fps > 0.02 {
+			mismatch("framerate", fps, "%.2f in SPS", v.sps.FPS())
+		}
+	}
+	if id, ok := number("videocodecid"); ok && v.hasVideo && flv.CodecID(id) != v.videoCodec {
+		mismatch("videocodecid", id, "%d(%s) in tags", v.videoCodec, v.videoCodec)
+	}
+	if id, ok := number("audiocodecid"); ok && v.hasAudio && flv.SoundFormat(id) != v.soundFormat {
+		mismatch("audiocodecid", id, "%d(%s) in tags", v.soundFormat, v.soundFormat)
+	}
+	if v.asc == nil {
+		return
+	}
+	if rate, ok := number("audiosamplerate"); ok && v.asc.Frequency() > 0 && int(rate) != v.asc.Frequency() {
+		mismatch("audiosamplerate", rate, "%d in AudioSpecificConfig", v.asc.Frequency())
+	}
+	if stereo, ok := v.metaData["stereo"].(bool); ok && v.asc.Channel > 0 && stereo != (v.asc.Channel >= 2) {
+		mismatch("stereo", stereo, "channel configuration is %d in AudioSpecificConfig", v.asc.Channel)
+	}
+}
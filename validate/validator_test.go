@@ -0,0 +1,106 @@
+package validate
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/foolishCDN/AV-spy/container/flv"
+)
+
+func TestValidate(t *testing.T) {
+	data, err := os.ReadFile("../container/flv/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Validate(bytes.NewReader(data), Config{})
+	assert.Nil(t, err)
+	assert.Empty(t, report.Issues)
+	assert.Equal(t, 0, report.ExitCode(SeverityInfo))
+
+	var sequenceHeader, keyFrame, interFrame *flv.VideoTag
+	demuxer := new(flv.Demuxer)
+	r := bytes.NewReader(data)
+	if _, err := demuxer.ReadHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	for interFrame == nil {
+		tag, err := demuxer.ReadTag(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		video, ok := tag.(*flv.VideoTag)
+		switch {
+		case !ok:
+		case video.PacketType == flv.SequenceHeader:
+			sequenceHeader = video
+		case video.FrameType == flv.KeyFrame && keyFrame == nil:
+			keyFrame = video
+		case video.FrameType == flv.InterFrame:
+			interFrame = video
+		}
+	}
+
+	var issues []Issue
+	v, err := New(Config{Disabled: []string{RuleStreamID}, MaxIssues: 1, OnIssue: func(issue Issue) {
+		issues = append(issues, issue)
+	}})
+	assert.Nil(t, err)
+	v.OnHeader(&flv.Header{Version: 1, HasVideo: true, HasAudio: true})
+	v.OnTag(interFrame, 0)
+	v.OnTag(sequenceHeader, 1)
+	v.OnTag(sequenceHeader, 2)
+	notKeyFrame := *keyFrame
+	notKeyFrame.FrameType = flv.InterFrame
+	v.OnTag(&notKeyFrame, 3)
+	annexB := *keyFrame
+	annexB.Bytes = nil
+	for _, nalu := range splitNALUsOrFail(t, keyFrame.Bytes) {
+		annexB.Bytes = append(append(annexB.Bytes, 0, 0, 0, 1), nalu...)
+	}
+	v.OnTag(&annexB, 4)
+	shortLength := *keyFrame
+	shortLength.Bytes = keyFrame.Bytes[2:]
+	v.OnTag(&shortLength, 5)
+	negative := *interFrame
+	negative.StreamID = 1
+	negative.PTS = negative.DTS - 1
+	v.OnTag(&negative, 6)
+	v.OnTag(&negative, 7)
+
+	report = v.Report()
+	assert.Equal(t, map[string]int{
+		RuleMissingSequenceHeader:   1,
+		RuleFirstFrameNotKeyFrame:   1,
+		RuleDuplicateSequenceHeader: 1,
+		RuleKeyFrameMismatch:        1,
+		RuleAnnexBInAVCC:            1,
+		RuleAVCCLengthSize:          1,
+		RuleNegativeCTS:             2,
+		RuleHeaderFlags:             1,
+	}, report.Counts)
+	assert.Equal(t, 8, len(report.Issues))
+	assert.Equal(t, 9, len(issues))
+	assert.Equal(t, int64(-1), report.Issues[len(report.Issues)-1].Offset)
+	assert.Equal(t, 1, report.ExitCode(SeverityError))
+
+	var buf bytes.Buffer
+	report.Print(&buf)
+	assert.Contains(t, buf.String(), "tags: 8, issues: 3 error, 6 warning, 0 info")
+
+	_, err = New(Config{Disabled: []string{"no_such_rule"}})
+	assert.NotNil(t, err)
+	_, err = Validate(io.LimitReader(bytes.NewReader(data), 3), Config{})
+	assert.NotNil(t, err)
+}
+
+func splitNALUsOrFail(t *testing.T, data []byte) [][]byte {
+	nalus, ok := splitAVCC(data, 4)
+	if !ok {
+		t.Fatal("split NALUs failed")
+	}
+	return nalus
+}